@@ -32,6 +32,10 @@ const (
 	timeout = 3000 // 默认超时时间：3秒
 )
 
+const (
+	GET_ALL_TOPIC_ATTRIBUTE = 612 // 获取全部topic扩展属性，slave从master同步
+)
+
 // CallOuterService 调用Broker对外的接口封装
 type CallOuterService struct {
 	topAddr        *TOPAddr
@@ -280,6 +284,21 @@ func (cos *CallOuterService) GetAllDelayOffset(brokerAddr string) string {
 	return string(response.Body)
 }
 
+// GetAllTopicAttribute 获取全部topic扩展属性
+func (cos *CallOuterService) GetAllTopicAttribute(brokerAddr string) string {
+	request := protocol.CreateRequestCommand(GET_ALL_TOPIC_ATTRIBUTE)
+	response, err := cos.remotingClient.InvokeSync(brokerAddr, request, timeout)
+	if err != nil {
+		logger.Errorf("get all topic attribute err: %s, brokerAddr=%s, %s.", err, brokerAddr, request)
+		return ""
+	}
+	if response == nil || response.Code != protocol.SUCCESS {
+		logger.Errorf("get all topic attribute failed. brokerAddr=%s, response code is %d.", brokerAddr, response.Code)
+		return ""
+	}
+	return string(response.Body)
+}
+
 // GetAllSubscriptionGroupConfig 获取订阅组配置
 // Author gaoyanlei
 // Since 2017/8/22
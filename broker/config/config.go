@@ -19,6 +19,11 @@ import (
 	"github.com/boltmq/common/constant"
 )
 
+const (
+	StoreTypePersistent = "persistent" // 基于mmap文件的持久化存储
+	StoreTypeMemory     = "memory"     // 基于内存的存储，不落盘
+)
+
 type Config struct {
 	MQHome  string        `toml:"-"`       // BoltMQ安装运行路径
 	CfgPath string        `toml:"-"`       // BoltMQ配置文件路径
@@ -36,6 +41,11 @@ type ClusterConfig struct {
 	BrokerRole   string   `toml:"broker_role"`   // broker角色 主/备
 	HaServerIP   string   `toml:"ha_server_ip"`  // 主备配置
 	NameSrvAddrs []string `toml:"namesrv_addrs"` // Namesrv地址
+	// 选举复制模式：同一broker_name的broker自动选主，leader以broker_id=0注册，broker_id为节点在选举组中的id
+	ElectionEnable bool     `toml:"election_enable"` // 是否开启选举复制模式
+	ElectionPeers  []string `toml:"election_peers"`  // 选举组全部节点，格式：broker_id@ip:port
+	// 同步双写：SYNC_MASTER写入需等待sync_replicas个slave确认后才返回成功
+	SyncReplicas int `toml:"sync_replicas"` // 需要确认写入的slave数量，默认1
 }
 
 // BrokerConfig
@@ -61,13 +71,43 @@ type BrokerConfig struct {
 	NotifyConsumerIdsChangedEnable     bool   `toml:"notify_consumer_ids_changed_enable"`     // notify consumerId changed 开关
 	OffsetCheckInSlave                 bool   `toml:"offset_check_in_slave"`                  // slave 是否需要纠正位点
 	HaMasterAddress                    string `toml:"ha_master_addr"`                         // 适用场景：HA功能配置(将slave角色的 ha地址，指向master角色)
+	CompressionCodecClientVersion      int32  `toml:"compression_codec_client_version"`       // 支持snappy/zstd消息体的最低客户端版本，低于该版本时由broker解压后返回，为0不解压
+	// http管理接口，以json管理topic、消费分组、消费进度、配置及查询消息
+	HttpAdminHost  string `toml:"http_admin_host"`  // 监听ip，为空时只监听127.0.0.1
+	HttpAdminPort  int    `toml:"http_admin_port"`  // 监听端口，为0不开启
+	HttpAdminToken string `toml:"http_admin_token"` // 写接口及消息查询接口的认证token，为空时不开放
 }
 
 // StoreConfig 存储相关配置
 type StoreConfig struct {
+	Type             string `toml:"type"`               // 存储类型：persistent、memory
 	RootDir          string `toml:"root_dir"`           // store的数据存储目录
 	FlushDiskType    string `toml:"flush_disk_type"`    // 刷盘方式
 	FileReservedTime int    `toml:"file_reserved_time"` // 消息保存时间
+	// 逻辑队列扩展文件，保存每条消息属性的bloom filter，按消息属性过滤时跳过不匹配的消息
+	ConsumeQueueExtEnable    bool  `toml:"consume_queue_ext_enable"`     // 是否开启
+	ConsumeQueueExtBloomBits int32 `toml:"consume_queue_ext_bloom_bits"` // 每条消息bloom filter的位数，需为8的倍数，0使用默认值256
+	// HA复制通道安全配置，master与slave需一致
+	HaTLSEnable       bool     `toml:"ha_tls_enable"`        // 是否开启TLS
+	HaTLSCertFile     string   `toml:"ha_tls_cert_file"`     // 本节点证书
+	HaTLSKeyFile      string   `toml:"ha_tls_key_file"`      // 本节点证书私钥
+	HaTLSCAFile       string   `toml:"ha_tls_ca_file"`       // CA证书，配置后双向校验证书
+	HaTLSServerName   string   `toml:"ha_tls_server_name"`   // slave校验master证书使用的名称
+	HaTLSAllowedNames []string `toml:"ha_tls_allowed_names"` // 允许连接的slave证书名称
+	HaAuthSecret      string   `toml:"ha_auth_secret"`       // 共享密钥
+	HaSlaveAutoRebase bool     `toml:"ha_slave_auto_rebase"` // slave同步位置早于master最小offset时，是否清空本地数据重新同步
+	// 启动时从commitlog重建逻辑队列及索引
+	RebuildTopics []string `toml:"rebuild_topics"` // 重建逻辑队列的topic，*表示全部
+	RebuildIndex  bool     `toml:"rebuild_index"`  // 是否重建索引文件
+	// 冷存储配置，写满的commitlog文件上传后才会被删除
+	ColdStorageType      string `toml:"cold_storage_type"`       // 冷存储类型：local、s3，为空时不开启
+	ColdStorageDir       string `toml:"cold_storage_dir"`        // local冷存储目录
+	ColdStorageEndpoint  string `toml:"cold_storage_endpoint"`   // s3服务地址
+	ColdStorageRegion    string `toml:"cold_storage_region"`     // s3 region
+	ColdStorageBucket    string `toml:"cold_storage_bucket"`     // s3 bucket
+	ColdStoragePrefix    string `toml:"cold_storage_prefix"`     // s3对象名前缀
+	ColdStorageAccessKey string `toml:"cold_storage_access_key"` // s3 access key
+	ColdStorageSecretKey string `toml:"cold_storage_secret_key"` // s3 secret key
 }
 
 // LogConfig 日志配置
@@ -92,7 +132,7 @@ func (cfg *Config) String() string {
 		return "<nil>"
 	}
 
-	return fmt.Sprintf("Config [ClusterName=%s, BrokerName=%s, BrokerId=%d, BrokerRole=%s, DeleteWhen=%d, FileReservedTime=%d, FlushDiskType=%s, AutoCreateTopicEnable=%t, Store.RootDir=%s, Log.CfgFilePath=%s]",
+	return fmt.Sprintf("Config [ClusterName=%s, BrokerName=%s, BrokerId=%d, BrokerRole=%s, DeleteWhen=%d, FileReservedTime=%d, FlushDiskType=%s, AutoCreateTopicEnable=%t, Store.Type=%s, Store.RootDir=%s, Log.CfgFilePath=%s]",
 		cfg.Cluster.Name, cfg.Cluster.BrokerName, cfg.Cluster.BrokerId, cfg.Cluster.BrokerRole, cfg.Broker.DeleteWhen,
-		cfg.Store.FileReservedTime, cfg.Store.FlushDiskType, cfg.Broker.AutoCreateTopicEnable, cfg.Store.RootDir, cfg.Log.CfgFilePath)
+		cfg.Store.FileReservedTime, cfg.Store.FlushDiskType, cfg.Broker.AutoCreateTopicEnable, cfg.Store.Type, cfg.Store.RootDir, cfg.Log.CfgFilePath)
 }
@@ -88,6 +88,7 @@ var defaultConfig = &Config{
 		HaMasterAddress:                    "",
 	},
 	Store: StoreConfig{
+		Type:             StoreTypePersistent,
 		RootDir:          defaultRootDir(),
 		FileReservedTime: 48,
 		FlushDiskType:    "SYNC_FLUSH",
@@ -29,6 +29,11 @@ import (
 )
 
 func main() {
+	// 离线校验存储文件：broker verify -root <dir> [-repair]
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		os.Exit(verify(os.Args[2:]))
+	}
+
 	c := flag.String("c", "", "broker config file, default etc/broker.toml")
 	p := flag.String("p", "broker.pid", "pid file, default broker.pid")
 	h := flag.Bool("h", false, "help")
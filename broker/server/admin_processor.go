@@ -15,10 +15,14 @@ package server
 
 import (
 	"fmt"
+	"math/rand"
 	"strconv"
 	"strings"
 
 	"github.com/boltmq/boltmq/common"
+	"github.com/boltmq/boltmq/store"
+	"github.com/boltmq/boltmq/store/persistent"
+	"github.com/boltmq/common/basis"
 	"github.com/boltmq/common/logger"
 	"github.com/boltmq/common/message"
 	"github.com/boltmq/common/net/core"
@@ -121,6 +125,22 @@ func (abp *adminBrokerProcessor) ProcessRequest(ctx core.Context, request *proto
 		return abp.cloneGroupOffset(ctx, request)
 	case protocol.VIEW_BROKER_STATS_DATA:
 		return abp.ViewBrokerStatsData(ctx, request) // 查看Broker统计信息
+	case QUERY_DLQ_MESSAGES:
+		return abp.queryDLQMessages(ctx, request) // 查询死信消息
+	case RESEND_DLQ_MESSAGES:
+		return abp.resendDLQMessages(ctx, request) // 重发死信消息
+	case UPDATE_TOPIC_ATTRIBUTE:
+		return abp.updateTopicAttribute(ctx, request) // 更新topic扩展属性
+	case GET_TOPIC_ATTRIBUTE:
+		return abp.getTopicAttribute(ctx, request) // 查询topic扩展属性
+	case GET_ALL_TOPIC_ATTRIBUTE:
+		return abp.getAllTopicAttribute(ctx, request) // 查询全部topic扩展属性
+	case PROMOTE_TO_MASTER:
+		return abp.promoteToMaster(ctx, request) // slave切换为master
+	case DEMOTE_TO_SLAVE:
+		return abp.demoteToSlave(ctx, request) // master切换为slave
+	case REBUILD_CONSUME_QUEUE:
+		return abp.rebuildConsumeQueue(ctx, request) // 重建逻辑队列及索引
 	default:
 
 	}
@@ -139,11 +159,22 @@ func (abp *adminBrokerProcessor) updateAndCreateTopic(ctx core.Context, request
 		return response, err
 	}
 
+	if err := abp.createTopic(requestHeader); err != nil {
+		response.Remark = err.Error()
+		return response, nil
+	}
+
+	response.Code = protocol.SUCCESS
+	response.Remark = ""
+	return response, nil
+}
+
+// createTopic 更新创建topic配置并注册到namesrv
+func (abp *adminBrokerProcessor) createTopic(requestHeader *head.CreateTopicRequestHeader) error {
 	// Topic名字是否与保留字段冲突
 	if strings.EqualFold(requestHeader.Topic, abp.brokerController.cfg.Cluster.Name) {
 		logger.Infof("the topic[%s] is conflict with system reserved words.", requestHeader.Topic)
-		response.Remark = fmt.Sprintf("the topic[%s] is conflict with system reserved words.", requestHeader.Topic)
-		return response, nil
+		return fmt.Errorf("the topic[%s] is conflict with system reserved words.", requestHeader.Topic)
 	}
 
 	readQueueNums := requestHeader.ReadQueueNums
@@ -157,11 +188,8 @@ func (abp *adminBrokerProcessor) updateAndCreateTopic(ctx core.Context, request
 	abp.brokerController.tpConfigManager.updateTopicConfig(topicConfig)
 	abp.brokerController.registerBrokerAll(false, true)
 
-	response.Code = protocol.SUCCESS
-	response.Remark = ""
-
 	logger.Infof("update and create topic success, topic=%s, cluster name=%s.", requestHeader.Topic, abp.brokerController.cfg.Cluster.Name)
-	return response, nil
+	return nil
 }
 
 func (abp *adminBrokerProcessor) getMaxOffset(ctx core.Context, request *protocol.RemotingCommand) (*protocol.RemotingCommand, error) {
@@ -189,15 +217,20 @@ func (abp *adminBrokerProcessor) deleteTopic(ctx core.Context, request *protocol
 		return nil, err
 	}
 
-	abp.brokerController.tpConfigManager.deleteTopicConfig(requestHeader.Topic)
-	abp.brokerController.tasks.startDeleteTopicTask()
-
+	abp.removeTopic(requestHeader.Topic)
 	logger.Infof("delete topic called by %s.", ctx.LocalAddr())
 	response.Code = protocol.SUCCESS
 	response.Remark = ""
 	return response, nil
 }
 
+// removeTopic 删除topic配置及扩展属性，并清理不再使用的逻辑队列
+func (abp *adminBrokerProcessor) removeTopic(topic string) {
+	abp.brokerController.tpConfigManager.deleteTopicConfig(topic)
+	abp.brokerController.tpAttrManager.deleteTopicAttribute(topic)
+	abp.brokerController.tasks.startDeleteTopicTask()
+}
+
 // getAllTopicConfig 获得Topic配置信息
 // Author rongzhihong
 // Since 2017/9/19
@@ -530,6 +563,14 @@ func (abp *adminBrokerProcessor) getTopicStatsInfo(ctx core.Context, request *pr
 		return nil, err
 	}
 
+	// 附加topic生效的保留策略，不识别该字段的客户端直接忽略
+	if pms, ok := abp.brokerController.messageStore.(*persistent.PersistentMessageStore); ok {
+		content, err = appendJSONField(content, "retention", pms.TopicRetentionStats(topic))
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	response.Code = protocol.SUCCESS
 	response.Body = content
 	response.Remark = ""
@@ -639,13 +680,27 @@ func (abp *adminBrokerProcessor) getConsumeStats(ctx core.Context, request *prot
 		return nil, errors.Wrap(err, 0)
 	}
 
+	content, err := abp.encodeConsumeStats(requestHeader.ConsumerGroup, requestHeader.Topic)
+	if err != nil {
+		return nil, err
+	}
+
+	response.Body = content
+	response.Code = protocol.SUCCESS
+	response.Remark = ""
+
+	return response, nil
+}
+
+// encodeConsumeStats 统计消费分组在topic上的消费进度，topic为空时统计该分组消费的全部topic
+func (abp *adminBrokerProcessor) encodeConsumeStats(consumerGroup, topic string) ([]byte, error) {
 	consumeStats := stats.NewConsumeStatsPlus()
 
 	topics := set.NewSet()
-	if common.IsBlank(requestHeader.Topic) {
-		topics = abp.brokerController.csmOffsetManager.whichTopicByConsumer(requestHeader.ConsumerGroup)
+	if common.IsBlank(topic) {
+		topics = abp.brokerController.csmOffsetManager.whichTopicByConsumer(consumerGroup)
 	} else {
-		topics.Add(requestHeader.Topic)
+		topics.Add(topic)
 	}
 
 	for topic := range topics.Iterator().C {
@@ -660,12 +715,12 @@ func (abp *adminBrokerProcessor) getConsumeStats(ctx core.Context, request *prot
 
 			// Consumer不在线的时候，也允许查询消费进度
 			{
-				findSubscriptionData := abp.brokerController.csmManager.findSubscriptionData(requestHeader.ConsumerGroup, topic)
+				findSubscriptionData := abp.brokerController.csmManager.findSubscriptionData(consumerGroup, topic)
 				// 如果Consumer在线，而且这个topic没有被订阅，那么就跳过
 				if nil == findSubscriptionData && abp.brokerController.csmManager.findSubscriptionDataCount(
-					requestHeader.ConsumerGroup) > 0 {
+					consumerGroup) > 0 {
 					logger.Warnf("consumeStats, the consumer group[%s], topic[%s] not exist.",
-						requestHeader.ConsumerGroup, topic)
+						consumerGroup, topic)
 					continue
 				}
 			}
@@ -683,7 +738,7 @@ func (abp *adminBrokerProcessor) getConsumeStats(ctx core.Context, request *prot
 					brokerOffset = 0
 				}
 
-				consumerOffset := abp.brokerController.csmOffsetManager.queryOffset(requestHeader.ConsumerGroup, topic, i)
+				consumerOffset := abp.brokerController.csmOffsetManager.queryOffset(consumerGroup, topic, i)
 				if consumerOffset < 0 {
 					consumerOffset = 0
 				}
@@ -704,7 +759,7 @@ func (abp *adminBrokerProcessor) getConsumeStats(ctx core.Context, request *prot
 				consumeStats.OffsetTable[mqKey] = offsetWrapper
 			}
 
-			consumeTps := abp.brokerController.brokerStats.TpsGroupGetNums(requestHeader.ConsumerGroup, topic)
+			consumeTps := abp.brokerController.brokerStats.TpsGroupGetNums(consumerGroup, topic)
 			consumeStats.ConsumeTps += consumeTps
 		}
 	}
@@ -713,16 +768,7 @@ func (abp *adminBrokerProcessor) getConsumeStats(ctx core.Context, request *prot
 	consumeTpsMath, _ := strconv.ParseFloat(consumeTpsStr, 64)
 	consumeStats.ConsumeTps = consumeTpsMath
 
-	content, err := common.Encode(consumeStats)
-	if err != nil {
-		return nil, err
-	}
-
-	response.Body = content
-	response.Code = protocol.SUCCESS
-	response.Remark = ""
-
-	return response, nil
+	return common.Encode(consumeStats)
 }
 
 // getAllConsumerOffset 所有消费者的偏移量
@@ -1173,3 +1219,299 @@ func (abp *adminBrokerProcessor) ViewBrokerStatsData(ctx core.Context, request *
 	response.Remark = ""
 	return response, nil
 }
+
+// queryDLQMessages 查询消费分组死信队列中的消息
+func (abp *adminBrokerProcessor) queryDLQMessages(ctx core.Context, request *protocol.RemotingCommand) (*protocol.RemotingCommand, error) {
+	response := protocol.CreateDefaultResponseCommand()
+	requestHeader := &queryDLQMessagesRequestHeader{}
+	err := request.DecodeCommandCustomHeader(requestHeader)
+	if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	dlqTopic := getDLQTopic(requestHeader.ConsumerGroup)
+	messageStore := abp.brokerController.messageStore
+	maxOffset := messageStore.MaxOffsetInQueue(dlqTopic, requestHeader.QueueId)
+	if maxOffset <= 0 {
+		response.Code = protocol.SYSTEM_ERROR
+		response.Remark = fmt.Sprintf("dlq topic[%s] queueId[%d] has no message", dlqTopic, requestHeader.QueueId)
+		return response, nil
+	}
+
+	minOffset := messageStore.MinOffsetInQueue(dlqTopic, requestHeader.QueueId)
+	offset := requestHeader.Offset
+	if offset < minOffset {
+		offset = minOffset
+	}
+
+	msgList := &dlqMessageList{MinOffset: minOffset, MaxOffset: maxOffset}
+	for ; offset < maxOffset && len(msgList.Messages) < int(requestHeader.MaxNums); offset++ {
+		msgExt := abp.lookDLQMessage(dlqTopic, requestHeader.QueueId, offset)
+		if msgExt == nil {
+			continue
+		}
+
+		msgList.Messages = append(msgList.Messages, &dlqMessage{
+			MsgId:           msgExt.MsgId,
+			Topic:           msgExt.GetProperty(message.PROPERTY_RETRY_TOPIC),
+			QueueOffset:     offset,
+			CommitLogOffset: msgExt.CommitLogOffset,
+			ReconsumeTimes:  msgExt.ReconsumeTimes,
+			StoreTimestamp:  msgExt.StoreTimestamp,
+			Keys:            msgExt.GetKeys(),
+			Tags:            msgExt.GetTags(),
+			BodyLength:      len(msgExt.Body),
+		})
+	}
+
+	content, err := ffjson.Marshal(msgList)
+	if err != nil {
+		return nil, err
+	}
+
+	response.Body = content
+	response.Code = protocol.SUCCESS
+	response.Remark = ""
+	return response, nil
+}
+
+// resendDLQMessages 将死信队列中指定的消息重发回原始topic
+func (abp *adminBrokerProcessor) resendDLQMessages(ctx core.Context, request *protocol.RemotingCommand) (*protocol.RemotingCommand, error) {
+	response := protocol.CreateDefaultResponseCommand()
+	requestHeader := &resendDLQMessagesRequestHeader{}
+	err := request.DecodeCommandCustomHeader(requestHeader)
+	if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	resendBody := &resendDLQMessagesBody{}
+	if err := common.Decode(request.Body, resendBody); err != nil {
+		response.Code = protocol.SYSTEM_ERROR
+		response.Remark = fmt.Sprintf("decode resend dlq messages body err: %s", err)
+		return response, nil
+	}
+
+	dlqTopic := getDLQTopic(requestHeader.ConsumerGroup)
+	result := &resendDLQMessagesResult{}
+	for _, offset := range resendBody.Offsets {
+		if abp.resendDLQMessage(dlqTopic, requestHeader.QueueId, offset) {
+			result.SucceedOffsets = append(result.SucceedOffsets, offset)
+		} else {
+			result.FailedOffsets = append(result.FailedOffsets, offset)
+		}
+	}
+
+	logger.Infof("resend dlq messages called by %s, topic: %s queueId: %d succeed: %d failed: %d.", parseChannelRemoteAddr(ctx),
+		dlqTopic, requestHeader.QueueId, len(result.SucceedOffsets), len(result.FailedOffsets))
+
+	content, err := ffjson.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+
+	response.Body = content
+	response.Code = protocol.SUCCESS
+	response.Remark = ""
+	return response, nil
+}
+
+// lookDLQMessage 查询死信队列offset处的消息，offset不在队列范围内或消息不属于死信队列时返回nil
+func (abp *adminBrokerProcessor) lookDLQMessage(dlqTopic string, queueId int32, offset int64) *message.MessageExt {
+	messageStore := abp.brokerController.messageStore
+	if offset < messageStore.MinOffsetInQueue(dlqTopic, queueId) || offset >= messageStore.MaxOffsetInQueue(dlqTopic, queueId) {
+		return nil
+	}
+
+	// 逻辑队列单元不存在时返回的commitlog offset为0，需要校验查到的消息属于该死信队列
+	commitLogOffset := messageStore.CommitLogOffsetInQueue(dlqTopic, queueId, offset)
+	msgExt := messageStore.LookMessageByOffset(commitLogOffset)
+	if msgExt == nil || msgExt.Topic != dlqTopic || msgExt.QueueId != queueId {
+		return nil
+	}
+
+	return msgExt
+}
+
+// resendDLQMessage 重发一条死信消息，重发后的消息重新开始计算重试次数
+func (abp *adminBrokerProcessor) resendDLQMessage(dlqTopic string, queueId int32, offset int64) bool {
+	messageStore := abp.brokerController.messageStore
+	msgExt := abp.lookDLQMessage(dlqTopic, queueId, offset)
+	if msgExt == nil {
+		logger.Warnf("resend dlq message not found, topic: %s queueId: %d offset: %d.", dlqTopic, queueId, offset)
+		return false
+	}
+
+	topic := msgExt.GetProperty(message.PROPERTY_RETRY_TOPIC)
+	topicConfig := abp.brokerController.tpConfigManager.selectTopicConfig(topic)
+	if topicConfig == nil || topicConfig.WriteQueueNums <= 0 {
+		logger.Warnf("resend dlq message, origin topic[%s] not exist, msgId: %s.", topic, msgExt.MsgId)
+		return false
+	}
+
+	delete(msgExt.Properties, message.PROPERTY_RETRY_TOPIC)
+	delete(msgExt.Properties, message.PROPERTY_DELAY_TIME_LEVEL)
+
+	msgInner := new(store.MessageExtInner)
+	msgInner.Topic = topic
+	msgInner.Body = msgExt.Body
+	msgInner.Flag = msgExt.Flag
+	message.SetPropertiesMap(&msgInner.Message, msgExt.Properties)
+	msgInner.PropertiesString = message.MessageProperties2String(msgExt.Properties)
+	msgInner.TagsCode = basis.TagsString2tagsCode(topicConfig.TpFilterType, msgExt.GetTags())
+	msgInner.QueueId = rand.Int31n(topicConfig.WriteQueueNums)
+	msgInner.SysFlag = msgExt.SysFlag
+	msgInner.BornTimestamp = msgExt.BornTimestamp
+	msgInner.BornHost = msgExt.BornHost
+	msgInner.StoreHost = abp.brokerController.getStoreHost()
+	msgInner.ReconsumeTimes = 0
+
+	putMessageResult := messageStore.PutMessage(msgInner)
+	if putMessageResult == nil || putMessageResult.Status != store.PUTMESSAGE_PUT_OK {
+		logger.Errorf("resend dlq message failed, topic: %s msgId: %s.", topic, msgExt.MsgId)
+		return false
+	}
+
+	return true
+}
+
+// updateTopicAttribute 更新topic扩展属性，如压缩策略
+func (abp *adminBrokerProcessor) updateTopicAttribute(ctx core.Context, request *protocol.RemotingCommand) (*protocol.RemotingCommand, error) {
+	response := protocol.CreateDefaultResponseCommand()
+	requestHeader := &topicAttributeRequestHeader{}
+	err := request.DecodeCommandCustomHeader(requestHeader)
+	if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	attr := &topicAttribute{}
+	if err := ffjson.Unmarshal(request.Body, attr); err != nil {
+		response.Code = protocol.SYSTEM_ERROR
+		response.Remark = fmt.Sprintf("decode topic attribute err: %s", err)
+		return response, nil
+	}
+
+	attr.Topic = requestHeader.Topic
+	if err := attr.check(); err != nil {
+		response.Code = protocol.SYSTEM_ERROR
+		response.Remark = err.Error()
+		return response, nil
+	}
+
+	abp.brokerController.tpAttrManager.updateTopicAttribute(attr)
+	logger.Infof("update topic attribute called by %s, topic: %s.", ctx.RemoteAddr(), attr.Topic)
+
+	response.Code = protocol.SUCCESS
+	response.Remark = ""
+	return response, nil
+}
+
+// getTopicAttribute 查询topic扩展属性
+func (abp *adminBrokerProcessor) getTopicAttribute(ctx core.Context, request *protocol.RemotingCommand) (*protocol.RemotingCommand, error) {
+	response := protocol.CreateDefaultResponseCommand()
+	requestHeader := &topicAttributeRequestHeader{}
+	err := request.DecodeCommandCustomHeader(requestHeader)
+	if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	attr := abp.brokerController.tpAttrManager.getTopicAttribute(requestHeader.Topic)
+	if attr == nil {
+		attr = &topicAttribute{Topic: requestHeader.Topic, Compression: store.COMPRESSION_NONE.String()}
+	}
+
+	content, err := ffjson.Marshal(attr)
+	if err != nil {
+		return nil, err
+	}
+
+	response.Body = content
+	response.Code = protocol.SUCCESS
+	response.Remark = ""
+	return response, nil
+}
+
+// getAllTopicAttribute 查询全部topic扩展属性，slave定时同步
+func (abp *adminBrokerProcessor) getAllTopicAttribute(ctx core.Context, request *protocol.RemotingCommand) (*protocol.RemotingCommand, error) {
+	response := protocol.CreateDefaultResponseCommand()
+	content := abp.brokerController.tpAttrManager.encode(false)
+	if content == "" {
+		response.Code = protocol.SYSTEM_ERROR
+		response.Remark = "encode topic attribute failed"
+		return response, nil
+	}
+
+	response.Body = []byte(content)
+	response.Code = protocol.SUCCESS
+	response.Remark = ""
+	return response, nil
+}
+
+// promoteToMaster slave切换为master
+func (abp *adminBrokerProcessor) promoteToMaster(ctx core.Context, request *protocol.RemotingCommand) (*protocol.RemotingCommand, error) {
+	response := protocol.CreateDefaultResponseCommand()
+	requestHeader := &promoteToMasterRequestHeader{}
+	err := request.DecodeCommandCustomHeader(requestHeader)
+	if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	role, _ := requestHeader.role()
+	logger.Infof("promote to master called by %s, role: %s, force: %t.", ctx.RemoteAddr(), role, requestHeader.Force)
+	if err := abp.brokerController.promoteToMaster(role, requestHeader.MaxFallBehind, requestHeader.Force); err != nil {
+		logger.Warnf("promote to master failed: %s.", err)
+		response.Code = protocol.SYSTEM_ERROR
+		response.Remark = err.Error()
+		return response, nil
+	}
+
+	response.Code = protocol.SUCCESS
+	response.Remark = ""
+	return response, nil
+}
+
+// demoteToSlave master切换为指定master的slave
+func (abp *adminBrokerProcessor) demoteToSlave(ctx core.Context, request *protocol.RemotingCommand) (*protocol.RemotingCommand, error) {
+	response := protocol.CreateDefaultResponseCommand()
+	requestHeader := &demoteToSlaveRequestHeader{}
+	err := request.DecodeCommandCustomHeader(requestHeader)
+	if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	logger.Infof("demote to slave called by %s, master ha address: %s, master max offset: %d.",
+		ctx.RemoteAddr(), requestHeader.MasterHaAddress, requestHeader.MasterMaxOffset)
+	if err := abp.brokerController.demoteToSlave(requestHeader.MasterHaAddress,
+		requestHeader.MasterMaxOffset, requestHeader.BrokerId); err != nil {
+		logger.Warnf("demote to slave failed: %s.", err)
+		response.Code = protocol.SYSTEM_ERROR
+		response.Remark = err.Error()
+		return response, nil
+	}
+
+	response.Code = protocol.SUCCESS
+	response.Remark = ""
+	return response, nil
+}
+
+// rebuildConsumeQueue 从commitlog重建逻辑队列及索引，进度通过broker运行时信息查看
+func (abp *adminBrokerProcessor) rebuildConsumeQueue(ctx core.Context, request *protocol.RemotingCommand) (*protocol.RemotingCommand, error) {
+	response := protocol.CreateDefaultResponseCommand()
+	requestHeader := &rebuildConsumeQueueRequestHeader{}
+	err := request.DecodeCommandCustomHeader(requestHeader)
+	if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	logger.Infof("rebuild consume queue called by %s, topics: %s, index: %t.", ctx.RemoteAddr(),
+		requestHeader.Topics, requestHeader.RebuildIndex)
+	if err := abp.brokerController.rebuildConsumeQueue(requestHeader.topics(), requestHeader.RebuildIndex); err != nil {
+		logger.Warnf("rebuild consume queue failed: %s.", err)
+		response.Code = protocol.SYSTEM_ERROR
+		response.Remark = err.Error()
+		return response, nil
+	}
+
+	response.Code = protocol.SUCCESS
+	response.Remark = ""
+	return response, nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/boltmq/common/utils/codec"
+)
+
+const (
+	SEND_BATCH_MESSAGE = 320 // 批量发送同一topic、同一队列的消息
+)
+
+// batchMessage 批量消息体中的一条消息
+type batchMessage struct {
+	Flag       int32
+	Body       []byte
+	Properties string
+}
+
+// decodeBatchMessages 解析批量消息请求体，每条消息的格式为:
+//
+//	totalSize(int32) magicCode(int32) bodyCRC(int32) flag(int32) bodyLen(int32) body propertiesLen(int16) properties
+//
+// bodyCRC不为0时校验消息体
+func decodeBatchMessages(data []byte) ([]*batchMessage, error) {
+	var (
+		msgs   []*batchMessage
+		reader = bytes.NewReader(data)
+	)
+
+	for reader.Len() > 0 {
+		var totalSize, magicCode, bodyCRC, flag, bodyLen int32
+		for _, v := range []*int32{&totalSize, &magicCode, &bodyCRC, &flag, &bodyLen} {
+			if err := binary.Read(reader, binary.BigEndian, v); err != nil {
+				return nil, fmt.Errorf("batch message %d header truncated", len(msgs))
+			}
+		}
+
+		if bodyLen < 0 || int(bodyLen) > reader.Len() {
+			return nil, fmt.Errorf("batch message %d body length %d is invalid", len(msgs), bodyLen)
+		}
+
+		body := make([]byte, bodyLen)
+		reader.Read(body)
+
+		var propertiesLen int16
+		if err := binary.Read(reader, binary.BigEndian, &propertiesLen); err != nil {
+			return nil, fmt.Errorf("batch message %d properties truncated", len(msgs))
+		}
+
+		if propertiesLen < 0 || int(propertiesLen) > reader.Len() {
+			return nil, fmt.Errorf("batch message %d properties length %d is invalid", len(msgs), propertiesLen)
+		}
+
+		properties := make([]byte, propertiesLen)
+		reader.Read(properties)
+
+		if expect := 4*5 + bodyLen + 2 + int32(propertiesLen); totalSize != expect {
+			return nil, fmt.Errorf("batch message %d total size %d not matched %d", len(msgs), totalSize, expect)
+		}
+
+		if bodyCRC != 0 {
+			if crc, _ := codec.Crc32(body); crc != bodyCRC {
+				return nil, fmt.Errorf("batch message %d body crc %d not matched %d", len(msgs), crc, bodyCRC)
+			}
+		}
+
+		msgs = append(msgs, &batchMessage{Flag: flag, Body: body, Properties: string(properties)})
+	}
+
+	if len(msgs) == 0 {
+		return nil, fmt.Errorf("batch message is empty")
+	}
+
+	return msgs, nil
+}
+
+// sendBatchMessageItem 批量消息中每条消息的写入结果
+type sendBatchMessageItem struct {
+	MsgId       string `json:"msgId"`
+	QueueOffset int64  `json:"queueOffset"`
+}
+
+// sendBatchMessageResult 批量发送消息的结果，顺序与请求中的消息一致
+type sendBatchMessageResult struct {
+	QueueId int32                   `json:"queueId"`
+	Items   []*sendBatchMessageItem `json:"items"`
+}
@@ -14,8 +14,11 @@
 package server
 
 import (
+	"fmt"
+
 	"github.com/boltmq/boltmq/broker/trace"
 	"github.com/boltmq/boltmq/common"
+	"github.com/boltmq/boltmq/store/sql92"
 	"github.com/boltmq/common/constant"
 	"github.com/boltmq/common/logger"
 	"github.com/boltmq/common/net/core"
@@ -66,6 +69,24 @@ func (cmp *clientManageProcessor) heartBeat(ctx core.Context, request *protocol.
 	heartbeatDataPlus.Decode(request.Body)
 	consumerDataSet := heartbeatDataPlus.ConsumerDataSet
 	chanInfo := newChannelInfo(ctx, heartbeatDataPlus.ClientID, request.Language, ctx.UniqueSocketAddr().String(), request.Version)
+
+	// 校验SQL92订阅表达式，非法表达式直接拒绝注册
+	for _, consumerData := range consumerDataSet {
+		for _, sub := range consumerData.SubscriptionDataSet {
+			if !sql92.IsExpression(sub.SubString) {
+				continue
+			}
+
+			if _, err := sql92.Compile(sub.SubString); err != nil {
+				logger.Warnf("consumer subscription expression %s invalid, group: %s, err: %s.", sub.SubString, consumerData.GroupName, err)
+				response.Code = protocol.SUBSCRIPTION_PARSE_FAILED
+				response.Remark = fmt.Sprintf("the consumer's subscription expression[%s] of topic[%s] is invalid: %s",
+					sub.SubString, sub.Topic, err)
+				return response, nil
+			}
+		}
+	}
+
 	for _, consumerData := range consumerDataSet {
 		subscriptionGroupConfig :=
 			cmp.brokerController.subGroupManager.findSubscriptionGroupConfig(consumerData.GroupName)
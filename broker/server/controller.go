@@ -16,6 +16,7 @@ package server
 import (
 	"bytes"
 	"fmt"
+	"strings"
 
 	"github.com/boltmq/boltmq/broker/client"
 	"github.com/boltmq/boltmq/broker/config"
@@ -23,6 +24,7 @@ import (
 	"github.com/boltmq/boltmq/stats"
 	"github.com/boltmq/boltmq/stats/sstats"
 	"github.com/boltmq/boltmq/store"
+	"github.com/boltmq/boltmq/store/memory"
 	"github.com/boltmq/boltmq/store/persistent"
 	"github.com/boltmq/common/basis"
 	"github.com/boltmq/common/logger"
@@ -56,6 +58,7 @@ type BrokerController struct {
 	remotingClient              remoting.RemotingClient
 	remotingServer              remoting.RemotingServer
 	tpConfigManager             *topicConfigManager
+	tpAttrManager               *topicAttributeManager
 	updateMasterHASrvAddrPeriod bool
 	filterSrvManager            *filterServerManager
 	sendMessageHookList         []trace.SendMessageHook
@@ -63,6 +66,8 @@ type BrokerController struct {
 	brokerStatsRelatedStore     stats.BrokerStatsRelatedStore
 	brokerStats                 stats.BrokerStats
 	tasks                       *controllerTasks
+	electionId                  int64 // 选举复制模式下节点在选举组中的id，作为slave时的brokerId
+	httpAdmin                   *httpAdminServer
 }
 
 // NewBrokerController 创建BrokerController对象
@@ -79,6 +84,7 @@ func NewBrokerController(cfg *config.Config) (*BrokerController, error) {
 	controller.dataVersion = basis.NewDataVersion()
 	controller.csmOffsetManager = newConsumerOffsetManager(controller)
 	controller.tpConfigManager = newTopicConfigManager(controller)
+	controller.tpAttrManager = newTopicAttributeManager(controller)
 	controller.pullMsgProcessor = newPullMessageProcessor(controller)
 	controller.pullRequestHoldSrv = newPullRequestHoldService(controller)
 	controller.tsCheckSupervisor = newTransactionCheckSupervisor(controller)
@@ -94,6 +100,7 @@ func NewBrokerController(cfg *config.Config) (*BrokerController, error) {
 	controller.tasks = newControllerTasks(controller)
 	controller.slaveSync = newSlaveSynchronize(controller)
 	controller.brokerStats = stats.NewBrokerStats(controller.cfg.Cluster.Name)
+	controller.httpAdmin = newHttpAdminServer(controller)
 	controller.updateMasterHASrvAddrPeriod = false
 	if len(controller.cfg.Cluster.NameSrvAddrs) > 0 {
 		controller.callOuter.UpdateNameServerAddressList(controller.cfg.Cluster.NameSrvAddrs)
@@ -103,6 +110,20 @@ func NewBrokerController(cfg *config.Config) (*BrokerController, error) {
 	return controller, nil
 }
 
+// NewStoreConfig 按broker配置生成持久化存储配置，与broker启动时使用的存储配置一致，离线工具使用
+func NewStoreConfig(cfg *config.Config) (*persistent.Config, error) {
+	controller := &BrokerController{
+		cfg:      cfg,
+		storeCfg: persistent.NewConfig(cfg.Store.RootDir),
+	}
+
+	if err := controller.fixConfig(); err != nil {
+		return nil, err
+	}
+
+	return controller.storeCfg, nil
+}
+
 func (controller *BrokerController) fixConfig() error {
 	if brokerRole, err := persistent.ParseBrokerRoleType(controller.cfg.Cluster.BrokerRole); err != nil {
 		return err
@@ -110,6 +131,29 @@ func (controller *BrokerController) fixConfig() error {
 		controller.storeCfg.BrokerRole = brokerRole
 	}
 
+	// 选举复制模式下以slave启动，由选举结果切换角色
+	if controller.cfg.Cluster.ElectionEnable {
+		if controller.cfg.Cluster.BrokerId == basis.MASTER_ID {
+			return fmt.Errorf("broker id must not be %d when election enable", basis.MASTER_ID)
+		}
+
+		if controller.cfg.Store.Type != config.StoreTypePersistent {
+			return fmt.Errorf("election requires %s store", config.StoreTypePersistent)
+		}
+
+		controller.electionId = controller.cfg.Cluster.BrokerId
+		controller.storeCfg.BrokerRole = persistent.SLAVE
+		controller.storeCfg.ReplicatedLogEnable = true
+		controller.storeCfg.ElectionSelfId = controller.cfg.Cluster.BrokerId
+		controller.storeCfg.ElectionPeers = strings.Join(controller.cfg.Cluster.ElectionPeers, ";")
+	}
+
+	if controller.cfg.Cluster.SyncReplicas < 0 {
+		return fmt.Errorf("sync replicas %d is invalid", controller.cfg.Cluster.SyncReplicas)
+	} else if controller.cfg.Cluster.SyncReplicas > 0 {
+		controller.storeCfg.SyncReplicasQuorum = int32(controller.cfg.Cluster.SyncReplicas)
+	}
+
 	if flushDisk, err := persistent.ParseFlushDiskType(controller.cfg.Store.FlushDiskType); err != nil {
 		return err
 	} else {
@@ -131,7 +175,44 @@ func (controller *BrokerController) fixConfig() error {
 	default:
 	}
 
+	switch controller.cfg.Store.Type {
+	case config.StoreTypePersistent, config.StoreTypeMemory:
+	default:
+		return fmt.Errorf("unknown store type: %s", controller.cfg.Store.Type)
+	}
+
 	controller.storeCfg.HaListenPort = int32(controller.cfg.Broker.Port + 1)
+	if controller.cfg.Store.HaTLSEnable {
+		if controller.cfg.Store.HaTLSCertFile == "" || controller.cfg.Store.HaTLSKeyFile == "" {
+			return fmt.Errorf("ha tls requires cert file and key file")
+		}
+
+		controller.storeCfg.HaTLSEnable = true
+		controller.storeCfg.HaTLSCertFile = controller.cfg.Store.HaTLSCertFile
+		controller.storeCfg.HaTLSKeyFile = controller.cfg.Store.HaTLSKeyFile
+		controller.storeCfg.HaTLSCAFile = controller.cfg.Store.HaTLSCAFile
+		controller.storeCfg.HaTLSServerName = controller.cfg.Store.HaTLSServerName
+		controller.storeCfg.HaTLSAllowedNames = strings.Join(controller.cfg.Store.HaTLSAllowedNames, ";")
+	}
+	controller.storeCfg.HaAuthSecret = controller.cfg.Store.HaAuthSecret
+	controller.storeCfg.ConsumeQueueExtEnable = controller.cfg.Store.ConsumeQueueExtEnable
+	if bloomBits := controller.cfg.Store.ConsumeQueueExtBloomBits; bloomBits != 0 {
+		if bloomBits < 0 || bloomBits%8 != 0 {
+			return fmt.Errorf("consume queue ext bloom bits %d should be a positive multiple of 8", bloomBits)
+		}
+		controller.storeCfg.ConsumeQueueExtBloomBits = bloomBits
+	}
+	controller.storeCfg.HaSlaveAutoRebase = controller.cfg.Store.HaSlaveAutoRebase
+	controller.storeCfg.RebuildTopics = strings.Join(controller.cfg.Store.RebuildTopics, ";")
+	controller.storeCfg.RebuildIndex = controller.cfg.Store.RebuildIndex
+	controller.storeCfg.ColdStorageType = controller.cfg.Store.ColdStorageType
+	controller.storeCfg.ColdStorageDir = controller.cfg.Store.ColdStorageDir
+	controller.storeCfg.ColdStorageEndpoint = controller.cfg.Store.ColdStorageEndpoint
+	controller.storeCfg.ColdStorageRegion = controller.cfg.Store.ColdStorageRegion
+	controller.storeCfg.ColdStorageBucket = controller.cfg.Store.ColdStorageBucket
+	controller.storeCfg.ColdStoragePrefix = controller.cfg.Store.ColdStoragePrefix
+	controller.storeCfg.ColdStorageAccessKey = controller.cfg.Store.ColdStorageAccessKey
+	controller.storeCfg.ColdStorageSecretKey = controller.cfg.Store.ColdStorageSecretKey
 	if controller.cfg.Broker.HaMasterAddress != "" {
 		controller.storeCfg.HaMasterAddress = controller.cfg.Broker.HaMasterAddress // HA功能配置此项
 	}
@@ -148,13 +229,15 @@ func (controller *BrokerController) init() bool {
 	result := controller.tpConfigManager.load()
 	result = result && controller.csmOffsetManager.load()
 	result = result && controller.subGroupManager.load()
+	result = result && controller.tpAttrManager.load()
 
 	if result {
-		controller.messageStore = persistent.NewMessageStore(controller.storeCfg, controller.brokerStats)
+		controller.messageStore = controller.newMessageStore()
 		if !controller.messageStore.Load() {
 			controller.Shutdown()
 			return false
 		}
+		controller.tpAttrManager.applyRetentions()
 	}
 
 	controller.brokerStatsRelatedStore = sstats.NewBrokerStatsRelatedStore(controller.messageStore)
@@ -168,6 +251,24 @@ func (controller *BrokerController) init() bool {
 	return true
 }
 
+// newMessageStore 根据配置的存储类型创建消息存储
+func (controller *BrokerController) newMessageStore() store.MessageStore {
+	if controller.cfg.Store.Type == config.StoreTypeMemory {
+		logger.Info("broker use memory message store, messages will not be persisted.")
+		return memory.NewMessageStore(memory.NewConfig(), controller.brokerStats)
+	}
+
+	ms := persistent.NewMessageStore(controller.storeCfg, controller.brokerStats)
+	if pms, ok := ms.(*persistent.PersistentMessageStore); ok {
+		pms.SetTransactionCheckExecuter(controller.tsCheckSupervisor)
+		if controller.cfg.Cluster.ElectionEnable {
+			pms.SetRoleChangeListener(controller.onElectionRoleChange)
+		}
+	}
+
+	return ms
+}
+
 // registerProcessor 注册提供服务
 // Author gaoyanlei
 // Since 2017/8/25
@@ -185,6 +286,7 @@ func (controller *BrokerController) registerProcessor() {
 	sendMessageProcessor.RegisterSendMessageHook(controller.sendMessageHookList)                       // 发送消息回调
 	controller.remotingServer.RegisterProcessor(protocol.SEND_MESSAGE, sendMessageProcessor)           // 未优化过发送消息
 	controller.remotingServer.RegisterProcessor(protocol.SEND_MESSAGE_V2, sendMessageProcessor)        // 优化过发送消息
+	controller.remotingServer.RegisterProcessor(SEND_BATCH_MESSAGE, sendMessageProcessor)              // 批量发送消息
 	controller.remotingServer.RegisterProcessor(protocol.CONSUMER_SEND_MSG_BACK, sendMessageProcessor) // 消费失败消息
 
 	// 拉取消息事件处理器 PullMessageProcessor
@@ -225,6 +327,8 @@ func (controller *BrokerController) Shutdown() {
 		controller.pullRequestHoldSrv.shutdown()
 	}
 
+	controller.httpAdmin.shutdown()
+
 	if controller.remotingServer != nil {
 		controller.remotingServer.Shutdown()
 	}
@@ -236,6 +340,7 @@ func (controller *BrokerController) Shutdown() {
 	controller.csmOffsetManager.cfgManagerLoader.persist()
 	controller.tpConfigManager.cfgManagerLoader.persist()
 	controller.subGroupManager.cfgManagerLoader.persist()
+	controller.tpAttrManager.cfgManagerLoader.persist()
 
 	if controller.brokerStats != nil {
 		controller.brokerStats.Shutdown()
@@ -270,6 +375,13 @@ func (controller *BrokerController) updateNameServerAddr() {
 // Author: tianyuliang
 // Since: 2017/10/10
 func (controller *BrokerController) synchronizeMaster2Slave() {
+	// 选举复制模式下由选举服务复制commitlog，不使用HA。以slave启动，元数据从当前leader同步，成为leader时停止
+	if controller.cfg.Cluster.ElectionEnable {
+		controller.updateMasterHASrvAddrPeriod = false
+		controller.tasks.startSlaveSynchronizeTask()
+		return
+	}
+
 	if controller.storeCfg.BrokerRole != persistent.SLAVE {
 		controller.tasks.startPrintMasterAndSlaveDiffTask()
 		return
@@ -284,6 +396,23 @@ func (controller *BrokerController) synchronizeMaster2Slave() {
 	controller.tasks.startSlaveSynchronizeTask()
 }
 
+// onElectionRoleChange 选举导致角色变化后更新brokerId，leader以brokerId=0重新注册到所有namesrv。
+// follower从注册结果中的leader地址同步消费进度、topic及订阅组等元数据，leader停止同步
+func (controller *BrokerController) onElectionRoleChange(role persistent.BrokerRoleType) {
+	controller.slaveSync.masterAddr = ""
+	if role == persistent.SLAVE {
+		controller.cfg.Cluster.BrokerId = controller.electionId
+		controller.tasks.startSlaveSynchronizeTask()
+	} else {
+		controller.cfg.Cluster.BrokerId = basis.MASTER_ID
+		controller.tasks.stopSlaveSynchronizeTask()
+	}
+	controller.cfg.Cluster.BrokerRole = role.String()
+
+	logger.Infof("broker role change to %s, broker id: %d.", role, controller.cfg.Cluster.BrokerId)
+	controller.registerBrokerAll(true, false)
+}
+
 // RegisterConsumeMessageHook 注册消费消息的回调
 // Author rongzhihong
 // Since 2017/9/11
@@ -397,6 +526,10 @@ func (controller *BrokerController) Start() {
 		controller.brokerStats.Start()
 	}
 
+	if err := controller.httpAdmin.start(); err != nil {
+		logger.Errorf("http admin start err: %s.", err)
+	}
+
 	controller.registerBrokerAll(true, false)
 	controller.tasks.startRegisterAllBrokerTask() // 每个Broker会每隔30s向NameSrv更新自身topic信息
 	controller.tasks.startDeleteTopicTask()
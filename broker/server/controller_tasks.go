@@ -125,6 +125,10 @@ func (ctasks *controllerTasks) startBrokerStatsRecordTask() {
 // Author: tianyuliang
 // Since: 2017/10/10
 func (ctasks *controllerTasks) startPersistConsumerOffsetTask() {
+	if ctasks.persistConsumerOffsetTask != nil {
+		return
+	}
+
 	period := time.Duration(ctasks.brokerController.cfg.Broker.FlushConsumerOffsetInterval) * time.Millisecond
 	ctasks.persistConsumerOffsetTask = system.NewTicker(false, 10*time.Second, period, func() {
 		ctasks.brokerController.csmOffsetManager.cfgManagerLoader.persist()
@@ -159,6 +163,10 @@ func (ctasks *controllerTasks) startFetchNameServerAddrTask() {
 // Author: tianyuliang
 // Since: 2017/10/10
 func (ctasks *controllerTasks) startSlaveSynchronizeTask() {
+	if ctasks.slaveSynchronizeTask != nil {
+		return
+	}
+
 	ctasks.slaveSynchronizeTask = system.NewTicker(false, 10*time.Second, 1*time.Minute, func() {
 		ctasks.brokerController.slaveSync.syncAll()
 	})
@@ -170,6 +178,10 @@ func (ctasks *controllerTasks) startSlaveSynchronizeTask() {
 // Author: tianyuliang
 // Since: 2017/10/10
 func (ctasks *controllerTasks) startPrintMasterAndSlaveDiffTask() {
+	if ctasks.printMasterAndSlaveDiffTask != nil {
+		return
+	}
+
 	ctasks.printMasterAndSlaveDiffTask = system.NewTicker(false, 10*time.Second, 1*time.Minute, func() {
 		diff := ctasks.brokerController.messageStore.SlaveFallBehindMuch()
 		if diff > 0 {
@@ -180,6 +192,24 @@ func (ctasks *controllerTasks) startPrintMasterAndSlaveDiffTask() {
 	logger.Infof("print-master-slave-diff task start success.")
 }
 
+// stopSlaveSynchronizeTask slave切换为master时停止同步
+func (ctasks *controllerTasks) stopSlaveSynchronizeTask() {
+	if ctasks.slaveSynchronizeTask != nil {
+		ctasks.slaveSynchronizeTask.Stop()
+		ctasks.slaveSynchronizeTask = nil
+		logger.Info("slave-synchronize task stop success.")
+	}
+}
+
+// stopPrintMasterAndSlaveDiffTask master切换为slave时停止输出主从偏移量差值
+func (ctasks *controllerTasks) stopPrintMasterAndSlaveDiffTask() {
+	if ctasks.printMasterAndSlaveDiffTask != nil {
+		ctasks.printMasterAndSlaveDiffTask.Stop()
+		ctasks.printMasterAndSlaveDiffTask = nil
+		logger.Info("print-master-slave-diff task stop success.")
+	}
+}
+
 // startRegisterAllBrokerTask 注册所有Broker
 // Author: tianyuliang
 // Since: 2017/10/10
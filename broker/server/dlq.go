@@ -0,0 +1,88 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"fmt"
+)
+
+const (
+	QUERY_DLQ_MESSAGES  = 600 // 查询死信队列中的消息
+	RESEND_DLQ_MESSAGES = 601 // 将死信消息重发回原始topic
+)
+
+// queryDLQMessagesRequestHeader 查询死信消息请求头
+type queryDLQMessagesRequestHeader struct {
+	ConsumerGroup string `json:"consumerGroup"`
+	QueueId       int32  `json:"queueId"`
+	Offset        int64  `json:"offset"`
+	MaxNums       int32  `json:"maxNums"`
+}
+
+func (header *queryDLQMessagesRequestHeader) CheckFields() error {
+	if header.ConsumerGroup == "" {
+		return fmt.Errorf("consumerGroup is empty")
+	}
+
+	if header.MaxNums <= 0 {
+		return fmt.Errorf("maxNums %d is invalid", header.MaxNums)
+	}
+
+	return nil
+}
+
+// resendDLQMessagesRequestHeader 重发死信消息请求头，需要重发的逻辑offset在请求体中
+type resendDLQMessagesRequestHeader struct {
+	ConsumerGroup string `json:"consumerGroup"`
+	QueueId       int32  `json:"queueId"`
+}
+
+func (header *resendDLQMessagesRequestHeader) CheckFields() error {
+	if header.ConsumerGroup == "" {
+		return fmt.Errorf("consumerGroup is empty")
+	}
+
+	return nil
+}
+
+// dlqMessage 死信消息概要
+type dlqMessage struct {
+	MsgId           string `json:"msgId"`
+	Topic           string `json:"topic"` // 原始topic
+	QueueOffset     int64  `json:"queueOffset"`
+	CommitLogOffset int64  `json:"commitLogOffset"`
+	ReconsumeTimes  int32  `json:"reconsumeTimes"`
+	StoreTimestamp  int64  `json:"storeTimestamp"`
+	Keys            string `json:"keys"`
+	Tags            string `json:"tags"`
+	BodyLength      int    `json:"bodyLength"`
+}
+
+// dlqMessageList 查询死信消息的结果
+type dlqMessageList struct {
+	MinOffset int64         `json:"minOffset"`
+	MaxOffset int64         `json:"maxOffset"`
+	Messages  []*dlqMessage `json:"messages"`
+}
+
+// resendDLQMessagesBody 重发死信消息请求体
+type resendDLQMessagesBody struct {
+	Offsets []int64 `json:"offsets"`
+}
+
+// resendDLQMessagesResult 重发死信消息的结果
+type resendDLQMessagesResult struct {
+	SucceedOffsets []int64 `json:"succeedOffsets"`
+	FailedOffsets  []int64 `json:"failedOffsets"`
+}
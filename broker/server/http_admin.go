@@ -0,0 +1,404 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/boltmq/boltmq/common"
+	"github.com/boltmq/boltmq/common/httpapi"
+	"github.com/boltmq/boltmq/store"
+	"github.com/boltmq/common/logger"
+	"github.com/boltmq/common/message"
+	"github.com/boltmq/common/protocol"
+	"github.com/boltmq/common/protocol/head"
+	"github.com/boltmq/common/protocol/subscription"
+	"github.com/boltmq/common/utils/system"
+)
+
+const (
+	httpAdminMaxQueryNum = 64          // 按key查询消息的最大条数
+	httpAdminDefaultHost = "127.0.0.1" // 未配置监听ip时只允许本机访问
+)
+
+// httpMessage 查询到的消息，消息体为base64编码
+type httpMessage struct {
+	MsgId           string            `json:"msgId"`
+	Topic           string            `json:"topic"`
+	QueueId         int32             `json:"queueId"`
+	QueueOffset     int64             `json:"queueOffset"`
+	CommitLogOffset int64             `json:"commitLogOffset"`
+	BornTimestamp   int64             `json:"bornTimestamp"`
+	StoreTimestamp  int64             `json:"storeTimestamp"`
+	ReconsumeTimes  int32             `json:"reconsumeTimes"`
+	Keys            string            `json:"keys"`
+	Tags            string            `json:"tags"`
+	Properties      map[string]string `json:"properties"`
+	Body            []byte            `json:"body"`
+}
+
+// httpAdminServer broker的http管理接口，与adminBrokerProcessor使用相同的管理对象，以json返回结果。
+// 写接口及返回消息内容的查询接口需要在Authorization头中携带"Bearer <token>"，未配置token时不开放
+type httpAdminServer struct {
+	brokerController *BrokerController
+	admin            *adminBrokerProcessor
+	server           *httpapi.Server
+}
+
+func newHttpAdminServer(controller *BrokerController) *httpAdminServer {
+	has := &httpAdminServer{
+		brokerController: controller,
+		admin:            newAdminBrokerProcessor(controller),
+	}
+	if controller.cfg.Broker.HttpAdminPort <= 0 {
+		return has
+	}
+
+	host := controller.cfg.Broker.HttpAdminHost
+	if host == "" {
+		host = httpAdminDefaultHost
+	}
+	server := httpapi.NewServer("http admin", net.JoinHostPort(host, strconv.Itoa(controller.cfg.Broker.HttpAdminPort)),
+		func() string {
+			return controller.cfg.Broker.HttpAdminToken
+		})
+	server.HandleFunc("/topics", server.Get(has.allTopicConfig))
+	server.HandleFunc("/topic", has.topic)
+	server.HandleFunc("/subscription-groups", server.Get(has.allSubscriptionGroup))
+	server.HandleFunc("/subscription-group", has.subscriptionGroup)
+	server.HandleFunc("/consume-stats", server.Get(has.consumeStats))
+	server.HandleFunc("/consumer/reset-offset", server.Post(has.resetOffset))
+	server.HandleFunc("/runtime", server.Get(has.runtimeInfo))
+	server.HandleFunc("/config", server.Private(has.config))
+	server.HandleFunc("/message", server.Get(server.Private(has.messageById)))
+	server.HandleFunc("/messages", server.Get(server.Private(has.messagesByKey)))
+	has.server = server
+
+	return has
+}
+
+func (has *httpAdminServer) start() error {
+	if has.server == nil {
+		return nil
+	}
+
+	return has.server.Start()
+}
+
+func (has *httpAdminServer) shutdown() {
+	if has.server != nil {
+		has.server.Shutdown()
+	}
+}
+
+// allTopicConfig 获得全部topic配置，对应GET_ALL_TOPIC_CONFIG
+func (has *httpAdminServer) allTopicConfig(w http.ResponseWriter, r *http.Request) {
+	content := has.brokerController.tpConfigManager.encode(false)
+	if content == "" {
+		httpapi.WriteError(w, http.StatusNotFound, "no topic in this broker")
+		return
+	}
+	httpapi.WriteContent(w, []byte(content))
+}
+
+// topic GET查询topic配置；POST以CreateTopicRequestHeader格式的json创建或更新topic；DELETE删除topic
+func (has *httpAdminServer) topic(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		topic := r.FormValue("topic")
+		topicConfig := has.brokerController.tpConfigManager.selectTopicConfig(topic)
+		if topicConfig == nil {
+			httpapi.WriteError(w, http.StatusNotFound, fmt.Sprintf("topic[%s] not exist", topic))
+			return
+		}
+		httpapi.WriteJSON(w, topicConfig)
+	case http.MethodPost:
+		if !has.server.Authorize(w, r) {
+			return
+		}
+		requestHeader := &head.CreateTopicRequestHeader{}
+		if !has.decodeBody(w, r, requestHeader) {
+			return
+		}
+		if requestHeader.Topic == "" {
+			httpapi.WriteError(w, http.StatusBadRequest, "topic is empty")
+			return
+		}
+
+		if err := has.admin.createTopic(requestHeader); err != nil {
+			httpapi.WriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		httpapi.WriteJSON(w, has.brokerController.tpConfigManager.selectTopicConfig(requestHeader.Topic))
+	case http.MethodDelete:
+		if !has.server.Authorize(w, r) {
+			return
+		}
+		topic := r.FormValue("topic")
+		if topic == "" {
+			httpapi.WriteError(w, http.StatusBadRequest, "topic is empty")
+			return
+		}
+
+		has.admin.removeTopic(topic)
+		logger.Infof("http admin delete topic %s, client: %s.", topic, r.RemoteAddr)
+		httpapi.WriteJSON(w, map[string]string{"topic": topic})
+	default:
+		httpapi.WriteError(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method))
+	}
+}
+
+// allSubscriptionGroup 获得全部消费分组，对应GET_ALL_SUBSCRIPTIONGROUP_CONFIG
+func (has *httpAdminServer) allSubscriptionGroup(w http.ResponseWriter, r *http.Request) {
+	content := has.brokerController.subGroupManager.encode(false)
+	if content == "" {
+		httpapi.WriteError(w, http.StatusNotFound, "no subscription group in this broker")
+		return
+	}
+	httpapi.WriteContent(w, []byte(content))
+}
+
+// subscriptionGroup GET查询消费分组；POST以SubscriptionGroupConfig格式的json创建或更新消费分组；DELETE删除消费分组
+func (has *httpAdminServer) subscriptionGroup(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		group := r.FormValue("group")
+		config := has.brokerController.subGroupManager.findSubscriptionGroupConfig(group)
+		if config == nil {
+			httpapi.WriteError(w, http.StatusNotFound, fmt.Sprintf("subscription group[%s] not exist", group))
+			return
+		}
+		httpapi.WriteJSON(w, config)
+	case http.MethodPost:
+		if !has.server.Authorize(w, r) {
+			return
+		}
+		config := &subscription.SubscriptionGroupConfig{}
+		if !has.decodeBody(w, r, config) {
+			return
+		}
+		if config.GroupName == "" {
+			httpapi.WriteError(w, http.StatusBadRequest, "groupName is empty")
+			return
+		}
+
+		has.brokerController.subGroupManager.updateSubscriptionGroupConfig(config)
+		logger.Infof("http admin update subscription group %s, client: %s.", config.GroupName, r.RemoteAddr)
+		httpapi.WriteJSON(w, config)
+	case http.MethodDelete:
+		if !has.server.Authorize(w, r) {
+			return
+		}
+		group := r.FormValue("group")
+		if group == "" {
+			httpapi.WriteError(w, http.StatusBadRequest, "group is empty")
+			return
+		}
+
+		has.brokerController.subGroupManager.deleteSubscriptionGroupConfig(group)
+		logger.Infof("http admin delete subscription group %s, client: %s.", group, r.RemoteAddr)
+		httpapi.WriteJSON(w, map[string]string{"group": group})
+	default:
+		httpapi.WriteError(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method))
+	}
+}
+
+// consumeStats 获得消费分组的消费进度，对应GET_CONSUME_STATS
+func (has *httpAdminServer) consumeStats(w http.ResponseWriter, r *http.Request) {
+	group := r.FormValue("group")
+	if group == "" {
+		httpapi.WriteError(w, http.StatusBadRequest, "group is empty")
+		return
+	}
+
+	content, err := has.admin.encodeConsumeStats(group, r.FormValue("topic"))
+	if err != nil {
+		httpapi.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	httpapi.WriteContent(w, content)
+}
+
+// resetOffset 以ResetOffsetRequestHeader格式的json重置消费进度，对应INVOKE_BROKER_TO_RESET_OFFSET
+func (has *httpAdminServer) resetOffset(w http.ResponseWriter, r *http.Request) {
+	requestHeader := &head.ResetOffsetRequestHeader{}
+	if !has.decodeBody(w, r, requestHeader) {
+		return
+	}
+
+	logger.Infof("[reset-offset] reset offset started by %s. topic=%s, group=%s, timestamp=%d, isForce=%t.",
+		r.RemoteAddr, requestHeader.Topic, requestHeader.Group, requestHeader.Timestamp, requestHeader.IsForce)
+	response := has.brokerController.b2Client.resetOffset(requestHeader.Topic, requestHeader.Group, requestHeader.Timestamp, requestHeader.IsForce)
+	if response.Code != protocol.SUCCESS {
+		httpapi.WriteError(w, http.StatusInternalServerError, response.Remark)
+		return
+	}
+	if len(response.Body) == 0 {
+		httpapi.WriteJSON(w, map[string]string{"topic": requestHeader.Topic, "group": requestHeader.Group})
+		return
+	}
+	httpapi.WriteContent(w, response.Body)
+}
+
+// runtimeInfo 获取broker运行时信息，对应GET_BROKER_RUNTIME_INFO
+func (has *httpAdminServer) runtimeInfo(w http.ResponseWriter, r *http.Request) {
+	httpapi.WriteJSON(w, has.admin.prepareRuntimeInfo())
+}
+
+// config 需认证，GET获得broker配置，不返回密钥；POST更新broker配置，与UPDATE_BROKER_CONFIG相同交由updateAllConfig处理
+func (has *httpAdminServer) config(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		cfg := *has.brokerController.cfg
+		cfg.Store.HaAuthSecret = ""
+		cfg.Store.ColdStorageSecretKey = ""
+		cfg.Broker.HttpAdminToken = ""
+		httpapi.WriteJSON(w, map[string]interface{}{
+			"version": has.brokerController.dataVersion.Json(),
+			"config":  &cfg,
+		})
+	case http.MethodPost:
+		content, err := ioutil.ReadAll(r.Body)
+		if err != nil || len(content) == 0 {
+			httpapi.WriteError(w, http.StatusBadRequest, "content is empty")
+			return
+		}
+
+		logger.Infof("http admin update broker config, new config: %s, client: %s.", string(content), r.RemoteAddr)
+		if err := has.brokerController.updateAllConfig(content); err != nil {
+			httpapi.WriteError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		httpapi.WriteJSON(w, map[string]string{"version": has.brokerController.dataVersion.Json()})
+	default:
+		httpapi.WriteError(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method))
+	}
+}
+
+// messageById 根据msgId查询消息，对应VIEW_MESSAGE_BY_ID
+func (has *httpAdminServer) messageById(w http.ResponseWriter, r *http.Request) {
+	msgId := r.FormValue("msgId")
+	messageId, err := message.DecodeMessageId(msgId)
+	if err != nil {
+		httpapi.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid msgId %s: %s", msgId, err))
+		return
+	}
+
+	msgExt := has.brokerController.messageStore.LookMessageByOffset(int64(messageId.Offset))
+	if msgExt == nil {
+		httpapi.WriteError(w, http.StatusNotFound, fmt.Sprintf("can not find message by msgId: %s", msgId))
+		return
+	}
+	httpapi.WriteJSON(w, newHttpMessage(msgExt))
+}
+
+// messagesByKey 根据topic及key查询消息，对应QUERY_MESSAGE。begin、end为存储时间范围，默认不限制
+func (has *httpAdminServer) messagesByKey(w http.ResponseWriter, r *http.Request) {
+	topic, key := r.FormValue("topic"), r.FormValue("key")
+	if topic == "" || key == "" {
+		httpapi.WriteError(w, http.StatusBadRequest, "topic or key is empty")
+		return
+	}
+
+	maxNum, err := formInt(r, "maxNum", httpAdminMaxQueryNum)
+	if err != nil || maxNum <= 0 || maxNum > httpAdminMaxQueryNum {
+		httpapi.WriteError(w, http.StatusBadRequest, fmt.Sprintf("maxNum should be in [1, %d]", httpAdminMaxQueryNum))
+		return
+	}
+	begin, err := formInt(r, "begin", 0)
+	if err != nil {
+		httpapi.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid begin: %s", err))
+		return
+	}
+	end, err := formInt(r, "end", system.CurrentTimeMillis())
+	if err != nil {
+		httpapi.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid end: %s", err))
+		return
+	}
+
+	messages := make([]*httpMessage, 0)
+	result := has.brokerController.messageStore.QueryMessage(topic, key, int32(maxNum), begin, end)
+	if result != nil {
+		for _, bufferResult := range result.MessageMapedList {
+			if msg := decodeHttpMessage(bufferResult); msg != nil {
+				messages = append(messages, msg)
+			}
+		}
+	}
+	httpapi.WriteJSON(w, messages)
+}
+
+// decodeHttpMessage 解码并释放查询到的消息，压缩的消息解压后返回
+func decodeHttpMessage(bufferResult store.BufferResult) *httpMessage {
+	defer bufferResult.Release()
+
+	data, err := store.DecompressMessageData(bufferResult.Buffer().Bytes())
+	if err != nil {
+		logger.Warnf("http admin decompress message err: %s.", err)
+		return nil
+	}
+
+	msgExt, err := message.DecodeMessageExt(data, true, false)
+	if err != nil {
+		logger.Warnf("http admin decode message err: %s.", err)
+		return nil
+	}
+
+	return newHttpMessage(msgExt)
+}
+
+func newHttpMessage(msgExt *message.MessageExt) *httpMessage {
+	return &httpMessage{
+		MsgId:           msgExt.MsgId,
+		Topic:           msgExt.Topic,
+		QueueId:         msgExt.QueueId,
+		QueueOffset:     msgExt.QueueOffset,
+		CommitLogOffset: msgExt.CommitLogOffset,
+		BornTimestamp:   msgExt.BornTimestamp,
+		StoreTimestamp:  msgExt.StoreTimestamp,
+		ReconsumeTimes:  msgExt.ReconsumeTimes,
+		Keys:            msgExt.GetKeys(),
+		Tags:            msgExt.GetTags(),
+		Properties:      msgExt.Properties,
+		Body:            msgExt.Body,
+	}
+}
+
+// formInt 读取整数参数，参数为空时返回默认值
+func formInt(r *http.Request, name string, defaultValue int64) (int64, error) {
+	value := r.FormValue(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// decodeBody 解码json请求体，失败时写入错误应答
+func (has *httpAdminServer) decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	content, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = common.Decode(content, v)
+	}
+	if err != nil {
+		httpapi.WriteError(w, http.StatusBadRequest, fmt.Sprintf("decode request body err: %s", err))
+		return false
+	}
+
+	return true
+}
@@ -17,6 +17,7 @@ import (
 	"bytes"
 
 	"github.com/boltmq/boltmq/store"
+	"github.com/boltmq/common/logger"
 	"github.com/boltmq/common/protocol"
 )
 
@@ -26,15 +27,17 @@ import (
 type ManyMessageTransfer struct {
 	remotingCommand  *protocol.RemotingCommand
 	getMessageResult *store.GetMessageResult
+	legacyClient     bool // 客户端不支持snappy/zstd，需要解压后返回
 }
 
 // NewManyMessageTransfer  初始化
 // Author rongzhihong
 // Since 2017/9/17
-func NewManyMessageTransfer(remotingCommand *protocol.RemotingCommand, getMessageResult *store.GetMessageResult) *ManyMessageTransfer {
+func NewManyMessageTransfer(remotingCommand *protocol.RemotingCommand, getMessageResult *store.GetMessageResult, legacyClient bool) *ManyMessageTransfer {
 	mmt := new(ManyMessageTransfer)
 	mmt.remotingCommand = remotingCommand
 	mmt.getMessageResult = getMessageResult
+	mmt.legacyClient = legacyClient
 	mmt.EncodeBody()
 	return mmt
 }
@@ -50,7 +53,15 @@ func (mmt *ManyMessageTransfer) EncodeBody() {
 	bodyBuffer := bytes.NewBuffer([]byte{})
 	for e := mmt.getMessageResult.MessageBufferList.Front(); e != nil; e = e.Next() {
 		if bufferResult, ok := e.Value.(store.ByteBuffer); ok {
-			bodyBuffer.Write(bufferResult.Bytes())
+			data := bufferResult.Bytes()
+			if mmt.legacyClient {
+				if decompressed, err := store.DecompressForLegacyClient(data); err != nil {
+					logger.Warnf("pull message decompress for legacy client err: %s.", err)
+				} else {
+					data = decompressed
+				}
+			}
+			bodyBuffer.Write(data)
 		}
 	}
 	mmt.remotingCommand.Body = bodyBuffer.Bytes()
@@ -15,6 +15,7 @@ package pagecache
 
 import (
 	"github.com/boltmq/boltmq/store"
+	"github.com/boltmq/common/logger"
 	"github.com/boltmq/common/protocol"
 )
 
@@ -44,7 +45,14 @@ func (mmt *OneMessageTransfer) EncodeBody() {
 	if mmt.bufferResult == nil || mmt.bufferResult.Buffer() == nil {
 		return
 	}
-	mmt.remotingCommand.Body = mmt.bufferResult.Buffer().Bytes()
+
+	// 根据消息ID查看消息用于管理工具，压缩的消息解压后返回
+	data, err := store.DecompressMessageData(mmt.bufferResult.Buffer().Bytes())
+	if err != nil {
+		logger.Warnf("view message decompress err: %s.", err)
+		data = mmt.bufferResult.Buffer().Bytes()
+	}
+	mmt.remotingCommand.Body = data
 }
 
 // Bytes  实现Serirable接口
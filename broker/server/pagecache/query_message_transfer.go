@@ -17,6 +17,7 @@ import (
 	"bytes"
 
 	"github.com/boltmq/boltmq/store"
+	"github.com/boltmq/common/logger"
 	"github.com/boltmq/common/protocol"
 )
 
@@ -47,9 +48,15 @@ func (omt *QueryMessageTransfer) EncodeBody() {
 		return
 	}
 
+	// 查询消息用于管理工具查看，压缩的消息解压后返回
 	bodyBuffer := bytes.NewBuffer([]byte{})
 	for _, mappedByteBuffer := range omt.queryMessageResult.MessageBufferList {
-		bodyBuffer.Write(mappedByteBuffer.Bytes())
+		data, err := store.DecompressMessageData(mappedByteBuffer.Bytes())
+		if err != nil {
+			logger.Warnf("query message decompress err: %s.", err)
+			data = mappedByteBuffer.Bytes()
+		}
+		bodyBuffer.Write(data)
 	}
 	omt.remotingCommand.Body = bodyBuffer.Bytes()
 }
@@ -22,6 +22,7 @@ import (
 	"github.com/boltmq/boltmq/common"
 	"github.com/boltmq/boltmq/store"
 	"github.com/boltmq/boltmq/store/persistent"
+	"github.com/boltmq/boltmq/store/sql92"
 	"github.com/boltmq/common/basis"
 	"github.com/boltmq/common/constant"
 	"github.com/boltmq/common/filter"
@@ -159,6 +160,9 @@ func (pmsgp *pullMessageProcessor) processRequest(request *protocol.RemotingComm
 	if hasSubscriptionFlag {
 		var err error
 		subscriptionData, err = filter.BuildSubscriptionData4Ponit(requestHeader.ConsumerGroup, requestHeader.Topic, requestHeader.Subscription)
+		if err == nil && sql92.IsExpression(requestHeader.Subscription) {
+			_, err = sql92.Compile(requestHeader.Subscription)
+		}
 		if err != nil {
 			logger.Warnf("parse the consumer's subscription %s failed, group: %s.",
 				requestHeader.Subscription, requestHeader.ConsumerGroup)
@@ -279,7 +283,7 @@ func (pmsgp *pullMessageProcessor) processRequest(request *protocol.RemotingComm
 			pmsgp.brokerController.brokerStats.IncGroupGetSize(requestHeader.ConsumerGroup, requestHeader.Topic, getMessageResult.BufferTotalSize)
 			pmsgp.brokerController.brokerStats.IncBrokerGetNums(getMessageResult.GetMessageCount())
 
-			manyMessageTransfer := pagecache.NewManyMessageTransfer(response, getMessageResult)
+			manyMessageTransfer := pagecache.NewManyMessageTransfer(response, getMessageResult, pmsgp.isLegacyCodecClient(request.Version))
 			_, err = ctx.WriteSerialData(manyMessageTransfer)
 			if err != nil {
 				logger.Errorf("transfer many message by pagecache failed, RemoteAddr:%s, Error:%s.",
@@ -348,6 +352,12 @@ func (pmsgp *pullMessageProcessor) processRequest(request *protocol.RemotingComm
 	return response, nil
 }
 
+// isLegacyCodecClient 客户端是否不支持snappy/zstd压缩的消息，未配置支持的最低版本时直接返回压缩的消息
+func (pmsgp *pullMessageProcessor) isLegacyCodecClient(version int32) bool {
+	minVersion := pmsgp.brokerController.cfg.Broker.CompressionCodecClientVersion
+	return minVersion > 0 && version < minVersion
+}
+
 func (pmsgp *pullMessageProcessor) hasConsumeMessageHook() bool {
 	return pmsgp.csmMsgHookList != nil && len(pmsgp.csmMsgHookList) > 0
 }
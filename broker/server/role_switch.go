@@ -0,0 +1,165 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"fmt"
+
+	"github.com/boltmq/boltmq/store/persistent"
+	"github.com/boltmq/common/basis"
+	"github.com/boltmq/common/logger"
+	"github.com/boltmq/common/utils/verify"
+)
+
+const (
+	PROMOTE_TO_MASTER = 620 // slave切换为master
+	DEMOTE_TO_SLAVE   = 621 // master切换为指定master的slave
+)
+
+// promoteToMasterRequestHeader slave切换为master请求头
+type promoteToMasterRequestHeader struct {
+	BrokerRole    string `json:"brokerRole"`    // 切换后的角色 ASYNC_MASTER/SYNC_MASTER，默认ASYNC_MASTER
+	MaxFallBehind int64  `json:"maxFallBehind"` // 允许落后master的最大字节数
+	Force         bool   `json:"force"`         // 无法获取master同步进度时强制切换
+}
+
+func (header *promoteToMasterRequestHeader) CheckFields() error {
+	if _, err := header.role(); err != nil {
+		return err
+	}
+
+	if header.MaxFallBehind < 0 {
+		return fmt.Errorf("maxFallBehind %d is invalid", header.MaxFallBehind)
+	}
+
+	return nil
+}
+
+func (header *promoteToMasterRequestHeader) role() (persistent.BrokerRoleType, error) {
+	if header.BrokerRole == "" {
+		return persistent.ASYNC_MASTER, nil
+	}
+
+	role, err := persistent.ParseBrokerRoleType(header.BrokerRole)
+	if err != nil {
+		return role, err
+	}
+
+	if role == persistent.SLAVE {
+		return role, fmt.Errorf("brokerRole %s is not master", header.BrokerRole)
+	}
+
+	return role, nil
+}
+
+// demoteToSlaveRequestHeader master切换为slave请求头
+type demoteToSlaveRequestHeader struct {
+	MasterHaAddress string `json:"masterHaAddress"` // 新master的HA地址 ip:port
+	MasterMaxOffset int64  `json:"masterMaxOffset"` // 新master的commitlog最大offset，本地超出部分切换时截断
+	BrokerId        int64  `json:"brokerId"`        // 切换后的brokerId，不能为0
+}
+
+func (header *demoteToSlaveRequestHeader) CheckFields() error {
+	if !verify.CheckIpAndPort(header.MasterHaAddress) {
+		return fmt.Errorf("masterHaAddress %s is invalid", header.MasterHaAddress)
+	}
+
+	// 未填写时为0，会截断全部数据
+	if header.MasterMaxOffset <= 0 {
+		return fmt.Errorf("masterMaxOffset %d is invalid", header.MasterMaxOffset)
+	}
+
+	if header.BrokerId == basis.MASTER_ID {
+		return fmt.Errorf("brokerId must not be %d", basis.MASTER_ID)
+	}
+
+	return nil
+}
+
+// persistentStoreForRoleSwitch 人工切换主备只支持非选举模式下的持久化存储
+func (controller *BrokerController) persistentStoreForRoleSwitch() (*persistent.PersistentMessageStore, error) {
+	if controller.cfg.Cluster.ElectionEnable {
+		return nil, fmt.Errorf("broker role is managed by election")
+	}
+
+	pms, ok := controller.messageStore.(*persistent.PersistentMessageStore)
+	if !ok {
+		return nil, fmt.Errorf("store type %s not support role switch", controller.cfg.Store.Type)
+	}
+
+	return pms, nil
+}
+
+// promoteToMaster slave切换为master：检查同步进度，截断不完整的尾部数据并停止HA同步，
+// 切换角色后启动定时消息投递，以brokerId=0重新注册到所有namesrv
+func (controller *BrokerController) promoteToMaster(role persistent.BrokerRoleType, maxFallBehind int64, force bool) error {
+	pms, err := controller.persistentStoreForRoleSwitch()
+	if err != nil {
+		return err
+	}
+
+	if controller.storeCfg.BrokerRole != persistent.SLAVE {
+		return fmt.Errorf("broker role %s is not slave", controller.storeCfg.BrokerRole)
+	}
+
+	fallBehind := pms.SlaveFallBehindMuch()
+	if !force {
+		if fallBehind < 0 {
+			return fmt.Errorf("master offset is unknown, use force to promote")
+		}
+
+		if fallBehind > maxFallBehind {
+			return fmt.Errorf("slave fall behind master %d bytes, more than %d", fallBehind, maxFallBehind)
+		}
+	}
+
+	if err := pms.PromoteToMaster(role); err != nil {
+		return err
+	}
+
+	controller.cfg.Cluster.BrokerId = basis.MASTER_ID
+	controller.cfg.Cluster.BrokerRole = role.String()
+	controller.updateMasterHASrvAddrPeriod = false
+	controller.slaveSync.masterAddr = ""
+	controller.tasks.stopSlaveSynchronizeTask()
+	controller.tasks.startPrintMasterAndSlaveDiffTask()
+	controller.tasks.startPersistConsumerOffsetTask()
+
+	logger.Infof("broker promote to master, role: %s, fall behind: %d.", role, fallBehind)
+	controller.registerBrokerAll(true, false)
+	return nil
+}
+
+// demoteToSlave master切换为slave：停止定时消息投递，截断未复制到新master的数据后从新master同步，
+// 以brokerId重新注册到所有namesrv
+func (controller *BrokerController) demoteToSlave(masterHaAddr string, masterMaxOffset, brokerId int64) error {
+	pms, err := controller.persistentStoreForRoleSwitch()
+	if err != nil {
+		return err
+	}
+
+	if err := pms.DemoteToSlave(masterHaAddr, masterMaxOffset); err != nil {
+		return err
+	}
+
+	controller.cfg.Cluster.BrokerId = brokerId
+	controller.cfg.Cluster.BrokerRole = persistent.SLAVE.String()
+	controller.updateMasterHASrvAddrPeriod = false
+	controller.tasks.stopPrintMasterAndSlaveDiffTask()
+	controller.tasks.startSlaveSynchronizeTask()
+
+	logger.Infof("broker demote to slave, master ha address: %s, broker id: %d.", masterHaAddr, brokerId)
+	controller.registerBrokerAll(true, false)
+	return nil
+}
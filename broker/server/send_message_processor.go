@@ -30,6 +30,7 @@ import (
 	"github.com/boltmq/common/protocol"
 	"github.com/boltmq/common/protocol/head"
 	"github.com/boltmq/common/sysflag"
+	"github.com/pquerna/ffjson/ffjson"
 )
 
 const (
@@ -66,7 +67,12 @@ func (smp *SendMessageProcessor) ProcessRequest(ctx core.Context, request *proto
 
 	traceContext := smp.basicSendMsgProcessor.buildMsgContext(ctx, requestHeader)
 	smp.basicSendMsgProcessor.ExecuteSendMessageHookBefore(ctx, request, traceContext)
-	response := smp.SendMessage(ctx, request, traceContext, requestHeader)
+	var response *protocol.RemotingCommand
+	if request.Code == SEND_BATCH_MESSAGE {
+		response = smp.sendBatchMessage(ctx, request, traceContext, requestHeader)
+	} else {
+		response = smp.SendMessage(ctx, request, traceContext, requestHeader)
+	}
 	smp.basicSendMsgProcessor.ExecuteSendMessageHookAfter(response, traceContext)
 	return response, nil
 }
@@ -122,15 +128,7 @@ func (smp *SendMessageProcessor) ConsumerSendMsgBack(conn core.Context,
 	}
 
 	newTopic := getRetryTopic(requestHeader.Group)
-	var queueIdInt int32
-	if queueIdInt < 0 {
-		num := (smp.basicSendMsgProcessor.random.Int31() % 99999999) % retryQueueNums
-		if num > 0 {
-			queueIdInt = num
-		} else {
-			queueIdInt = -num
-		}
-	}
+	queueIdInt := (smp.basicSendMsgProcessor.random.Int31() % 99999999) % retryQueueNums
 
 	// 如果是单元化模式，则对 topic 进行设置
 	topicSysFlag := 0
@@ -173,24 +171,20 @@ func (smp *SendMessageProcessor) ConsumerSendMsgBack(conn core.Context,
 	// 客户端自动决定定时级别
 	delayLevel := requestHeader.DelayLevel
 
-	// 死信消息处理
+	// 死信消息处理，超过最大重试次数的消息进入死信队列，死信队列只写不可读，需要通过管理命令查看、重发
 	if msgExt.ReconsumeTimes >= subscriptionGroupConfig.RetryMaxTimes || delayLevel < 0 {
 		newTopic = getDLQTopic(requestHeader.Group)
-		if queueIdInt < 0 {
-			num := (smp.basicSendMsgProcessor.random.Int31() % 99999999) % DLQ_NUMS_PER_GROUP
-			if num > 0 {
-				queueIdInt = num
-			} else {
-				queueIdInt = -num
-			}
-		}
+		queueIdInt = (smp.basicSendMsgProcessor.random.Int31() % 99999999) % DLQ_NUMS_PER_GROUP
 
 		topicConfig, err = smp.brokerController.tpConfigManager.createTopicInSendMessageBackMethod(newTopic, DLQ_NUMS_PER_GROUP, constant.PERM_WRITE, 0)
-		if nil == topicConfig {
+		if nil == topicConfig || err != nil {
 			response.Code = protocol.SYSTEM_ERROR
 			response.Remark = fmt.Sprintf("topic[%s] not exist", newTopic)
 			return response
 		}
+
+		logger.Infof("message reconsume times %d exceed max times %d, send to dlq topic %s, msgId: %s.",
+			msgExt.ReconsumeTimes, subscriptionGroupConfig.RetryMaxTimes, newTopic, msgExt.MsgId)
 	} else {
 		if 0 == delayLevel {
 			delayLevel = 3 + msgExt.ReconsumeTimes
@@ -311,40 +305,10 @@ func (smp *SendMessageProcessor) SendMessage(ctx core.Context, request *protocol
 		}
 	}
 
+	smp.compressMessage(msgInner)
 	putMessageResult := smp.brokerController.messageStore.PutMessage(msgInner)
 	if putMessageResult != nil {
-		sendOK := false
-		switch putMessageResult.Status {
-		case store.PUTMESSAGE_PUT_OK:
-			sendOK = true
-			response.Code = protocol.SUCCESS
-		case store.FLUSH_DISK_TIMEOUT:
-			response.Code = protocol.FLUSH_DISK_TIMEOUT
-			sendOK = true
-		case store.FLUSH_SLAVE_TIMEOUT:
-			response.Code = protocol.FLUSH_SLAVE_TIMEOUT
-			sendOK = true
-		case store.SLAVE_NOT_AVAILABLE:
-			response.Code = protocol.SLAVE_NOT_AVAILABLE
-			sendOK = true
-
-		case store.CREATE_MAPPED_FILE_FAILED:
-			response.Code = protocol.SYSTEM_ERROR
-			response.Remark = "create maped file failed, please make sure OS and JDK both 64bit."
-		case store.MESSAGE_ILLEGAL:
-			response.Code = protocol.MESSAGE_ILLEGAL
-			response.Remark = "the message is illegal, maybe length not matched."
-		case store.SERVICE_NOT_AVAILABLE:
-			response.Code = protocol.SERVICE_NOT_AVAILABLE
-			response.Remark = "service not available now, maybe disk full, " + smp.diskUtil() + ", maybe your broker machine memory too small."
-		case store.PUTMESSAGE_UNKNOWN_ERROR:
-			response.Code = protocol.SYSTEM_ERROR
-			response.Remark = "UNKNOWN_ERROR"
-		default:
-			response.Code = protocol.SYSTEM_ERROR
-			response.Remark = "UNKNOWN_ERROR DEFAULT"
-		}
-
+		sendOK := smp.putMessageResultToResponse(putMessageResult, response)
 		if sendOK {
 			smp.brokerController.brokerStats.IncTopicPutNums(msgInner.Topic)
 			smp.brokerController.brokerStats.IncTopicPutSize(msgInner.Topic, putMessageResult.Result.WroteBytes)
@@ -378,6 +342,169 @@ func (smp *SendMessageProcessor) SendMessage(ctx core.Context, request *protocol
 	return response
 }
 
+// sendBatchMessage 批量消息，请求体中的消息写入同一队列，响应头为第一条消息的结果，响应体为每条消息的结果
+func (smp *SendMessageProcessor) sendBatchMessage(ctx core.Context, request *protocol.RemotingCommand,
+	traceContext *trace.SendMessageContext, requestHeader *head.SendMessageRequestHeader) *protocol.RemotingCommand {
+	responseHeader := new(head.SendMessageResponseHeader)
+	response := protocol.CreateDefaultResponseCommand(responseHeader)
+	response.Opaque = request.Opaque
+	response.Code = -1
+	smp.basicSendMsgProcessor.msgCheck(ctx, requestHeader, response)
+	if response.Code != -1 {
+		return response
+	}
+
+	batchMsgs, err := decodeBatchMessages(request.Body)
+	if err != nil {
+		response.Code = protocol.MESSAGE_ILLEGAL
+		response.Remark = err.Error()
+		return response
+	}
+
+	topicConfig := smp.brokerController.tpConfigManager.selectTopicConfig(requestHeader.Topic)
+	queueIdInt := requestHeader.QueueId
+	if queueIdInt < 0 {
+		queueIdInt = (smp.basicSendMsgProcessor.random.Int31() % 99999999) % topicConfig.WriteQueueNums
+	}
+
+	sysFlag := requestHeader.SysFlag
+	if basis.MULTI_TAG == topicConfig.TpFilterType {
+		sysFlag |= sysflag.MultiTagsFlag
+	}
+
+	bornHost := ctx.RemoteAddr().String()
+	storeHost := smp.brokerController.getStoreHost()
+	msgs := make([]*store.MessageExtInner, 0, len(batchMsgs))
+	for _, batchMsg := range batchMsgs {
+		msgInner := new(store.MessageExtInner)
+		msgInner.Topic = requestHeader.Topic
+		msgInner.Body = batchMsg.Body
+		msgInner.Flag = batchMsg.Flag
+		message.SetPropertiesMap(&msgInner.Message, message.String2messageProperties(batchMsg.Properties))
+		msgInner.PropertiesString = batchMsg.Properties
+		msgInner.TagsCode = basis.TagsString2tagsCode(topicConfig.TpFilterType, msgInner.GetTags())
+		msgInner.QueueId = queueIdInt
+		msgInner.SysFlag = sysFlag
+		msgInner.BornTimestamp = requestHeader.BornTimestamp
+		msgInner.BornHost = bornHost
+		msgInner.StoreHost = storeHost
+		msgInner.ReconsumeTimes = requestHeader.ReconsumeTimes
+
+		// 批量消息不支持事务消息
+		if len(msgInner.GetProperty(message.PROPERTY_TRANSACTION_PREPARED)) > 0 {
+			response.Code = protocol.MESSAGE_ILLEGAL
+			response.Remark = "batch message does not support transaction message"
+			return response
+		}
+
+		smp.compressMessage(msgInner)
+		msgs = append(msgs, msgInner)
+	}
+
+	putMessageResult := smp.brokerController.messageStore.PutMessages(msgs)
+	if putMessageResult == nil {
+		response.Code = protocol.SYSTEM_ERROR
+		response.Remark = "store putMessages return null"
+		return response
+	}
+
+	if !smp.putMessageResultToResponse(putMessageResult, response) {
+		return response
+	}
+
+	smp.brokerController.brokerStats.IncTopicBatchPutNums(requestHeader.Topic, len(msgs))
+	smp.brokerController.brokerStats.IncTopicPutSize(requestHeader.Topic, putMessageResult.Result.WroteBytes)
+	smp.brokerController.brokerStats.IncBrokerBatchPutNums(len(msgs))
+
+	result := &sendBatchMessageResult{QueueId: queueIdInt}
+	for _, r := range putMessageResult.Results {
+		result.Items = append(result.Items, &sendBatchMessageItem{MsgId: r.MsgId, QueueOffset: r.LogicsOffset})
+	}
+
+	body, err := ffjson.Marshal(result)
+	if err != nil {
+		logger.Errorf("send batch message marshal result err: %s.", err)
+	}
+
+	response.Remark = ""
+	response.Body = body
+	responseHeader.MsgId = putMessageResult.Result.MsgId
+	responseHeader.QueueId = queueIdInt
+	responseHeader.QueueOffset = putMessageResult.Result.LogicsOffset
+
+	DoResponse(ctx, request, response)
+	if smp.brokerController.cfg.Broker.LongPollingEnable {
+		smp.brokerController.pullRequestHoldSrv.notifyMessageArriving(
+			requestHeader.Topic, queueIdInt, putMessageResult.Result.LogicsOffset+int64(len(msgs)))
+	}
+
+	// 消息轨迹：记录发送成功的第一条消息
+	if smp.HasSendMessageHook() {
+		traceContext.MsgId = responseHeader.MsgId
+		traceContext.QueueId = responseHeader.QueueId
+		traceContext.QueueOffset = responseHeader.QueueOffset
+	}
+	return nil
+}
+
+// compressMessage 按topic的压缩策略压缩消息体，并在sysflag中记录压缩算法；客户端已压缩的消息不再压缩
+func (smp *SendMessageProcessor) compressMessage(msgInner *store.MessageExtInner) {
+	if msgInner.SysFlag&store.CompressedFlag != 0 {
+		return
+	}
+
+	ct, minSize := smp.brokerController.tpAttrManager.compressionPolicy(msgInner.Topic)
+	if ct == store.COMPRESSION_NONE || len(msgInner.Body) < int(minSize) {
+		return
+	}
+
+	body, err := store.CompressBody(msgInner.Body, ct)
+	if err != nil {
+		logger.Warnf("compress message body by %s err: %s, topic: %s.", ct, err, msgInner.Topic)
+		return
+	}
+
+	msgInner.Body = body
+	msgInner.SysFlag = store.BuildCompressionSysFlag(msgInner.SysFlag, ct)
+}
+
+// putMessageResultToResponse 根据存储结果设置响应码，返回消息是否写入成功
+func (smp *SendMessageProcessor) putMessageResultToResponse(putMessageResult *store.PutMessageResult, response *protocol.RemotingCommand) bool {
+	sendOK := false
+	switch putMessageResult.Status {
+	case store.PUTMESSAGE_PUT_OK:
+		sendOK = true
+		response.Code = protocol.SUCCESS
+	case store.FLUSH_DISK_TIMEOUT:
+		response.Code = protocol.FLUSH_DISK_TIMEOUT
+		sendOK = true
+	case store.FLUSH_SLAVE_TIMEOUT:
+		response.Code = protocol.FLUSH_SLAVE_TIMEOUT
+		sendOK = true
+	case store.SLAVE_NOT_AVAILABLE:
+		response.Code = protocol.SLAVE_NOT_AVAILABLE
+		sendOK = true
+
+	case store.CREATE_MAPPED_FILE_FAILED:
+		response.Code = protocol.SYSTEM_ERROR
+		response.Remark = "create maped file failed, please make sure OS and JDK both 64bit."
+	case store.MESSAGE_ILLEGAL:
+		response.Code = protocol.MESSAGE_ILLEGAL
+		response.Remark = "the message is illegal, maybe length not matched."
+	case store.SERVICE_NOT_AVAILABLE:
+		response.Code = protocol.SERVICE_NOT_AVAILABLE
+		response.Remark = "service not available now, maybe disk full, " + smp.diskUtil() + ", maybe your broker machine memory too small."
+	case store.PUTMESSAGE_UNKNOWN_ERROR:
+		response.Code = protocol.SYSTEM_ERROR
+		response.Remark = "UNKNOWN_ERROR"
+	default:
+		response.Code = protocol.SYSTEM_ERROR
+		response.Remark = "UNKNOWN_ERROR DEFAULT"
+	}
+
+	return sendOK
+}
+
 // HasSendMessageHook 判断是否存在发送消息回调
 // Author rongzhihong
 // Since 2017/9/5
@@ -467,7 +594,7 @@ func (bsmp *basicSendMessageProcessor) parseRequestHeader(request *protocol.Remo
 		}
 		requestHeader = head.CreateSendMessageRequestHeaderV1(requestHeaderV2)
 
-	} else if request.Code == protocol.SEND_MESSAGE {
+	} else if request.Code == protocol.SEND_MESSAGE || request.Code == SEND_BATCH_MESSAGE {
 		requestHeader = &head.SendMessageRequestHeader{}
 		err := request.DecodeCommandCustomHeader(requestHeader)
 		if err != nil {
@@ -41,6 +41,7 @@ func (slave *slaveSynchronize) syncAll() {
 	slave.syncConsumerOffset()
 	slave.syncDelayOffset()
 	slave.syncSubscriptionGroupConfig()
+	slave.syncTopicAttribute()
 }
 
 // syncTopicConfig 同步Topic信息
@@ -130,3 +131,18 @@ func (slave *slaveSynchronize) syncSubscriptionGroupConfig() {
 		logger.Infof("update slave subscription group from master, %s.", slave.masterAddr)
 	}
 }
+
+// syncTopicAttribute 同步topic扩展属性，如压缩及保留策略
+func (slave *slaveSynchronize) syncTopicAttribute() {
+	if slave.masterAddr == "" {
+		return
+	}
+
+	content := slave.brokerController.callOuter.GetAllTopicAttribute(slave.masterAddr)
+	if content == "" {
+		return
+	}
+
+	slave.brokerController.tpAttrManager.replaceAll([]byte(content))
+	logger.Infof("update slave topic attribute from master. masterAddr=%s.", slave.masterAddr)
+}
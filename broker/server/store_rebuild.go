@@ -0,0 +1,60 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/boltmq/boltmq/store/persistent"
+)
+
+const (
+	REBUILD_CONSUME_QUEUE = 630 // 从commitlog重建逻辑队列及索引
+)
+
+// rebuildConsumeQueueRequestHeader 重建逻辑队列请求头
+type rebuildConsumeQueueRequestHeader struct {
+	Topics       string `json:"topics"`       // 重建的topic，多个以,分隔，*表示全部
+	RebuildIndex bool   `json:"rebuildIndex"` // 是否重建索引文件
+}
+
+func (header *rebuildConsumeQueueRequestHeader) CheckFields() error {
+	if len(header.topics()) == 0 && !header.RebuildIndex {
+		return fmt.Errorf("topics and rebuildIndex are both empty")
+	}
+
+	return nil
+}
+
+func (header *rebuildConsumeQueueRequestHeader) topics() []string {
+	var topics []string
+	for _, topic := range strings.Split(header.Topics, ",") {
+		if topic = strings.TrimSpace(topic); topic != "" {
+			topics = append(topics, topic)
+		}
+	}
+
+	return topics
+}
+
+// rebuildConsumeQueue 异步重建逻辑队列及索引，重建期间其他topic正常收发
+func (controller *BrokerController) rebuildConsumeQueue(topics []string, rebuildIndex bool) error {
+	pms, ok := controller.messageStore.(*persistent.PersistentMessageStore)
+	if !ok {
+		return fmt.Errorf("store type %s not support rebuild consume queue", controller.cfg.Store.Type)
+	}
+
+	return pms.RebuildConsumeQueue(topics, rebuildIndex)
+}
@@ -0,0 +1,279 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/boltmq/boltmq/broker/client"
+	"github.com/boltmq/boltmq/store"
+	"github.com/boltmq/boltmq/store/persistent"
+	"github.com/boltmq/common/logger"
+	"github.com/pquerna/ffjson/ffjson"
+)
+
+const (
+	UPDATE_TOPIC_ATTRIBUTE  = 610                            // 更新topic扩展属性
+	GET_TOPIC_ATTRIBUTE     = 611                            // 查询topic扩展属性
+	GET_ALL_TOPIC_ATTRIBUTE = client.GET_ALL_TOPIC_ATTRIBUTE // 查询全部topic扩展属性，slave从master同步
+)
+
+const (
+	CLEANUP_POLICY_DELETE  = "delete"  // 按保留时间及字节数删除
+	CLEANUP_POLICY_COMPACT = "compact" // 按消息key压缩，只保留每个key的最新消息
+)
+
+// topicAttribute topic扩展属性，TopicConfig之外按topic生效的策略
+type topicAttribute struct {
+	Topic           string `json:"topic"`
+	Compression     string `json:"compression"`     // 消息体压缩算法 none/zlib/snappy/zstd
+	CompressMinSize int32  `json:"compressMinSize"` // 消息体不小于该字节数时才压缩
+	RetentionHours  int64  `json:"retentionHours"`  // 消息保留时间，单位小时，0表示使用全局配置
+	RetentionBytes  int64  `json:"retentionBytes"`  // 消息保留的最大字节数，0表示不限制
+	CleanupPolicy   string `json:"cleanupPolicy"`   // 清理策略 delete/compact，空表示delete
+	TombstoneHours  int64  `json:"tombstoneHours"`  // 压缩时消息体为空的删除标记保留时间，单位小时，0表示24小时
+}
+
+func (attr *topicAttribute) check() error {
+	if attr.Topic == "" {
+		return fmt.Errorf("topic is empty")
+	}
+
+	if _, err := store.ParseCompressionType(attr.Compression); err != nil {
+		return err
+	}
+
+	if attr.CompressMinSize < 0 {
+		return fmt.Errorf("compressMinSize %d is invalid", attr.CompressMinSize)
+	}
+
+	if attr.RetentionHours < 0 {
+		return fmt.Errorf("retentionHours %d is invalid", attr.RetentionHours)
+	}
+
+	if attr.RetentionBytes < 0 {
+		return fmt.Errorf("retentionBytes %d is invalid", attr.RetentionBytes)
+	}
+
+	switch attr.CleanupPolicy {
+	case "", CLEANUP_POLICY_DELETE, CLEANUP_POLICY_COMPACT:
+	default:
+		return fmt.Errorf("cleanupPolicy %s is invalid", attr.CleanupPolicy)
+	}
+
+	if attr.TombstoneHours < 0 {
+		return fmt.Errorf("tombstoneHours %d is invalid", attr.TombstoneHours)
+	}
+
+	return nil
+}
+
+// topicAttributeRequestHeader 更新、查询topic扩展属性请求头，更新时属性在请求体中
+type topicAttributeRequestHeader struct {
+	Topic string `json:"topic"`
+}
+
+func (header *topicAttributeRequestHeader) CheckFields() error {
+	if header.Topic == "" {
+		return fmt.Errorf("topic is empty")
+	}
+
+	return nil
+}
+
+// topicAttributeTable topic扩展属性持久化结构
+type topicAttributeTable struct {
+	Attributes map[string]*topicAttribute `json:"attributes"`
+}
+
+// topicAttributeManager 管理topic扩展属性
+type topicAttributeManager struct {
+	brokerController *BrokerController
+	lock             sync.RWMutex
+	table            *topicAttributeTable
+	cfgManagerLoader *configManagerLoader
+}
+
+func newTopicAttributeManager(brokerController *BrokerController) *topicAttributeManager {
+	tam := &topicAttributeManager{
+		brokerController: brokerController,
+		table:            &topicAttributeTable{Attributes: make(map[string]*topicAttribute)},
+	}
+	tam.cfgManagerLoader = newConfigManagerLoader(tam)
+	return tam
+}
+
+func (tam *topicAttributeManager) load() bool {
+	return tam.cfgManagerLoader.load()
+}
+
+func (tam *topicAttributeManager) encode(prettyFormat bool) string {
+	tam.lock.RLock()
+	defer tam.lock.RUnlock()
+
+	if buf, err := ffjson.Marshal(tam.table); err == nil {
+		return string(buf)
+	}
+	return ""
+}
+
+func (tam *topicAttributeManager) decode(buf []byte) {
+	if buf == nil || len(buf) == 0 {
+		return
+	}
+
+	table := &topicAttributeTable{}
+	if err := ffjson.Unmarshal(buf, table); err != nil {
+		logger.Errorf("topicAttributeManager decode err: %s, buf = %s.", err, string(buf))
+		return
+	}
+
+	if table.Attributes == nil {
+		table.Attributes = make(map[string]*topicAttribute)
+	}
+
+	tam.lock.Lock()
+	tam.table = table
+	tam.lock.Unlock()
+}
+
+func (tam *topicAttributeManager) configFilePath() string {
+	return fmt.Sprintf("%s%c%s%ctopicAttribute.json", tam.brokerController.storeCfg.StorePathRootDir,
+		os.PathSeparator, defaultConfigDir, os.PathSeparator)
+}
+
+// getTopicAttribute 查询topic扩展属性，不存在时返回nil
+func (tam *topicAttributeManager) getTopicAttribute(topic string) *topicAttribute {
+	tam.lock.RLock()
+	defer tam.lock.RUnlock()
+
+	attr, ok := tam.table.Attributes[topic]
+	if !ok {
+		return nil
+	}
+
+	copied := *attr
+	return &copied
+}
+
+// updateTopicAttribute 更新topic扩展属性并持久化
+func (tam *topicAttributeManager) updateTopicAttribute(attr *topicAttribute) {
+	tam.lock.Lock()
+	old := tam.table.Attributes[attr.Topic]
+	tam.table.Attributes[attr.Topic] = attr
+	tam.lock.Unlock()
+
+	if old != nil {
+		logger.Infof("update topic attribute, old: %v, new: %v.", old, attr)
+	} else {
+		logger.Infof("create topic attribute: %v.", attr)
+	}
+
+	tam.applyRetention(attr.Topic, attr)
+	tam.cfgManagerLoader.persist()
+}
+
+// deleteTopicAttribute 删除topic时清除扩展属性
+func (tam *topicAttributeManager) deleteTopicAttribute(topic string) {
+	tam.lock.Lock()
+	_, ok := tam.table.Attributes[topic]
+	delete(tam.table.Attributes, topic)
+	tam.lock.Unlock()
+
+	if ok {
+		logger.Infof("delete topic attribute, topic: %s.", topic)
+		tam.applyRetention(topic, nil)
+		tam.cfgManagerLoader.persist()
+	}
+}
+
+// replaceAll 以master的topic扩展属性替换本地属性并持久化，用于slave同步，切换为master后策略不丢失
+func (tam *topicAttributeManager) replaceAll(buf []byte) {
+	table := &topicAttributeTable{}
+	if err := ffjson.Unmarshal(buf, table); err != nil {
+		logger.Errorf("topicAttributeManager replace all err: %s, buf = %s.", err, string(buf))
+		return
+	}
+
+	if table.Attributes == nil {
+		table.Attributes = make(map[string]*topicAttribute)
+	}
+
+	tam.lock.Lock()
+	var removed []string
+	for topic := range tam.table.Attributes {
+		if _, ok := table.Attributes[topic]; !ok {
+			removed = append(removed, topic)
+		}
+	}
+	tam.table = table
+	tam.lock.Unlock()
+
+	for _, topic := range removed {
+		tam.applyRetention(topic, nil)
+	}
+	tam.applyRetentions()
+	tam.cfgManagerLoader.persist()
+}
+
+// applyRetentions 存储加载后设置所有topic的保留策略
+func (tam *topicAttributeManager) applyRetentions() {
+	tam.lock.RLock()
+	attrs := make([]*topicAttribute, 0, len(tam.table.Attributes))
+	for _, attr := range tam.table.Attributes {
+		attrs = append(attrs, attr)
+	}
+	tam.lock.RUnlock()
+
+	for _, attr := range attrs {
+		tam.applyRetention(attr.Topic, attr)
+	}
+}
+
+// applyRetention 设置topic的保留及压缩策略，只有持久化存储支持，attr为nil时恢复全局配置
+func (tam *topicAttributeManager) applyRetention(topic string, attr *topicAttribute) {
+	pms, ok := tam.brokerController.messageStore.(*persistent.PersistentMessageStore)
+	if !ok {
+		return
+	}
+
+	if attr == nil {
+		pms.SetTopicRetention(topic, nil)
+		return
+	}
+
+	pms.SetTopicRetention(topic, &persistent.TopicRetention{
+		ReservedTime:  attr.RetentionHours,
+		MaxBytes:      attr.RetentionBytes,
+		Compact:       attr.CleanupPolicy == CLEANUP_POLICY_COMPACT,
+		TombstoneTime: attr.TombstoneHours,
+	})
+}
+
+// compressionPolicy topic的压缩算法及最小压缩字节数
+func (tam *topicAttributeManager) compressionPolicy(topic string) (store.CompressionType, int32) {
+	attr := tam.getTopicAttribute(topic)
+	if attr == nil {
+		return store.COMPRESSION_NONE, 0
+	}
+
+	ct, err := store.ParseCompressionType(attr.Compression)
+	if err != nil {
+		return store.COMPRESSION_NONE, 0
+	}
+
+	return ct, attr.CompressMinSize
+}
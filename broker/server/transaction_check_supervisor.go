@@ -28,10 +28,10 @@ func newTransactionCheckSupervisor(brokerController *BrokerController) *transact
 	return trans
 }
 
-// gotoCheck 回调检查方法
+// GotoCheck 回调检查方法
 // Author rongzhihong
 // Since 2017/9/17
-func (trans *transactionCheckSupervisor) gotoCheck(producerGroupHashCode int, tranStateTableOffset, commitLogOffset int64, msgSize int) {
+func (trans *transactionCheckSupervisor) GotoCheck(producerGroupHashCode int, tranStateTableOffset, commitLogOffset int64, msgSize int) {
 	// 第一步、查询Producer
 	clientChannelInfo := trans.brokerController.prcManager.pickProducerChannelRandomly(producerGroupHashCode)
 	if clientChannelInfo == nil {
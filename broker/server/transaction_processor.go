@@ -48,6 +48,11 @@ func newEndTransactionProcessor(brokerController *BrokerController) *endTransact
 func (etp *endTransactionProcessor) ProcessRequest(ctx core.Context, request *protocol.RemotingCommand) (*protocol.RemotingCommand, error) {
 	response := protocol.CreateDefaultResponseCommand()
 	requestHeader := &head.EndTransactionRequestHeader{}
+	err := request.DecodeCommandCustomHeader(requestHeader)
+	if err != nil {
+		logger.Errorf("end transaction err: %s.", err)
+		return response, err
+	}
 
 	// 回查应答
 	if requestHeader.FromTransactionCheck {
@@ -142,10 +147,7 @@ func (etp *endTransactionProcessor) ProcessRequest(ctx core.Context, request *pr
 		if putMessageResult != nil {
 			switch putMessageResult.Status {
 			// Success
-			case store.PUTMESSAGE_PUT_OK:
-			case store.FLUSH_DISK_TIMEOUT:
-			case store.FLUSH_SLAVE_TIMEOUT:
-			case store.SLAVE_NOT_AVAILABLE:
+			case store.PUTMESSAGE_PUT_OK, store.FLUSH_DISK_TIMEOUT, store.FLUSH_SLAVE_TIMEOUT, store.SLAVE_NOT_AVAILABLE:
 				response.Code = protocol.SUCCESS
 				response.Remark = ""
 			case store.CREATE_MAPPED_FILE_FAILED:
@@ -187,6 +189,7 @@ func (etp *endTransactionProcessor) endMessageTransaction(msgExt *message.Messag
 	msgInner.Body = msgExt.Body
 	msgInner.Flag = msgExt.Flag
 	msgInner.Properties = msgExt.Properties
+	msgInner.SysFlag = msgExt.SysFlag
 
 	tagsFlag := msgInner.SysFlag & sysflag.MultiTagsFlag
 
@@ -199,9 +202,7 @@ func (etp *endTransactionProcessor) endMessageTransaction(msgExt *message.Messag
 
 	tagsCodeValue := basis.TagsString2tagsCode(topicFilterType, msgInner.GetTags())
 	msgInner.TagsCode = tagsCodeValue
-	msgInner.PropertiesString = message.MessageProperties2String(msgExt.Properties)
 
-	msgInner.SysFlag = msgExt.SysFlag
 	msgInner.BornTimestamp = msgExt.BornTimestamp
 	msgInner.BornHost = msgExt.BornHost
 	msgInner.StoreHost = msgExt.StoreHost
@@ -211,6 +212,7 @@ func (etp *endTransactionProcessor) endMessageTransaction(msgExt *message.Messag
 	if msgInner.Properties != nil {
 		delete(msgInner.Properties, message.PROPERTY_DELAY_TIME_LEVEL)
 	}
+	msgInner.PropertiesString = message.MessageProperties2String(msgInner.Properties)
 
 	msgInner.Topic = msgExt.Topic
 	msgInner.QueueId = msgExt.QueueId
@@ -14,12 +14,14 @@
 package server
 
 import (
+	"encoding/json"
 	"fmt"
 	"os/exec"
 	"strings"
 
 	"github.com/boltmq/common/basis"
 	"github.com/boltmq/common/net/core"
+	"github.com/pquerna/ffjson/ffjson"
 )
 
 // min int64 的最小值
@@ -73,3 +75,19 @@ func parseChannelRemoteAddr(ctx core.Context) string {
 
 	return remoteAddr
 }
+
+// appendJSONField 在json对象中追加字段，用于兼容地扩展外部定义的应答结构
+func appendJSONField(content []byte, name string, value interface{}) ([]byte, error) {
+	fields := make(map[string]json.RawMessage)
+	if err := ffjson.Unmarshal(content, &fields); err != nil {
+		return nil, err
+	}
+
+	buf, err := ffjson.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	fields[name] = json.RawMessage(buf)
+	return ffjson.Marshal(fields)
+}
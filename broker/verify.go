@@ -0,0 +1,74 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/boltmq/boltmq/broker/config"
+	"github.com/boltmq/boltmq/broker/server"
+	"github.com/boltmq/boltmq/common"
+	"github.com/boltmq/boltmq/store/persistent"
+	"github.com/boltmq/common/logger"
+)
+
+// verify 离线校验commitlog、逻辑队列及索引文件，发现损坏时返回1，校验失败返回2
+func verify(args []string) int {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	root := flags.String("root", "", "store root dir, default root_dir in broker config")
+	c := flags.String("c", "", "broker config file, default etc/broker.toml")
+	repair := flags.Bool("repair", false, "rebuild consume queues and index files from commit log")
+	flags.Parse(args)
+
+	// 使用broker的存储配置，root不为空时覆盖配置中的存储目录
+	var storeCfg *persistent.Config
+	cfg, err := config.ParseConfig(*c)
+	if err != nil {
+		if *root == "" {
+			fmt.Printf("load config: %s.\n", err)
+			return 2
+		}
+		fmt.Printf("load config: %s, verify %s with default store config.\n", err, *root)
+		storeCfg = persistent.NewConfig(*root)
+	} else {
+		if *root != "" {
+			cfg.Store.RootDir = *root
+		}
+		if storeCfg, err = server.NewStoreConfig(cfg); err != nil {
+			fmt.Printf("store config: %s.\n", err)
+			return 2
+		}
+	}
+	*root = storeCfg.StorePathRootDir
+
+	if err := logger.ConfigAsBytes([]byte(common.DefaultFrontLogXmlCfg)); err != nil {
+		fmt.Printf("front log config load failed, %s\n", err)
+		return 2
+	}
+	defer logger.Flush()
+
+	report, err := persistent.Verify(storeCfg, *repair)
+	if err != nil {
+		fmt.Printf("verify %s: %s.\n", *root, err)
+		return 2
+	}
+
+	fmt.Println(report)
+	if !report.OK() && !report.Repaired {
+		return 1
+	}
+
+	return 0
+}
@@ -55,6 +55,10 @@ func GetStorePathConsumeQueue(rootDir string) string {
 	return fmt.Sprintf("%s%cconsumequeue", rootDir, os.PathSeparator)
 }
 
+func GetStorePathConsumeQueueExt(rootDir string) string {
+	return fmt.Sprintf("%s%cconsumequeue_ext", rootDir, os.PathSeparator)
+}
+
 func GetStorePathIndex(rootDir string) string {
 	return fmt.Sprintf("%s%cindex", rootDir, os.PathSeparator)
 }
@@ -71,6 +75,10 @@ func GetDelayOffsetStorePath(rootDir string) string {
 	return fmt.Sprintf("%s%cconfig%cdelayOffset.json", rootDir, os.PathSeparator, os.PathSeparator)
 }
 
+func GetCompactionStatePath(rootDir string) string {
+	return fmt.Sprintf("%s%cconfig%ccompaction.json", rootDir, os.PathSeparator, os.PathSeparator)
+}
+
 func GetTranStateTableStorePath(rootDir string) string {
 	return fmt.Sprintf("%s%ctransaction%cstatetable", rootDir, os.PathSeparator, os.PathSeparator)
 }
@@ -78,3 +86,7 @@ func GetTranStateTableStorePath(rootDir string) string {
 func GetTranRedoLogStorePath(rootDir string) string {
 	return fmt.Sprintf("%s%ctransaction%credolog", rootDir, os.PathSeparator, os.PathSeparator)
 }
+
+func GetElectionStatePath(rootDir string) string {
+	return fmt.Sprintf("%s%celection%craft.json", rootDir, os.PathSeparator, os.PathSeparator)
+}
@@ -66,6 +66,10 @@ func String2File(data []byte, flPath string) error {
 
 	oldData, err := ioutil.ReadFile(filePath)
 	if err != nil {
+		if os.IsNotExist(err) {
+			// 首次写入，没有需要备份的原文件
+			return os.Rename(tmpFilePath, filePath)
+		}
 		return err
 	}
 
@@ -0,0 +1,169 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package httpapi
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/boltmq/boltmq/common"
+	"github.com/boltmq/common/logger"
+)
+
+// Error http接口的错误应答
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+const (
+	readHeaderTimeout = 5 * time.Second  // 读取请求头的超时时间
+	readTimeout       = 30 * time.Second // 读取整个请求的超时时间
+	writeTimeout      = 60 * time.Second // 写入应答的超时时间
+)
+
+// Server 以json返回结果的http接口。需认证的接口在Authorization头中携带"Bearer <token>"，未配置token时不开放
+type Server struct {
+	name   string        // 日志中的服务名称
+	token  func() string // 每次请求时读取，配置更新后立即生效
+	mux    *http.ServeMux
+	server *http.Server
+}
+
+func NewServer(name, addr string, token func() string) *Server {
+	mux := http.NewServeMux()
+	return &Server{
+		name:  name,
+		token: token,
+		mux:   mux,
+		server: &http.Server{
+			Addr:              addr,
+			Handler:           mux,
+			ReadHeaderTimeout: readHeaderTimeout,
+			ReadTimeout:       readTimeout,
+			WriteTimeout:      writeTimeout,
+		},
+	}
+}
+
+func (s *Server) HandleFunc(pattern string, handler http.HandlerFunc) {
+	s.mux.HandleFunc(pattern, handler)
+}
+
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		if err := s.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Errorf("%s serve err: %s.", s.name, err)
+		}
+	}()
+	logger.Infof("%s start, listen %s.", s.name, s.server.Addr)
+	return nil
+}
+
+func (s *Server) Shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := s.server.Shutdown(ctx); err != nil {
+		logger.Warnf("%s shutdown err: %s.", s.name, err)
+		return
+	}
+	logger.Infof("%s shutdown.", s.name)
+}
+
+// Get 只允许GET请求
+func (s *Server) Get(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			WriteError(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// Post 只允许经过认证的POST请求
+func (s *Server) Post(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			WriteError(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method))
+			return
+		}
+		s.Private(handler)(w, r)
+	}
+}
+
+// Private 只允许经过认证的请求，用于写接口及返回消息内容等敏感数据的读接口
+func (s *Server) Private(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.Authorize(w, r) {
+			handler(w, r)
+		}
+	}
+}
+
+// Authorize 校验请求的token，失败时写入错误应答
+func (s *Server) Authorize(w http.ResponseWriter, r *http.Request) bool {
+	token := s.token()
+	if token == "" {
+		WriteError(w, http.StatusForbidden, "api is disabled without token")
+		return false
+	}
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") ||
+		subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+		logger.Warnf("%s unauthorized request %s %s from %s.", s.name, r.Method, r.URL.Path, r.RemoteAddr)
+		WriteError(w, http.StatusUnauthorized, "unauthorized")
+		return false
+	}
+
+	return true
+}
+
+func WriteJSON(w http.ResponseWriter, v interface{}) {
+	content, err := common.Encode(v)
+	if err != nil {
+		WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	WriteContent(w, content)
+}
+
+// WriteContent 写入已编码的json，nil表示编码失败
+func WriteContent(w http.ResponseWriter, content []byte) {
+	if content == nil {
+		WriteError(w, http.StatusInternalServerError, "encode failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(content)
+}
+
+func WriteError(w http.ResponseWriter, code int, message string) {
+	content, _ := common.Encode(&Error{Code: code, Message: message})
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write(content)
+}
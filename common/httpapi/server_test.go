@@ -0,0 +1,90 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package httpapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServerAuthorize(t *testing.T) {
+	token := ""
+	s := NewServer("test", "127.0.0.1:0", func() string { return token })
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		WriteJSON(w, map[string]string{"ok": "true"})
+	}
+	s.HandleFunc("/get", s.Get(handler))
+	s.HandleFunc("/post", s.Post(handler))
+	s.HandleFunc("/private", s.Get(s.Private(handler)))
+
+	cases := []struct {
+		token  string
+		method string
+		path   string
+		auth   string
+		expect int
+	}{
+		{"", http.MethodGet, "/get", "", http.StatusOK},
+		{"", http.MethodPost, "/get", "", http.StatusMethodNotAllowed},
+		{"", http.MethodPost, "/post", "Bearer abc", http.StatusForbidden}, // 未配置token时不开放
+		{"abc", http.MethodGet, "/post", "Bearer abc", http.StatusMethodNotAllowed},
+		{"abc", http.MethodPost, "/post", "", http.StatusUnauthorized},
+		{"abc", http.MethodPost, "/post", "Bearer abd", http.StatusUnauthorized},
+		{"abc", http.MethodPost, "/post", "Bearer abc", http.StatusOK},
+		{"", http.MethodGet, "/private", "", http.StatusForbidden},
+		{"abc", http.MethodGet, "/private", "abc", http.StatusUnauthorized},
+		{"abc", http.MethodGet, "/private", "Bearer abc", http.StatusOK},
+	}
+
+	for _, c := range cases {
+		token = c.token
+		r := httptest.NewRequest(c.method, c.path, nil)
+		if c.auth != "" {
+			r.Header.Set("Authorization", c.auth)
+		}
+
+		w := httptest.NewRecorder()
+		s.mux.ServeHTTP(w, r)
+		if w.Code != c.expect {
+			t.Errorf("%s %s with token %q auth %q code=%d, expect %d", c.method, c.path, c.token, c.auth, w.Code, c.expect)
+			return
+		}
+	}
+}
+
+func TestWriteContent(t *testing.T) {
+	w := httptest.NewRecorder()
+	WriteContent(w, nil)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("write nil content code=%d", w.Code)
+		return
+	}
+
+	w = httptest.NewRecorder()
+	WriteContent(w, []byte(`{"a":1}`))
+	if w.Code != http.StatusOK || w.Body.String() != `{"a":1}` ||
+		w.Header().Get("Content-Type") != "application/json; charset=utf-8" {
+		t.Errorf("write content code=%d body=%s", w.Code, w.Body.String())
+		return
+	}
+}
+
+func TestServerTimeouts(t *testing.T) {
+	s := NewServer("test", "127.0.0.1:0", func() string { return "" })
+	if s.server.ReadHeaderTimeout <= 0 || s.server.ReadTimeout <= 0 || s.server.WriteTimeout <= 0 {
+		t.Errorf("server timeouts not set, readHeader=%s read=%s write=%s",
+			s.server.ReadHeaderTimeout, s.server.ReadTimeout, s.server.WriteTimeout)
+	}
+}
@@ -23,6 +23,20 @@ type NameSrvConfig struct {
 	Host      string `toml:"host"`           // 监听地址
 	Port      int    `toml:"port"`           // 监听端口
 	KVCfgPath string `toml:"kv_config_path"` // kv文件存储路径
+
+	// 多个namesrv之间同步路由及kv配置
+	IP               string   `toml:"ip"`                 // 本机ip地址，用于其他namesrv识别，配置peers时必须设置
+	Peers            []string `toml:"peers"`              // 其他namesrv地址，格式：ip:port，可以包含本机
+	PeerSyncInterval int      `toml:"peer_sync_interval"` // 与其他namesrv交换路由快照的间隔，单位毫秒
+
+	// 路由表持久化，重启后在broker重新注册之前应答路由查询
+	RouteSnapshotPath     string `toml:"route_snapshot_path"`     // 路由快照文件路径，为空不持久化
+	RouteSnapshotInterval int    `toml:"route_snapshot_interval"` // 持久化路由快照的间隔，单位毫秒
+	RouteSnapshotTTL      int    `toml:"route_snapshot_ttl"`      // 加载的broker没有重新注册时的保留时间，单位毫秒
+
+	// http接口，以json查询集群、路由及kv配置
+	HttpAddr  string `toml:"http_addr"`  // 监听地址，格式：host:port，为空不开启
+	HttpToken string `toml:"http_token"` // 写接口的认证token，为空不开放写接口
 }
 
 // LogConfig 日志配置
@@ -39,8 +39,13 @@ func ParseConfig(path string) (*Config, error) {
 
 var defaultConfig = &Config{
 	NameSrv: NameSrvConfig{
-		Host: "0.0.0.0",
-		Port: 9876,
+		Host:             "0.0.0.0",
+		Port:             9876,
+		PeerSyncInterval: 10000,
+
+		RouteSnapshotPath:     "nsrv-route.json",
+		RouteSnapshotInterval: 10000,
+		RouteSnapshotTTL:      60000,
 	},
 	Log: LogConfig{
 		CfgFilePath: "etc/seelog-nsrv.xml",
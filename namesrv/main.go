@@ -90,7 +90,11 @@ func main() {
 		os.Exit(0)
 	})
 
-	controller.Start()
+	if err := controller.Start(); err != nil {
+		controller.Shutdown()
+		logger.Errorf("controller start failed, %s.", err)
+		os.Exit(0)
+	}
 }
 
 func runDaemon(pidfile string) (*daemon.Context, error) {
@@ -44,7 +44,7 @@ func (listener *brokerHouseKeepingListener) OnContextConnect(ctx core.Context) {
 	logger.Infof("broker house keeping, connect request, %s.", ctx)
 }
 
-// OnContextClose 关闭Channel,通知Topic路由管理器，清除无效Broker
+// OnContextClose 关闭Channel,通知Topic路由管理器，清除无效Broker及路由订阅
 // Author: tianyuliang
 // Since: 2017/9/6
 func (listener *brokerHouseKeepingListener) OnContextClosed(ctx core.Context) {
@@ -55,9 +55,10 @@ func (listener *brokerHouseKeepingListener) OnContextClosed(ctx core.Context) {
 
 	logger.Infof("broker house keeping, close request, %s.", ctx)
 	listener.controller.riManager.onChannelDestroy(ctx.RemoteAddr().String(), ctx)
+	listener.controller.routeSubscriptions.removeChannel(ctx.RemoteAddr().String())
 }
 
-// OnContextError Channel出现异常,通知Topic路由管理器，清除无效Broker
+// OnContextError Channel出现异常,通知Topic路由管理器，清除无效Broker及路由订阅
 // Author: tianyuliang
 // Since: 2017/9/6
 func (listener *brokerHouseKeepingListener) OnContextError(ctx core.Context, err error) {
@@ -68,9 +69,10 @@ func (listener *brokerHouseKeepingListener) OnContextError(ctx core.Context, err
 
 	logger.Infof("broker house keeping, error request, %s.", ctx)
 	listener.controller.riManager.onChannelDestroy(ctx.RemoteAddr().String(), ctx)
+	listener.controller.routeSubscriptions.removeChannel(ctx.RemoteAddr().String())
 }
 
-// OnContextIdle Channe的Idle时间超时,通知Topic路由管理器，清除无效Brokers
+// OnContextIdle Channe的Idle时间超时,通知Topic路由管理器，清除无效Brokers及路由订阅
 // Author: tianyuliang
 // Since: 2017/9/6
 func (listener *brokerHouseKeepingListener) OnContextIdle(ctx core.Context) {
@@ -81,4 +83,5 @@ func (listener *brokerHouseKeepingListener) OnContextIdle(ctx core.Context) {
 
 	logger.Infof("broker house keeping, idle request, %s.", ctx)
 	listener.controller.riManager.onChannelDestroy(ctx.RemoteAddr().String(), ctx)
+	listener.controller.routeSubscriptions.removeChannel(ctx.RemoteAddr().String())
 }
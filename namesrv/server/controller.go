@@ -14,6 +14,9 @@
 package server
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/boltmq/boltmq/namesrv/config"
 	"github.com/boltmq/common/logger"
 	"github.com/boltmq/common/net/remoting"
@@ -29,6 +32,9 @@ type NameSrvController struct {
 	houseKeepingListener remoting.ContextEventListener // 扫描不活跃连接
 	requestProcessor     remoting.RequestProcessor     // 默认请求处理器
 	tasks                *controllerTask               // Namesrv定时器服务
+	peers                *peerSyncService              // 与其他namesrv同步路由及kv配置
+	routeSubscriptions   *routeSubscriptionManager     // topic路由变化订阅
+	httpGateway          *httpGateway                  // http接口
 }
 
 // NewNamesrvController 初始化默认的NamesrvController
@@ -45,17 +51,33 @@ func NewNamesrvController(cfg *config.Config) *NameSrvController {
 
 	controller.tasks = newControllerTask(controller)
 	controller.kvCfgManager = newKVConfigManager(controller)
+	controller.peers = newPeerSyncService(controller)
+	controller.routeSubscriptions = newRouteSubscriptionManager(controller)
+	controller.riManager.routeChanged = controller.routeSubscriptions.routeChanged
 	controller.houseKeepingListener = newBrokerHouseKeepingListener(controller)
+	controller.httpGateway = newHttpGateway(controller)
 	return controller
 }
 
 // Load 加载NamesrvController必要的资源
 func (controller *NameSrvController) Load() error {
+	// 多个namesrv之间以ip识别自己及比较配置版本，默认host(0.0.0.0)无法区分
+	if controller.cfg.NameSrv.IP == "" {
+		for _, peer := range controller.cfg.NameSrv.Peers {
+			if strings.TrimSpace(peer) != "" {
+				return errors.Errorf("namesrv ip is required when peers are configured")
+			}
+		}
+	}
+
 	err := controller.kvCfgManager.load()
 	if err != nil {
 		return errors.Wrap(err, 0)
 	}
 
+	// 加载路由快照，broker重新注册前即可应答路由查询
+	controller.riManager.loadSnapshot(controller.cfg.NameSrv.RouteSnapshotPath, int64(controller.cfg.NameSrv.RouteSnapshotTTL))
+
 	// 注册默认DefaultRequestProcessor，只要start启动就开始处理请求
 	controller.registerProcessor()
 
@@ -72,10 +94,25 @@ func (controller *NameSrvController) Load() error {
 // Author: tianyuliang
 // Since: 2017/9/14
 func (controller *NameSrvController) Start() error {
+	if err := controller.httpGateway.start(); err != nil {
+		return errors.Wrap(err, 0)
+	}
+	controller.peers.start()
+	controller.routeSubscriptions.start()
 	controller.remotingServer.Start()
 	return nil
 }
 
+// addr 本namesrv地址，用于namesrv之间识别
+func (controller *NameSrvController) addr() string {
+	ip := controller.cfg.NameSrv.IP
+	if ip == "" {
+		ip = controller.cfg.NameSrv.Host
+	}
+
+	return fmt.Sprintf("%s:%d", ip, controller.cfg.NameSrv.Port)
+}
+
 // Shutdown 关闭NamesrvController控制器
 // Author: tianyuliang
 // Since: 2017/9/14
@@ -91,6 +128,17 @@ func (controller *NameSrvController) Shutdown() {
 		logger.Info("stop printNamesrvTask success.")
 	}
 
+	if controller.tasks.routeSnapshotTask != nil {
+		controller.tasks.routeSnapshotTask.Stop()
+		// 关闭连接会清除broker，在此之前持久化路由快照
+		controller.riManager.persistSnapshot(controller.cfg.NameSrv.RouteSnapshotPath)
+		logger.Info("stop routeSnapshotTask success.")
+	}
+
+	controller.peers.shutdown()
+	controller.routeSubscriptions.shutdown()
+	controller.httpGateway.shutdown()
+
 	if controller.remotingServer != nil {
 		controller.remotingServer.Shutdown()
 		logger.Info("shutdown remotingServer success.")
@@ -112,6 +160,10 @@ func (controller *NameSrvController) runTasks() {
 		// 启动(延迟1分钟执行)第二个定时任务：每隔10分钟打印NameServer全局配置,即KVConfigManager.configTable变量的内容
 		controller.tasks.printNameSrvTask.Start()
 		logger.Info("start printNamesrvTask ok")
+
+		// 启动第三个定时任务：周期性持久化路由快照
+		controller.tasks.routeSnapshotTask.Start()
+		logger.Info("start routeSnapshotTask ok")
 	}()
 }
 
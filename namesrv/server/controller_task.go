@@ -20,9 +20,10 @@ import (
 )
 
 type controllerTask struct {
-	controller       *NameSrvController
-	scanBrokerTask   *system.Ticker // 扫描2分钟不活跃broker的定时器
-	printNameSrvTask *system.Ticker // 周期性打印namesrv数据的定时器
+	controller        *NameSrvController
+	scanBrokerTask    *system.Ticker // 扫描2分钟不活跃broker的定时器
+	printNameSrvTask  *system.Ticker // 周期性打印namesrv数据的定时器
+	routeSnapshotTask *system.Ticker // 周期性持久化路由快照的定时器
 }
 
 func newControllerTask(controller *NameSrvController) *controllerTask {
@@ -35,6 +36,12 @@ func newControllerTask(controller *NameSrvController) *controllerTask {
 
 	tasks.printNameSrvTask = system.NewTicker(false, 1*time.Minute, 10*time.Minute, func() {
 		tasks.controller.kvCfgManager.printAllPeriodically()
+		tasks.controller.kvCfgManager.pruneTombstones()
+	})
+
+	interval := time.Duration(controller.cfg.NameSrv.RouteSnapshotInterval) * time.Millisecond
+	tasks.routeSnapshotTask = system.NewTicker(false, interval, interval, func() {
+		tasks.controller.riManager.persistSnapshot(tasks.controller.cfg.NameSrv.RouteSnapshotPath)
 	})
 
 	return tasks
@@ -43,9 +50,11 @@ func newControllerTask(controller *NameSrvController) *controllerTask {
 func (tasks *controllerTask) start() {
 	tasks.scanBrokerTask.Start()
 	tasks.printNameSrvTask.Start()
+	tasks.routeSnapshotTask.Start()
 }
 
 func (tasks *controllerTask) shutdown() {
 	tasks.scanBrokerTask.Stop()
 	tasks.printNameSrvTask.Stop()
+	tasks.routeSnapshotTask.Stop()
 }
@@ -0,0 +1,178 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/boltmq/boltmq/common/httpapi"
+	"github.com/boltmq/common/logger"
+	"github.com/boltmq/common/protocol/namesrv"
+)
+
+// httpGateway namesrv的http接口，以json返回集群、路由及kv配置，供运维脚本及监控使用。
+// 写接口需要在Authorization头中携带"Bearer <token>"，未配置token时不开放写接口
+type httpGateway struct {
+	controller *NameSrvController
+	server     *httpapi.Server
+}
+
+func newHttpGateway(controller *NameSrvController) *httpGateway {
+	gw := &httpGateway{controller: controller}
+	if controller.cfg.NameSrv.HttpAddr == "" {
+		return gw
+	}
+
+	server := httpapi.NewServer("http gateway", controller.cfg.NameSrv.HttpAddr, func() string {
+		return controller.cfg.NameSrv.HttpToken
+	})
+	server.HandleFunc("/cluster", server.Get(gw.clusterInfo))
+	server.HandleFunc("/cluster/topics", server.Get(gw.topicsByCluster))
+	server.HandleFunc("/topics", server.Get(gw.allTopics))
+	server.HandleFunc("/topic/route", server.Get(gw.topicRoute))
+	server.HandleFunc("/kv", gw.kvConfig)
+	server.HandleFunc("/broker/wipe-write-perm", server.Post(gw.wipeWritePerm))
+	gw.server = server
+
+	return gw
+}
+
+func (gw *httpGateway) start() error {
+	if gw.server == nil {
+		return nil
+	}
+
+	return gw.server.Start()
+}
+
+func (gw *httpGateway) shutdown() {
+	if gw.server != nil {
+		gw.server.Shutdown()
+	}
+}
+
+// clusterInfo 获取所有broker集群信息，对应getBrokerClusterInfo
+func (gw *httpGateway) clusterInfo(w http.ResponseWriter, r *http.Request) {
+	httpapi.WriteContent(w, gw.controller.riManager.getAllClusterInfo())
+}
+
+// topicsByCluster 获取指定集群下的全部topic，对应getTopicsByCluster
+func (gw *httpGateway) topicsByCluster(w http.ResponseWriter, r *http.Request) {
+	cluster := r.URL.Query().Get("cluster")
+	if cluster == "" {
+		httpapi.WriteError(w, http.StatusBadRequest, "cluster is empty")
+		return
+	}
+
+	httpapi.WriteContent(w, gw.controller.riManager.getTopicsByCluster(cluster))
+}
+
+// allTopics 获取全部topic列表，对应getAllTopicListFromNamesrv
+func (gw *httpGateway) allTopics(w http.ResponseWriter, r *http.Request) {
+	httpapi.WriteContent(w, gw.controller.riManager.getAllTopicList())
+}
+
+// topicRoute 获取topic路由，对应getRouteInfoByTopic
+func (gw *httpGateway) topicRoute(w http.ResponseWriter, r *http.Request) {
+	topic := r.URL.Query().Get("topic")
+	if topic == "" {
+		httpapi.WriteError(w, http.StatusBadRequest, "topic is empty")
+		return
+	}
+
+	topicRouteData := gw.controller.riManager.pickupTopicRouteData(topic)
+	if topicRouteData == nil {
+		httpapi.WriteError(w, http.StatusNotFound, fmt.Sprintf("no topic route info in name server for the topic: %s", topic))
+		return
+	}
+	topicRouteData.OrderTopicConf = gw.controller.kvCfgManager.getKVConfig(namesrv.NAMESPACE_ORDER_TOPIC_CONFIG, topic)
+
+	content, err := topicRouteData.Encode()
+	if err != nil {
+		logger.Errorf("http gateway encode topic %s route err: %s.", topic, err)
+		httpapi.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	httpapi.WriteContent(w, content)
+}
+
+// kvConfig GET查询namespace下的kv配置，指定key时只返回该配置；POST新增或修改配置；DELETE删除配置
+func (gw *httpGateway) kvConfig(w http.ResponseWriter, r *http.Request) {
+	namespace, key := r.FormValue("namespace"), r.FormValue("key")
+	if namespace == "" {
+		httpapi.WriteError(w, http.StatusBadRequest, "namespace is empty")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if key != "" {
+			value := gw.controller.kvCfgManager.getKVConfig(namespace, key)
+			if value == "" {
+				httpapi.WriteError(w, http.StatusNotFound, fmt.Sprintf("no config item, namespace: %s key: %s", namespace, key))
+				return
+			}
+			httpapi.WriteJSON(w, map[string]string{"namespace": namespace, "key": key, "value": value})
+			return
+		}
+
+		content := gw.controller.kvCfgManager.getKVListByNamespace(namespace)
+		if len(content) == 0 {
+			httpapi.WriteError(w, http.StatusNotFound, fmt.Sprintf("no config item, namespace: %s", namespace))
+			return
+		}
+		httpapi.WriteContent(w, content)
+	case http.MethodPost:
+		if !gw.server.Authorize(w, r) {
+			return
+		}
+		value := r.FormValue("value")
+		if key == "" || value == "" {
+			httpapi.WriteError(w, http.StatusBadRequest, "key or value is empty")
+			return
+		}
+
+		gw.controller.kvCfgManager.putKVConfig(namespace, key, value)
+		logger.Infof("http gateway put kv config, namespace: %s key: %s, client: %s.", namespace, key, r.RemoteAddr)
+		httpapi.WriteJSON(w, map[string]string{"namespace": namespace, "key": key, "value": value})
+	case http.MethodDelete:
+		if !gw.server.Authorize(w, r) {
+			return
+		}
+		if key == "" {
+			httpapi.WriteError(w, http.StatusBadRequest, "key is empty")
+			return
+		}
+
+		gw.controller.kvCfgManager.deleteKVConfig(namespace, key)
+		logger.Infof("http gateway delete kv config, namespace: %s key: %s, client: %s.", namespace, key, r.RemoteAddr)
+		httpapi.WriteJSON(w, map[string]string{"namespace": namespace, "key": key})
+	default:
+		httpapi.WriteError(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method))
+	}
+}
+
+// wipeWritePerm 去掉broker的写权限，对应wipeWritePermOfBroker
+func (gw *httpGateway) wipeWritePerm(w http.ResponseWriter, r *http.Request) {
+	brokerName := r.FormValue("brokerName")
+	if brokerName == "" {
+		httpapi.WriteError(w, http.StatusBadRequest, "brokerName is empty")
+		return
+	}
+
+	wipeTopicCount := gw.controller.riManager.wipeWritePermOfBrokerByLock(brokerName)
+	logger.Infof("http gateway wipe write perm of broker[%s], client: %s, %d.", brokerName, r.RemoteAddr, wipeTopicCount)
+	httpapi.WriteJSON(w, map[string]interface{}{"brokerName": brokerName, "wipeTopicCount": wipeTopicCount})
+}
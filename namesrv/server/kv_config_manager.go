@@ -22,15 +22,46 @@ import (
 	"github.com/boltmq/boltmq/common"
 	"github.com/boltmq/common/logger"
 	"github.com/boltmq/common/protocol"
+	"github.com/boltmq/common/utils/system"
 )
 
+const (
+	kvTombstoneRetention = 24 * 60 * 60 * 1000 // 删除版本的保留时间，超过后不再同步，单位毫秒
+)
+
+// kvConfigVersion KV配置的版本，删除后保留版本用于namesrv之间同步
+type kvConfigVersion struct {
+	Version int64  `json:"version"` // 毫秒时间戳，同一namesrv内单调递增
+	Origin  string `json:"origin"`  // 修改配置的namesrv，版本相同时按地址比较
+	Deleted bool   `json:"deleted"` // 是否已删除
+}
+
+// newerThan 版本是否比other新
+func (v *kvConfigVersion) newerThan(other *kvConfigVersion) bool {
+	if other == nil {
+		return true
+	}
+
+	return v.Version > other.Version || (v.Version == other.Version && v.Origin > other.Origin)
+}
+
+// kvConfigEntry namesrv之间复制的KV配置
+type kvConfigEntry struct {
+	Namespace string `json:"namespace"`
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+	kvConfigVersion
+}
+
 // kvConfigManager KV配置管理器
 // Author: tianyuliang
 // Since: 2017/9/8
 type kvConfigManager struct {
-	configTable map[string]map[string]string // 数据格式：Namespace[Key[Value]]
-	rwLock      sync.RWMutex
-	controller  *NameSrvController
+	configTable  map[string]map[string]string           // 数据格式：Namespace[Key[Value]]
+	versionTable map[string]map[string]*kvConfigVersion // 数据格式：Namespace[Key[Version]]，包括已删除的配置
+	lastVersion  int64
+	rwLock       sync.RWMutex
+	controller   *NameSrvController
 }
 
 // newKVConfigManager 初始化KV配置管理器
@@ -38,8 +69,9 @@ type kvConfigManager struct {
 // Since: 2017/9/6
 func newKVConfigManager(controller *NameSrvController) *kvConfigManager {
 	kvCfgManager := &kvConfigManager{
-		configTable: make(map[string]map[string]string),
-		controller:  controller,
+		configTable:  make(map[string]map[string]string),
+		versionTable: make(map[string]map[string]*kvConfigVersion),
+		controller:   controller,
 	}
 	return kvCfgManager
 }
@@ -68,7 +100,10 @@ func (kvCfg *kvConfigManager) printAllPeriodically() {
 // Since: 2017/9/6
 func (kvCfg *kvConfigManager) persist() {
 	kvCfg.rwLock.RLock()
+	defer kvCfg.rwLock.RUnlock()
+
 	kvConfigWrapper := NewKVConfigSerializeWrapper(kvCfg.configTable)
+	kvConfigWrapper.VersionTable = kvCfg.versionTable
 	content, err := common.Encode(kvConfigWrapper)
 	if err != nil {
 		logger.Errorf("kv config encode failed, err: %s.", err)
@@ -78,14 +113,145 @@ func (kvCfg *kvConfigManager) persist() {
 	kvConfigPath := kvCfg.controller.cfg.NameSrv.KVCfgPath
 	common.String2File(content, kvConfigPath)
 	logger.Info("persist kv config success.")
+}
+
+// pruneTombstones 清理超过保留时间的删除版本，返回清理的数量
+func (kvCfg *kvConfigManager) pruneTombstones() int {
+	count := 0
+	expired := system.CurrentTimeMillis() - kvTombstoneRetention
+	kvCfg.rwLock.Lock()
+	for namespace, versions := range kvCfg.versionTable {
+		for key, version := range versions {
+			if !version.Deleted || version.Version > expired {
+				continue
+			}
+			if _, ok := kvCfg.configTable[namespace][key]; ok {
+				continue
+			}
+
+			delete(versions, key)
+			count++
+		}
+		if len(versions) == 0 {
+			delete(kvCfg.versionTable, namespace)
+		}
+	}
+	kvCfg.rwLock.Unlock()
+
+	if count > 0 {
+		logger.Infof("prune kv config tombstones, count: %d.", count)
+		kvCfg.persist()
+	}
 
-	kvCfg.rwLock.RUnlock()
+	return count
+}
+
+// nextVersion 生成本地修改的版本，调用方持有写锁
+func (kvCfg *kvConfigManager) nextVersion(deleted bool) *kvConfigVersion {
+	version := system.CurrentTimeMillis()
+	if version <= kvCfg.lastVersion {
+		version = kvCfg.lastVersion + 1
+	}
+	kvCfg.lastVersion = version
+
+	return &kvConfigVersion{Version: version, Origin: kvCfg.controller.addr(), Deleted: deleted}
+}
+
+// setVersion 记录配置版本，调用方持有写锁
+func (kvCfg *kvConfigManager) setVersion(namespace, key string, version *kvConfigVersion) {
+	versions, ok := kvCfg.versionTable[namespace]
+	if !ok {
+		versions = make(map[string]*kvConfigVersion)
+		kvCfg.versionTable[namespace] = versions
+	}
+	versions[key] = version
+
+	if version.Version > kvCfg.lastVersion {
+		kvCfg.lastVersion = version.Version
+	}
+}
+
+// entry 构造复制的配置，调用方持有锁
+func (kvCfg *kvConfigManager) entry(namespace, key string) *kvConfigEntry {
+	entry := &kvConfigEntry{Namespace: namespace, Key: key}
+	if version, ok := kvCfg.versionTable[namespace][key]; ok {
+		entry.kvConfigVersion = *version
+	}
+	if value, ok := kvCfg.configTable[namespace][key]; ok {
+		entry.Value = value
+	}
+
+	return entry
+}
+
+// allEntries 全部配置及版本，用于与其他namesrv交换
+func (kvCfg *kvConfigManager) allEntries() []*kvConfigEntry {
+	kvCfg.rwLock.RLock()
+	defer kvCfg.rwLock.RUnlock()
+
+	var entries []*kvConfigEntry
+	for namespace, kvTable := range kvCfg.configTable {
+		for key := range kvTable {
+			entries = append(entries, kvCfg.entry(namespace, key))
+		}
+	}
+
+	for namespace, versions := range kvCfg.versionTable {
+		for key, version := range versions {
+			if version.Deleted {
+				entries = append(entries, kvCfg.entry(namespace, key))
+			}
+		}
+	}
+
+	return entries
+}
+
+// mergeEntries 合并其他namesrv复制的配置，只接受更新的版本，返回生效的数量
+func (kvCfg *kvConfigManager) mergeEntries(entries []*kvConfigEntry) int {
+	count := 0
+	kvCfg.rwLock.Lock()
+	for _, entry := range entries {
+		if entry == nil || entry.Namespace == "" || entry.Key == "" {
+			continue
+		}
+
+		current := kvCfg.versionTable[entry.Namespace][entry.Key]
+		if !entry.kvConfigVersion.newerThan(current) {
+			continue
+		}
+
+		version := entry.kvConfigVersion
+		kvCfg.setVersion(entry.Namespace, entry.Key, &version)
+		if entry.Deleted {
+			delete(kvCfg.configTable[entry.Namespace], entry.Key)
+		} else {
+			kvTable, ok := kvCfg.configTable[entry.Namespace]
+			if !ok {
+				kvTable = make(map[string]string)
+				kvCfg.configTable[entry.Namespace] = kvTable
+			}
+			kvTable[entry.Key] = entry.Value
+		}
+
+		logger.Infof("merge kv config, namespace: %s key: %s value: %s version: %d origin: %s deleted: %t.",
+			entry.Namespace, entry.Key, entry.Value, entry.Version, entry.Origin, entry.Deleted)
+		count++
+	}
+	kvCfg.rwLock.Unlock()
+
+	if count > 0 {
+		kvCfg.persist()
+	}
+
+	return count
 }
 
 // deleteKVConfigByValue 从指定Namespace配置中，根据value，删除对应的key键
 // Author: tianyuliang
 // Since: 2017/9/6
 func (kvCfg *kvConfigManager) deleteKVConfigByValue(namespace, value string) {
+	var entries []*kvConfigEntry
 	kvCfg.rwLock.Lock()
 	if kvTable, ok := kvCfg.configTable[namespace]; ok && kvTable != nil {
 		cloneKvTable := make(map[string]string)
@@ -96,6 +262,8 @@ func (kvCfg *kvConfigManager) deleteKVConfigByValue(namespace, value string) {
 		for k, v := range cloneKvTable {
 			if v == value {
 				delete(kvTable, k)
+				kvCfg.setVersion(namespace, k, kvCfg.nextVersion(true))
+				entries = append(entries, kvCfg.entry(namespace, k))
 				format := "delete ips by project group delete a config item, Namespace: %s Key: %s Value: %s"
 				logger.Info(format, namespace, k, v)
 			}
@@ -103,6 +271,7 @@ func (kvCfg *kvConfigManager) deleteKVConfigByValue(namespace, value string) {
 	}
 	kvCfg.rwLock.Unlock()
 	kvCfg.persist()
+	kvCfg.controller.peers.replicate(entries)
 }
 
 // getKVConfigByValue 从指定Namespace配置中，根据value，反向查找key列表，并将key列表通过分号;拼接为字符串
@@ -110,6 +279,8 @@ func (kvCfg *kvConfigManager) deleteKVConfigByValue(namespace, value string) {
 // Since: 2017/9/6
 func (kvCfg *kvConfigManager) getKVConfigByValue(namespace, value string) string {
 	kvCfg.rwLock.RLock()
+	defer kvCfg.rwLock.RUnlock()
+
 	if kvTable, ok := kvCfg.configTable[namespace]; ok && kvTable != nil {
 		buf := new(bytes.Buffer)
 		splitor := ""
@@ -122,7 +293,6 @@ func (kvCfg *kvConfigManager) getKVConfigByValue(namespace, value string) string
 		}
 		return buf.String()
 	}
-	kvCfg.rwLock.RUnlock()
 	return ""
 }
 
@@ -131,12 +301,13 @@ func (kvCfg *kvConfigManager) getKVConfigByValue(namespace, value string) string
 // Since: 2017/9/6
 func (kvCfg *kvConfigManager) getKVConfig(namespace, key string) string {
 	kvCfg.rwLock.RLock()
+	defer kvCfg.rwLock.RUnlock()
+
 	if kvTable, ok := kvCfg.configTable[namespace]; ok && kvTable != nil {
 		if value, ok := kvTable[key]; ok {
 			return value
 		}
 	}
-	kvCfg.rwLock.RUnlock()
 	return ""
 }
 
@@ -145,6 +316,8 @@ func (kvCfg *kvConfigManager) getKVConfig(namespace, key string) string {
 // Since: 2017/9/6
 func (kvCfg *kvConfigManager) getKVListByNamespace(namespace string) []byte {
 	kvCfg.rwLock.RLock()
+	defer kvCfg.rwLock.RUnlock()
+
 	if kvTable, ok := kvCfg.configTable[namespace]; ok && kvTable != nil {
 		tb := protocol.NewKVTable()
 		for topic, value := range kvTable {
@@ -158,7 +331,6 @@ func (kvCfg *kvConfigManager) getKVListByNamespace(namespace string) []byte {
 
 		return buf
 	}
-	kvCfg.rwLock.RUnlock()
 
 	return []byte{}
 }
@@ -167,16 +339,20 @@ func (kvCfg *kvConfigManager) getKVListByNamespace(namespace string) []byte {
 // Author: tianyuliang
 // Since: 2017/9/6
 func (kvCfg *kvConfigManager) deleteKVConfig(namespace, key string) {
+	var entries []*kvConfigEntry
 	kvCfg.rwLock.Lock()
 	if kvTable, ok := kvCfg.configTable[namespace]; ok && kvTable != nil {
 		format := "delete a config item, Namespace: %s Key: %s Value: %s"
 		value, _ := kvTable[key]
 		logger.Info(format, namespace, key, value)
 		delete(kvTable, key)
+		kvCfg.setVersion(namespace, key, kvCfg.nextVersion(true))
+		entries = append(entries, kvCfg.entry(namespace, key))
 	}
 	kvCfg.rwLock.Unlock()
 
 	kvCfg.persist()
+	kvCfg.controller.peers.replicate(entries)
 }
 
 // putKVConfig 向Namesrv追加KV配置
@@ -197,6 +373,8 @@ func (kvCfg *kvConfigManager) putKVConfig(namespace, key, value string) {
 	_, exist = kvTable[key]
 	// 检查key是否已存在
 	kvTable[key] = value
+	kvCfg.setVersion(namespace, key, kvCfg.nextVersion(false))
+	entry := kvCfg.entry(namespace, key)
 	kvCfg.rwLock.Unlock()
 
 	if exist {
@@ -208,6 +386,7 @@ func (kvCfg *kvConfigManager) putKVConfig(namespace, key, value string) {
 	}
 
 	kvCfg.persist()
+	kvCfg.controller.peers.replicate([]*kvConfigEntry{entry})
 }
 
 // load 加载kvConfig.json至kvConfigManager的configTable，即持久化转移到内存
@@ -259,6 +438,13 @@ func (kvCfg *kvConfigManager) load() error {
 		for k, v := range kvConfigWrapper.ConfigTable {
 			kvCfg.configTable[k] = v
 		}
+		for namespace, versions := range kvConfigWrapper.VersionTable {
+			for key, version := range versions {
+				if version != nil {
+					kvCfg.setVersion(namespace, key, version)
+				}
+			}
+		}
 		logger.Info("set configTable from %s to kvCfg", cfgName)
 	}
 
@@ -17,7 +17,8 @@ package server
 // Author: tianyuliang
 // Since: 2017/9/4
 type KVConfigSerializeWrapper struct {
-	ConfigTable map[string]map[string]string `json:"configTable"` // 数据格式：Namespace[Key[Value]]
+	ConfigTable  map[string]map[string]string           `json:"configTable"`            // 数据格式：Namespace[Key[Value]]
+	VersionTable map[string]map[string]*kvConfigVersion `json:"versionTable,omitempty"` // 数据格式：Namespace[Key[Version]]，包括已删除的配置
 }
 
 // NewKVConfigSerializeWrapper 初始化KV配置
@@ -0,0 +1,216 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/boltmq/boltmq/common"
+	"github.com/boltmq/common/logger"
+	"github.com/boltmq/common/net/core"
+	"github.com/boltmq/common/net/remoting"
+	"github.com/boltmq/common/protocol"
+	"github.com/boltmq/common/protocol/base"
+	"github.com/boltmq/common/utils/system"
+)
+
+const (
+	SYNC_NAMESRV_SNAPSHOT  = 640 // namesrv之间交换路由快照及kv配置
+	SYNC_NAMESRV_KV_CONFIG = 641 // 向其他namesrv复制kv配置变更
+
+	peerSyncTimeout = 3000 // 同步请求超时时间，单位毫秒
+)
+
+// peerBrokerData 直接注册到namesrv的broker，同步给其他namesrv
+type peerBrokerData struct {
+	ClusterName              string                            `json:"clusterName"`
+	BrokerAddr               string                            `json:"brokerAddr"`
+	BrokerName               string                            `json:"brokerName"`
+	BrokerId                 int64                             `json:"brokerId"`
+	HaServerAddr             string                            `json:"haServerAddr"`
+	TpConfigSerializeWrapper *base.TopicConfigSerializeWrapper `json:"topicConfigSerializeWrapper"` // 包括DataVersion
+	FilterServerList         []string                          `json:"filterServerList"`
+	LastUpdateTimestamp      int64                             `json:"lastUpdateTimestamp"` // 最后心跳时间
+}
+
+// peerSyncBody namesrv之间同步的数据，交换快照时包括直接注册的broker及全部kv配置
+type peerSyncBody struct {
+	NameSrvAddr string            `json:"nameSrvAddr"`
+	Brokers     []*peerBrokerData `json:"brokers"`
+	KVConfigs   []*kvConfigEntry  `json:"kvConfigs"`
+}
+
+// peerSyncService 与其他namesrv同步路由及kv配置。kv配置修改后立即复制，并定期交换快照，
+// 对方返回自己的快照，使所有namesrv最终持有相同的路由及kv配置
+type peerSyncService struct {
+	controller     *NameSrvController
+	peers          []string
+	remotingClient remoting.RemotingClient
+	syncTask       *system.Ticker
+}
+
+func newPeerSyncService(controller *NameSrvController) *peerSyncService {
+	ps := &peerSyncService{controller: controller}
+
+	self := controller.addr()
+	for _, peer := range controller.cfg.NameSrv.Peers {
+		peer = strings.TrimSpace(peer)
+		if peer != "" && peer != self {
+			ps.peers = append(ps.peers, peer)
+		}
+	}
+
+	if len(ps.peers) == 0 {
+		return ps
+	}
+
+	ps.remotingClient = remoting.NewNMRemotingClient()
+	interval := time.Duration(controller.cfg.NameSrv.PeerSyncInterval) * time.Millisecond
+	ps.syncTask = system.NewTicker(false, 5*time.Second, interval, func() {
+		ps.syncSnapshot()
+	})
+
+	return ps
+}
+
+func (ps *peerSyncService) start() {
+	if len(ps.peers) == 0 {
+		return
+	}
+
+	ps.remotingClient.Start()
+	ps.syncTask.Start()
+	logger.Infof("peer sync service start, peers: %s.", strings.Join(ps.peers, ","))
+}
+
+func (ps *peerSyncService) shutdown() {
+	if len(ps.peers) == 0 {
+		return
+	}
+
+	ps.syncTask.Stop()
+	ps.remotingClient.Shutdown()
+	logger.Info("peer sync service shutdown.")
+}
+
+// snapshot 本namesrv的快照
+func (ps *peerSyncService) snapshot() *peerSyncBody {
+	return &peerSyncBody{
+		NameSrvAddr: ps.controller.addr(),
+		Brokers:     ps.controller.riManager.directBrokers(),
+		KVConfigs:   ps.controller.kvCfgManager.allEntries(),
+	}
+}
+
+// merge 合并其他namesrv同步的数据
+func (ps *peerSyncService) merge(data *peerSyncBody) {
+	if len(data.Brokers) > 0 {
+		ps.controller.riManager.mergePeerBrokers(data.Brokers)
+	}
+
+	if len(data.KVConfigs) > 0 {
+		ps.controller.kvCfgManager.mergeEntries(data.KVConfigs)
+	}
+}
+
+// syncSnapshot 与每个namesrv交换快照
+func (ps *peerSyncService) syncSnapshot() {
+	data := ps.snapshot()
+	for _, peer := range ps.peers {
+		response, err := ps.invoke(peer, SYNC_NAMESRV_SNAPSHOT, data)
+		if err != nil {
+			logger.Warnf("sync snapshot to namesrv %s err: %s.", peer, err)
+			continue
+		}
+
+		peerData := &peerSyncBody{}
+		if err := common.Decode(response.Body, peerData); err != nil {
+			logger.Warnf("decode snapshot of namesrv %s err: %s.", peer, err)
+			continue
+		}
+		ps.merge(peerData)
+	}
+}
+
+// replicate 异步复制kv配置变更，失败的由定期交换快照补齐
+func (ps *peerSyncService) replicate(entries []*kvConfigEntry) {
+	if len(ps.peers) == 0 || len(entries) == 0 {
+		return
+	}
+
+	data := &peerSyncBody{NameSrvAddr: ps.controller.addr(), KVConfigs: entries}
+	for _, peer := range ps.peers {
+		go func(peer string) {
+			if _, err := ps.invoke(peer, SYNC_NAMESRV_KV_CONFIG, data); err != nil {
+				logger.Warnf("replicate kv config to namesrv %s err: %s.", peer, err)
+			}
+		}(peer)
+	}
+}
+
+func (ps *peerSyncService) invoke(peer string, code int32, data *peerSyncBody) (*protocol.RemotingCommand, error) {
+	content, err := common.Encode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	request := protocol.CreateRequestCommand(code)
+	request.Body = content
+	response, err := ps.remotingClient.InvokeSync(peer, request, peerSyncTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if response == nil {
+		return nil, fmt.Errorf("response is nil")
+	}
+
+	if response.Code != protocol.SUCCESS {
+		return nil, fmt.Errorf("code: %d, remark: %s", response.Code, response.Remark)
+	}
+
+	return response, nil
+}
+
+// syncFromPeer 处理其他namesrv同步的数据，交换快照时返回本namesrv的快照
+func (processor *defaultRequestProcessor) syncFromPeer(ctx core.Context, request *protocol.RemotingCommand) (*protocol.RemotingCommand, error) {
+	response := protocol.CreateDefaultResponseCommand()
+	ps := processor.controller.peers
+
+	data := &peerSyncBody{}
+	if err := common.Decode(request.Body, data); err != nil {
+		logger.Errorf("sync from namesrv %s decode err: %s.", ctx.RemoteAddr(), err)
+		response.Code = protocol.SYSTEM_ERROR
+		response.Remark = err.Error()
+		return response, nil
+	}
+	ps.merge(data)
+
+	if request.Code == SYNC_NAMESRV_SNAPSHOT {
+		content, err := common.Encode(ps.snapshot())
+		if err != nil {
+			logger.Errorf("sync from namesrv %s encode snapshot err: %s.", ctx.RemoteAddr(), err)
+			response.Code = protocol.SYSTEM_ERROR
+			response.Remark = err.Error()
+			return response, nil
+		}
+		response.Body = content
+	}
+
+	response.Code = protocol.SUCCESS
+	response.Remark = ""
+	return response, nil
+}
@@ -89,6 +89,14 @@ func (processor *defaultRequestProcessor) ProcessRequest(ctx core.Context, reque
 		return processor.getHasUnitSubTopicList(ctx, request) // code=312, 获取含有单元化订阅组的 Topic 列表
 	case protocol.GET_HAS_UNIT_SUB_UNUNIT_TOPIC_LIST:
 		return processor.getHasUnitSubUnUnitTopicList(ctx, request) // code=313, 获取含有单元化订阅组的非单元化 Topic 列表
+	case SYNC_NAMESRV_SNAPSHOT:
+		return processor.syncFromPeer(ctx, request) // code=640, namesrv之间交换路由快照及kv配置
+	case SYNC_NAMESRV_KV_CONFIG:
+		return processor.syncFromPeer(ctx, request) // code=641, 其他namesrv复制的kv配置变更
+	case SUBSCRIBE_TOPIC_ROUTE:
+		return processor.subscribeTopicRoute(ctx, request) // code=642, 订阅topic路由变化
+	case UNSUBSCRIBE_TOPIC_ROUTE:
+		return processor.unsubscribeTopicRoute(ctx, request) // code=643, 取消订阅topic路由变化
 	default:
 		logger.Warn("invalid request. %s, %d.", ctx, request.Code)
 	}
@@ -41,7 +41,10 @@ type routeInfoManager struct {
 	clusterAddrTable  map[string]set.Set              // clusterName[set<brokerName>]
 	brokerLiveTable   map[string]*base.BrokerLiveInfo // brokerAddr[brokerLiveTable]
 	filterServerTable map[string][]string             // brokerAddr[FilterServer]
+	directBrokerTable map[string]*peerBrokerData      // brokerAddr[直接注册到本namesrv的broker]
+	provisionalTable  map[string]bool                 // brokerAddr[从快照加载、尚未重新注册的broker]
 	rwLock            sync.RWMutex                    // read & write lock
+	routeChanged      func()                          // 路由表可能变化后回调，不能阻塞
 }
 
 // newRouteInfoManager 初始化Topic路由管理器
@@ -52,6 +55,8 @@ func newRouteInfoManager() *routeInfoManager {
 		clusterAddrTable:  make(map[string]set.Set, 32),
 		brokerLiveTable:   make(map[string]*base.BrokerLiveInfo, 256),
 		filterServerTable: make(map[string][]string, 256),
+		directBrokerTable: make(map[string]*peerBrokerData, 256),
+		provisionalTable:  make(map[string]bool, 256),
 	}
 
 	return rim
@@ -79,6 +84,14 @@ func (rim *routeInfoManager) deleteTopic(topic string) {
 
 	delete(rim.topicQueueTable, topic)
 	logger.Info("delete topic[%s] from topicQueueTable.", topic)
+	rim.notifyRouteChanged()
+}
+
+// notifyRouteChanged 通知路由表可能发生变化
+func (rim *routeInfoManager) notifyRouteChanged() {
+	if rim.routeChanged != nil {
+		rim.routeChanged()
+	}
 }
 
 // getAllTopicList 获取所有Topic列表
@@ -126,11 +139,24 @@ func (rim *routeInfoManager) getAllTopicList() []byte {
 func (rim *routeInfoManager) registerBroker(clusterName, brokerAddr, brokerName string, brokerId int64,
 	haServerAddr string, topicConfigWrapper *base.TopicConfigSerializeWrapper,
 	filterServerList []string, ctx core.Context) *namesrv.RegisterBrokerResult {
-	result := &namesrv.RegisterBrokerResult{}
 	rim.rwLock.Lock()
 	defer rim.rwLock.Unlock()
+	defer rim.notifyRouteChanged()
+
+	return rim.doRegisterBroker(clusterName, brokerAddr, brokerName, brokerId, haServerAddr,
+		topicConfigWrapper, filterServerList, ctx)
+}
+
+// doRegisterBroker 注册Broker，调用方持有写锁。ctx为nil表示从其他namesrv同步的broker
+func (rim *routeInfoManager) doRegisterBroker(clusterName, brokerAddr, brokerName string, brokerId int64,
+	haServerAddr string, topicConfigWrapper *base.TopicConfigSerializeWrapper,
+	filterServerList []string, ctx core.Context) *namesrv.RegisterBrokerResult {
+	result := &namesrv.RegisterBrokerResult{}
 	logger.Info("register broker start.")
 
+	// 从快照加载的broker重新注册，以注册的数据为准
+	replaced := topicConfigWrapper != nil && rim.replaceProvisionalBroker(brokerAddr, brokerName, brokerId)
+
 	// 更新集群信息，维护rim.NamesrvController.routeInfoManager.clusterAddrTable变量
 	// (1)若Broker集群名字不在该Map变量中，则初始化一个Set集合,并将brokerName存入该Set集合中
 	// (2)然后以clusterName为key值，该Set集合为values值存入此routeInfoManager.clusterAddrTable变量中
@@ -154,6 +180,14 @@ func (rim *routeInfoManager) registerBroker(clusterName, brokerAddr, brokerName
 		rim.brokerAddrTable[brokerName] = brokerData
 	}
 
+	// 主备切换后同一地址以新的brokerId注册，删除该地址原来的brokerId
+	for id, addr := range brokerData.BrokerAddrs {
+		if addr == brokerAddr && id != int(brokerId) {
+			delete(brokerData.BrokerAddrs, id)
+			logger.Infof("broker %s change id from %d to %d, brokerName=%s.", brokerAddr, id, brokerId, brokerName)
+		}
+	}
+
 	oldAddr, ok := brokerData.BrokerAddrs[int(brokerId)]
 	registerFirst = registerFirst || ok || oldAddr == ""
 	brokerData.BrokerAddrs[int(brokerId)] = brokerAddr
@@ -162,7 +196,7 @@ func (rim *routeInfoManager) registerBroker(clusterName, brokerAddr, brokerName
 	// 更新Topic信息: 若Broker的注册请求消息中topic的配置不为空，并且该Broker是主(即brokerId=0)
 	if topicConfigWrapper != nil && brokerId == basis.MASTER_ID {
 		isChanged := rim.isBrokerTopicConfigChanged(brokerAddr, topicConfigWrapper.DataVersion)
-		if isChanged || registerFirst {
+		if isChanged || registerFirst || replaced {
 			// 更新Topic信息: 若Broker的注册请求消息中topic的配置不为空，并且该Broker是主(即brokerId=0)，则搜集topic关联的queueData信息
 			if tcTable := topicConfigWrapper.TpConfigTable; tcTable != nil && tcTable.TopicConfigs != nil {
 				tcTable.Foreach(func(topic string, topicConfig *base.TopicConfig) {
@@ -186,6 +220,19 @@ func (rim *routeInfoManager) registerBroker(clusterName, brokerAddr, brokerName
 		}
 		rim.brokerLiveTable[brokerAddr] = brokerLiveInfo
 		//rim.printbrokerLiveTable()
+
+		// 记录直接注册的broker，用于与其他namesrv交换路由
+		if ctx != nil {
+			rim.directBrokerTable[brokerAddr] = &peerBrokerData{
+				ClusterName:              clusterName,
+				BrokerAddr:               brokerAddr,
+				BrokerName:               brokerName,
+				BrokerId:                 brokerId,
+				HaServerAddr:             haServerAddr,
+				TpConfigSerializeWrapper: topicConfigWrapper,
+				FilterServerList:         filterServerList,
+			}
+		}
 	}
 
 	// 更新Filter Server列表: 对于filterServerList不为空的,以broker地址为key值存入
@@ -235,6 +282,7 @@ func (rim *routeInfoManager) wipeWritePermOfBrokerByLock(brokerName string) int
 	rim.rwLock.Lock()
 	wipeTopicCount = rim.wipeWritePermOfBroker(brokerName)
 	rim.rwLock.Unlock()
+	rim.notifyRouteChanged()
 	return wipeTopicCount
 }
 
@@ -332,6 +380,8 @@ func (rim *routeInfoManager) createAndUpdateQueueData(brokerName string, topicCo
 func (rim *routeInfoManager) unRegisterBroker(clusterName, brokerAddr, brokerName string, brokerId int64) {
 	rim.rwLock.Lock()
 
+	delete(rim.directBrokerTable, brokerAddr)
+	delete(rim.provisionalTable, brokerAddr)
 	result := "failed"
 	if _, ok := rim.brokerLiveTable[brokerAddr]; ok {
 		delete(rim.brokerLiveTable, brokerAddr)
@@ -391,6 +441,7 @@ func (rim *routeInfoManager) unRegisterBroker(clusterName, brokerAddr, brokerNam
 		rim.removeTopicByBrokerName(brokerName)
 	}
 	rim.rwLock.Unlock()
+	rim.notifyRouteChanged()
 
 	logger.Warn("execute unRegisterBroker() and print add periodically.")
 	rim.printAllPeriodically()
@@ -500,8 +551,10 @@ func (rim *routeInfoManager) scanNotActiveBroker() {
 		currentTime := system.CurrentTimeMillis()
 
 		if lastTimestamp < currentTime {
-			// 主动关闭Channel通道，关闭后打印日志
-			brokerLiveInfo.Ctx.Close()
+			// 主动关闭Channel通道，关闭后打印日志，从其他namesrv同步的broker没有Channel
+			if brokerLiveInfo.Ctx != nil {
+				brokerLiveInfo.Ctx.Close()
+			}
 
 			// 删除无效Broker列表
 			rim.rwLock.RLock()
@@ -533,7 +586,7 @@ func (rim *routeInfoManager) onChannelDestroy(remoteAddr string, ctx core.Contex
 	if ctx != nil {
 		rim.rwLock.RLock()
 		for key, brokerLive := range rim.brokerLiveTable {
-			if brokerLive != nil && brokerLive.Ctx.RemoteAddr() == ctx.RemoteAddr() {
+			if brokerLive != nil && brokerLive.Ctx != nil && brokerLive.Ctx.RemoteAddr() == ctx.RemoteAddr() {
 				brokerAddrFound = key
 				queryBroker = true
 			}
@@ -552,6 +605,8 @@ func (rim *routeInfoManager) onChannelDestroy(remoteAddr string, ctx core.Contex
 		rim.rwLock.Lock()
 		// 1 清理brokerLiveTable
 		delete(rim.brokerLiveTable, brokerAddrFound)
+		delete(rim.directBrokerTable, brokerAddrFound)
+		delete(rim.provisionalTable, brokerAddrFound)
 
 		// 2 清理FilterServer
 		delete(rim.filterServerTable, brokerAddrFound)
@@ -612,7 +667,7 @@ func (rim *routeInfoManager) onChannelDestroy(remoteAddr string, ctx core.Contex
 			for topic, queueDataList := range rim.topicQueueTable {
 				if queueDataList != nil {
 					for index, queueData := range queueDataList {
-						if queueData.BrokerName == brokerAddrFound {
+						if queueData.BrokerName == brokerNameFound {
 							// 从queueDataList切片中删除索引为index的数据
 							queueDataList = append(queueDataList[:index], queueDataList[index+1:]...)
 							rim.topicQueueTable[topic] = queueDataList // 使用append()操作后，queueDataList切片地址已改变，因此需要再次设置rim.topicQueueTable的数据
@@ -628,12 +683,62 @@ func (rim *routeInfoManager) onChannelDestroy(remoteAddr string, ctx core.Contex
 			}
 		}
 		rim.rwLock.Unlock()
+		rim.notifyRouteChanged()
 	}
 
 	logger.Warn("execute onChannelDestroy() and print add periodically.")
 	rim.printAllPeriodically()
 }
 
+// directBrokers 直接注册到本namesrv的broker及最后心跳时间
+func (rim *routeInfoManager) directBrokers() []*peerBrokerData {
+	rim.rwLock.RLock()
+	defer rim.rwLock.RUnlock()
+
+	brokers := make([]*peerBrokerData, 0, len(rim.directBrokerTable))
+	for brokerAddr, broker := range rim.directBrokerTable {
+		brokerLiveInfo, ok := rim.brokerLiveTable[brokerAddr]
+		if !ok {
+			continue
+		}
+
+		copied := *broker
+		copied.LastUpdateTimestamp = brokerLiveInfo.LastUpdateTimestamp
+		brokers = append(brokers, &copied)
+	}
+
+	return brokers
+}
+
+// mergePeerBrokers 注册其他namesrv同步的broker，直接注册的broker以本地为准。
+// 同步的broker按对方的心跳时间过期，对方不再同步后由scanNotActiveBroker清除
+func (rim *routeInfoManager) mergePeerBrokers(brokers []*peerBrokerData) {
+	now := system.CurrentTimeMillis()
+	rim.rwLock.Lock()
+	defer rim.rwLock.Unlock()
+	defer rim.notifyRouteChanged()
+
+	for _, broker := range brokers {
+		if broker == nil || broker.TpConfigSerializeWrapper == nil {
+			continue
+		}
+
+		if _, ok := rim.directBrokerTable[broker.BrokerAddr]; ok {
+			continue
+		}
+
+		if broker.LastUpdateTimestamp+brokerChannelExpiredTime < now {
+			continue
+		}
+
+		rim.doRegisterBroker(broker.ClusterName, broker.BrokerAddr, broker.BrokerName, broker.BrokerId,
+			broker.HaServerAddr, broker.TpConfigSerializeWrapper, broker.FilterServerList, nil)
+		if brokerLiveInfo, ok := rim.brokerLiveTable[broker.BrokerAddr]; ok && broker.LastUpdateTimestamp < now {
+			brokerLiveInfo.LastUpdateTimestamp = broker.LastUpdateTimestamp
+		}
+	}
+}
+
 // printAllPeriodically 定期打印当前类的数据结构(常用于业务调试)
 // Author: tianyuliang
 // Since: 2017/9/6
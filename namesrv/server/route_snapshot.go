@@ -0,0 +1,165 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"strings"
+
+	"github.com/boltmq/boltmq/common"
+	"github.com/boltmq/common/basis"
+	"github.com/boltmq/common/logger"
+	"github.com/boltmq/common/protocol/base"
+	"github.com/boltmq/common/utils/system"
+	set "github.com/deckarep/golang-set"
+)
+
+// routeSnapshot 持久化的路由表，namesrv重启后加载，在broker重新注册之前应答路由查询
+type routeSnapshot struct {
+	TopicQueueTable   map[string][]*base.QueueData `json:"topicQueueTable"`   // topic[list<QueueData>]
+	BrokerAddrTable   map[string]*base.BrokerData  `json:"brokerAddrTable"`   // brokerName[BrokerData]
+	ClusterAddrTable  map[string][]string          `json:"clusterAddrTable"`  // clusterName[list<brokerName>]
+	FilterServerTable map[string][]string          `json:"filterServerTable"` // brokerAddr[FilterServer]
+	HaServerTable     map[string]string            `json:"haServerTable"`     // brokerAddr[HaServerAddr]
+	Timestamp         int64                        `json:"timestamp"`         // 快照时间
+}
+
+// persistSnapshot 将路由表持久化到文件
+func (rim *routeInfoManager) persistSnapshot(path string) {
+	if path == "" {
+		return
+	}
+
+	rim.rwLock.RLock()
+	snapshot := &routeSnapshot{
+		TopicQueueTable:   rim.topicQueueTable,
+		BrokerAddrTable:   rim.brokerAddrTable,
+		ClusterAddrTable:  make(map[string][]string, len(rim.clusterAddrTable)),
+		FilterServerTable: rim.filterServerTable,
+		HaServerTable:     make(map[string]string, len(rim.brokerLiveTable)),
+		Timestamp:         system.CurrentTimeMillis(),
+	}
+	for clusterName, brokerNames := range rim.clusterAddrTable {
+		if brokerNames == nil {
+			continue
+		}
+		for brokerName := range brokerNames.Iterator().C {
+			snapshot.ClusterAddrTable[clusterName] = append(snapshot.ClusterAddrTable[clusterName], brokerName.(string))
+		}
+	}
+	for brokerAddr, brokerLiveInfo := range rim.brokerLiveTable {
+		if brokerLiveInfo != nil && brokerLiveInfo.HaServerAddr != "" {
+			snapshot.HaServerTable[brokerAddr] = brokerLiveInfo.HaServerAddr
+		}
+	}
+	// 编码时持有读锁，避免与路由表的修改并发
+	content, err := common.Encode(snapshot)
+	rim.rwLock.RUnlock()
+
+	if err != nil {
+		logger.Errorf("route snapshot encode err: %s.", err)
+		return
+	}
+
+	if err := common.String2File(content, path); err != nil {
+		logger.Errorf("persist route snapshot %s err: %s.", path, err)
+	}
+}
+
+// loadSnapshot 加载持久化的路由表。加载的broker标记为临时的，ttl毫秒内没有重新注册则被scanNotActiveBroker清除，
+// 重新注册时以注册的数据为准。快照不存在或无法解析时以空路由表启动
+func (rim *routeInfoManager) loadSnapshot(path string, ttl int64) {
+	if path == "" {
+		return
+	}
+
+	ok, err := common.PathExists(path)
+	if err != nil || !ok {
+		return
+	}
+
+	content, err := common.File2String(path)
+	if err != nil {
+		logger.Warnf("read route snapshot %s err: %s.", path, err)
+		return
+	}
+	if strings.TrimSpace(content) == "" {
+		return
+	}
+
+	snapshot := &routeSnapshot{}
+	if err := common.Decode([]byte(content), snapshot); err != nil {
+		logger.Warnf("route snapshot %s decode err: %s.", path, err)
+		return
+	}
+
+	rim.rwLock.Lock()
+	defer rim.rwLock.Unlock()
+
+	for topic, queueDatas := range snapshot.TopicQueueTable {
+		if len(queueDatas) > 0 {
+			rim.topicQueueTable[topic] = queueDatas
+		}
+	}
+
+	for clusterName, brokerNames := range snapshot.ClusterAddrTable {
+		brokerNameSet, ok := rim.clusterAddrTable[clusterName]
+		if !ok || brokerNameSet == nil {
+			brokerNameSet = set.NewSet()
+			rim.clusterAddrTable[clusterName] = brokerNameSet
+		}
+		for _, brokerName := range brokerNames {
+			brokerNameSet.Add(brokerName)
+		}
+	}
+
+	for brokerAddr, filterServerList := range snapshot.FilterServerTable {
+		if len(filterServerList) > 0 {
+			rim.filterServerTable[brokerAddr] = filterServerList
+		}
+	}
+
+	// 临时broker的心跳时间使其在ttl毫秒后过期
+	lastUpdateTimestamp := system.CurrentTimeMillis() + ttl - brokerChannelExpiredTime
+	for brokerName, brokerData := range snapshot.BrokerAddrTable {
+		if brokerData == nil || len(brokerData.BrokerAddrs) == 0 {
+			continue
+		}
+		rim.brokerAddrTable[brokerName] = brokerData
+
+		for _, brokerAddr := range brokerData.BrokerAddrs {
+			brokerLiveInfo := base.NewBrokerLiveInfo(basis.NewDataVersion(0), snapshot.HaServerTable[brokerAddr], nil)
+			brokerLiveInfo.LastUpdateTimestamp = lastUpdateTimestamp
+			rim.brokerLiveTable[brokerAddr] = brokerLiveInfo
+			rim.provisionalTable[brokerAddr] = true
+		}
+	}
+
+	logger.Infof("load route snapshot %s success, topics: %d, brokers: %d, snapshot time: %d.",
+		path, len(rim.topicQueueTable), len(rim.provisionalTable), snapshot.Timestamp)
+}
+
+// replaceProvisionalBroker 快照加载的broker重新注册时删除它的临时路由，调用方持有写锁。
+// 返回true表示该broker是临时的，需要以注册的topic配置重建路由
+func (rim *routeInfoManager) replaceProvisionalBroker(brokerAddr, brokerName string, brokerId int64) bool {
+	if !rim.provisionalTable[brokerAddr] {
+		return false
+	}
+
+	delete(rim.provisionalTable, brokerAddr)
+	if brokerId == basis.MASTER_ID {
+		rim.removeTopicByBrokerName(brokerName)
+	}
+	logger.Infof("provisional broker %s re-registered, brokerName=%s.", brokerAddr, brokerName)
+	return true
+}
@@ -0,0 +1,278 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/boltmq/common/logger"
+	"github.com/boltmq/common/net/core"
+	"github.com/boltmq/common/protocol"
+	"github.com/boltmq/common/protocol/base"
+	"github.com/boltmq/common/protocol/namesrv"
+)
+
+const (
+	SUBSCRIBE_TOPIC_ROUTE      = 642 // 订阅topic路由变化
+	UNSUBSCRIBE_TOPIC_ROUTE    = 643 // 取消订阅topic路由变化
+	NOTIFY_TOPIC_ROUTE_CHANGED = 644 // namesrv通知客户端topic路由变化，oneway
+)
+
+// topicRouteSubscribeRequestHeader 订阅、取消订阅topic路由请求头
+type topicRouteSubscribeRequestHeader struct {
+	Topics string `json:"topics"` // 订阅的topic，多个以,分隔
+}
+
+func (header *topicRouteSubscribeRequestHeader) CheckFields() error {
+	if len(header.topics()) == 0 {
+		return fmt.Errorf("topics is empty")
+	}
+
+	return nil
+}
+
+func (header *topicRouteSubscribeRequestHeader) topics() []string {
+	var topics []string
+	for _, topic := range strings.Split(header.Topics, ",") {
+		if topic = strings.TrimSpace(topic); topic != "" {
+			topics = append(topics, topic)
+		}
+	}
+
+	return topics
+}
+
+// notifyTopicRouteChangedRequestHeader 通知topic路由变化请求头，新的路由在请求体中，请求体为空表示topic已没有路由
+type notifyTopicRouteChangedRequestHeader struct {
+	Topic string `json:"topic"`
+}
+
+func (header *notifyTopicRouteChangedRequestHeader) CheckFields() error {
+	return nil
+}
+
+// routeSubscriptionManager 管理订阅topic路由的连接。路由表变化后异步比较订阅topic的路由，
+// 与上次通知的不同时推送给订阅的连接，连续的变化合并为一次比较
+type routeSubscriptionManager struct {
+	controller  *NameSrvController
+	subscribers map[string]map[string]core.Context // topic[remoteAddr[ctx]]
+	channels    map[string]map[string]bool         // remoteAddr[topic]
+	routes      map[string][]byte                  // topic[上次通知的路由]
+	rwLock      sync.RWMutex
+	changedChan chan struct{}
+	closeChan   chan struct{}
+}
+
+func newRouteSubscriptionManager(controller *NameSrvController) *routeSubscriptionManager {
+	return &routeSubscriptionManager{
+		controller:  controller,
+		subscribers: make(map[string]map[string]core.Context),
+		channels:    make(map[string]map[string]bool),
+		routes:      make(map[string][]byte),
+		changedChan: make(chan struct{}, 1),
+		closeChan:   make(chan struct{}),
+	}
+}
+
+func (rsm *routeSubscriptionManager) start() {
+	go func() {
+		for {
+			select {
+			case <-rsm.changedChan:
+				rsm.notifyChangedRoutes()
+			case <-rsm.closeChan:
+				return
+			}
+		}
+	}()
+}
+
+func (rsm *routeSubscriptionManager) shutdown() {
+	close(rsm.closeChan)
+}
+
+// routeChanged 路由表发生变化，不阻塞调用方
+func (rsm *routeSubscriptionManager) routeChanged() {
+	select {
+	case rsm.changedChan <- struct{}{}:
+	default:
+	}
+}
+
+// subscribe 订阅topic路由变化
+func (rsm *routeSubscriptionManager) subscribe(ctx core.Context, topics []string) {
+	remoteAddr := ctx.RemoteAddr().String()
+	rsm.rwLock.Lock()
+	defer rsm.rwLock.Unlock()
+
+	for _, topic := range topics {
+		ctxs, ok := rsm.subscribers[topic]
+		if !ok {
+			ctxs = make(map[string]core.Context)
+			rsm.subscribers[topic] = ctxs
+			rsm.routes[topic] = rsm.routeSignature(topic)
+		}
+		ctxs[remoteAddr] = ctx
+
+		channelTopics, ok := rsm.channels[remoteAddr]
+		if !ok {
+			channelTopics = make(map[string]bool)
+			rsm.channels[remoteAddr] = channelTopics
+		}
+		channelTopics[topic] = true
+	}
+
+	logger.Infof("subscribe topic route, client: %s, topics: %s.", remoteAddr, strings.Join(topics, ","))
+}
+
+// unsubscribe 取消订阅topic路由
+func (rsm *routeSubscriptionManager) unsubscribe(remoteAddr string, topics []string) {
+	rsm.rwLock.Lock()
+	defer rsm.rwLock.Unlock()
+
+	for _, topic := range topics {
+		rsm.removeSubscriber(topic, remoteAddr)
+	}
+
+	logger.Infof("unsubscribe topic route, client: %s, topics: %s.", remoteAddr, strings.Join(topics, ","))
+}
+
+// removeChannel 连接关闭后删除它的全部订阅
+func (rsm *routeSubscriptionManager) removeChannel(remoteAddr string) {
+	rsm.rwLock.Lock()
+	defer rsm.rwLock.Unlock()
+
+	channelTopics, ok := rsm.channels[remoteAddr]
+	if !ok {
+		return
+	}
+
+	for topic := range channelTopics {
+		rsm.removeSubscriber(topic, remoteAddr)
+	}
+	logger.Infof("remove topic route subscriptions of client %s.", remoteAddr)
+}
+
+// removeSubscriber 调用方持有写锁
+func (rsm *routeSubscriptionManager) removeSubscriber(topic, remoteAddr string) {
+	if ctxs, ok := rsm.subscribers[topic]; ok {
+		delete(ctxs, remoteAddr)
+		if len(ctxs) == 0 {
+			delete(rsm.subscribers, topic)
+			delete(rsm.routes, topic)
+		}
+	}
+
+	if channelTopics, ok := rsm.channels[remoteAddr]; ok {
+		delete(channelTopics, topic)
+		if len(channelTopics) == 0 {
+			delete(rsm.channels, remoteAddr)
+		}
+	}
+}
+
+// notifyChangedRoutes 比较订阅topic的路由，推送发生变化的路由
+func (rsm *routeSubscriptionManager) notifyChangedRoutes() {
+	type notification struct {
+		topic string
+		route []byte
+		ctxs  []core.Context
+	}
+
+	var notifications []*notification
+	rsm.rwLock.Lock()
+	for topic, ctxs := range rsm.subscribers {
+		signature := rsm.routeSignature(topic)
+		if bytes.Equal(signature, rsm.routes[topic]) {
+			continue
+		}
+		rsm.routes[topic] = signature
+
+		n := &notification{topic: topic, route: signature}
+		for _, ctx := range ctxs {
+			n.ctxs = append(n.ctxs, ctx)
+		}
+		notifications = append(notifications, n)
+	}
+	rsm.rwLock.Unlock()
+
+	for _, n := range notifications {
+		logger.Infof("topic %s route changed, notify %d clients.", n.topic, len(n.ctxs))
+		for _, ctx := range n.ctxs {
+			request := protocol.CreateRequestCommand(NOTIFY_TOPIC_ROUTE_CHANGED, &notifyTopicRouteChangedRequestHeader{Topic: n.topic})
+			request.Body = n.route
+			request.MarkOnewayRPC()
+			rsm.controller.remotingServer.InvokeOneway(ctx, request, 1000)
+		}
+	}
+}
+
+// routeSignature topic当前的路由，broker按名称排序使相同的路由编码一致，没有路由时返回nil
+func (rsm *routeSubscriptionManager) routeSignature(topic string) []byte {
+	route := rsm.controller.riManager.pickupTopicRouteData(topic)
+	if route == nil {
+		return nil
+	}
+
+	queueDatas := make([]*base.QueueData, len(route.QueueDatas))
+	copy(queueDatas, route.QueueDatas)
+	sort.Slice(queueDatas, func(i, j int) bool { return queueDatas[i].BrokerName < queueDatas[j].BrokerName })
+	route.QueueDatas = queueDatas
+	sort.Slice(route.BrokerDatas, func(i, j int) bool { return route.BrokerDatas[i].BrokerName < route.BrokerDatas[j].BrokerName })
+	route.OrderTopicConf = rsm.controller.kvCfgManager.getKVConfig(namesrv.NAMESPACE_ORDER_TOPIC_CONFIG, topic)
+
+	content, err := route.Encode()
+	if err != nil {
+		logger.Errorf("encode topic %s route err: %s.", topic, err)
+		return nil
+	}
+
+	return content
+}
+
+// subscribeTopicRoute 订阅topic路由变化，路由变化后namesrv主动通知
+func (processor *defaultRequestProcessor) subscribeTopicRoute(ctx core.Context, request *protocol.RemotingCommand) (*protocol.RemotingCommand, error) {
+	response := protocol.CreateDefaultResponseCommand()
+	requestHeader := &topicRouteSubscribeRequestHeader{}
+	err := request.DecodeCommandCustomHeader(requestHeader)
+	if err != nil {
+		logger.Errorf("subscribe topic route err: %s.", err)
+		return response, err
+	}
+
+	processor.controller.routeSubscriptions.subscribe(ctx, requestHeader.topics())
+	response.Code = protocol.SUCCESS
+	response.Remark = ""
+	return response, nil
+}
+
+// unsubscribeTopicRoute 取消订阅topic路由变化
+func (processor *defaultRequestProcessor) unsubscribeTopicRoute(ctx core.Context, request *protocol.RemotingCommand) (*protocol.RemotingCommand, error) {
+	response := protocol.CreateDefaultResponseCommand()
+	requestHeader := &topicRouteSubscribeRequestHeader{}
+	err := request.DecodeCommandCustomHeader(requestHeader)
+	if err != nil {
+		logger.Errorf("unsubscribe topic route err: %s.", err)
+		return response, err
+	}
+
+	processor.controller.routeSubscriptions.unsubscribe(ctx.RemoteAddr().String(), requestHeader.topics())
+	response.Code = protocol.SUCCESS
+	response.Remark = ""
+	return response, nil
+}
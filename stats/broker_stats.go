@@ -36,10 +36,12 @@ type BrokerStats interface {
 	Shutdown()
 	GetStatsItem(statsName, statsKey string) *StatsItem
 	IncTopicPutNums(topic string)
+	IncTopicBatchPutNums(topic string, incValue int)
 	IncTopicPutSize(topic string, size int64)
 	IncGroupGetNums(group, topic string, incValue int)
 	IncGroupGetSize(group, topic string, incValue int)
 	IncBrokerPutNums()
+	IncBrokerBatchPutNums(incValue int)
 	IncBrokerGetNums(incValue int)
 	IncSendBackNums(group, topic string)
 	TpsGroupGetNums(group, topic string) float64
@@ -125,6 +127,11 @@ func (bss *brokerStatsService) IncTopicPutNums(topic string) {
 	bss.statsTable[TOPIC_PUT_NUMS].AddValue(topic, 1, 1)
 }
 
+// IncTopicBatchPutNums  Topic批量Put消息个数加incValue
+func (bss *brokerStatsService) IncTopicBatchPutNums(topic string, incValue int) {
+	bss.statsTable[TOPIC_PUT_NUMS].AddValue(topic, int64(incValue), 1)
+}
+
 // IncTopicPutSize  Topic Put流量增加size
 // Author rongzhihong
 // Since 2017/9/17
@@ -154,6 +161,12 @@ func (bss *brokerStatsService) IncBrokerPutNums() {
 	atomic.AddInt64(&(statsItem.ValueCounter), 1)
 }
 
+// IncBrokerBatchPutNums  broker批量Put消息个数加incValue
+func (bss *brokerStatsService) IncBrokerBatchPutNums(incValue int) {
+	statsItem := bss.statsTable[BROKER_PUT_NUMS].GetAndCreateStatsItem(bss.clusterName)
+	atomic.AddInt64(&(statsItem.ValueCounter), int64(incValue))
+}
+
 // IncBrokerGetNums  broker Get消息个数加incValue
 // Author rongzhihong
 // Since 2017/9/17
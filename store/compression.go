@@ -0,0 +1,227 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package store
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/boltmq/common/message"
+	"github.com/boltmq/common/utils/codec"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressionType 消息体压缩算法
+type CompressionType int32
+
+const (
+	COMPRESSION_NONE CompressionType = iota
+	COMPRESSION_ZLIB
+	COMPRESSION_SNAPPY
+	COMPRESSION_ZSTD
+)
+
+const (
+	CompressedFlag       = 0x1 // 消息体已压缩，与sysflag中的压缩标识一致
+	compressionTypeShift = 8
+	compressionTypeMask  = 0x7 << compressionTypeShift // sysflag中记录压缩算法的位，为0时按zlib解压以兼容客户端压缩的消息
+
+	sysFlagPos  = 4 + 4 + 4 + 4 + 4 + 8 + 8              // 存储格式中SYSFLAG的位置
+	bodyCRCPos  = 4 + 4                                  // 存储格式中BODYCRC的位置
+	bodyLenPos  = sysFlagPos + 4 + 8 + 8 + 8 + 8 + 4 + 8 // 存储格式中BODY长度的位置
+	msgMinBytes = bodyLenPos + 4 + 1 + 2                 // 消息体、topic、properties均为空时的消息长度
+)
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// ParseCompressionType 根据名称解析压缩算法，名称为空时不压缩
+func ParseCompressionType(name string) (CompressionType, error) {
+	switch strings.ToLower(name) {
+	case "", "none":
+		return COMPRESSION_NONE, nil
+	case "zlib":
+		return COMPRESSION_ZLIB, nil
+	case "snappy":
+		return COMPRESSION_SNAPPY, nil
+	case "zstd":
+		return COMPRESSION_ZSTD, nil
+	}
+
+	return COMPRESSION_NONE, fmt.Errorf("unknown compression type %s", name)
+}
+
+func (ct CompressionType) String() string {
+	switch ct {
+	case COMPRESSION_NONE:
+		return "none"
+	case COMPRESSION_ZLIB:
+		return "zlib"
+	case COMPRESSION_SNAPPY:
+		return "snappy"
+	case COMPRESSION_ZSTD:
+		return "zstd"
+	}
+
+	return "unknown"
+}
+
+// CompressBody 按指定算法压缩消息体
+func CompressBody(body []byte, ct CompressionType) ([]byte, error) {
+	switch ct {
+	case COMPRESSION_NONE:
+		return body, nil
+	case COMPRESSION_ZLIB:
+		var buf bytes.Buffer
+		w := zlib.NewWriter(&buf)
+		if _, err := w.Write(body); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case COMPRESSION_SNAPPY:
+		return snappy.Encode(nil, body), nil
+	case COMPRESSION_ZSTD:
+		return zstdEncoder.EncodeAll(body, nil), nil
+	}
+
+	return nil, fmt.Errorf("unknown compression type %d", ct)
+}
+
+// DecompressBody 根据sysFlag中记录的压缩算法解压消息体，未压缩时原样返回
+func DecompressBody(body []byte, sysFlag int32) ([]byte, error) {
+	switch GetCompressionType(sysFlag) {
+	case COMPRESSION_NONE:
+		return body, nil
+	case COMPRESSION_ZLIB:
+		r, err := zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	case COMPRESSION_SNAPPY:
+		return snappy.Decode(nil, body)
+	case COMPRESSION_ZSTD:
+		return zstdDecoder.DecodeAll(body, nil)
+	}
+
+	return nil, fmt.Errorf("unknown compression sysflag %d", sysFlag)
+}
+
+// BuildCompressionSysFlag 在sysFlag中记录压缩标识及压缩算法
+func BuildCompressionSysFlag(sysFlag int32, ct CompressionType) int32 {
+	sysFlag = ClearCompressionSysFlag(sysFlag)
+	if ct == COMPRESSION_NONE {
+		return sysFlag
+	}
+
+	return sysFlag | CompressedFlag | (int32(ct) << compressionTypeShift)
+}
+
+// GetCompressionType 获取sysFlag中记录的压缩算法
+func GetCompressionType(sysFlag int32) CompressionType {
+	if sysFlag&CompressedFlag == 0 {
+		return COMPRESSION_NONE
+	}
+
+	ct := CompressionType((sysFlag & compressionTypeMask) >> compressionTypeShift)
+	if ct == COMPRESSION_NONE {
+		return COMPRESSION_ZLIB
+	}
+	return ct
+}
+
+// ClearCompressionSysFlag 清除sysFlag中的压缩标识及压缩算法
+func ClearCompressionSysFlag(sysFlag int32) int32 {
+	return sysFlag &^ (CompressedFlag | compressionTypeMask)
+}
+
+// DecompressMessageExt 解压消息体并清除压缩标识，用于管理工具查看消息
+func DecompressMessageExt(msgExt *message.MessageExt) error {
+	if GetCompressionType(msgExt.SysFlag) == COMPRESSION_NONE {
+		return nil
+	}
+
+	body, err := DecompressBody(msgExt.Body, msgExt.SysFlag)
+	if err != nil {
+		return err
+	}
+
+	msgExt.Body = body
+	msgExt.SysFlag = ClearCompressionSysFlag(msgExt.SysFlag)
+	return nil
+}
+
+// DecompressForLegacyClient 将snappy/zstd压缩的消息解压为未压缩的存储格式。旧版本客户端只识别压缩标识并按zlib解压，
+// zlib压缩及未压缩的消息原样返回
+func DecompressForLegacyClient(data []byte) ([]byte, error) {
+	if len(data) < msgMinBytes {
+		return data, nil
+	}
+
+	switch GetCompressionType(int32(binary.BigEndian.Uint32(data[sysFlagPos:]))) {
+	case COMPRESSION_NONE, COMPRESSION_ZLIB:
+		return data, nil
+	}
+
+	return DecompressMessageData(data)
+}
+
+// DecompressMessageData 将commitlog存储格式的消息解压为未压缩的存储格式，
+// 同时修正TOTALSIZE、BODYCRC及SYSFLAG，未压缩的消息原样返回
+func DecompressMessageData(data []byte) ([]byte, error) {
+	if len(data) < msgMinBytes {
+		return data, nil
+	}
+
+	sysFlag := int32(binary.BigEndian.Uint32(data[sysFlagPos:]))
+	if GetCompressionType(sysFlag) == COMPRESSION_NONE {
+		return data, nil
+	}
+
+	bodyLen := int(int32(binary.BigEndian.Uint32(data[bodyLenPos:])))
+	bodyPos := bodyLenPos + 4
+	if bodyLen < 0 || bodyPos+bodyLen > len(data) {
+		return nil, fmt.Errorf("message body length %d is invalid", bodyLen)
+	}
+
+	body, err := DecompressBody(data[bodyPos:bodyPos+bodyLen], sysFlag)
+	if err != nil {
+		return nil, err
+	}
+
+	tail := data[bodyPos+bodyLen:]
+	result := make([]byte, 0, bodyPos+len(body)+len(tail))
+	result = append(result, data[:bodyLenPos]...)
+	result = append(result, make([]byte, 4)...)
+	result = append(result, body...)
+	result = append(result, tail...)
+
+	bodyCRC, _ := codec.Crc32(body)
+	binary.BigEndian.PutUint32(result, uint32(len(result)))
+	binary.BigEndian.PutUint32(result[bodyCRCPos:], uint32(bodyCRC))
+	binary.BigEndian.PutUint32(result[sysFlagPos:], uint32(ClearCompressionSysFlag(sysFlag)))
+	binary.BigEndian.PutUint32(result[bodyLenPos:], uint32(len(body)))
+	return result, nil
+}
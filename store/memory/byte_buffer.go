@@ -0,0 +1,116 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package memory
+
+import (
+	"github.com/boltmq/boltmq/store"
+	"github.com/boltmq/common/utils/convert"
+)
+
+// byteBuffer 基于内存切片的ByteBuffer实现
+type byteBuffer struct {
+	buf     []byte
+	readPos int // read at &buf[readPos]
+}
+
+func newByteBuffer(buf []byte) *byteBuffer {
+	// 限制容量，避免Write时覆盖共享的底层数组
+	return &byteBuffer{buf: buf[:len(buf):len(buf)]}
+}
+
+func (bb *byteBuffer) Bytes() []byte {
+	return bb.buf
+}
+
+func (bb *byteBuffer) Write(data []byte) (n int, err error) {
+	bb.buf = append(bb.buf, data...)
+	return len(data), nil
+}
+
+func (bb *byteBuffer) WriteInt8(i int8) (err error) {
+	_, err = bb.Write(convert.Int8ToBytes(i))
+	return
+}
+
+func (bb *byteBuffer) WriteInt16(i int16) (err error) {
+	_, err = bb.Write(convert.Int16ToBytes(i))
+	return
+}
+
+func (bb *byteBuffer) WriteInt32(i int32) (err error) {
+	_, err = bb.Write(convert.Int32ToBytes(i))
+	return
+}
+
+func (bb *byteBuffer) WriteInt64(i int64) (err error) {
+	_, err = bb.Write(convert.Int64ToBytes(i))
+	return
+}
+
+func (bb *byteBuffer) Read(data []byte) (n int, err error) {
+	n = copy(data, bb.buf[bb.readPos:])
+	bb.readPos += n
+	return
+}
+
+func (bb *byteBuffer) ReadInt8() int8 {
+	int8bytes := make([]byte, 1)
+	bb.Read(int8bytes)
+	return convert.BytesToInt8(int8bytes)
+}
+
+func (bb *byteBuffer) ReadInt16() int16 {
+	int16bytes := make([]byte, 2)
+	bb.Read(int16bytes)
+	return convert.BytesToInt16(int16bytes)
+}
+
+func (bb *byteBuffer) ReadInt32() int32 {
+	int32bytes := make([]byte, 4)
+	bb.Read(int32bytes)
+	return convert.BytesToInt32(int32bytes)
+}
+
+func (bb *byteBuffer) ReadInt64() int64 {
+	int64bytes := make([]byte, 8)
+	bb.Read(int64bytes)
+	return convert.BytesToInt64(int64bytes)
+}
+
+// bufferResult 查询内存消息返回结果
+type bufferResult struct {
+	byteBuffer  *byteBuffer
+	startOffset int64
+	size        int32
+}
+
+func newBufferResult(startOffset int64, data []byte) *bufferResult {
+	return &bufferResult{
+		byteBuffer:  newByteBuffer(data),
+		startOffset: startOffset,
+		size:        int32(len(data)),
+	}
+}
+
+// Release 内存数据由GC回收，无需释放
+func (br *bufferResult) Release() {
+}
+
+func (br *bufferResult) Buffer() store.ByteBuffer {
+	return br.byteBuffer
+}
+
+func (br *bufferResult) Size() int {
+	return int(br.size)
+}
@@ -0,0 +1,252 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package memory
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/boltmq/boltmq/store"
+	"github.com/boltmq/common/logger"
+	"github.com/boltmq/common/message"
+	"github.com/boltmq/common/sysflag"
+)
+
+const (
+	// 与persistent的消息格式保持一致，客户端可以按同样的方式解码
+	MessageMagicCode = 0xAABBCCDD ^ 1880681586 + 8
+	// 消息固定部分长度：TOTALSIZE ~ PREPARED_TRANSACTION_OFFSET，以及BODY/TOPIC/PROPERTIES的长度字段
+	msgFixedLength = 4 + 4 + 4 + 4 + 4 + 8 + 8 + 4 + 8 + 8 + 8 + 8 + 4 + 8 + 4 + 1 + 2
+)
+
+// logEntry 内存中的一条物理消息
+type logEntry struct {
+	phyOffset      int64
+	topic          string
+	queueId        int32
+	queueOffset    int64
+	keys           []string
+	storeTimestamp int64
+	data           []byte
+	queued         bool // 是否占用逻辑队列位置，事务Prepared/Rollback消息不占用
+}
+
+// commitLog 内存物理队列，消息按写入顺序连续编址
+type commitLog struct {
+	entries         []*logEntry
+	minOffset       int64
+	maxOffset       int64
+	totalSize       int64
+	maxMessageSize  int32
+	topicQueueTable map[string]int64
+	mutex           sync.RWMutex
+}
+
+func newCommitLog(maxMessageSize int32) *commitLog {
+	clog := &commitLog{}
+	clog.maxMessageSize = maxMessageSize
+	clog.topicQueueTable = make(map[string]int64, 1024)
+	return clog
+}
+
+// appendMessage 序列化消息并追加到内存队列，调用方需持有写锁
+func (clog *commitLog) appendMessage(msg *store.MessageExtInner) (*store.AppendMessageResult, *logEntry) {
+	wroteOffset := clog.maxOffset
+	msgId, err := message.CreateMessageId(msg.StoreHost, wroteOffset)
+	if err != nil {
+		logger.Warnf("memory commitlog create message id err: %s.", err)
+	}
+
+	key := msg.Topic + "-" + strconv.Itoa(int(msg.QueueId))
+	queueOffset := clog.topicQueueTable[key]
+
+	propertiesData := []byte(msg.PropertiesString)
+	topicData := []byte(msg.Topic)
+	msgLen := int32(msgFixedLength + len(msg.Body) + len(topicData) + len(propertiesData))
+	if msgLen > clog.maxMessageSize {
+		logger.Errorf("message size exceeded, msg total size: %d, msg body size: %d, maxMessageSize: %d.",
+			msgLen, len(msg.Body), clog.maxMessageSize)
+		return &store.AppendMessageResult{Status: store.MESSAGE_SIZE_EXCEEDED}, nil
+	}
+
+	messageMagicCode := MessageMagicCode
+	buf := bytes.NewBuffer(make([]byte, 0, msgLen))
+	binary.Write(buf, binary.BigEndian, msgLen)                        // 1 TOTALSIZE
+	binary.Write(buf, binary.BigEndian, int32(messageMagicCode))       // 2 MAGICCODE
+	binary.Write(buf, binary.BigEndian, msg.BodyCRC)                   // 3 BODYCRC
+	binary.Write(buf, binary.BigEndian, msg.QueueId)                   // 4 QUEUEID
+	binary.Write(buf, binary.BigEndian, msg.Flag)                      // 5 FLAG
+	binary.Write(buf, binary.BigEndian, queueOffset)                   // 6 QUEUEOFFSET
+	binary.Write(buf, binary.BigEndian, wroteOffset)                   // 7 PHYSICALOFFSET
+	binary.Write(buf, binary.BigEndian, msg.SysFlag)                   // 8 SYSFLAG
+	binary.Write(buf, binary.BigEndian, msg.BornTimestamp)             // 9 BORNTIMESTAMP
+	buf.Write(hostStringToBytes(msg.BornHost))                         // 10 BORNHOST
+	binary.Write(buf, binary.BigEndian, msg.StoreTimestamp)            // 11 STORETIMESTAMP
+	buf.Write(hostStringToBytes(msg.StoreHost))                        // 12 STOREHOSTADDRESS
+	binary.Write(buf, binary.BigEndian, msg.ReconsumeTimes)            // 13 RECONSUMETIMES
+	binary.Write(buf, binary.BigEndian, msg.PreparedTransactionOffset) // 14 Prepared Transaction Offset
+	binary.Write(buf, binary.BigEndian, int32(len(msg.Body)))          // 15 BODY
+	buf.Write(msg.Body)
+	binary.Write(buf, binary.BigEndian, int8(len(topicData))) // 16 TOPIC
+	buf.Write(topicData)
+	binary.Write(buf, binary.BigEndian, int16(len(propertiesData))) // 17 PROPERTIES
+	buf.Write(propertiesData)
+
+	entry := &logEntry{
+		phyOffset:      wroteOffset,
+		topic:          msg.Topic,
+		queueId:        msg.QueueId,
+		queueOffset:    queueOffset,
+		keys:           splitKeys(msg.GetKeys()),
+		storeTimestamp: msg.StoreTimestamp,
+		data:           buf.Bytes(),
+	}
+	clog.entries = append(clog.entries, entry)
+	clog.maxOffset += int64(msgLen)
+	clog.totalSize += int64(msgLen)
+
+	// 事务Prepared/Rollback消息不占用逻辑队列位置
+	switch sysflag.GetTransactionValue(int(msg.SysFlag)) {
+	case sysflag.TransactionNotType, sysflag.TransactionCommitType:
+		clog.topicQueueTable[key] = queueOffset + 1
+		entry.queued = true
+	}
+
+	return &store.AppendMessageResult{
+		Status:         store.APPENDMESSAGE_PUT_OK,
+		WroteOffset:    wroteOffset,
+		WroteBytes:     int64(msgLen),
+		MsgId:          msgId,
+		StoreTimestamp: msg.StoreTimestamp,
+		LogicsOffset:   queueOffset,
+	}, entry
+}
+
+// evict 淘汰最早的消息，直到内存占用不超过maxSize，调用方需持有写锁
+func (clog *commitLog) evict(maxSize int64) []*logEntry {
+	var evicted []*logEntry
+	for maxSize > 0 && clog.totalSize > maxSize && len(clog.entries) > 1 {
+		entry := clog.entries[0]
+		clog.entries[0] = nil
+		clog.entries = clog.entries[1:]
+		clog.totalSize -= int64(len(entry.data))
+		clog.minOffset = clog.entries[0].phyOffset
+		evicted = append(evicted, entry)
+	}
+
+	return evicted
+}
+
+// findEntry 根据物理offset查找消息，调用方需持有读锁
+func (clog *commitLog) findEntry(offset int64) *logEntry {
+	idx := sort.Search(len(clog.entries), func(i int) bool {
+		return clog.entries[i].phyOffset >= offset
+	})
+
+	if idx < len(clog.entries) && clog.entries[idx].phyOffset == offset {
+		return clog.entries[idx]
+	}
+
+	return nil
+}
+
+func (clog *commitLog) getMessage(offset int64, size int32) *bufferResult {
+	clog.mutex.RLock()
+	defer clog.mutex.RUnlock()
+
+	entry := clog.findEntry(offset)
+	if entry == nil {
+		return nil
+	}
+
+	if size <= 0 || int(size) > len(entry.data) {
+		size = int32(len(entry.data))
+	}
+
+	return newBufferResult(offset, entry.data[:size])
+}
+
+func (clog *commitLog) pickupStoretimestamp(offset int64) int64 {
+	clog.mutex.RLock()
+	defer clog.mutex.RUnlock()
+
+	entry := clog.findEntry(offset)
+	if entry == nil {
+		return -1
+	}
+
+	return entry.storeTimestamp
+}
+
+func (clog *commitLog) getMinOffset() int64 {
+	clog.mutex.RLock()
+	defer clog.mutex.RUnlock()
+	return clog.minOffset
+}
+
+func (clog *commitLog) getMaxOffset() int64 {
+	clog.mutex.RLock()
+	defer clog.mutex.RUnlock()
+	return clog.maxOffset
+}
+
+func (clog *commitLog) removeQueueFromTopicQueueTable(topic string, queueId int32) {
+	clog.mutex.Lock()
+	defer clog.mutex.Unlock()
+	delete(clog.topicQueueTable, topic+"-"+strconv.Itoa(int(queueId)))
+}
+
+func (clog *commitLog) destroy() {
+	clog.mutex.Lock()
+	defer clog.mutex.Unlock()
+
+	clog.entries = nil
+	clog.minOffset = 0
+	clog.maxOffset = 0
+	clog.totalSize = 0
+	clog.topicQueueTable = make(map[string]int64, 1024)
+}
+
+func hostStringToBytes(hostAddr string) []byte {
+	host, port, err := message.SplitHostPort(hostAddr)
+	if err != nil {
+		logger.Warnf("parse message %s err: %s.", hostAddr, err)
+		return make([]byte, 8)
+	}
+
+	ipBytes := []byte(net.ParseIP(host).To4())
+	if len(ipBytes) == 0 {
+		ipBytes = make([]byte, 4)
+	}
+
+	addrBytes := bytes.NewBuffer(ipBytes)
+	binary.Write(addrBytes, binary.BigEndian, &port)
+	return addrBytes.Bytes()
+}
+
+func splitKeys(keys string) []string {
+	var result []string
+	for _, key := range strings.Split(keys, message.KEY_SEPARATOR) {
+		if len(key) > 0 {
+			result = append(result, key)
+		}
+	}
+
+	return result
+}
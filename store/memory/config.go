@@ -0,0 +1,32 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package memory
+
+// Config 内存存储配置
+type Config struct {
+	MaxMessageSize            int32 `json:"MaxMessageSize"`            // 单条消息最大字节数
+	MaxStoreSize              int64 `json:"MaxStoreSize"`              // 内存中保留消息的最大字节数，超过后淘汰最早的消息，0表示不限制
+	MaxTransferBytesOnMessage int32 `json:"MaxTransferBytesOnMessage"` // 单次Pull消息传输的最大字节数
+	MaxTransferCountOnMessage int32 `json:"MaxTransferCountOnMessage"` // 单次Pull消息传输的最大条数
+}
+
+// NewConfig 创建默认内存存储配置
+func NewConfig() *Config {
+	return &Config{
+		MaxMessageSize:            1024 * 512,
+		MaxStoreSize:              1024 * 1024 * 256,
+		MaxTransferBytesOnMessage: 1024 * 256,
+		MaxTransferCountOnMessage: 32,
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package memory
+
+import (
+	"sort"
+	"sync"
+)
+
+// cqUnit 逻辑队列存储单元，与persistent的20字节存储单元对应
+type cqUnit struct {
+	phyOffset      int64
+	size           int32
+	tagsCode       int64
+	storeTimestamp int64
+}
+
+// consumeQueue 内存逻辑队列
+type consumeQueue struct {
+	topic     string
+	queueId   int32
+	minOffset int64 // units[0]对应的逻辑offset
+	units     []cqUnit
+	mutex     sync.RWMutex
+}
+
+func newConsumeQueue(topic string, queueId int32) *consumeQueue {
+	return &consumeQueue{
+		topic:   topic,
+		queueId: queueId,
+	}
+}
+
+func (cq *consumeQueue) putMessagePostionInfo(unit cqUnit, logicOffset int64) bool {
+	cq.mutex.Lock()
+	defer cq.mutex.Unlock()
+
+	if len(cq.units) == 0 {
+		cq.minOffset = logicOffset
+	}
+
+	expectOffset := cq.minOffset + int64(len(cq.units))
+	if logicOffset != expectOffset {
+		return false
+	}
+
+	cq.units = append(cq.units, unit)
+	return true
+}
+
+func (cq *consumeQueue) getMinOffsetInQueue() int64 {
+	cq.mutex.RLock()
+	defer cq.mutex.RUnlock()
+	return cq.minOffset
+}
+
+func (cq *consumeQueue) getMaxOffsetInQueue() int64 {
+	cq.mutex.RLock()
+	defer cq.mutex.RUnlock()
+	return cq.minOffset + int64(len(cq.units))
+}
+
+func (cq *consumeQueue) getUnit(offset int64) (cqUnit, bool) {
+	cq.mutex.RLock()
+	defer cq.mutex.RUnlock()
+
+	idx := offset - cq.minOffset
+	if idx < 0 || idx >= int64(len(cq.units)) {
+		return cqUnit{}, false
+	}
+
+	return cq.units[idx], true
+}
+
+// getUnits 获取从offset开始最多maxNums个存储单元
+func (cq *consumeQueue) getUnits(offset int64, maxNums int) []cqUnit {
+	cq.mutex.RLock()
+	defer cq.mutex.RUnlock()
+
+	idx := offset - cq.minOffset
+	if idx < 0 || idx >= int64(len(cq.units)) {
+		return nil
+	}
+
+	end := idx + int64(maxNums)
+	if end > int64(len(cq.units)) {
+		end = int64(len(cq.units))
+	}
+
+	units := make([]cqUnit, end-idx)
+	copy(units, cq.units[idx:end])
+	return units
+}
+
+// getOffsetInQueueByTime 取最接近timestamp的逻辑offset，队列为空时返回0
+func (cq *consumeQueue) getOffsetInQueueByTime(timestamp int64) int64 {
+	cq.mutex.RLock()
+	defer cq.mutex.RUnlock()
+
+	if len(cq.units) == 0 {
+		return 0
+	}
+
+	idx := sort.Search(len(cq.units), func(i int) bool {
+		return cq.units[i].storeTimestamp >= timestamp
+	})
+
+	if idx == 0 {
+		return cq.minOffset
+	}
+
+	if idx == len(cq.units) {
+		return cq.minOffset + int64(idx) - 1
+	}
+
+	if cq.units[idx].storeTimestamp == timestamp {
+		return cq.minOffset + int64(idx)
+	}
+
+	// 取最接近timestamp的offset
+	if timestamp-cq.units[idx-1].storeTimestamp > cq.units[idx].storeTimestamp-timestamp {
+		return cq.minOffset + int64(idx)
+	}
+
+	return cq.minOffset + int64(idx) - 1
+}
+
+// truncateBefore 删除逻辑offset小于minOffset的存储单元
+func (cq *consumeQueue) truncateBefore(minOffset int64) {
+	cq.mutex.Lock()
+	defer cq.mutex.Unlock()
+
+	idx := minOffset - cq.minOffset
+	if idx <= 0 {
+		return
+	}
+
+	if idx >= int64(len(cq.units)) {
+		cq.units = nil
+	} else {
+		cq.units = cq.units[idx:]
+	}
+	cq.minOffset = minOffset
+}
+
+func (cq *consumeQueue) isEmpty() bool {
+	cq.mutex.RLock()
+	defer cq.mutex.RUnlock()
+	return len(cq.units) == 0
+}
@@ -13,5 +13,683 @@
 // limitations under the License.
 package memory
 
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/boltmq/boltmq/stats"
+	"github.com/boltmq/boltmq/store"
+	"github.com/boltmq/common/logger"
+	"github.com/boltmq/common/message"
+	"github.com/boltmq/common/protocol/heartbeat"
+	"github.com/boltmq/common/sysflag"
+	"github.com/boltmq/common/utils/codec"
+	"github.com/boltmq/common/utils/system"
+)
+
+const (
+	maxFilterMessageCount = 800 // 单次拉取最多过滤的消息条数
+)
+
+// MemoryMessageStore 基于内存的消息存储，不落盘，适用于测试及开发环境
 type MemoryMessageStore struct {
+	config              *Config
+	msgFilter           store.MessageFilter // 消息过滤
+	clog                *commitLog
+	consumeTopicTable   map[string]map[int32]*consumeQueue
+	consumeQueueTableMu sync.RWMutex
+	keyIndexTable       map[string][]int64 // topic#key -> 物理offset列表
+	keyIndexTableMu     sync.RWMutex
+	storeStats          stats.StoreStats
+	brokerStats         stats.BrokerStats
+	shutdownFlag        int32 // 存储服务是否关闭
+}
+
+// NewMessageStore 创建内存消息存储
+func NewMessageStore(config *Config, brokerStats stats.BrokerStats) store.MessageStore {
+	return newMemoryMessageStore(config, brokerStats)
+}
+
+func newMemoryMessageStore(config *Config, brokerStats stats.BrokerStats) *MemoryMessageStore {
+	if config == nil {
+		config = NewConfig()
+	}
+
+	ms := &MemoryMessageStore{}
+	ms.config = config
+	ms.msgFilter = new(store.DefaultMessageFilter)
+	ms.clog = newCommitLog(config.MaxMessageSize)
+	ms.consumeTopicTable = make(map[string]map[int32]*consumeQueue)
+	ms.keyIndexTable = make(map[string][]int64)
+	ms.storeStats = stats.NewStoreStats()
+	ms.brokerStats = brokerStats
+	ms.shutdownFlag = 1
+	return ms
+}
+
+// Load 内存存储没有需要加载的数据
+func (ms *MemoryMessageStore) Load() bool {
+	return true
+}
+
+func (ms *MemoryMessageStore) Start() error {
+	go ms.storeStats.Start()
+	atomic.StoreInt32(&ms.shutdownFlag, 0)
+	return nil
+}
+
+func (ms *MemoryMessageStore) Shutdown() {
+	if atomic.CompareAndSwapInt32(&ms.shutdownFlag, 0, 1) {
+		ms.storeStats.Shutdown()
+	}
+}
+
+func (ms *MemoryMessageStore) isShutdown() bool {
+	return atomic.LoadInt32(&ms.shutdownFlag) == 1
+}
+
+func (ms *MemoryMessageStore) Destroy() {
+	ms.clog.destroy()
+
+	ms.consumeQueueTableMu.Lock()
+	ms.consumeTopicTable = make(map[string]map[int32]*consumeQueue)
+	ms.consumeQueueTableMu.Unlock()
+
+	ms.keyIndexTableMu.Lock()
+	ms.keyIndexTable = make(map[string][]int64)
+	ms.keyIndexTableMu.Unlock()
+}
+
+func (ms *MemoryMessageStore) PutMessage(msg *store.MessageExtInner) *store.PutMessageResult {
+	if ms.isShutdown() {
+		return &store.PutMessageResult{Status: store.SERVICE_NOT_AVAILABLE}
+	}
+
+	// message topic长度校验
+	if len(msg.Topic) > 127 {
+		logger.Warnf("put message topic length too long %d.", len(msg.Topic))
+		return &store.PutMessageResult{Status: store.MESSAGE_ILLEGAL}
+	}
+
+	// message properties长度校验
+	if len(msg.PropertiesString) > 32767 {
+		logger.Warnf("put message properties length too long, %d.", len(msg.PropertiesString))
+		return &store.PutMessageResult{Status: store.MESSAGE_ILLEGAL}
+	}
+
+	beginTime := system.CurrentTimeMillis()
+	msg.StoreTimestamp = beginTime
+	msg.BodyCRC, _ = codec.Crc32(msg.Body)
+
+	ms.clog.mutex.Lock()
+	result, entry := ms.clog.appendMessage(msg)
+	if result.Status != store.APPENDMESSAGE_PUT_OK {
+		ms.clog.mutex.Unlock()
+		ms.storeStats.SetPutMessageFailedTimes(1)
+		return &store.PutMessageResult{Status: store.MESSAGE_ILLEGAL, Result: result}
+	}
+
+	// 在锁内分发，保证逻辑队列与物理队列顺序一致
+	ms.dispatch(msg, entry, result)
+	evicted := ms.clog.evict(ms.config.MaxStoreSize)
+	ms.clog.mutex.Unlock()
+
+	for _, e := range evicted {
+		ms.removeEntryIndex(e)
+	}
+
+	eclipseTime := system.CurrentTimeMillis() - beginTime
+	ms.storeStats.SetPutMessageEntireTimeMax(eclipseTime)
+	size := ms.storeStats.GetSinglePutMessageTopicTimesTotal(msg.Topic)
+	ms.storeStats.SetSinglePutMessageTopicTimesTotal(msg.Topic, atomic.AddInt64(&size, 1))
+	size = ms.storeStats.GetSinglePutMessageTopicSizeTotal(msg.Topic)
+	ms.storeStats.SetSinglePutMessageTopicSizeTotal(msg.Topic, atomic.AddInt64(&size, result.WroteBytes))
+
+	return &store.PutMessageResult{Status: store.PUTMESSAGE_PUT_OK, Result: result}
+}
+
+// PutMessages 批量写入同一topic、同一队列的普通消息
+func (ms *MemoryMessageStore) PutMessages(msgs []*store.MessageExtInner) *store.PutMessageResult {
+	if ms.isShutdown() {
+		return &store.PutMessageResult{Status: store.SERVICE_NOT_AVAILABLE}
+	}
+
+	if len(msgs) == 0 {
+		return &store.PutMessageResult{Status: store.MESSAGE_ILLEGAL}
+	}
+
+	topic, queueId := msgs[0].Topic, msgs[0].QueueId
+	totalLen := 0
+	for _, msg := range msgs {
+		if msg.Topic != topic || msg.QueueId != queueId {
+			logger.Warnf("put messages topic or queue mismatch, %s-%d %s-%d.", topic, queueId, msg.Topic, msg.QueueId)
+			return &store.PutMessageResult{Status: store.MESSAGE_ILLEGAL}
+		}
+
+		if len(msg.Topic) > 127 || len(msg.PropertiesString) > 32767 {
+			logger.Warnf("put messages topic or properties length too long, %d %d.", len(msg.Topic), len(msg.PropertiesString))
+			return &store.PutMessageResult{Status: store.MESSAGE_ILLEGAL}
+		}
+
+		if sysflag.GetTransactionValue(int(msg.SysFlag)) != sysflag.TransactionNotType {
+			logger.Warnf("put messages not support transaction message, topic: %s.", msg.Topic)
+			return &store.PutMessageResult{Status: store.MESSAGE_ILLEGAL}
+		}
+
+		totalLen += msgFixedLength + len(msg.Body) + len(msg.Topic) + len(msg.PropertiesString)
+	}
+
+	// 整批消息的大小不能超过单条消息的最大值
+	if totalLen > int(ms.config.MaxMessageSize) {
+		logger.Errorf("batch message size exceeded, total size: %d, msg nums: %d, maxMessageSize: %d.",
+			totalLen, len(msgs), ms.config.MaxMessageSize)
+		ms.storeStats.SetPutMessageFailedTimes(1)
+		return &store.PutMessageResult{Status: store.MESSAGE_ILLEGAL}
+	}
+
+	beginTime := system.CurrentTimeMillis()
+	for _, msg := range msgs {
+		msg.StoreTimestamp = beginTime
+		msg.BodyCRC, _ = codec.Crc32(msg.Body)
+	}
+
+	ms.clog.mutex.Lock()
+	results := make([]*store.AppendMessageResult, 0, len(msgs))
+	wroteBytes := int64(0)
+	for _, msg := range msgs {
+		result, entry := ms.clog.appendMessage(msg)
+		if result.Status != store.APPENDMESSAGE_PUT_OK {
+			// 整批大小已校验，不会出现部分写入
+			ms.clog.mutex.Unlock()
+			ms.storeStats.SetPutMessageFailedTimes(1)
+			return &store.PutMessageResult{Status: store.MESSAGE_ILLEGAL, Result: result}
+		}
+
+		ms.dispatch(msg, entry, result)
+		results = append(results, result)
+		wroteBytes += result.WroteBytes
+	}
+	evicted := ms.clog.evict(ms.config.MaxStoreSize)
+	ms.clog.mutex.Unlock()
+
+	for _, e := range evicted {
+		ms.removeEntryIndex(e)
+	}
+
+	eclipseTime := system.CurrentTimeMillis() - beginTime
+	ms.storeStats.SetPutMessageEntireTimeMax(eclipseTime)
+	size := ms.storeStats.GetSinglePutMessageTopicTimesTotal(topic)
+	ms.storeStats.SetSinglePutMessageTopicTimesTotal(topic, atomic.AddInt64(&size, int64(len(msgs))))
+	size = ms.storeStats.GetSinglePutMessageTopicSizeTotal(topic)
+	ms.storeStats.SetSinglePutMessageTopicSizeTotal(topic, atomic.AddInt64(&size, wroteBytes))
+
+	result := &store.AppendMessageResult{
+		Status:         store.APPENDMESSAGE_PUT_OK,
+		WroteOffset:    results[0].WroteOffset,
+		WroteBytes:     wroteBytes,
+		MsgId:          results[0].MsgId,
+		StoreTimestamp: beginTime,
+		LogicsOffset:   results[0].LogicsOffset,
+	}
+	return &store.PutMessageResult{Status: store.PUTMESSAGE_PUT_OK, Result: result, Results: results}
+}
+
+// dispatch 构建逻辑队列及消息索引
+func (ms *MemoryMessageStore) dispatch(msg *store.MessageExtInner, entry *logEntry, result *store.AppendMessageResult) {
+	switch sysflag.GetTransactionValue(int(msg.SysFlag)) {
+	case sysflag.TransactionNotType, sysflag.TransactionCommitType:
+		cq := ms.findConsumeQueue(msg.Topic, msg.QueueId)
+		unit := cqUnit{
+			phyOffset:      result.WroteOffset,
+			size:           int32(result.WroteBytes),
+			tagsCode:       msg.TagsCode,
+			storeTimestamp: msg.StoreTimestamp,
+		}
+		if !cq.putMessagePostionInfo(unit, result.LogicsOffset) {
+			logger.Warnf("memory consume queue put message position info failed, topic: %s queueId: %d offset: %d.",
+				msg.Topic, msg.QueueId, result.LogicsOffset)
+		}
+	}
+
+	if len(entry.keys) > 0 {
+		ms.keyIndexTableMu.Lock()
+		for _, key := range entry.keys {
+			idxKey := buildKey(entry.topic, key)
+			ms.keyIndexTable[idxKey] = append(ms.keyIndexTable[idxKey], entry.phyOffset)
+		}
+		ms.keyIndexTableMu.Unlock()
+	}
+}
+
+// removeEntryIndex 消息被淘汰后，清理对应的逻辑队列及索引
+func (ms *MemoryMessageStore) removeEntryIndex(entry *logEntry) {
+	// 事务Prepared/Rollback消息的queueOffset是下一条消息的位置，不能据此截断逻辑队列
+	if entry.queued {
+		ms.consumeQueueTableMu.RLock()
+		cq, ok := ms.consumeTopicTable[entry.topic][entry.queueId]
+		ms.consumeQueueTableMu.RUnlock()
+		if ok {
+			cq.truncateBefore(entry.queueOffset + 1)
+		}
+	}
+
+	if len(entry.keys) > 0 {
+		ms.keyIndexTableMu.Lock()
+		for _, key := range entry.keys {
+			idxKey := buildKey(entry.topic, key)
+			offsets := ms.keyIndexTable[idxKey]
+			for len(offsets) > 0 && offsets[0] <= entry.phyOffset {
+				offsets = offsets[1:]
+			}
+
+			if len(offsets) == 0 {
+				delete(ms.keyIndexTable, idxKey)
+			} else {
+				ms.keyIndexTable[idxKey] = offsets
+			}
+		}
+		ms.keyIndexTableMu.Unlock()
+	}
+}
+
+func buildKey(topic, key string) string {
+	return topic + "#" + key
+}
+
+func (ms *MemoryMessageStore) findConsumeQueue(topic string, queueId int32) *consumeQueue {
+	ms.consumeQueueTableMu.RLock()
+	cq, ok := ms.consumeTopicTable[topic][queueId]
+	ms.consumeQueueTableMu.RUnlock()
+	if ok {
+		return cq
+	}
+
+	ms.consumeQueueTableMu.Lock()
+	defer ms.consumeQueueTableMu.Unlock()
+
+	cqMap, ok := ms.consumeTopicTable[topic]
+	if !ok {
+		cqMap = make(map[int32]*consumeQueue)
+		ms.consumeTopicTable[topic] = cqMap
+	}
+
+	cq, ok = cqMap[queueId]
+	if !ok {
+		cq = newConsumeQueue(topic, queueId)
+		cqMap[queueId] = cq
+	}
+
+	return cq
+}
+
+func (ms *MemoryMessageStore) GetMessage(group string, topic string, queueId int32, offset int64, maxMsgNums int32,
+	subscriptionData *heartbeat.SubscriptionData) *store.GetMessageResult {
+	if ms.isShutdown() {
+		logger.Warn("message store has shutdown, so getMessage is forbidden.")
+		return nil
+	}
+
+	beginTime := system.CurrentTimeMillis()
+	status := store.NO_MESSAGE_IN_QUEUE
+	nextBeginOffset := offset
+	getResult := new(store.GetMessageResult)
+
+	cq := ms.findConsumeQueue(topic, queueId)
+	minOffset := cq.getMinOffsetInQueue()
+	maxOffset := cq.getMaxOffsetInQueue()
+
+	if maxOffset == 0 {
+		status = store.NO_MESSAGE_IN_QUEUE
+		nextBeginOffset = 0
+	} else if offset < minOffset {
+		status = store.OFFSET_TOO_SMALL
+		nextBeginOffset = minOffset
+	} else if offset == maxOffset {
+		status = store.OFFSET_OVERFLOW_ONE
+		nextBeginOffset = offset
+	} else if offset > maxOffset {
+		status = store.OFFSET_OVERFLOW_BADLY
+		if 0 == minOffset {
+			nextBeginOffset = minOffset
+		} else {
+			nextBeginOffset = maxOffset
+		}
+	} else {
+		units := cq.getUnits(offset, maxFilterMessageCount)
+		status = store.NO_MATCHED_MESSAGE
+
+		i := 0
+		for ; i < len(units); i++ {
+			unit := units[i]
+			if ms.isTheBatchFull(unit.size, maxMsgNums, int32(getResult.BufferTotalSize), int32(getResult.GetMessageCount())) {
+				break
+			}
+
+			// 消息过滤
+			if !ms.msgFilter.IsMessageMatched(subscriptionData, unit.tagsCode) {
+				if getResult.BufferTotalSize == 0 {
+					status = store.NO_MATCHED_MESSAGE
+				}
+				continue
+			}
+
+			selectResult := ms.clog.getMessage(unit.phyOffset, unit.size)
+			if selectResult == nil {
+				// 消息已被淘汰
+				if getResult.BufferTotalSize == 0 {
+					status = store.MESSAGE_WAS_REMOVING
+				}
+				continue
+			}
+
+			if !ms.msgFilter.IsMatchedByCommitLog(subscriptionData, selectResult.byteBuffer.Bytes()) {
+				selectResult.Release()
+				if getResult.BufferTotalSize == 0 {
+					status = store.NO_MATCHED_MESSAGE
+				}
+				continue
+			}
+
+			ms.storeStats.SetMessageTransferedMsgCount(1)
+			getResult.AddMessage(selectResult)
+			status = store.FOUND
+		}
+
+		nextBeginOffset = offset + int64(i)
+	}
+
+	if store.FOUND == status {
+		ms.storeStats.SetMessageTimesTotalFound(1)
+	} else {
+		ms.storeStats.SetMessageTimesTotalMiss(1)
+	}
+	ms.storeStats.SetMessageEntireTimeMax(system.CurrentTimeMillis() - beginTime)
+
+	getResult.Status = status
+	getResult.NextBeginOffset = nextBeginOffset
+	getResult.MaxOffset = maxOffset
+	getResult.MinOffset = minOffset
+	return getResult
+}
+
+func (ms *MemoryMessageStore) isTheBatchFull(sizePy, maxMsgNums, bufferTotal, messageTotal int32) bool {
+	if 0 == bufferTotal || 0 == messageTotal {
+		return false
+	}
+
+	if (messageTotal + 1) > maxMsgNums {
+		return true
+	}
+
+	if (bufferTotal + sizePy) > ms.config.MaxTransferBytesOnMessage {
+		return true
+	}
+
+	if (messageTotal + 1) > ms.config.MaxTransferCountOnMessage {
+		return true
+	}
+
+	return false
+}
+
+// MaxOffsetInQueue 获取指定队列最大Offset 如果队列不存在，返回-1
+func (ms *MemoryMessageStore) MaxOffsetInQueue(topic string, queueId int32) int64 {
+	return ms.findConsumeQueue(topic, queueId).getMaxOffsetInQueue()
+}
+
+// MinOffsetInQueue 获取指定队列最小Offset 如果队列不存在，返回-1
+func (ms *MemoryMessageStore) MinOffsetInQueue(topic string, queueId int32) int64 {
+	return ms.findConsumeQueue(topic, queueId).getMinOffsetInQueue()
+}
+
+// CommitLogOffsetInQueue 获取逻辑队列中消息对应的物理offset
+func (ms *MemoryMessageStore) CommitLogOffsetInQueue(topic string, queueId int32, cqOffset int64) int64 {
+	unit, ok := ms.findConsumeQueue(topic, queueId).getUnit(cqOffset)
+	if !ok {
+		return 0
+	}
+
+	return unit.phyOffset
+}
+
+// OffsetInQueueByTime 根据消息时间获取某个队列中对应的offset
+func (ms *MemoryMessageStore) OffsetInQueueByTime(topic string, queueId int32, timestamp int64) int64 {
+	return ms.findConsumeQueue(topic, queueId).getOffsetInQueueByTime(timestamp)
+}
+
+// LookMessageByOffset 通过物理队列Offset，查询消息。 如果发生错误，则返回null
+func (ms *MemoryMessageStore) LookMessageByOffset(commitLogOffset int64) *message.MessageExt {
+	selectResult := ms.clog.getMessage(commitLogOffset, 0)
+	if selectResult == nil {
+		return nil
+	}
+
+	msgExt, err := message.DecodeMessageExt(selectResult.byteBuffer.Bytes(), true, false)
+	if err != nil {
+		logger.Errorf("message store look message by offset err: %s.", err)
+		return nil
+	}
+
+	// 压缩的消息解压后返回，拉取消息时仍返回压缩的数据
+	if err := store.DecompressMessageExt(msgExt); err != nil {
+		logger.Errorf("message store decompress message by offset %d err: %s.", commitLogOffset, err)
+		return nil
+	}
+
+	return msgExt
+}
+
+// SelectOneMessageByOffset 通过物理队列Offset，查询消息。 如果发生错误，则返回null
+func (ms *MemoryMessageStore) SelectOneMessageByOffset(commitLogOffset int64) store.BufferResult {
+	selectResult := ms.clog.getMessage(commitLogOffset, 0)
+	if selectResult == nil {
+		return nil
+	}
+
+	return selectResult
+}
+
+// SelectOneMessageByOffsetAndSize 通过物理队列Offset、size，查询消息。 如果发生错误，则返回null
+func (ms *MemoryMessageStore) SelectOneMessageByOffsetAndSize(commitLogOffset int64, msgSize int32) store.BufferResult {
+	selectResult := ms.clog.getMessage(commitLogOffset, msgSize)
+	if selectResult == nil {
+		return nil
+	}
+
+	return selectResult
+}
+
+func (ms *MemoryMessageStore) RunningDataInfo() string {
+	return fmt.Sprintf("%v", ms.RuntimeInfo())
+}
+
+// RuntimeInfo 获取运行时统计数据
+func (ms *MemoryMessageStore) RuntimeInfo() map[string]string {
+	result := ms.storeStats.RuntimeInfo()
+	result["commitLogMinOffset"] = fmt.Sprintf("%d", ms.clog.getMinOffset())
+	result["commitLogMaxOffset"] = fmt.Sprintf("%d", ms.clog.getMaxOffset())
+	return result
+}
+
+// MaxPhyOffset 获取物理队列最大offset
+func (ms *MemoryMessageStore) MaxPhyOffset() int64 {
+	return ms.clog.getMaxOffset()
+}
+
+// MinPhyOffset 获取物理队列最小offset
+func (ms *MemoryMessageStore) MinPhyOffset() int64 {
+	return ms.clog.getMinOffset()
+}
+
+// EarliestMessageTime 获取队列中最早的消息时间，如果找不到对应时间，则返回-1
+func (ms *MemoryMessageStore) EarliestMessageTime(topic string, queueId int32) int64 {
+	cq := ms.findConsumeQueue(topic, queueId)
+	return ms.MessageStoreTimeStamp(topic, queueId, cq.getMinOffsetInQueue())
+}
+
+// MessageStoreTimeStamp 获取队列中存储时间，如果找不到对应时间，则返回-1
+func (ms *MemoryMessageStore) MessageStoreTimeStamp(topic string, queueId int32, offset int64) int64 {
+	unit, ok := ms.findConsumeQueue(topic, queueId).getUnit(offset)
+	if !ok {
+		return -1
+	}
+
+	return unit.storeTimestamp
+}
+
+func (ms *MemoryMessageStore) MessageTotalInQueue(topic string, queueId int32) int64 {
+	cq := ms.findConsumeQueue(topic, queueId)
+	return cq.getMaxOffsetInQueue() - cq.getMinOffsetInQueue()
+}
+
+// GetCommitLogData 内存存储不支持主备复制
+func (ms *MemoryMessageStore) GetCommitLogData(offset int64) store.BufferResult {
+	return nil
+}
+
+// AppendToCommitLog 内存存储不支持主备复制
+func (ms *MemoryMessageStore) AppendToCommitLog(startOffset int64, data []byte) bool {
+	logger.Warn("memory message store not support append to commitlog.")
+	return false
+}
+
+func (ms *MemoryMessageStore) ExcuteDeleteFilesManualy() {
+}
+
+// QueryMessage 根据消息key查询消息，按存储时间倒序返回
+func (ms *MemoryMessageStore) QueryMessage(topic string, key string, maxNum int32, begin int64, end int64) *store.QueryMessageResult {
+	queryMsgResult := store.NewQueryMessageResult()
+
+	ms.keyIndexTableMu.RLock()
+	offsets := append([]int64(nil), ms.keyIndexTable[buildKey(topic, key)]...)
+	ms.keyIndexTableMu.RUnlock()
+
+	for i := len(offsets) - 1; i >= 0 && int32(len(queryMsgResult.MessageMapedList)) < maxNum; i-- {
+		storeTimestamp := ms.clog.pickupStoretimestamp(offsets[i])
+		if storeTimestamp < begin || storeTimestamp > end {
+			continue
+		}
+
+		selectResult := ms.clog.getMessage(offsets[i], 0)
+		if selectResult == nil {
+			continue
+		}
+
+		queryMsgResult.AddMessage(selectResult)
+		queryMsgResult.MessageBufferList = append(queryMsgResult.MessageBufferList, selectResult.Buffer())
+		queryMsgResult.BufferTotalSize += int32(selectResult.Size())
+	}
+
+	queryMsgResult.IndexLastUpdatePhyoffset = ms.clog.getMaxOffset()
+	queryMsgResult.IndexLastUpdateTimestamp = system.CurrentTimeMillis()
+	return queryMsgResult
+}
+
+// UpdateHaMasterAddress 内存存储不支持主备复制
+func (ms *MemoryMessageStore) UpdateHaMasterAddress(newAddr string) {
+}
+
+// SlaveFallBehindMuch 内存存储不支持主备复制
+func (ms *MemoryMessageStore) SlaveFallBehindMuch() int64 {
+	return 0
+}
+
+// CleanUnusedTopic 清除未使用Topic
+func (ms *MemoryMessageStore) CleanUnusedTopic(topics []string) int32 {
+	exists := make(map[string]struct{}, len(topics))
+	for _, topic := range topics {
+		exists[topic] = struct{}{}
+	}
+
+	var removed []*consumeQueue
+	ms.consumeQueueTableMu.Lock()
+	for topic, cqMap := range ms.consumeTopicTable {
+		if _, ok := exists[topic]; ok {
+			continue
+		}
+
+		for _, cq := range cqMap {
+			removed = append(removed, cq)
+		}
+		delete(ms.consumeTopicTable, topic)
+		logger.Infof("clean unused topic: %s, consume queue destroyed.", topic)
+	}
+	ms.consumeQueueTableMu.Unlock()
+
+	for _, cq := range removed {
+		ms.clog.removeQueueFromTopicQueueTable(cq.topic, cq.queueId)
+	}
+
+	return int32(len(removed))
+}
+
+// CleanExpiredConsumerQueue 清除失效的消费队列
+func (ms *MemoryMessageStore) CleanExpiredConsumerQueue() {
+	var expired []*consumeQueue
+	ms.consumeQueueTableMu.Lock()
+	for topic, cqMap := range ms.consumeTopicTable {
+		for queueId, cq := range cqMap {
+			// 队列中的消息已全部被淘汰
+			if cq.isEmpty() && cq.getMinOffsetInQueue() > 0 {
+				logger.Infof("cleanExpiredConsumerQueue: %s %d consumer queue destroyed.", topic, queueId)
+				expired = append(expired, cq)
+				delete(cqMap, queueId)
+			}
+		}
+
+		if len(cqMap) == 0 {
+			logger.Infof("cleanExpiredConsumerQueue: %s, topic destroyed.", topic)
+			delete(ms.consumeTopicTable, topic)
+		}
+	}
+	ms.consumeQueueTableMu.Unlock()
+
+	for _, cq := range expired {
+		ms.clog.removeQueueFromTopicQueueTable(cq.topic, cq.queueId)
+	}
+}
+
+// MessageIds 批量获取MessageId
+func (ms *MemoryMessageStore) MessageIds(topic string, queueId int32, minOffset, maxOffset int64, storeHost string) map[string]int64 {
+	messageIds := make(map[string]int64)
+	if ms.isShutdown() {
+		return messageIds
+	}
+
+	cq := ms.findConsumeQueue(topic, queueId)
+	if minOffset < cq.getMinOffsetInQueue() {
+		minOffset = cq.getMinOffsetInQueue()
+	}
+
+	units := cq.getUnits(minOffset, int(maxOffset-minOffset))
+	for i, unit := range units {
+		msgId, err := message.CreateMessageId(storeHost, unit.phyOffset)
+		if err != nil {
+			logger.Errorf("message store get message ids create message id err: %s.", err)
+			break
+		}
+
+		messageIds[msgId] = minOffset + int64(i)
+	}
+
+	return messageIds
+}
+
+// CheckInDiskByConsumeOffset 内存存储的消息都不在磁盘
+func (ms *MemoryMessageStore) CheckInDiskByConsumeOffset(topic string, queueId int32, consumeOffset int64) bool {
+	return false
+}
+
+// EncodeScheduleMsg 内存存储没有定时消息进度
+func (ms *MemoryMessageStore) EncodeScheduleMsg() string {
+	return ""
+}
+
+func (ms *MemoryMessageStore) StoreStats() stats.StoreStats {
+	return ms.storeStats
+}
+
+func (ms *MemoryMessageStore) BrokerStats() stats.BrokerStats {
+	return ms.brokerStats
 }
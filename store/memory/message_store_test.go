@@ -0,0 +1,239 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package memory
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/boltmq/boltmq/store"
+	"github.com/boltmq/common/message"
+	"github.com/boltmq/common/sysflag"
+	"github.com/boltmq/common/utils/system"
+)
+
+func newTestMessage(topic string, queueId int32, key string) *store.MessageExtInner {
+	msg := new(store.MessageExtInner)
+	msg.Topic = topic
+	msg.QueueId = queueId
+	msg.Body = []byte("hello boltmq")
+	msg.SetKeys(key)
+	msg.PropertiesString = message.MessageProperties2String(msg.Properties)
+	msg.BornTimestamp = system.CurrentTimeMillis()
+	msg.BornHost = "127.0.0.1:10911"
+	msg.StoreHost = "127.0.0.1:11911"
+	return msg
+}
+
+func TestPutAndGetMessage(t *testing.T) {
+	ms := NewMessageStore(NewConfig(), nil)
+	ms.Load()
+	ms.Start()
+	defer ms.Shutdown()
+
+	for i := 0; i < 10; i++ {
+		result := ms.PutMessage(newTestMessage("TestTopic", 1, fmt.Sprintf("key-%d", i)))
+		if result.Status != store.PUTMESSAGE_PUT_OK {
+			t.Errorf("put message status: %s", result.Status)
+			return
+		}
+
+		if result.Result.LogicsOffset != int64(i) {
+			t.Errorf("put message logics offset: %d, expect: %d", result.Result.LogicsOffset, i)
+			return
+		}
+	}
+
+	if ms.MaxOffsetInQueue("TestTopic", 1) != 10 || ms.MinOffsetInQueue("TestTopic", 1) != 0 {
+		t.Errorf("max offset: %d min offset: %d", ms.MaxOffsetInQueue("TestTopic", 1), ms.MinOffsetInQueue("TestTopic", 1))
+		return
+	}
+
+	getResult := ms.GetMessage("TestGroup", "TestTopic", 1, 2, 4, nil)
+	if getResult.Status != store.FOUND || getResult.GetMessageCount() != 4 || getResult.NextBeginOffset != 6 {
+		t.Errorf("get message status: %s count: %d next offset: %d", getResult.Status, getResult.GetMessageCount(), getResult.NextBeginOffset)
+		return
+	}
+
+	getResult = ms.GetMessage("TestGroup", "TestTopic", 1, 10, 4, nil)
+	if getResult.Status != store.OFFSET_OVERFLOW_ONE {
+		t.Errorf("get message status: %s", getResult.Status)
+		return
+	}
+
+	phyOffset := ms.CommitLogOffsetInQueue("TestTopic", 1, 3)
+	msgExt := ms.LookMessageByOffset(phyOffset)
+	if msgExt == nil || msgExt.Topic != "TestTopic" || msgExt.QueueOffset != 3 || string(msgExt.Body) != "hello boltmq" {
+		t.Errorf("look message by offset %d failed: %v", phyOffset, msgExt)
+		return
+	}
+
+	queryResult := ms.QueryMessage("TestTopic", "key-5", 32, 0, system.CurrentTimeMillis())
+	if len(queryResult.MessageBufferList) != 1 {
+		t.Errorf("query message by key count: %d", len(queryResult.MessageBufferList))
+		return
+	}
+
+	storeTimestamp := ms.MessageStoreTimeStamp("TestTopic", 1, 9)
+	if offset := ms.OffsetInQueueByTime("TestTopic", 1, storeTimestamp+1000); offset != 9 {
+		t.Errorf("offset in queue by time: %d", offset)
+		return
+	}
+}
+
+func TestEvictMessage(t *testing.T) {
+	cfg := NewConfig()
+	cfg.MaxStoreSize = 1024
+	ms := NewMessageStore(cfg, nil)
+	ms.Load()
+	ms.Start()
+	defer ms.Shutdown()
+
+	for i := 0; i < 100; i++ {
+		ms.PutMessage(newTestMessage("TestTopic", 0, "key"))
+	}
+
+	minOffset := ms.MinOffsetInQueue("TestTopic", 0)
+	if minOffset == 0 || ms.MaxOffsetInQueue("TestTopic", 0) != 100 {
+		t.Errorf("evict message min offset: %d max offset: %d", minOffset, ms.MaxOffsetInQueue("TestTopic", 0))
+		return
+	}
+
+	if ms.MinPhyOffset() != ms.CommitLogOffsetInQueue("TestTopic", 0, minOffset) {
+		t.Errorf("evict message min phy offset: %d", ms.MinPhyOffset())
+		return
+	}
+
+	getResult := ms.GetMessage("TestGroup", "TestTopic", 0, 0, 4, nil)
+	if getResult.Status != store.OFFSET_TOO_SMALL || getResult.NextBeginOffset != minOffset {
+		t.Errorf("get message status: %s next offset: %d", getResult.Status, getResult.NextBeginOffset)
+		return
+	}
+}
+
+func TestEvictPreparedMessage(t *testing.T) {
+	probe := NewMessageStore(NewConfig(), nil)
+	probe.Load()
+	probe.Start()
+	msgSize := probe.PutMessage(newTestMessage("TestTopic", 0, "key")).Result.WroteBytes
+	probe.Shutdown()
+
+	// 只保留最后一条消息，prepared消息与之前的普通消息都被淘汰
+	cfg := NewConfig()
+	cfg.MaxStoreSize = msgSize
+	ms := NewMessageStore(cfg, nil)
+	ms.Load()
+	ms.Start()
+	defer ms.Shutdown()
+
+	ms.PutMessage(newTestMessage("TestTopic", 0, "key"))
+	prepared := newTestMessage("TestTopic", 0, "key")
+	prepared.SysFlag = int32(sysflag.TransactionPreparedType)
+	ms.PutMessage(prepared)
+	ms.PutMessage(newTestMessage("TestTopic", 0, "key"))
+
+	if ms.MinOffsetInQueue("TestTopic", 0) != 1 || ms.MaxOffsetInQueue("TestTopic", 0) != 2 {
+		t.Errorf("evict prepared message min offset: %d max offset: %d",
+			ms.MinOffsetInQueue("TestTopic", 0), ms.MaxOffsetInQueue("TestTopic", 0))
+		return
+	}
+
+	getResult := ms.GetMessage("TestGroup", "TestTopic", 0, 1, 4, nil)
+	if getResult.Status != store.FOUND || getResult.GetMessageCount() != 1 {
+		t.Errorf("get message status: %s count: %d", getResult.Status, getResult.GetMessageCount())
+		return
+	}
+}
+
+func TestPutMessages(t *testing.T) {
+	ms := NewMessageStore(NewConfig(), nil)
+	ms.Load()
+	ms.Start()
+	defer ms.Shutdown()
+
+	ms.PutMessage(newTestMessage("TestTopic", 2, "key"))
+
+	var msgs []*store.MessageExtInner
+	for i := 0; i < 5; i++ {
+		msgs = append(msgs, newTestMessage("TestTopic", 2, fmt.Sprintf("batch-%d", i)))
+	}
+
+	result := ms.PutMessages(msgs)
+	if result.Status != store.PUTMESSAGE_PUT_OK || len(result.Results) != 5 {
+		t.Errorf("put messages status: %s results: %d", result.Status, len(result.Results))
+		return
+	}
+
+	for i, r := range result.Results {
+		if r.LogicsOffset != int64(i+1) {
+			t.Errorf("put messages logics offset: %d, expect: %d", r.LogicsOffset, i+1)
+			return
+		}
+	}
+
+	if ms.MaxOffsetInQueue("TestTopic", 2) != 6 {
+		t.Errorf("max offset: %d", ms.MaxOffsetInQueue("TestTopic", 2))
+		return
+	}
+
+	result = ms.PutMessages([]*store.MessageExtInner{newTestMessage("TestTopic", 2, "a"), newTestMessage("TestTopic", 3, "b")})
+	if result.Status != store.MESSAGE_ILLEGAL {
+		t.Errorf("put messages with different queue status: %s", result.Status)
+		return
+	}
+}
+
+func TestLookCompressedMessage(t *testing.T) {
+	ms := NewMessageStore(NewConfig(), nil)
+	ms.Load()
+	ms.Start()
+	defer ms.Shutdown()
+
+	for _, ct := range []store.CompressionType{store.COMPRESSION_ZLIB, store.COMPRESSION_SNAPPY, store.COMPRESSION_ZSTD} {
+		msg := newTestMessage("TestTopic", 0, "key")
+		body, err := store.CompressBody(msg.Body, ct)
+		if err != nil {
+			t.Errorf("compress body by %s err: %s", ct, err)
+			return
+		}
+		msg.Body = body
+		msg.SysFlag = store.BuildCompressionSysFlag(msg.SysFlag, ct)
+
+		result := ms.PutMessage(msg)
+		if result.Status != store.PUTMESSAGE_PUT_OK {
+			t.Errorf("put message status: %s", result.Status)
+			return
+		}
+
+		msgExt := ms.LookMessageByOffset(result.Result.WroteOffset)
+		if msgExt == nil || string(msgExt.Body) != "hello boltmq" || msgExt.SysFlag&store.CompressedFlag != 0 {
+			t.Errorf("look compressed message by %s failed: %v", ct, msgExt)
+			return
+		}
+
+		bufferResult := ms.SelectOneMessageByOffset(result.Result.WroteOffset)
+		data, err := store.DecompressMessageData(bufferResult.Buffer().Bytes())
+		bufferResult.Release()
+		if err != nil {
+			t.Errorf("decompress message data by %s err: %s", ct, err)
+			return
+		}
+
+		msgExt, err = message.DecodeMessageExt(data, true, false)
+		if err != nil || string(msgExt.Body) != "hello boltmq" || int(msgExt.StoreSize) != len(data) {
+			t.Errorf("decode decompressed message data by %s failed: %v", ct, err)
+			return
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package store
+
+import (
+	"sync"
+
+	"github.com/boltmq/boltmq/store/sql92"
+	"github.com/boltmq/common/logger"
+	"github.com/boltmq/common/message"
+	"github.com/boltmq/common/protocol/heartbeat"
+)
+
+const (
+	SUBSCRIPTION_ALL = "*"
+	// maxCachedExpressions 缓存的编译后表达式上限，超过后清空重新编译
+	maxCachedExpressions = 1024
+)
+
+// MessageFilter 消息过滤接口
+// Author zhoufei
+// Since 2017/9/6
+type MessageFilter interface {
+	// IsMessageMatched 根据逻辑队列中的tag hashcode过滤
+	IsMessageMatched(subscriptionData *heartbeat.SubscriptionData, tagsCode int64) bool
+	// IsMatchedByCommitLog 根据commitlog中的消息属性过滤，msgBuffer为一条完整的消息
+	IsMatchedByCommitLog(subscriptionData *heartbeat.SubscriptionData, msgBuffer []byte) bool
+	// IsMatchedByBloomFilter 读取消息前根据属性bloom filter排除不可能匹配的消息，mayContain判断属性取值是否可能存在
+	IsMatchedByBloomFilter(subscriptionData *heartbeat.SubscriptionData, mayContain func(value string) bool) bool
+}
+
+// DefaultMessageFilter 消息过滤规则实现，按tag hashcode过滤，SQL92订阅按消息属性过滤
+// Author zhoufei
+// Since 2017/9/6
+type DefaultMessageFilter struct {
+	expressions map[string]*sql92.Expression // key: 订阅表达式
+	mutex       sync.RWMutex
+}
+
+func (filer *DefaultMessageFilter) IsMessageMatched(subscriptionData *heartbeat.SubscriptionData, tagsCode int64) bool {
+	if nil == subscriptionData {
+		return true
+	}
+
+	if subscriptionData.ClassFilterMode {
+		return true
+	}
+
+	if subscriptionData.SubString == SUBSCRIPTION_ALL {
+		return true
+	}
+
+	// SQL92订阅需要读取消息属性后过滤
+	if sql92.IsExpression(subscriptionData.SubString) {
+		return true
+	}
+
+	return subscriptionData.CodeSet.Contains(tagsCode)
+}
+
+func (filer *DefaultMessageFilter) IsMatchedByCommitLog(subscriptionData *heartbeat.SubscriptionData, msgBuffer []byte) bool {
+	if nil == subscriptionData || !sql92.IsExpression(subscriptionData.SubString) {
+		return true
+	}
+
+	expr := filer.compile(subscriptionData.SubString)
+	if expr == nil {
+		return false
+	}
+
+	msgExt, err := message.DecodeMessageExt(msgBuffer, false, false)
+	if err != nil {
+		logger.Errorf("message filter decode message err: %s.", err)
+		return false
+	}
+
+	return expr.Evaluate(msgExt.Properties)
+}
+
+func (filer *DefaultMessageFilter) IsMatchedByBloomFilter(subscriptionData *heartbeat.SubscriptionData, mayContain func(value string) bool) bool {
+	if nil == subscriptionData || !sql92.IsExpression(subscriptionData.SubString) {
+		return true
+	}
+
+	expr := filer.compile(subscriptionData.SubString)
+	if expr == nil {
+		return false
+	}
+
+	for _, values := range expr.RequiredValues() {
+		matched := false
+		for _, value := range values {
+			if mayContain(value) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+// compile 获取订阅表达式编译结果，同一订阅只编译一次
+func (filer *DefaultMessageFilter) compile(subString string) *sql92.Expression {
+	filer.mutex.RLock()
+	expr, ok := filer.expressions[subString]
+	filer.mutex.RUnlock()
+	if ok {
+		return expr
+	}
+
+	expr, err := sql92.Compile(subString)
+	if err != nil {
+		// 非法表达式在心跳时已被拒绝，这里记录后按不匹配处理
+		logger.Errorf("message filter compile expression %s err: %s.", subString, err)
+	}
+
+	filer.mutex.Lock()
+	if filer.expressions == nil || len(filer.expressions) >= maxCachedExpressions {
+		filer.expressions = make(map[string]*sql92.Expression)
+	}
+	filer.expressions[subString] = expr
+	filer.mutex.Unlock()
+
+	return expr
+}
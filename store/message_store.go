@@ -23,11 +23,12 @@ import (
 // Author zhoufei
 // Since 2017/9/6
 type MessageStore interface {
-	Load() bool                                        //
-	Start() error                                      //
-	Shutdown()                                         // 关闭存储服务
-	Destroy()                                          //
-	PutMessage(msg *MessageExtInner) *PutMessageResult //
+	Load() bool                                            //
+	Start() error                                          //
+	Shutdown()                                             // 关闭存储服务
+	Destroy()                                              //
+	PutMessage(msg *MessageExtInner) *PutMessageResult     //
+	PutMessages(msgs []*MessageExtInner) *PutMessageResult // 批量写入同一队列的消息
 	GetMessage(group string, topic string, queueId int32, offset int64, maxMsgNums int32, subscriptionData *heartbeat.SubscriptionData) *GetMessageResult
 	MaxOffsetInQueue(topic string, queueId int32) int64                                              // 获取指定队列最大Offset 如果队列不存在，返回-1
 	MinOffsetInQueue(topic string, queueId int32) int64                                              // 获取指定队列最小Offset 如果队列不存在，返回-1
@@ -82,7 +82,16 @@ func (clog *commitLog) putMessage(msg *store.MessageExtInner) *store.PutMessageR
 	msg.StoreTimestamp = system.CurrentTimeMillis()
 	msg.BodyCRC, _ = codec.Crc32(msg.Body)
 
-	// TODO 事务消息处理
+	// 压缩复制的消息已投递过，不再重定向
+	compactCopy := isCompactCopy(msg.Properties)
+	tranType := sysflag.GetTransactionValue(int(msg.SysFlag))
+	if !compactCopy && (sysflag.TransactionNotType == tranType || sysflag.TransactionCommitType == tranType) {
+		// 定时、延时投递的消息先写入TIMER_TOPIC、SCHEDULE_TOPIC，到期后再投递到真实topic
+		if !clog.redirectTimerMessage(msg) {
+			clog.redirectDelayMessage(msg)
+		}
+	}
+
 	clog.mutex.Lock()
 	beginLockTimestamp := system.CurrentTimeMillis()
 	msg.BornTimestamp = beginLockTimestamp
@@ -122,6 +131,12 @@ func (clog *commitLog) putMessage(msg *store.MessageExtInner) *store.PutMessageR
 		return &store.PutMessageResult{Status: store.PUTMESSAGE_UNKNOWN_ERROR, Result: result}
 	}
 
+	// prepared消息的LogicsOffset为分配的事务状态表offset
+	tranStateTableOffset := msg.QueueOffset
+	if sysflag.TransactionPreparedType == tranType {
+		tranStateTableOffset = result.LogicsOffset
+	}
+
 	// dispatchRequest
 	disRequest := &dispatchRequest{
 		topic:                     msg.Topic,
@@ -133,9 +148,11 @@ func (clog *commitLog) putMessage(msg *store.MessageExtInner) *store.PutMessageR
 		consumeQueueOffset:        result.LogicsOffset,
 		keys:                      msg.GetKeys(),
 		sysFlag:                   msg.SysFlag,
-		tranStateTableOffset:      msg.QueueOffset,
+		tranStateTableOffset:      tranStateTableOffset,
 		preparedTransactionOffset: msg.PreparedTransactionOffset,
-		producerGroup:             message.PROPERTY_PRODUCER_GROUP,
+		producerGroup:             msg.GetProperty(message.PROPERTY_PRODUCER_GROUP),
+		propertiesMap:             clog.dispatchProperties(msg),
+		compactCopy:               compactCopy,
 	}
 
 	clog.messageStore.dispatchMsgService.putRequest(disRequest)
@@ -154,35 +171,247 @@ func (clog *commitLog) putMessage(msg *store.MessageExtInner) *store.PutMessageR
 	clog.messageStore.storeStats.SetSinglePutMessageTopicSizeTotal(msg.Topic, atomic.AddInt64(&size, result.WroteBytes))
 
 	// Synchronization flush
-	if SYNC_FLUSH == clog.messageStore.config.FlushDisk {
-		if msg.IsWaitStoreMsgOK() {
-			if gcService, ok := clog.flushCLogService.(*groupCommitService); ok {
-				request := newGroupCommitRequest(result.WroteOffset + result.WroteBytes)
-				gcService.putRequest(request)
-
-				flushOk := request.waitForFlush(int64(clog.messageStore.config.SyncFlushTimeout))
-				if flushOk == false {
-					logger.Errorf("do groupcommit, wait for flush failed, topic: %s tags: %s client address: %s.",
-						msg.Topic, msg.GetTags(), msg.BornHost)
-					putMessageResult.Status = store.FLUSH_DISK_TIMEOUT
-				}
-			}
+	if !clog.handleDiskFlush(msg, result.WroteOffset+result.WroteBytes) {
+		putMessageResult.Status = store.FLUSH_DISK_TIMEOUT
+	}
+
+	// 选举复制模式下等待多数节点确认
+	if !clog.handleReplicated(msg, result.WroteOffset+result.WroteBytes) {
+		putMessageResult.Status = store.FLUSH_SLAVE_TIMEOUT
+	}
+
+	// Synchronous write double
+	if status := clog.handleHA(msg, result.WroteOffset+result.WroteBytes); status != store.PUTMESSAGE_PUT_OK {
+		putMessageResult.Status = status
+	}
+
+	return putMessageResult
+}
+
+// dispatchProperties 开启逻辑队列扩展文件时解析写入的消息属性，用于生成bloom filter，与重放commitlog时的结果一致
+func (clog *commitLog) dispatchProperties(msg *store.MessageExtInner) map[string]string {
+	if !clog.messageStore.config.ConsumeQueueExtEnable {
+		return nil
+	}
+
+	return message.String2messageProperties(msg.PropertiesString)
+}
+
+// putMessages 将同一队列的一批消息在一次加锁中连续写入同一个文件
+func (clog *commitLog) putMessages(msgs []*store.MessageExtInner) *store.PutMessageResult {
+	storeTimestamp := system.CurrentTimeMillis()
+	for _, msg := range msgs {
+		msg.StoreTimestamp = storeTimestamp
+		msg.BodyCRC, _ = codec.Crc32(msg.Body)
+	}
+
+	clog.mutex.Lock()
+	beginLockTimestamp := system.CurrentTimeMillis()
+	for _, msg := range msgs {
+		msg.BornTimestamp = beginLockTimestamp
+	}
+
+	mf, err := clog.mfq.getLastMappedFile(int64(0))
+	if err != nil || mf == nil {
+		clog.mutex.Unlock()
+		logger.Errorf("put messages get last mapped file err: %v.", err)
+		return &store.PutMessageResult{Status: store.CREATE_MAPPED_FILE_FAILED}
+	}
+
+	result, results := mf.appendMessagesWithCallBack(msgs, clog.appendMsgCallback)
+	switch result.Status {
+	case store.APPENDMESSAGE_PUT_OK:
+		break
+	case store.END_OF_FILE:
+		mf, err = clog.mfq.getLastMappedFile(int64(0))
+		if err != nil || mf == nil {
+			clog.mutex.Unlock()
+			logger.Errorf("put messages create mapped file2 err: %v, topic: %s.", err, msgs[0].Topic)
+			return &store.PutMessageResult{Status: store.CREATE_MAPPED_FILE_FAILED, Result: result}
 		}
-	} else {
+
+		result, results = mf.appendMessagesWithCallBack(msgs, clog.appendMsgCallback)
+		if result.Status != store.APPENDMESSAGE_PUT_OK {
+			clog.mutex.Unlock()
+			return &store.PutMessageResult{Status: store.MESSAGE_ILLEGAL, Result: result}
+		}
+	case store.MESSAGE_SIZE_EXCEEDED:
+		clog.mutex.Unlock()
+		return &store.PutMessageResult{Status: store.MESSAGE_ILLEGAL, Result: result}
+	default:
+		clog.mutex.Unlock()
+		return &store.PutMessageResult{Status: store.PUTMESSAGE_UNKNOWN_ERROR, Result: result}
+	}
+
+	for i, msg := range msgs {
+		clog.messageStore.dispatchMsgService.putRequest(&dispatchRequest{
+			topic:                     msg.Topic,
+			queueId:                   msg.QueueId,
+			commitLogOffset:           results[i].WroteOffset,
+			msgSize:                   results[i].WroteBytes,
+			tagsCode:                  msg.TagsCode,
+			storeTimestamp:            msg.StoreTimestamp,
+			consumeQueueOffset:        results[i].LogicsOffset,
+			keys:                      msg.GetKeys(),
+			sysFlag:                   msg.SysFlag,
+			tranStateTableOffset:      msg.QueueOffset,
+			preparedTransactionOffset: msg.PreparedTransactionOffset,
+			producerGroup:             msg.GetProperty(message.PROPERTY_PRODUCER_GROUP),
+			propertiesMap:             clog.dispatchProperties(msg),
+		})
+	}
+
+	eclipseTimeInLock := system.CurrentTimeMillis() - beginLockTimestamp
+	clog.mutex.Unlock()
+
+	if eclipseTimeInLock > 1000 {
+		logger.Warnf("putMessages in lock eclipse time(ms) %d.", eclipseTimeInLock)
+	}
+
+	putMessageResult := &store.PutMessageResult{Status: store.PUTMESSAGE_PUT_OK, Result: result, Results: results}
+
+	// Statistics
+	topic := msgs[0].Topic
+	size := clog.messageStore.storeStats.GetSinglePutMessageTopicSizeTotal(topic)
+	clog.messageStore.storeStats.SetSinglePutMessageTopicSizeTotal(topic, atomic.AddInt64(&size, result.WroteBytes))
+
+	// 最后一条消息刷盘即整批消息刷盘
+	if !clog.handleDiskFlush(msgs[len(msgs)-1], result.WroteOffset+result.WroteBytes) {
+		putMessageResult.Status = store.FLUSH_DISK_TIMEOUT
+	}
+
+	if !clog.handleReplicated(msgs[len(msgs)-1], result.WroteOffset+result.WroteBytes) {
+		putMessageResult.Status = store.FLUSH_SLAVE_TIMEOUT
+	}
+
+	if status := clog.handleHA(msgs[len(msgs)-1], result.WroteOffset+result.WroteBytes); status != store.PUTMESSAGE_PUT_OK {
+		putMessageResult.Status = status
+	}
+
+	return putMessageResult
+}
+
+// handleDiskFlush 同步刷盘时等待刷盘到nextOffset，超时返回false；异步刷盘时唤醒刷盘服务
+func (clog *commitLog) handleDiskFlush(msg *store.MessageExtInner, nextOffset int64) bool {
+	if SYNC_FLUSH != clog.messageStore.config.FlushDisk {
 		if flushRTimeService, ok := clog.flushCLogService.(*flushRealTimeService); ok {
 			flushRTimeService.wakeup()
 		}
+		return true
 	}
 
-	// Synchronous write double
-	if SYNC_MASTER == clog.messageStore.config.BrokerRole {
-		// TODO
+	if !msg.IsWaitStoreMsgOK() {
+		return true
 	}
 
-	return putMessageResult
+	gcService, ok := clog.flushCLogService.(*groupCommitService)
+	if !ok {
+		return true
+	}
+
+	request := newGroupCommitRequest(nextOffset)
+	gcService.putRequest(request)
+
+	flushOk := request.waitForFlush(int64(clog.messageStore.config.SyncFlushTimeout))
+	if flushOk == false {
+		logger.Errorf("do groupcommit, wait for flush failed, topic: %s tags: %s client address: %s.",
+			msg.Topic, msg.GetTags(), msg.BornHost)
+	}
+	return flushOk
+}
+
+// handleReplicated 选举复制模式下唤醒复制，并等待nextOffset之前的数据被多数节点确认，超时返回false
+func (clog *commitLog) handleReplicated(msg *store.MessageExtInner, nextOffset int64) bool {
+	election := clog.messageStore.election
+	if election == nil {
+		return true
+	}
+
+	election.notifyAppend()
+	if !msg.IsWaitStoreMsgOK() {
+		return true
+	}
+
+	replicateOk := election.waitForCommit(nextOffset, int64(clog.messageStore.config.ReplicatedCommitTimeout))
+	if !replicateOk {
+		logger.Errorf("wait for replicated commit failed, topic: %s next offset: %d client address: %s.",
+			msg.Topic, nextOffset, msg.BornHost)
+	}
+	return replicateOk
+}
+
+// handleHA SYNC_MASTER模式下等待配置数量的slave确认nextOffset之前的数据，返回确认结果
+func (clog *commitLog) handleHA(msg *store.MessageExtInner, nextOffset int64) store.PutMessageStatus {
+	if SYNC_MASTER != clog.messageStore.config.BrokerRole || clog.messageStore.ha == nil {
+		return store.PUTMESSAGE_PUT_OK
+	}
+
+	if !msg.IsWaitStoreMsgOK() {
+		return store.PUTMESSAGE_PUT_OK
+	}
+
+	status := clog.messageStore.ha.waitForSlaveAck(nextOffset)
+	if status != store.PUTMESSAGE_PUT_OK {
+		logger.Errorf("wait for slave ack failed, status: %s topic: %s next offset: %d client address: %s.",
+			status, msg.Topic, nextOffset, msg.BornHost)
+	}
+	return status
+}
+
+// redirectTimerMessage 将指定了绝对投递时间的消息转存到TIMER_TOPIC，投递时间已过时按普通消息处理
+func (clog *commitLog) redirectTimerMessage(msg *store.MessageExtInner) bool {
+	tms := clog.messageStore.timerMsgService
+	if tms == nil {
+		return false
+	}
+
+	deliverMs, ok := parseDeliverMs(msg)
+	if !ok || deliverMs <= msg.StoreTimestamp+tms.precisionMs {
+		return false
+	}
+
+	message.PutProperty(&msg.Message, message.PROPERTY_REAL_TOPIC, msg.Topic)
+	message.PutProperty(&msg.Message, message.PROPERTY_REAL_QUEUE_ID, strconv.Itoa(int(msg.QueueId)))
+	msg.PropertiesString = message.MessageProperties2String(msg.Properties)
+
+	msg.Topic = TIMER_TOPIC
+	msg.QueueId = TIMER_QUEUE_ID
+	msg.TagsCode = deliverMs
+	return true
+}
+
+// redirectDelayMessage 备份真实的topic、queueId，并将延时消息转存到延时级别对应的队列
+func (clog *commitLog) redirectDelayMessage(msg *store.MessageExtInner) {
+	sms := clog.messageStore.scheduleMsgService
+	if sms == nil {
+		return
+	}
+
+	delayLevel, err := strconv.Atoi(msg.GetProperty(message.PROPERTY_DELAY_TIME_LEVEL))
+	if err != nil || delayLevel <= 0 {
+		return
+	}
+
+	if int32(delayLevel) > sms.maxDelayLevel {
+		delayLevel = int(sms.maxDelayLevel)
+		msg.SetDelayTimeLevel(delayLevel)
+	}
+
+	message.PutProperty(&msg.Message, message.PROPERTY_REAL_TOPIC, msg.Topic)
+	message.PutProperty(&msg.Message, message.PROPERTY_REAL_QUEUE_ID, strconv.Itoa(int(msg.QueueId)))
+	msg.PropertiesString = message.MessageProperties2String(msg.Properties)
+
+	msg.Topic = SCHEDULE_TOPIC
+	msg.QueueId = delayLevel2QueueId(int32(delayLevel))
+	msg.TagsCode = sms.computeDeliverTimestamp(int32(delayLevel), msg.StoreTimestamp)
 }
 
 func (clog *commitLog) getMessage(offset int64, size int32) *mappedBufferResult {
+	// 本地已删除的数据从冷存储读取
+	if tiered := clog.messageStore.tiered; tiered != nil && offset < clog.getMinOffset() {
+		return tiered.getMessage(offset, size)
+	}
+
 	returnFirstOnNotFound := false
 	if 0 == offset {
 		returnFirstOnNotFound = true
@@ -251,7 +480,7 @@ func (clog *commitLog) recoverNormally() {
 }
 
 func (clog *commitLog) pickupStoretimestamp(offset int64, size int32) int64 {
-	if offset > clog.getMinOffset() {
+	if offset > clog.getMinOffset() || clog.messageStore.tiered != nil {
 		result := clog.getMessage(offset, size)
 		if result != nil {
 			defer result.Release()
@@ -339,9 +568,10 @@ func (clog *commitLog) checkMessageAndReturnSize(byteBuffer *mappedByteBuffer, c
 	}
 
 	var (
-		topic          = ""
-		keys           = ""
-		tagsCode int64 = 0
+		topic               = ""
+		keys                = ""
+		tagsCode      int64 = 0
+		propertiesMap map[string]string
 	)
 
 	// 16 TOPIC
@@ -358,13 +588,20 @@ func (clog *commitLog) checkMessageAndReturnSize(byteBuffer *mappedByteBuffer, c
 		propertiesBytes := make([]byte, propertiesLength)
 		byteBuffer.Read(propertiesBytes)
 		properties := string(propertiesBytes)
-		propertiesMap := message.String2messageProperties(properties)
+		propertiesMap = message.String2messageProperties(properties)
 		keys = propertiesMap[message.PROPERTY_KEYS]
 		tags := propertiesMap[message.PROPERTY_TAGS]
 		if len(tags) > 0 {
 			tagsCode = basis.TagsString2tagsCode(basis.ParseTopicFilterType(sysFlag), tags)
 		}
 
+		// Timer message processing
+		if TIMER_TOPIC == topic {
+			if deliverMs, err := strconv.ParseInt(propertiesMap[PROPERTY_TIMER_DELIVER_MS], 10, 64); err == nil {
+				tagsCode = deliverMs
+			}
+		}
+
 		// Timing message processing
 		delayLevelStr, ok := propertiesMap[message.PROPERTY_DELAY_TIME_LEVEL]
 		if SCHEDULE_TOPIC == topic && ok {
@@ -394,6 +631,8 @@ func (clog *commitLog) checkMessageAndReturnSize(byteBuffer *mappedByteBuffer, c
 		tranStateTableOffset:      int64(0),                  // 10
 		preparedTransactionOffset: preparedTransactionOffset, // 11
 		producerGroup:             "",                        // 12
+		propertiesMap:             propertiesMap,             // 13
+		compactCopy:               isCompactCopy(propertiesMap),
 	}
 }
 
@@ -508,8 +747,30 @@ func (clog *commitLog) isMappedFileMatchedRecover(mf *mappedFile) bool {
 	return false
 }
 
-func (clog *commitLog) deleteExpiredFile(expiredTime int64, deleteFilesInterval int32, intervalForcibly int64, cleanImmediately bool) int {
-	return clog.mfq.deleteExpiredFileByTime(expiredTime, int(deleteFilesInterval), intervalForcibly, cleanImmediately)
+// deleteExpiredFile 删除过期的文件，protectedOffset不小于0时不删除结束位置大于protectedOffset的文件，
+// 立即删除时由调用方放宽protectedOffset
+func (clog *commitLog) deleteExpiredFile(expiredTime, protectedOffset int64, deleteFilesInterval int32, intervalForcibly int64, cleanImmediately bool) int {
+	if protectedOffset < 0 {
+		return clog.mfq.deleteExpiredFileByTime(expiredTime, int(deleteFilesInterval), intervalForcibly, cleanImmediately)
+	}
+
+	return clog.mfq.deleteExpiredFiles(func(mf *mappedFile) bool {
+		if mf.fileFromOffset+mf.fileSize > protectedOffset {
+			return false
+		}
+		return cleanImmediately || system.CurrentTimeMillis() > mf.storeTimestamp+expiredTime
+	}, int(deleteFilesInterval), intervalForcibly, cleanImmediately)
+}
+
+// deleteUnneededFile 删除结束位置不大于neededOffset的文件，即不再被任何topic需要的文件，protectedOffset同deleteExpiredFile
+func (clog *commitLog) deleteUnneededFile(neededOffset, protectedOffset int64, deleteFilesInterval int32, intervalForcibly int64, cleanImmediately bool) int {
+	return clog.mfq.deleteExpiredFiles(func(mf *mappedFile) bool {
+		fileEndOffset := mf.fileFromOffset + mf.fileSize
+		if protectedOffset >= 0 && fileEndOffset > protectedOffset {
+			return false
+		}
+		return cleanImmediately || fileEndOffset <= neededOffset
+	}, int(deleteFilesInterval), intervalForcibly, cleanImmediately)
 }
 
 func (clog *commitLog) retryDeleteFirstFile(intervalForcibly int64) bool {
@@ -558,6 +819,47 @@ func (clog *commitLog) appendData(startOffset int64, data []byte) bool {
 	return mf.appendMessage(data)
 }
 
+// truncate 截断offset之后的数据，并清零截断的区域，避免重启恢复时被当作有效消息
+func (clog *commitLog) truncate(offset int64) {
+	clog.mutex.Lock()
+	defer clog.mutex.Unlock()
+
+	if mf := clog.mfq.findMappedFileByOffset(offset, false); mf != nil {
+		pos := offset % int64(clog.messageStore.config.MappedFileSizeCommitLog)
+		if pos < mf.wrotePostion {
+			dirty := mf.byteBuffer.mmapBuf[pos:mf.wrotePostion]
+			copy(dirty, make([]byte, len(dirty)))
+		}
+	}
+
+	clog.mfq.truncateDirtyFiles(offset)
+	if clog.mfq.committedWhere > offset {
+		clog.mfq.committedWhere = offset
+	}
+}
+
+// reset 删除全部文件，并在offset所在位置创建新文件，之后的数据从offset开始追加
+func (clog *commitLog) reset(offset int64) bool {
+	clog.mutex.Lock()
+	defer clog.mutex.Unlock()
+
+	clog.mfq.destroy()
+	clog.mfq.committedWhere = offset
+
+	mf, err := clog.mfq.getLastMappedFile(offset)
+	if err != nil || mf == nil {
+		logger.Errorf("commit log reset to %d create mapped file err: %v.", offset, err)
+		return false
+	}
+
+	// offset可能不是文件起始位置
+	pos := offset - mf.fileFromOffset
+	mf.wrotePostion = pos
+	mf.byteBuffer.writePos = int(pos)
+	mf.committedPosition = pos
+	return true
+}
+
 func (clog *commitLog) destroy() {
 	if clog.mfq != nil {
 		clog.mfq.destroy()
@@ -886,24 +1188,28 @@ func (damcb *defaultAppendMessageCallback) doAppend(fileFromOffset int64, byteBu
 		damcb.clog.topicQueueTable[key] = queryOffset
 	}
 
-	// TODO Transaction messages that require special handling
+	// Transaction messages that require special handling
+	tranType := sysflag.GetTransactionValue(int(msgInner.SysFlag))
+	switch tranType {
+	case sysflag.TransactionPreparedType:
+		// prepared消息不进入逻辑队列，QUEUEOFFSET记录事务状态表offset
+		queryOffset = damcb.clog.messageStore.tsService.getTranStateTableOffset()
+	case sysflag.TransactionRollbackType:
+		queryOffset = msgInner.QueueOffset
+	}
 
-	// Serialize message
-	propertiesData := []byte(msgInner.PropertiesString)
-	propertiesContentLength := len(propertiesData)
-	topicData := []byte(msgInner.Topic)
-	topicContentLength := len(topicData)
-	bodyContentLength := len(msgInner.Body)
+	// 压缩复制的消息沿用原消息的逻辑offset，不占用新的位置
+	compactCopy := isCompactCopy(msgInner.Properties)
+	if compactCopy {
+		queryOffset = msgInner.QueueOffset
+	}
 
-	msgLen := int32(TOTALSIZE + MAGICCODE + BODYCRC + QUEUE_ID + FLAG + QUEUE_OFFSET + PHYSICAL_OFFSET +
-		SYSFLAG + BORN_TIMESTAMP + BORN_HOST + STORE_TIMESTAMP + STORE_HOST_ADDRESS + RE_CONSUME_TIMES +
-		PREPARED_TRANSACTION_OFFSET + BODY_LENGTH + bodyContentLength + TOPIC_LENGTH + topicContentLength +
-		PROPERTIES_LENGTH + propertiesContentLength)
+	msgLen := damcb.calMsgLength(msgInner)
 
 	// Exceeds the maximum message
 	if msgLen > damcb.maxMessageSize {
 		logger.Errorf("message size exceeded, msg total size: %d, msg body size: %d, maxMessageSize: %d.",
-			msgLen, bodyContentLength, damcb.maxMessageSize)
+			msgLen, len(msgInner.Body), damcb.maxMessageSize)
 
 		return &store.AppendMessageResult{Status: store.MESSAGE_SIZE_EXCEEDED}
 	}
@@ -911,35 +1217,151 @@ func (damcb *defaultAppendMessageCallback) doAppend(fileFromOffset int64, byteBu
 	// Determines whether there is sufficient free space
 	spaceLen := msgLen + int32(END_FILE_MIN_BLANK_LENGTH)
 	if spaceLen > maxBlank {
-		damcb.resetMsgStoreItemMemory(maxBlank)
-		damcb.msgStoreItemMemory.WriteInt32(maxBlank)
-		blankMagicCode := BlankMagicCode
-		damcb.msgStoreItemMemory.WriteInt32(int32(blankMagicCode))
-		damcb.msgStoreItemMemory.Write(make([]byte, maxBlank-8))
+		damcb.writeBlank(byteBuffer, maxBlank)
+		return &store.AppendMessageResult{
+			Status:         store.END_OF_FILE,
+			WroteOffset:    wroteOffset,
+			WroteBytes:     int64(maxBlank),
+			MsgId:          msgId,
+			StoreTimestamp: msgInner.StoreTimestamp,
+			LogicsOffset:   queryOffset}
+	}
+
+	// Initialization of storage space
+	damcb.resetMsgStoreItemMemory(msgLen)
+	damcb.writeMessage(msgInner, msgLen, queryOffset, wroteOffset)
+	byteBuffer.Write(damcb.msgStoreItemMemory.Bytes())
+
+	result := &store.AppendMessageResult{
+		Status:         store.APPENDMESSAGE_PUT_OK,
+		WroteOffset:    wroteOffset,
+		WroteBytes:     int64(msgLen),
+		MsgId:          msgId,
+		StoreTimestamp: msgInner.StoreTimestamp,
+		LogicsOffset:   queryOffset}
+
+	switch tranType {
+	case sysflag.TransactionPreparedType:
+		damcb.clog.messageStore.tsService.nextTranStateTableOffset()
+		break
+	case sysflag.TransactionRollbackType:
+		break
+	case sysflag.TransactionNotType:
+		fallthrough
+	case sysflag.TransactionCommitType:
+		if compactCopy {
+			break
+		}
+		atomic.AddInt64(&queryOffset, 1) // The next update ConsumeQueue information
+		damcb.clog.topicQueueTable[key] = atomic.LoadInt64(&queryOffset)
+		break
+	default:
+		break
+	}
 
-		data := damcb.msgStoreItemMemory.Bytes()
-		byteBuffer.Write(data)
+	return result
+}
 
+// doAppendBatch 连续写入同一队列的一批非事务消息，整批消息不跨文件
+func (damcb *defaultAppendMessageCallback) doAppendBatch(fileFromOffset int64, byteBuffer *mappedByteBuffer, maxBlank int32,
+	msgs []*store.MessageExtInner) (*store.AppendMessageResult, []*store.AppendMessageResult) {
+	wroteOffset := fileFromOffset + int64(byteBuffer.writePos)
+	key := msgs[0].Topic + "-" + strconv.Itoa(int(msgs[0].QueueId))
+	queryOffset := damcb.clog.topicQueueTable[key]
+
+	totalLen := int32(0)
+	msgLens := make([]int32, len(msgs))
+	for i, msgInner := range msgs {
+		msgLens[i] = damcb.calMsgLength(msgInner)
+		totalLen += msgLens[i]
+	}
+
+	// 整批消息的大小不能超过单条消息的最大值
+	if totalLen > damcb.maxMessageSize {
+		logger.Errorf("batch message size exceeded, total size: %d, msg nums: %d, maxMessageSize: %d.",
+			totalLen, len(msgs), damcb.maxMessageSize)
+		return &store.AppendMessageResult{Status: store.MESSAGE_SIZE_EXCEEDED}, nil
+	}
+
+	if totalLen+int32(END_FILE_MIN_BLANK_LENGTH) > maxBlank {
+		damcb.writeBlank(byteBuffer, maxBlank)
 		return &store.AppendMessageResult{
 			Status:         store.END_OF_FILE,
 			WroteOffset:    wroteOffset,
 			WroteBytes:     int64(maxBlank),
+			StoreTimestamp: msgs[0].StoreTimestamp}, nil
+	}
+
+	damcb.resetMsgStoreItemMemory(totalLen)
+	results := make([]*store.AppendMessageResult, len(msgs))
+	phyOffset := wroteOffset
+	for i, msgInner := range msgs {
+		msgId, err := message.CreateMessageId(msgInner.StoreHost, phyOffset)
+		if err != nil {
+			logger.Warnf("create message id err: %s.", err)
+		}
+
+		damcb.writeMessage(msgInner, msgLens[i], queryOffset, phyOffset)
+		results[i] = &store.AppendMessageResult{
+			Status:         store.APPENDMESSAGE_PUT_OK,
+			WroteOffset:    phyOffset,
+			WroteBytes:     int64(msgLens[i]),
 			MsgId:          msgId,
 			StoreTimestamp: msgInner.StoreTimestamp,
 			LogicsOffset:   queryOffset}
+
+		phyOffset += int64(msgLens[i])
+		queryOffset++
 	}
 
+	byteBuffer.Write(damcb.msgStoreItemMemory.Bytes())
+	damcb.clog.topicQueueTable[key] = queryOffset
+
+	return &store.AppendMessageResult{
+		Status:         store.APPENDMESSAGE_PUT_OK,
+		WroteOffset:    wroteOffset,
+		WroteBytes:     int64(totalLen),
+		MsgId:          results[0].MsgId,
+		StoreTimestamp: msgs[0].StoreTimestamp,
+		LogicsOffset:   results[0].LogicsOffset}, results
+}
+
+// calMsgLength 计算消息序列化后的长度
+func (damcb *defaultAppendMessageCallback) calMsgLength(msgInner *store.MessageExtInner) int32 {
+	return int32(TOTALSIZE + MAGICCODE + BODYCRC + QUEUE_ID + FLAG + QUEUE_OFFSET + PHYSICAL_OFFSET +
+		SYSFLAG + BORN_TIMESTAMP + BORN_HOST + STORE_TIMESTAMP + STORE_HOST_ADDRESS + RE_CONSUME_TIMES +
+		PREPARED_TRANSACTION_OFFSET + BODY_LENGTH + len(msgInner.Body) + TOPIC_LENGTH + len(msgInner.Topic) +
+		PROPERTIES_LENGTH + len(msgInner.PropertiesString))
+}
+
+// writeBlank 剩余空间不足时，在文件末尾写入空白消息
+func (damcb *defaultAppendMessageCallback) writeBlank(byteBuffer *mappedByteBuffer, maxBlank int32) {
+	damcb.resetMsgStoreItemMemory(maxBlank)
+	damcb.msgStoreItemMemory.WriteInt32(maxBlank)
+	blankMagicCode := BlankMagicCode
+	damcb.msgStoreItemMemory.WriteInt32(int32(blankMagicCode))
+	damcb.msgStoreItemMemory.Write(make([]byte, maxBlank-8))
+
+	data := damcb.msgStoreItemMemory.Bytes()
+	byteBuffer.Write(data)
+}
+
+// writeMessage 将消息序列化到msgStoreItemMemory
+func (damcb *defaultAppendMessageCallback) writeMessage(msgInner *store.MessageExtInner, msgLen int32, queryOffset, phyOffset int64) {
+	propertiesData := []byte(msgInner.PropertiesString)
+	propertiesContentLength := len(propertiesData)
+	topicData := []byte(msgInner.Topic)
+	topicContentLength := len(topicData)
+	bodyContentLength := len(msgInner.Body)
 	messageMagicCode := MessageMagicCode
 
-	// Initialization of storage space
-	damcb.resetMsgStoreItemMemory(msgLen)
 	damcb.msgStoreItemMemory.WriteInt32(msgLen)                                         // 1 TOTALSIZE
 	damcb.msgStoreItemMemory.WriteInt32(int32(messageMagicCode))                        // 2 MAGICCODE
 	damcb.msgStoreItemMemory.WriteInt32(msgInner.BodyCRC)                               // 3 BODYCRC
 	damcb.msgStoreItemMemory.WriteInt32(msgInner.QueueId)                               // 4 QUEUEID
 	damcb.msgStoreItemMemory.WriteInt32(msgInner.Flag)                                  // 5 FLAG
 	damcb.msgStoreItemMemory.WriteInt64(queryOffset)                                    // 6 QUEUEOFFSET
-	damcb.msgStoreItemMemory.WriteInt64(fileFromOffset + int64(byteBuffer.writePos))    // 7 PHYSICALOFFSET
+	damcb.msgStoreItemMemory.WriteInt64(phyOffset)                                      // 7 PHYSICALOFFSET
 	damcb.msgStoreItemMemory.WriteInt32(msgInner.SysFlag)                               // 8 SYSFLAG
 	damcb.msgStoreItemMemory.WriteInt64(msgInner.BornTimestamp)                         // 9 BORNTIMESTAMP
 	damcb.msgStoreItemMemory.Write(damcb.hostStringToBytes(msgInner.BornHost))          // 10 BORNHOST
@@ -959,36 +1381,6 @@ func (damcb *defaultAppendMessageCallback) doAppend(fileFromOffset int64, byteBu
 	if propertiesContentLength > 0 {
 		damcb.msgStoreItemMemory.Write(propertiesData)
 	}
-
-	byteBuffer.Write(damcb.msgStoreItemMemory.Bytes())
-
-	result := &store.AppendMessageResult{
-		Status:         store.APPENDMESSAGE_PUT_OK,
-		WroteOffset:    wroteOffset,
-		WroteBytes:     int64(msgLen),
-		MsgId:          msgId,
-		StoreTimestamp: msgInner.StoreTimestamp,
-		LogicsOffset:   queryOffset}
-
-	tranType := sysflag.GetTransactionValue(int(msgInner.SysFlag))
-	switch tranType {
-	case sysflag.TransactionPreparedType:
-		// TODO 事务消息处理
-		break
-	case sysflag.TransactionRollbackType:
-		// TODO 事务消息处理
-		break
-	case sysflag.TransactionNotType:
-		fallthrough
-	case sysflag.TransactionCommitType:
-		atomic.AddInt64(&queryOffset, 1) // The next update ConsumeQueue information
-		damcb.clog.topicQueueTable[key] = atomic.LoadInt64(&queryOffset)
-		break
-	default:
-		break
-	}
-
-	return result
 }
 
 func (damcb *defaultAppendMessageCallback) hostStringToBytes(hostAddr string) []byte {
@@ -1102,8 +1494,23 @@ func (ccls *cleanCommitLogService) deleteExpiredFiles() {
 		deletePhysicFilesInterval := ccls.messageStore.config.DeleteCommitLogFilesInterval
 		destroyMappedFileIntervalForcibly := ccls.messageStore.config.DestroyMappedFileIntervalForcibly
 
-		deleteCount := ccls.messageStore.clog.deleteExpiredFile(fileReservedTime,
-			deletePhysicFilesInterval, int64(destroyMappedFileIntervalForcibly), cleanAtOnce)
+		// 未分发、未提交的事务及未投递的定时消息所在的文件不删除，强制清理时只保护未分发的数据
+		protectedOffset := ccls.messageStore.protectedPhyOffset(cleanAtOnce)
+		if cleanAtOnce {
+			if timerOffset := ccls.messageStore.timerMsgService.minPendingPhyOffset(); timerOffset >= 0 && timerOffset < protectedOffset {
+				logger.Warnf("clean commit log forcibly, pending timer messages from offset %d may be dropped.", timerOffset)
+			}
+		}
+
+		var deleteCount int
+		if neededOffset := ccls.messageStore.retention.neededPhyOffset(); neededOffset >= 0 {
+			// 设置了topic保留策略时，只删除不再被任何topic需要的文件
+			deleteCount = ccls.messageStore.clog.deleteUnneededFile(neededOffset, protectedOffset,
+				deletePhysicFilesInterval, int64(destroyMappedFileIntervalForcibly), cleanAtOnce)
+		} else {
+			deleteCount = ccls.messageStore.clog.deleteExpiredFile(fileReservedTime, protectedOffset,
+				deletePhysicFilesInterval, int64(destroyMappedFileIntervalForcibly), cleanAtOnce)
+		}
 
 		if deleteCount > 0 {
 			// TODO
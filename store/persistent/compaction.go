@@ -0,0 +1,627 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package persistent
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/boltmq/boltmq/common"
+	"github.com/boltmq/boltmq/store"
+	"github.com/boltmq/common/basis"
+	"github.com/boltmq/common/logger"
+	"github.com/boltmq/common/message"
+	"github.com/boltmq/common/sysflag"
+	"github.com/boltmq/common/utils/system"
+)
+
+const (
+	compactedTagsCode         int64 = math.MinInt64 // 被压缩的索引项的tagsCode，拉取消息时跳过
+	defaultTombstoneRetention int64 = 24            // 删除标记默认保留时间，单位小时
+	compactingFileName              = "compacting"  // 重写逻辑队列文件时的临时文件，位于存储根目录
+	maxCompactCopies                = 10000         // 每次压缩最多复制的存活消息数
+)
+
+const (
+	// PROPERTY_COMPACT_COPY 压缩时复制的存活消息，值为原消息的存储时间
+	PROPERTY_COMPACT_COPY = "COMPACT_COPY"
+)
+
+// compactKey key的最新消息
+type compactKey struct {
+	key       string
+	index     int64 // 最新消息的逻辑offset
+	tombstone bool  // 消息体为空的删除标记
+	storeTime int64
+}
+
+// queueCompaction 单个逻辑队列的压缩状态。keys按索引key hash分桶，
+// holes记录已被覆盖、尚未写入逻辑队列文件的逻辑offset
+type queueCompaction struct {
+	scanOffset   int64
+	keys         map[int32][]*compactKey
+	keyCount     int64
+	holes        map[int64]bool
+	copying      map[int64]bool // 上次压缩复制的消息，等待分发时替换位置
+	minPhyOffset int64          // 存活消息的最小物理offset，-1表示未计算
+}
+
+func newQueueCompaction(scanOffset int64) *queueCompaction {
+	return &queueCompaction{
+		scanOffset:   scanOffset,
+		keys:         make(map[int32][]*compactKey),
+		holes:        make(map[int64]bool),
+		copying:      make(map[int64]bool),
+		minPhyOffset: -1,
+	}
+}
+
+// queueCompactionState 持久化的逻辑队列压缩状态，重启后不需要重新扫描
+type queueCompactionState struct {
+	ScanOffset int64              `json:"scanOffset"`
+	Keys       []*compactKeyState `json:"keys"`
+	Holes      []int64            `json:"holes"`
+}
+
+type compactKeyState struct {
+	Hash      int32  `json:"hash"`
+	Key       string `json:"key"`
+	Index     int64  `json:"index"`
+	Tombstone bool   `json:"tombstone"`
+	StoreTime int64  `json:"storeTime"`
+}
+
+func (qc *queueCompaction) state() *queueCompactionState {
+	state := &queueCompactionState{ScanOffset: qc.scanOffset}
+	for hash, cks := range qc.keys {
+		for _, ck := range cks {
+			state.Keys = append(state.Keys, &compactKeyState{Hash: hash, Key: ck.key, Index: ck.index,
+				Tombstone: ck.tombstone, StoreTime: ck.storeTime})
+		}
+	}
+	for index := range qc.holes {
+		state.Holes = append(state.Holes, index)
+	}
+
+	return state
+}
+
+func newQueueCompactionByState(state *queueCompactionState) *queueCompaction {
+	qc := newQueueCompaction(state.ScanOffset)
+	for _, ks := range state.Keys {
+		qc.keys[ks.Hash] = append(qc.keys[ks.Hash], &compactKey{key: ks.Key, index: ks.Index,
+			tombstone: ks.Tombstone, storeTime: ks.StoreTime})
+		qc.keyCount++
+	}
+	for _, index := range state.Holes {
+		qc.holes[index] = true
+	}
+
+	return qc
+}
+
+// put 记录key的最新消息，之前的消息标记为待压缩
+func (qc *queueCompaction) put(hash int32, key string, index int64, tombstone bool, storeTime int64) {
+	for _, ck := range qc.keys[hash] {
+		if ck.key == key {
+			qc.holes[ck.index] = true
+			ck.index, ck.tombstone, ck.storeTime = index, tombstone, storeTime
+			return
+		}
+	}
+
+	qc.keys[hash] = append(qc.keys[hash], &compactKey{key: key, index: index, tombstone: tombstone, storeTime: storeTime})
+	qc.keyCount++
+}
+
+// dropBefore 移除逻辑offset小于minOffset的key及空洞，消息已随commitlog删除或被保留策略淘汰
+func (qc *queueCompaction) dropBefore(minOffset int64) bool {
+	dropped := false
+	for hash, cks := range qc.keys {
+		retained := cks[:0]
+		for _, ck := range cks {
+			if ck.index < minOffset {
+				qc.keyCount--
+				dropped = true
+				continue
+			}
+			retained = append(retained, ck)
+		}
+
+		if len(retained) == 0 {
+			delete(qc.keys, hash)
+		} else {
+			qc.keys[hash] = retained
+		}
+	}
+
+	for index := range qc.holes {
+		if index < minOffset {
+			delete(qc.holes, index)
+			dropped = true
+		}
+	}
+
+	return dropped
+}
+
+// expireTombstones 存储时间早于threshold且位于sealedOffset之前的删除标记标记为待压缩，并删除对应的key
+func (qc *queueCompaction) expireTombstones(sealedOffset, threshold int64) {
+	for hash, cks := range qc.keys {
+		retained := cks[:0]
+		for _, ck := range cks {
+			if ck.tombstone && ck.storeTime < threshold && ck.index < sealedOffset {
+				qc.holes[ck.index] = true
+				qc.keyCount--
+				continue
+			}
+			retained = append(retained, ck)
+		}
+
+		if len(retained) == 0 {
+			delete(qc.keys, hash)
+		} else {
+			qc.keys[hash] = retained
+		}
+	}
+}
+
+// compactionService 按消息key压缩topic，只保留每个key的最新消息。被覆盖的消息在写满的逻辑队列文件中标记为空洞，
+// 重写为新文件后替换，逻辑offset保持不变，消费者仍可从0开始消费。
+// 存活的消息超过topic的保留时间后复制到commitlog末尾，分发时替换逻辑队列中的位置，之前的commitlog文件可以删除。
+// 压缩状态在每次压缩后持久化，重启后从上次扫描的位置继续
+type compactionService struct {
+	messageStore *PersistentMessageStore
+	queues       map[*consumeQueue]*queueCompaction
+	loaded       map[string]*queueCompaction // 启动时加载的压缩状态，逻辑队列第一次压缩时使用
+	mutex        sync.Mutex
+}
+
+func newCompactionService(messageStore *PersistentMessageStore) *compactionService {
+	return &compactionService{
+		messageStore: messageStore,
+		queues:       make(map[*consumeQueue]*queueCompaction),
+	}
+}
+
+// run 压缩所有开启压缩的topic，由清理任务定期调用
+func (cs *compactionService) run() {
+	ms := cs.messageStore
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	topics := ms.retention.compactTopics()
+	queues := make(map[*consumeQueue]*queueCompaction)
+	if len(topics) == 0 {
+		if len(cs.queues) > 0 {
+			cs.queues = queues
+			cs.persist()
+		}
+		return
+	}
+
+	now := system.CurrentTimeMillis()
+	changed := false
+	quota := maxCompactCopies
+	for topic, cqs := range ms.retention.topicQueues() {
+		tombstoneTime, ok := topics[topic]
+		if !ok || ms.rebuildMsgService.isRebuilding(topic) {
+			continue
+		}
+
+		reservedTime, _ := ms.retention.effective(topic)
+		copyBefore := cs.copyBefore(now - reservedTime*60*60*1000)
+		for _, cq := range cqs {
+			atomic.StoreInt32(&cq.compacted, 1)
+			qc, ok := cs.queues[cq]
+			if !ok {
+				qc = cs.loadedQueue(cq)
+				changed = true
+			}
+
+			if cs.compact(cq, qc, now-tombstoneTime*60*60*1000, copyBefore, &quota) {
+				changed = true
+			}
+			queues[cq] = qc
+		}
+	}
+
+	if len(queues) != len(cs.queues) {
+		changed = true
+	}
+	cs.queues = queues
+	if changed {
+		cs.persist()
+	}
+}
+
+// loadedQueue 使用启动时加载的压缩状态，逻辑队列被截断或重建时重新扫描
+func (cs *compactionService) loadedQueue(cq *consumeQueue) *queueCompaction {
+	key := fmt.Sprintf("%s-%d", cq.topic, cq.queueId)
+	qc, ok := cs.loaded[key]
+	delete(cs.loaded, key)
+	if ok && qc.scanOffset <= cq.getMaxOffsetInQueue() {
+		return qc
+	}
+
+	return newQueueCompaction(cq.getMinOffsetInQueue())
+}
+
+// load 加载压缩状态，文件损坏时重新扫描
+func (cs *compactionService) load() {
+	filePath := common.GetCompactionStatePath(cs.messageStore.config.StorePathRootDir)
+	content, err := common.File2String(filePath)
+	if err != nil || len(content) == 0 {
+		content, err = common.File2String(filePath + ".bak")
+		if err != nil || len(content) == 0 {
+			return
+		}
+	}
+
+	states := make(map[string]*queueCompactionState)
+	if err := json.Unmarshal([]byte(content), &states); err != nil {
+		logger.Warnf("compaction decode state %s err: %s, rescan all compacted topics.", filePath, err)
+		return
+	}
+
+	cs.mutex.Lock()
+	cs.loaded = make(map[string]*queueCompaction, len(states))
+	for key, state := range states {
+		cs.loaded[key] = newQueueCompactionByState(state)
+	}
+	cs.mutex.Unlock()
+	logger.Infof("load compaction state %s success, %d queues.", filePath, len(states))
+}
+
+// persist 持久化压缩状态，调用方需持有mutex
+func (cs *compactionService) persist() {
+	states := make(map[string]*queueCompactionState, len(cs.queues))
+	for cq, qc := range cs.queues {
+		states[fmt.Sprintf("%s-%d", cq.topic, cq.queueId)] = qc.state()
+	}
+
+	content, err := json.Marshal(states)
+	if err != nil {
+		logger.Errorf("compaction encode state err: %s.", err)
+		return
+	}
+
+	filePath := common.GetCompactionStatePath(cs.messageStore.config.StorePathRootDir)
+	if err := common.String2File(content, filePath); err != nil {
+		logger.Errorf("compaction persist state %s err: %s.", filePath, err)
+	}
+}
+
+// neededPhyOffset 逻辑队列中存活消息的最小物理offset，未压缩过时返回false
+func (cs *compactionService) neededPhyOffset(cq *consumeQueue) (int64, bool) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	qc, ok := cs.queues[cq]
+	if !ok || qc.minPhyOffset < 0 {
+		return 0, false
+	}
+
+	return qc.minPhyOffset, true
+}
+
+// copyBefore 最后一条消息早于threshold的commitlog文件的结束位置，文件的最后一条消息不晚于下一个文件的第一条消息
+func (cs *compactionService) copyBefore(threshold int64) int64 {
+	clog := cs.messageStore.clog
+	mfs := clog.mfq.copyMappedFiles(0)
+	offset := int64(0)
+	for i := 0; i+1 < len(mfs); i++ {
+		storeTime := clog.pickupStoretimestamp(mfs[i+1].fileFromOffset, int32(message.MessageStoreTimestampPostion+8))
+		if storeTime < 0 || storeTime >= threshold {
+			break
+		}
+		offset = mfs[i].fileFromOffset + mfs[i].fileSize
+	}
+
+	return offset
+}
+
+// compact 扫描新写入的消息，重写含有待压缩消息的写满的逻辑队列文件，复制物理offset早于copyBefore的存活消息，
+// 返回压缩状态是否变化
+func (cs *compactionService) compact(cq *consumeQueue, qc *queueCompaction, tombstoneThreshold, copyBefore int64, quota *int) bool {
+	ms := cs.messageStore
+	minOffset, maxOffset := cq.getMinOffsetInQueue(), cq.getMaxOffsetInQueue()
+	if qc.scanOffset < minOffset {
+		qc.scanOffset = minOffset
+	}
+	changed := qc.dropBefore(minOffset)
+
+	scanOffset := qc.scanOffset
+	qc.scanOffset = cq.forEachEntry(qc.scanOffset, maxOffset, func(index, phyOffset int64, size int32, tagsCode int64) bool {
+		if tagsCode == compactedTagsCode {
+			return true
+		}
+
+		// 没有key及读取不到的消息不保留
+		key, tombstone, storeTime, ok := cs.readKey(phyOffset, size)
+		if ok && key != "" {
+			qc.put(indexKeyHash(ms.idxService.buildKey(cq.topic, key)), key, index, tombstone, storeTime)
+		} else {
+			qc.holes[index] = true
+		}
+		return true
+	})
+
+	changed = changed || qc.scanOffset != scanOffset
+
+	// 最后一个文件仍在写入，只重写之前写满的文件
+	mfs := cq.mfq.copyMappedFiles(0)
+	if len(mfs) < 2 {
+		cs.copyForward(cq, qc, copyBefore, quota)
+		return changed
+	}
+	sealedOffset := mfs[len(mfs)-1].fileFromOffset / CQStoreUnitSize
+	keyCount := qc.keyCount
+	qc.expireTombstones(sealedOffset, tombstoneThreshold)
+	changed = changed || qc.keyCount != keyCount
+
+	segments := make(map[int64][]int64)
+	for index := range qc.holes {
+		if index < sealedOffset {
+			logicOffset := index * CQStoreUnitSize
+			fileFromOffset := logicOffset - logicOffset%cq.mfSize
+			segments[fileFromOffset] = append(segments[fileFromOffset], index)
+		}
+	}
+
+	for _, mf := range mfs[:len(mfs)-1] {
+		holes, ok := segments[mf.fileFromOffset]
+		if !ok || !cs.rewriteSegment(cq, mf, holes) {
+			continue
+		}
+
+		for _, index := range holes {
+			delete(qc.holes, index)
+		}
+		changed = true
+		logger.Infof("compact topic %s queue %d file %s, %d messages removed.",
+			cq.topic, cq.queueId, mf.fileName, len(holes))
+	}
+
+	cs.copyForward(cq, qc, copyBefore, quota)
+	return changed
+}
+
+// copyForward 将物理offset早于copyBefore的存活消息复制到commitlog末尾，并计算存活消息的最小物理offset。
+// 复制的消息分发时替换原消息的位置，在此之前原消息仍被保护
+func (cs *compactionService) copyForward(cq *consumeQueue, qc *queueCompaction, copyBefore int64, quota *int) {
+	ms := cs.messageStore
+	copying := make(map[int64]bool)
+	minPhyOffset := int64(math.MaxInt64)
+	for _, cks := range qc.keys {
+		for _, ck := range cks {
+			phyOffset, size, ok := ms.retention.entry(cq, ck.index)
+			if !ok {
+				continue
+			}
+			if phyOffset < minPhyOffset {
+				minPhyOffset = phyOffset
+			}
+
+			// 从节点由主节点复制，上次复制的消息可能还未分发
+			if phyOffset >= copyBefore || qc.copying[ck.index] || *quota <= 0 || SLAVE == ms.config.BrokerRole {
+				continue
+			}
+
+			if !cs.copyMessage(cq, ck.index, phyOffset, size) {
+				*quota = 0
+				continue
+			}
+			copying[ck.index] = true
+			*quota--
+		}
+	}
+
+	if len(copying) > 0 {
+		logger.Infof("compact topic %s queue %d, %d live messages copied.", cq.topic, cq.queueId, len(copying))
+	}
+	qc.copying = copying
+	qc.minPhyOffset = minPhyOffset
+}
+
+// copyMessage 复制第index条消息到commitlog末尾，保留压缩的消息体及原消息的逻辑offset
+func (cs *compactionService) copyMessage(cq *consumeQueue, index, phyOffset int64, size int32) bool {
+	ms := cs.messageStore
+	msgExt := cs.readMessage(phyOffset, size)
+	if msgExt == nil || msgExt.Topic != cq.topic || msgExt.QueueId != cq.queueId {
+		return false
+	}
+
+	msgInner := new(store.MessageExtInner)
+	msgInner.Topic = msgExt.Topic
+	msgInner.QueueId = msgExt.QueueId
+	msgInner.QueueOffset = index
+	msgInner.Body = msgExt.Body
+	msgInner.Flag = msgExt.Flag
+
+	storeTime := msgExt.StoreTimestamp
+	if origin, ok := compactCopyStoreTime(msgExt.Properties); ok {
+		storeTime = origin
+	}
+	properties := make(map[string]string, len(msgExt.Properties)+1)
+	for key, value := range msgExt.Properties {
+		properties[key] = value
+	}
+	properties[PROPERTY_COMPACT_COPY] = strconv.FormatInt(storeTime, 10)
+	message.SetPropertiesMap(&msgInner.Message, properties)
+
+	msgInner.TagsCode = basis.TagsString2tagsCode(basis.ParseTopicFilterType(msgExt.SysFlag), msgInner.GetTags())
+	msgInner.SysFlag = int32(sysflag.ResetTransactionValue(int(msgExt.SysFlag), sysflag.TransactionNotType))
+	msgInner.BornTimestamp = msgExt.BornTimestamp
+	msgInner.BornHost = msgExt.BornHost
+	msgInner.StoreHost = msgExt.StoreHost
+	msgInner.ReconsumeTimes = msgExt.ReconsumeTimes
+	msgInner.SetWaitStoreMsgOK(false)
+	msgInner.PropertiesString = message.MessageProperties2String(msgInner.Properties)
+
+	result := ms.PutMessage(msgInner)
+	if result == nil || result.Status != store.PUTMESSAGE_PUT_OK {
+		logger.Warnf("compaction copy topic %s queue %d index %d failed.", cq.topic, cq.queueId, index)
+		return false
+	}
+
+	return true
+}
+
+// readKey 读取消息的第一个key、是否为删除标记及存储时间，复制的消息返回原消息的存储时间
+func (cs *compactionService) readKey(phyOffset int64, size int32) (string, bool, int64, bool) {
+	msg := cs.readMessage(phyOffset, size)
+	if msg == nil {
+		return "", false, 0, false
+	}
+
+	storeTime := msg.StoreTimestamp
+	if origin, ok := compactCopyStoreTime(msg.Properties); ok {
+		storeTime = origin
+	}
+	for _, key := range strings.Split(msg.GetKeys(), message.KEY_SEPARATOR) {
+		if key != "" {
+			return key, len(msg.Body) == 0, storeTime, true
+		}
+	}
+
+	return "", false, 0, true
+}
+
+// readMessage 读取消息，不解压消息体
+func (cs *compactionService) readMessage(phyOffset int64, size int32) *message.MessageExt {
+	result := cs.messageStore.clog.getMessage(phyOffset, size)
+	if result == nil {
+		return nil
+	}
+	defer result.Release()
+
+	msg, err := message.DecodeMessageExt(result.byteBuffer.Bytes(), true, false)
+	if err != nil {
+		logger.Warnf("compaction decode message at offset %d err: %s.", phyOffset, err)
+		return nil
+	}
+
+	return msg
+}
+
+// rewriteSegment 将写满的逻辑队列文件中待压缩的索引项标记为空洞，写入新文件后替换
+func (cs *compactionService) rewriteSegment(cq *consumeQueue, mf *mappedFile, holes []int64) bool {
+	cq.remapMutex.Lock()
+	defer cq.remapMutex.Unlock()
+
+	if !mf.hold() {
+		return false
+	}
+	data := make([]byte, mf.fileSize)
+	copy(data, mf.byteBuffer.mmapBuf[:mf.fileSize])
+	mf.release()
+
+	tagsCode := compactedTagsCode
+	for _, index := range holes {
+		pos := index*CQStoreUnitSize - mf.fileFromOffset + 12
+		binary.BigEndian.PutUint64(data[pos:pos+8], uint64(tagsCode))
+	}
+
+	tmpPath := filepath.Join(cs.messageStore.config.StorePathRootDir, compactingFileName)
+	if err := writeFileSync(tmpPath, data); err != nil {
+		logger.Errorf("compaction write file %s err: %s.", tmpPath, err)
+		return false
+	}
+
+	if err := os.Rename(tmpPath, mf.fileName); err != nil {
+		logger.Errorf("compaction replace file %s err: %s.", mf.fileName, err)
+		os.Remove(tmpPath)
+		return false
+	}
+
+	newMf, err := newMappedFile(mf.fileName, mf.fileSize)
+	if err != nil {
+		logger.Errorf("compaction map file %s err: %s.", mf.fileName, err)
+		return false
+	}
+	newMf.wrotePostion = mf.fileSize
+	newMf.committedPosition = mf.fileSize
+	newMf.byteBuffer.writePos = int(mf.fileSize)
+
+	if !cq.mfq.replaceMappedFile(mf, newMf) {
+		// 文件已被删除，同时删除替换的文件
+		newMf.destroy(0)
+		return false
+	}
+
+	// 读取中的请求释放后解除映射
+	mf.shutdown(0)
+	return true
+}
+
+func (cs *compactionService) keyCount(topic string) int64 {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	count := int64(0)
+	for cq, qc := range cs.queues {
+		if cq.topic == topic {
+			count += qc.keyCount
+		}
+	}
+
+	return count
+}
+
+func isCompactCopy(properties map[string]string) bool {
+	_, ok := properties[PROPERTY_COMPACT_COPY]
+	return ok
+}
+
+func compactCopyStoreTime(properties map[string]string) (int64, bool) {
+	value, ok := properties[PROPERTY_COMPACT_COPY]
+	if !ok {
+		return 0, false
+	}
+
+	storeTime, err := strconv.ParseInt(value, 10, 64)
+	return storeTime, err == nil
+}
+
+func writeFileSync(path string, data []byte) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	n, err := file.Write(data)
+	if err == nil && n != len(data) {
+		err = fmt.Errorf("write %d bytes, expect %d", n, len(data))
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+
+	return err
+}
@@ -0,0 +1,180 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package persistent
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/boltmq/boltmq/store"
+	"github.com/boltmq/common/message"
+	"github.com/boltmq/common/utils/system"
+)
+
+func TestQueueCompaction(t *testing.T) {
+	qc := newQueueCompaction(0)
+	put := func(key string, index int64, tombstone bool, storeTime int64) {
+		qc.put(indexKeyHash("config#"+key), key, index, tombstone, storeTime)
+	}
+
+	put("a", 0, false, 100)
+	put("b", 1, false, 100)
+	put("a", 2, false, 200)
+	put("b", 3, true, 200)
+	put("c", 4, true, 300)
+	if qc.keyCount != 3 {
+		t.Errorf("key count=%d, expect 3", qc.keyCount)
+		return
+	}
+
+	if len(qc.holes) != 2 || !qc.holes[0] || !qc.holes[1] {
+		t.Errorf("holes=%v, expect [0 1]", qc.holes)
+		return
+	}
+
+	// 删除标记c未写满文件，不删除
+	qc.expireTombstones(4, 1000)
+	if qc.keyCount != 2 || len(qc.holes) != 3 || !qc.holes[3] {
+		t.Errorf("key count=%d holes=%v after expire, expect 2 [0 1 3]", qc.keyCount, qc.holes)
+		return
+	}
+
+	put("b", 5, false, 400)
+	if qc.keyCount != 3 || len(qc.holes) != 3 {
+		t.Errorf("key count=%d holes=%v after put, expect 3 [0 1 3]", qc.keyCount, qc.holes)
+		return
+	}
+}
+
+func TestQueueCompactionState(t *testing.T) {
+	qc := newQueueCompaction(0)
+	put := func(key string, index int64, tombstone bool, storeTime int64) {
+		qc.put(indexKeyHash("config#"+key), key, index, tombstone, storeTime)
+	}
+
+	put("a", 0, false, 100)
+	put("b", 1, false, 100)
+	put("a", 2, false, 200)
+	put("c", 3, true, 300)
+	qc.scanOffset = 4
+
+	content, err := json.Marshal(map[string]*queueCompactionState{"config-0": qc.state()})
+	if err != nil {
+		t.Errorf("encode compaction state err: %s", err)
+		return
+	}
+
+	states := make(map[string]*queueCompactionState)
+	if err := json.Unmarshal(content, &states); err != nil || states["config-0"] == nil {
+		t.Errorf("decode compaction state err: %v", err)
+		return
+	}
+
+	loaded := newQueueCompactionByState(states["config-0"])
+	if loaded.scanOffset != 4 || loaded.keyCount != 3 || len(loaded.holes) != 1 || !loaded.holes[0] {
+		t.Errorf("loaded scan offset=%d key count=%d holes=%v", loaded.scanOffset, loaded.keyCount, loaded.holes)
+		return
+	}
+
+	// 加载后覆盖的key记录为空洞
+	loaded.put(indexKeyHash("config#c"), "c", 4, false, 400)
+	if loaded.keyCount != 3 || !loaded.holes[3] {
+		t.Errorf("key count=%d holes=%v after put, expect 3 [0 3]", loaded.keyCount, loaded.holes)
+		return
+	}
+
+	// 逻辑队列最小offset推进后移除之前的key及空洞
+	if !loaded.dropBefore(2) || loaded.keyCount != 2 || len(loaded.holes) != 1 || !loaded.holes[3] {
+		t.Errorf("key count=%d holes=%v after drop, expect 2 [3]", loaded.keyCount, loaded.holes)
+		return
+	}
+	if loaded.dropBefore(2) {
+		t.Errorf("drop again expect nothing changed")
+		return
+	}
+}
+
+func TestCompactionCopyForward(t *testing.T) {
+	ms := newElectionTestStore(t, ASYNC_MASTER)
+	if ms == nil {
+		return
+	}
+	defer destroyElectionTestStore(ms)
+
+	ms.retention.setTopicRetention("TestTopic", &TopicRetention{Compact: true})
+	for _, key := range []string{"a", "b", "a"} {
+		msg := new(store.MessageExtInner)
+		msg.Topic = "TestTopic"
+		msg.QueueId = 0
+		msg.Body = []byte("hello " + key)
+		message.SetPropertiesMap(&msg.Message, map[string]string{message.PROPERTY_KEYS: key})
+		msg.PropertiesString = message.MessageProperties2String(msg.Properties)
+		msg.BornTimestamp = system.CurrentTimeMillis()
+		msg.BornHost = "127.0.0.1:10911"
+		msg.StoreHost = "127.0.0.1:11911"
+		if result := ms.PutMessage(msg); result.Status != store.PUTMESSAGE_PUT_OK {
+			t.Errorf("put message status: %s", result.Status)
+			return
+		}
+	}
+	if !waitQueueOffset(ms, 3) {
+		t.Errorf("dispatch messages timeout")
+		return
+	}
+
+	cq := ms.findConsumeQueue("TestTopic", 0)
+	copyBefore := ms.clog.getMaxOffset()
+	originPhyOffset, _, _ := ms.retention.entry(cq, 1)
+	qc := newQueueCompaction(0)
+	quota := maxCompactCopies
+	ms.compaction.compact(cq, qc, 0, copyBefore, &quota)
+	if len(qc.copying) != 2 || !qc.holes[0] || qc.minPhyOffset != originPhyOffset {
+		t.Errorf("copying=%v holes=%v min phy offset=%d, expect [1 2] [0] %d",
+			qc.copying, qc.holes, qc.minPhyOffset, originPhyOffset)
+		return
+	}
+
+	// 复制的消息分发后替换原消息的位置，不占用新的逻辑offset
+	for i := 0; i < 50; i++ {
+		if phyOffset, _, _ := ms.retention.entry(cq, 1); phyOffset >= copyBefore {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	for index, key := range map[int64]string{1: "b", 2: "a"} {
+		phyOffset, size, ok := ms.retention.entry(cq, index)
+		if !ok || phyOffset < copyBefore {
+			t.Errorf("index %d phy offset=%d, expect remapped after %d", index, phyOffset, copyBefore)
+			return
+		}
+
+		msg := ms.compaction.readMessage(phyOffset, size)
+		if msg == nil || msg.GetKeys() != key || msg.QueueOffset != index || !isCompactCopy(msg.Properties) {
+			t.Errorf("index %d copied message=%v, expect key %s", index, msg, key)
+			return
+		}
+	}
+	if ms.MaxOffsetInQueue("TestTopic", 0) != 3 {
+		t.Errorf("max offset=%d after copy, expect 3", ms.MaxOffsetInQueue("TestTopic", 0))
+		return
+	}
+
+	// 再次压缩时存活的消息都在copyBefore之后
+	ms.compaction.compact(cq, qc, 0, copyBefore, &quota)
+	if len(qc.copying) != 0 || qc.minPhyOffset < copyBefore {
+		t.Errorf("copying=%v min phy offset=%d after remap, expect [] >= %d", qc.copying, qc.minPhyOffset, copyBefore)
+		return
+	}
+}
@@ -43,6 +43,7 @@ type Config struct {
 	CheckTransactionMessageAtleastInterval int64                 `json:"CheckTransactionMessageAtleastInterval"` // 事务回查至少间隔时间
 	CheckTransactionMessageTimerInterval   int64                 `json:"CheckTransactionMessageTimerInterval"`   // 事务回查定时间隔时间
 	CheckTransactionMessageEnable          bool                  `json:"CheckTransactionMessageEnable"`          // 是否开启事务Check过程，双十一时，可以关闭
+	CheckTransactionMessageMaxTimes        int32                 `json:"CheckTransactionMessageMaxTimes"`        // 事务回查最大次数，超过后回滚
 	MappedFileSizeCommitLog                int32                 `json:"MappedFileSizeCommitLog"`                // CommitLog每个文件大小 1G
 	MappedFileSizeConsumeQueue             int32                 `json:"MappedFileSizeConsumeQueue"`             // ConsumeQueue每个文件大小 默认存储30W条消息
 	FlushIntervalCommitLog                 int32                 `json:"FlushIntervalCommitLog"`                 // CommitLog刷盘间隔时间（单位毫秒）
@@ -72,20 +73,51 @@ type Config struct {
 	MaxHashSlotNum                         int32                 `json:"MaxHashSlotNum"`
 	MaxIndexNum                            int32                 `json:"MaxIndexNum"`
 	MaxMsgsNumBatch                        int32                 `json:"MaxMsgsNumBatch"`
-	MessageIndexSafe                       bool                  `json:"MessageIndexSafe"`         // 是否使用安全的消息索引功能，即可靠模式。可靠模式下，异常宕机恢复慢; 非可靠模式下，异常宕机恢复快
-	HaListenPort                           int32                 `json:"HaListenPort"`             // HA功能
-	HaSendHeartbeatInterval                int32                 `json:"HaSendHeartbeatInterval"`  //
-	HaHousekeepingInterval                 int32                 `json:"HaHousekeepingInterval"`   //
-	HaTransferBatchSize                    int32                 `json:"HaTransferBatchSize"`      //
-	HaMasterAddress                        string                `json:"HaMasterAddress"`          // 如果不设置，则从NameServer获取Master HA服务地址
-	HaSlaveFallbehindMax                   int32                 `json:"HaSlaveFallbehindMax"`     // Slave落后Master超过此值，则认为存在异常
-	BrokerRole                             BrokerRoleType        `json:"BrokerRole"`               //
-	FlushDisk                              FlushDiskType         `json:"FlushDisk"`                //
-	SyncFlushTimeout                       int32                 `json:"SyncFlushTimeout"`         // 同步刷盘超时时间
-	MessageDelayLevel                      string                `json:"MessageDelayLevel"`        // 定时消息相关
-	FlushDelayOffsetInterval               int64                 `json:"FlushDelayOffsetInterval"` //
-	CleanFileForciblyEnable                bool                  `json:"CleanFileForciblyEnable"`  // 磁盘空间超过90%警戒水位，自动开始删除文件
-	SyncMethod                             SynchronizationMethod `json:"SyncMethod"`               // 主从同步数据类型
+	MessageIndexSafe                       bool                  `json:"MessageIndexSafe"`          // 是否使用安全的消息索引功能，即可靠模式。可靠模式下，异常宕机恢复慢; 非可靠模式下，异常宕机恢复快
+	HaListenPort                           int32                 `json:"HaListenPort"`              // HA功能
+	HaSendHeartbeatInterval                int32                 `json:"HaSendHeartbeatInterval"`   //
+	HaHousekeepingInterval                 int32                 `json:"HaHousekeepingInterval"`    //
+	HaTransferBatchSize                    int32                 `json:"HaTransferBatchSize"`       //
+	HaMasterAddress                        string                `json:"HaMasterAddress"`           // 如果不设置，则从NameServer获取Master HA服务地址
+	HaSlaveFallbehindMax                   int32                 `json:"HaSlaveFallbehindMax"`      // Slave落后Master超过此值，则认为存在异常
+	BrokerRole                             BrokerRoleType        `json:"BrokerRole"`                //
+	FlushDisk                              FlushDiskType         `json:"FlushDisk"`                 //
+	SyncFlushTimeout                       int32                 `json:"SyncFlushTimeout"`          // 同步刷盘超时时间
+	MessageDelayLevel                      string                `json:"MessageDelayLevel"`         // 定时消息相关
+	FlushDelayOffsetInterval               int64                 `json:"FlushDelayOffsetInterval"`  //
+	TimerPrecisionMs                       int64                 `json:"TimerPrecisionMs"`          // 任意时间定时消息的时间轮刻度，毫秒
+	TimerWheelSlots                        int32                 `json:"TimerWheelSlots"`           // 时间轮槽位数
+	TimerMaxDelay                          int64                 `json:"TimerMaxDelay"`             // 定时消息最长延时，毫秒
+	CleanFileForciblyEnable                bool                  `json:"CleanFileForciblyEnable"`   // 磁盘空间超过90%警戒水位，自动开始删除文件
+	ConsumeQueueExtEnable                  bool                  `json:"ConsumeQueueExtEnable"`     // 是否开启逻辑队列扩展文件，保存每条消息属性的bloom filter
+	ConsumeQueueExtBloomBits               int32                 `json:"ConsumeQueueExtBloomBits"`  // 每条消息bloom filter的位数，需为8的倍数
+	SyncMethod                             SynchronizationMethod `json:"SyncMethod"`                // 主从同步数据类型
+	ReplicatedLogEnable                    bool                  `json:"ReplicatedLogEnable"`       // 是否开启选举复制模式，同一brokerName的broker自动选主
+	ElectionSelfId                         int64                 `json:"ElectionSelfId"`            // 本节点在选举组中的id
+	ElectionPeers                          string                `json:"ElectionPeers"`             // 选举组全部节点，格式：id@ip:port;id@ip:port
+	ElectionTimeout                        int32                 `json:"ElectionTimeout"`           // 未收到leader心跳超过该时间（单位毫秒，随机放大至两倍内）发起选举
+	ElectionHeartbeatInterval              int32                 `json:"ElectionHeartbeatInterval"` // leader心跳及复制间隔（单位毫秒）
+	ReplicatedCommitTimeout                int32                 `json:"ReplicatedCommitTimeout"`   // 等待多数副本确认的超时时间（单位毫秒）
+	SyncReplicasQuorum                     int32                 `json:"SyncReplicasQuorum"`        // SYNC_MASTER模式下写入需要确认的slave数量
+	SyncReplicasTimeout                    int32                 `json:"SyncReplicasTimeout"`       // 等待slave确认写入的超时时间（单位毫秒）
+	HaSlaveAutoRebase                      bool                  `json:"HaSlaveAutoRebase"`         // slave同步位置早于master最小offset时，是否清空本地数据从master最小offset重新同步
+	HaTLSEnable                            bool                  `json:"HaTLSEnable"`               // HA复制通道是否开启TLS
+	HaTLSCertFile                          string                `json:"HaTLSCertFile"`             // 本节点证书，master与slave均使用
+	HaTLSKeyFile                           string                `json:"HaTLSKeyFile"`              // 本节点证书私钥
+	HaTLSCAFile                            string                `json:"HaTLSCAFile"`               // CA证书，配置后双向校验证书（mTLS）
+	HaTLSServerName                        string                `json:"HaTLSServerName"`           // slave校验master证书使用的名称，默认为master地址的host
+	HaTLSAllowedNames                      string                `json:"HaTLSAllowedNames"`         // 允许连接的slave证书名称（CN或DNS），格式：name1;name2，为空时不限制
+	HaAuthSecret                           string                `json:"HaAuthSecret"`              // 共享密钥，配置后slave需以HMAC应答master下发的随机数
+	RebuildTopics                          string                `json:"RebuildTopics"`             // 启动时从commitlog重建逻辑队列的topic，多个以;分隔，*表示全部
+	RebuildIndex                           bool                  `json:"RebuildIndex"`              // 启动时是否从commitlog重建索引文件
+	ColdStorageType                        string                `json:"ColdStorageType"`           // 冷存储类型 local、s3，为空时不开启。开启后逻辑队列及索引不再随commitlog删除
+	ColdStorageDir                         string                `json:"ColdStorageDir"`            // local冷存储目录
+	ColdStorageEndpoint                    string                `json:"ColdStorageEndpoint"`       // s3服务地址，例如 https://s3.amazonaws.com
+	ColdStorageRegion                      string                `json:"ColdStorageRegion"`         // s3 region
+	ColdStorageBucket                      string                `json:"ColdStorageBucket"`         // s3 bucket
+	ColdStoragePrefix                      string                `json:"ColdStoragePrefix"`         // s3对象名前缀
+	ColdStorageAccessKey                   string                `json:"ColdStorageAccessKey"`      // s3 access key
+	ColdStorageSecretKey                   string                `json:"ColdStorageSecretKey"`      // s3 secret key
 }
 
 func NewConfig(storeRootDir string) *Config {
@@ -106,12 +138,13 @@ func newConfig(storeRootDir string) *Config {
 	conf.StoreCheckpoint = common.GetStorePathCheckpoint(storeRootDir)
 	conf.AbortFile = common.GetStorePathAbortFile(storeRootDir)
 	conf.TranStateTableStorePath = common.GetTranStateTableStorePath(storeRootDir)
-	conf.TranStateTableMappedFileSize = 2000000 * 1
+	conf.TranStateTableMappedFileSize = 2000000 * TSStoreUnitSize
 	conf.TranRedoLogStorePath = common.GetTranRedoLogStorePath(storeRootDir)
 	conf.TranRedoLogMappedFileSize = 2000000 * CQStoreUnitSize
 	conf.CheckTransactionMessageAtleastInterval = 1000 * 60
 	conf.CheckTransactionMessageTimerInterval = 1000 * 60
 	conf.CheckTransactionMessageEnable = true
+	conf.CheckTransactionMessageMaxTimes = 15
 	conf.MappedFileSizeCommitLog = 1024 * 1024 * 1024
 	conf.MappedFileSizeConsumeQueue = 300000 * CQStoreUnitSize
 	conf.FlushIntervalCommitLog = 1000
@@ -152,8 +185,20 @@ func newConfig(storeRootDir string) *Config {
 	conf.SyncFlushTimeout = 1000 * 5
 	conf.MessageDelayLevel = "1s 5s 10s 30s 1m 2m 3m 4m 5m 6m 7m 8m 9m 10m 20m 30m 1h 2h"
 	conf.FlushDelayOffsetInterval = 1000 * 10
+	conf.TimerPrecisionMs = 1000
+	conf.TimerWheelSlots = 3600
+	conf.TimerMaxDelay = 1000 * 60 * 60 * 24 * 40
 	conf.CleanFileForciblyEnable = true
+	conf.ConsumeQueueExtEnable = false
+	conf.ConsumeQueueExtBloomBits = 256
 	conf.SyncMethod = SYNCHRONIZATION_LAST
+	conf.ReplicatedLogEnable = false
+	conf.ElectionTimeout = 1000 * 3
+	conf.ElectionHeartbeatInterval = 500
+	conf.ReplicatedCommitTimeout = 1000 * 5
+	conf.SyncReplicasQuorum = 1
+	conf.SyncReplicasTimeout = 1000 * 5
+	conf.HaSlaveAutoRebase = false
 	return conf
 }
 
@@ -64,6 +64,9 @@ func (fcqs *flushConsumeQueueService) doFlush(retryTimes int32) {
 		}
 	}
 
+	// 事务状态表、redo log刷盘
+	fcqs.messageStore.tsService.commit(flushConsumeQueueLeastPages)
+
 	if 0 == flushConsumeQueueLeastPages {
 		if logicMsgTimestamp > 0 {
 			fcqs.messageStore.steCheckpoint.logicsMsgTimestamp = logicMsgTimestamp
@@ -121,11 +124,12 @@ func (ccqs *cleanConsumeQueueService) deleteExpiredFiles() {
 		ccqs.lastPhysicalMinOffset = minOffset
 	}
 
-	// 删除逻辑队列文件
+	// 删除逻辑队列文件，开启冷存储时保留
+	logicMinOffset := ccqs.messageStore.logicMinPhyOffset()
 	consumeTopicTables := ccqs.messageStore.consumeTopicTable
 	for _, value := range consumeTopicTables {
 		for _, logic := range value.consumeQueues {
-			deleteCount := logic.deleteExpiredFile(minOffset)
+			deleteCount := logic.deleteExpiredFile(logicMinOffset)
 
 			if deleteCount > 0 && deleteLogicsFilesInterval > 0 {
 				time.Sleep(time.Duration(deleteLogicsFilesInterval))
@@ -133,6 +137,9 @@ func (ccqs *cleanConsumeQueueService) deleteExpiredFiles() {
 		}
 	}
 
+	// 删除事务状态表、redo log
+	ccqs.messageStore.tsService.deleteExpiredFile(minOffset)
+
 	// 删除索引
-	ccqs.messageStore.idxService.deleteExpiredFile(minOffset)
+	ccqs.messageStore.idxService.deleteExpiredFile(logicMinOffset)
 }
@@ -20,9 +20,14 @@ import (
 	"fmt"
 	"math"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/boltmq/boltmq/common"
+	"github.com/boltmq/boltmq/store"
 	"github.com/boltmq/common/logger"
+	"github.com/boltmq/common/protocol/heartbeat"
 )
 
 type consumeQueue struct {
@@ -34,7 +39,11 @@ type consumeQueue struct {
 	storePath       string                  // 存储路径
 	mfSize          int64                   // 映射文件大小
 	maxPhysicOffset int64                   // 最后一个消息对应的物理Offset
-	minLogicOffset  int64                   // 逻辑队列的最小Offset，删除物理文件时，计算出来的最小Offset
+	minLogicOffset  int64                   // 逻辑队列的最小Offset，删除物理文件时，计算出来的最小Offset，原子读写
+	minOffsetMutex  sync.Mutex              // 保留策略与清理任务并发推进最小Offset
+	ext             *consumeQueueExt        // 扩展文件，未开启时为nil
+	compacted       int32                   // 按key压缩的队列，存活消息被复制后物理offset不再递增，原子读写
+	remapMutex      sync.Mutex              // 压缩重写文件与替换消息位置互斥
 }
 
 func newConsumeQueue(topic string, queueId int32, storePath string, mfSize int64, messageStore *PersistentMessageStore) *consumeQueue {
@@ -51,11 +60,20 @@ func newConsumeQueue(topic string, queueId int32, storePath string, mfSize int64
 	cq.mfq = newMappedFileQueue(queueDir, mfSize, nil)
 	cq.byteBufferIndex = newMappedByteBuffer(make([]byte, CQStoreUnitSize))
 
+	config := messageStore.config
+	if config.ConsumeQueueExtEnable && topic != TRANSACTION_REDOLOG_TOPIC {
+		cq.ext = newConsumeQueueExt(topic, queueId, common.GetStorePathConsumeQueueExt(config.StorePathRootDir),
+			mfSize, config.ConsumeQueueExtBloomBits)
+	}
+
 	return cq
 }
 
 func (cq *consumeQueue) load() bool {
 	result := cq.mfq.load()
+	if result && cq.ext != nil {
+		result = cq.ext.load()
+	}
 	resultMsg := "failed"
 	if result {
 		resultMsg = "success"
@@ -68,7 +86,7 @@ func (cq *consumeQueue) load() bool {
 func (cq *consumeQueue) getIndexBuffer(startIndex int64) *mappedBufferResult {
 	offset := startIndex * int64(CQStoreUnitSize)
 
-	if offset >= cq.minLogicOffset {
+	if offset >= atomic.LoadInt64(&cq.minLogicOffset) {
 		mf := cq.mfq.findMappedFileByOffset(offset, false)
 		if mf != nil {
 			result := mf.selectMappedBuffer(offset % cq.mfSize)
@@ -85,26 +103,74 @@ func (cq *consumeQueue) rollNextFile(index int64) int64 {
 	return nextIndex
 }
 
+// correctMinOffset 从当前最小位置向后查找第一条物理offset不小于phyMinOffset的索引，
+// 最小位置只前进不后退，全部过期时推进到队列末尾
 func (cq *consumeQueue) correctMinOffset(phyMinOffset int64) {
-	mf := cq.mfq.getFirstMappedFileOnLock()
-	if mf != nil {
+	cq.minOffsetMutex.Lock()
+	defer cq.minOffsetMutex.Unlock()
+
+	mfs := cq.mfq.copyMappedFiles(0)
+	if len(mfs) == 0 {
+		return
+	}
+
+	minLogicOffset := atomic.LoadInt64(&cq.minLogicOffset)
+	for _, mf := range mfs {
+		if mf.fileFromOffset+cq.mfSize <= minLogicOffset {
+			continue
+		}
+
 		result := mf.selectMappedBuffer(0)
-		if result != nil {
-			defer result.Release()
-			for i := 0; i < int(result.size); i += CQStoreUnitSize {
-				offsetPy := result.byteBuffer.ReadInt64()
-				result.byteBuffer.ReadInt32()
-				result.byteBuffer.ReadInt64()
-
-				if offsetPy >= phyMinOffset {
-					cq.minLogicOffset = result.mfile.fileFromOffset + int64(i)
-					//logger.Infof("compute logics min offset: %d, topic: %s, queueId: %d",
-					//	cq.getMinOffsetInQueue(), cq.topic, cq.queueId)
-					break
-				}
+		if result == nil {
+			continue
+		}
+
+		start := 0
+		if minLogicOffset > mf.fileFromOffset {
+			start = int(minLogicOffset - mf.fileFromOffset)
+			result.byteBuffer.readPos = start
+		}
+
+		for i := start; i < int(result.size); i += CQStoreUnitSize {
+			offsetPy := result.byteBuffer.ReadInt64()
+			result.byteBuffer.ReadInt32()
+			result.byteBuffer.ReadInt64()
+
+			if offsetPy >= phyMinOffset {
+				atomic.StoreInt64(&cq.minLogicOffset, mf.fileFromOffset+int64(i))
+				result.Release()
+				return
+			}
+		}
+		result.Release()
+	}
+
+	atomic.StoreInt64(&cq.minLogicOffset, cq.mfq.getMaxOffset())
+}
+
+// forEachEntry 顺序遍历[from, to)的索引，fn返回false时停止，返回停止时的逻辑offset
+func (cq *consumeQueue) forEachEntry(from, to int64, fn func(index, phyOffset int64, size int32, tagsCode int64) bool) int64 {
+	for from < to {
+		result := cq.getIndexBuffer(from)
+		if result == nil {
+			return from
+		}
+
+		for i := int32(0); i < result.size && from < to; i += CQStoreUnitSize {
+			phyOffset := result.byteBuffer.ReadInt64()
+			size := result.byteBuffer.ReadInt32()
+			tagsCode := result.byteBuffer.ReadInt64()
+
+			if !fn(from, phyOffset, size, tagsCode) {
+				result.Release()
+				return from
 			}
+			from++
 		}
+		result.Release()
 	}
+
+	return from
 }
 
 func getMappedFileByIndex(mfs *list.List, index int) *mappedFile {
@@ -191,6 +257,10 @@ func (cq *consumeQueue) recover() {
 		cq.mfq.truncateDirtyFiles(processOffset)
 
 	}
+
+	if cq.ext != nil {
+		cq.ext.truncate(cq.getMaxOffsetInQueue())
+	}
 }
 
 func (cq *consumeQueue) getOffsetInQueueByTime(timestamp int64) int64 {
@@ -200,8 +270,8 @@ func (cq *consumeQueue) getOffsetInQueueByTime(timestamp int64) int64 {
 		offset := 0
 		high := 0
 		low := 0
-		if cq.minLogicOffset > mf.fileFromOffset {
-			low = int(cq.minLogicOffset - mf.fileFromOffset)
+		if minLogicOffset := atomic.LoadInt64(&cq.minLogicOffset); minLogicOffset > mf.fileFromOffset {
+			low = int(minLogicOffset - mf.fileFromOffset)
 		}
 
 		midOffset, targetOffset, leftOffset, rightOffset := -1, -1, -1, -1
@@ -271,18 +341,19 @@ func (cq *consumeQueue) getOffsetInQueueByTime(timestamp int64) int64 {
 }
 
 func (cq *consumeQueue) getMinOffsetInQueue() int64 {
-	return cq.minLogicOffset / CQStoreUnitSize
+	return atomic.LoadInt64(&cq.minLogicOffset) / CQStoreUnitSize
 }
 
 func (cq *consumeQueue) getMaxOffsetInQueue() int64 {
 	return cq.mfq.getMaxOffset() / CQStoreUnitSize
 }
 
-func (cq *consumeQueue) putMessagePostionInfoWrapper(offset, size, tagsCode, storeTimestamp, logicOffset int64) {
+func (cq *consumeQueue) putMessagePostionInfoWrapper(offset, size, tagsCode, storeTimestamp, logicOffset int64,
+	properties map[string]string) {
 	maxRetries := 5
 	//canWrite := cq.messageStore.runFlags.isWriteable()
 	for i := 0; i < maxRetries; i++ {
-		result := cq.putMessagePostionInfo(offset, size, tagsCode, logicOffset)
+		result := cq.putMessagePostionInfo(offset, size, tagsCode, logicOffset, properties)
 		if result {
 			cq.messageStore.steCheckpoint.logicsMsgTimestamp = storeTimestamp
 			return
@@ -298,7 +369,7 @@ func (cq *consumeQueue) putMessagePostionInfoWrapper(offset, size, tagsCode, sto
 	cq.messageStore.runFlags.makeLogicsQueueError()
 }
 
-func (cq *consumeQueue) putMessagePostionInfo(offset, size, tagsCode, cqOffset int64) bool {
+func (cq *consumeQueue) putMessagePostionInfo(offset, size, tagsCode, cqOffset int64, properties map[string]string) bool {
 	if offset <= cq.maxPhysicOffset {
 		return true
 	}
@@ -317,7 +388,7 @@ func (cq *consumeQueue) putMessagePostionInfo(offset, size, tagsCode, cqOffset i
 	if mf != nil {
 		// 纠正MappedFile逻辑队列索引顺序
 		if mf.firstCreateInQueue && cqOffset != 0 && mf.wrotePostion == 0 {
-			cq.minLogicOffset = expectLogicOffset
+			atomic.StoreInt64(&cq.minLogicOffset, expectLogicOffset)
 			cq.fillPreBlank(mf, expectLogicOffset)
 			logger.Infof("fill pre blank space %s %d %d.", mf.fileName, expectLogicOffset, mf.wrotePostion)
 		}
@@ -333,7 +404,16 @@ func (cq *consumeQueue) putMessagePostionInfo(offset, size, tagsCode, cqOffset i
 		// 记录物理队列最大offset
 		cq.maxPhysicOffset = offset
 		byteBuffers := cq.byteBufferIndex.Bytes()
-		return mf.appendMessage(byteBuffers)
+		if !mf.appendMessage(byteBuffers) {
+			return false
+		}
+
+		// 扩展文件写入失败只影响过滤效率，不影响消息正确性
+		if cq.ext != nil && !cq.ext.put(cqOffset, properties) {
+			logger.Warnf("consumequeue ext put bloom filter failed, topic: %s queueId: %d offset: %d.",
+				cq.topic, cq.queueId, cqOffset)
+		}
+		return true
 	}
 
 	return false
@@ -354,6 +434,9 @@ func (cq *consumeQueue) fillPreBlank(mf *mappedFile, untilWhere int64) {
 }
 
 func (cq *consumeQueue) commit(flushLeastPages int32) bool {
+	if cq.ext != nil {
+		cq.ext.commit(flushLeastPages)
+	}
 	return cq.mfq.commit(flushLeastPages)
 }
 
@@ -386,6 +469,11 @@ func (cq *consumeQueue) getLastOffset() int64 {
 
 func (cq *consumeQueue) truncateDirtyLogicFiles(phyOffet int64) {
 	logicFileSize := int(cq.mfSize)
+	if cq.ext != nil {
+		defer func() {
+			cq.ext.truncate(cq.getMaxOffsetInQueue())
+		}()
+	}
 
 	for {
 		mf := cq.mfq.getLastMappedFile2()
@@ -436,8 +524,11 @@ func (cq *consumeQueue) truncateDirtyLogicFiles(phyOffet int64) {
 
 func (cq *consumeQueue) destroy() {
 	cq.maxPhysicOffset = -1
-	cq.minLogicOffset = 0
+	atomic.StoreInt64(&cq.minLogicOffset, 0)
 	cq.mfq.destroy()
+	if cq.ext != nil {
+		cq.ext.destroy()
+	}
 }
 
 func (cq *consumeQueue) resetMsgStoreItemMemory(length int32) {
@@ -450,7 +541,97 @@ func (cq *consumeQueue) resetMsgStoreItemMemory(length int32) {
 }
 
 func (cq *consumeQueue) deleteExpiredFile(offset int64) int {
-	count := cq.mfq.deleteExpiredFileByOffset(offset, CQStoreUnitSize)
+	var count int
+	if atomic.LoadInt32(&cq.compacted) == 1 {
+		count = cq.deleteCompactedFiles(offset)
+	} else {
+		count = cq.mfq.deleteExpiredFileByOffset(offset, CQStoreUnitSize)
+	}
 	cq.correctMinOffset(offset)
+	if cq.ext != nil {
+		cq.ext.deleteExpiredFile(cq.getMinOffsetInQueue())
+	}
 	return count
 }
+
+// deleteCompactedFiles 压缩的队列中存活的消息被复制到commitlog末尾，文件最后一条索引不再是最大的物理offset，
+// 写满的文件中所有未被压缩的索引都早于offset时才删除
+func (cq *consumeQueue) deleteCompactedFiles(offset int64) int {
+	toBeDeleteFileList := list.New()
+	mfs := cq.mfq.copyMappedFiles(0)
+	for i := 0; i < len(mfs)-1; i++ {
+		mf := mfs[i]
+		result := mf.selectMappedBuffer(0)
+		if result == nil {
+			break
+		}
+
+		expired := true
+		for pos := int32(0); pos < result.size; pos += CQStoreUnitSize {
+			phyOffset := result.byteBuffer.ReadInt64()
+			result.byteBuffer.ReadInt32()
+			tagsCode := result.byteBuffer.ReadInt64()
+			if tagsCode != compactedTagsCode && phyOffset >= offset {
+				expired = false
+				break
+			}
+		}
+		result.Release()
+
+		if !expired || !mf.destroy(1000*60) {
+			break
+		}
+		toBeDeleteFileList.PushBack(mf)
+		logger.Infof("physic min offset %d, compacted logics file %s expired, delete it.", offset, mf.fileName)
+	}
+
+	cq.mfq.deleteExpiredFile(toBeDeleteFileList)
+	return toBeDeleteFileList.Len()
+}
+
+// remapPosition 将第index条索引指向压缩时复制的消息，tagsCode不变，已被压缩的索引不再替换
+func (cq *consumeQueue) remapPosition(index, offset int64, size int32) bool {
+	if index < cq.getMinOffsetInQueue() || index >= cq.getMaxOffsetInQueue() {
+		return false
+	}
+
+	cq.remapMutex.Lock()
+	defer cq.remapMutex.Unlock()
+
+	logicOffset := index * CQStoreUnitSize
+	mf := cq.mfq.findMappedFileByOffset(logicOffset, false)
+	if mf == nil || !mf.hold() {
+		return false
+	}
+	defer mf.release()
+
+	pos := logicOffset - mf.fileFromOffset
+	unit := mf.byteBuffer.mmapBuf[pos : pos+CQStoreUnitSize]
+	if int64(binary.BigEndian.Uint64(unit[12:20])) == compactedTagsCode {
+		return false
+	}
+
+	binary.BigEndian.PutUint64(unit[0:8], uint64(offset))
+	binary.BigEndian.PutUint32(unit[8:12], uint32(size))
+	mf.flush()
+	atomic.StoreInt32(&cq.compacted, 1)
+	return true
+}
+
+// isMatchedByExt 根据扩展文件中的bloom filter判断第index条消息是否可能匹配订阅
+func (cq *consumeQueue) isMatchedByExt(filter store.MessageFilter, subscriptionData *heartbeat.SubscriptionData, index int64) bool {
+	if cq.ext == nil {
+		return true
+	}
+
+	var (
+		bits   []byte
+		loaded bool
+	)
+	return filter.IsMatchedByBloomFilter(subscriptionData, func(value string) bool {
+		if !loaded {
+			bits, loaded = cq.ext.get(index), true
+		}
+		return bits == nil || bloomMayContain(bits, value)
+	})
+}
@@ -0,0 +1,189 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package persistent
+
+import (
+	"container/list"
+	"fmt"
+	"hash/fnv"
+	"os"
+
+	"github.com/boltmq/boltmq/store/sql92"
+	"github.com/boltmq/common/logger"
+)
+
+const (
+	bloomHashNums = 4 // bloom filter哈希函数个数
+)
+
+// consumeQueueExt 逻辑队列扩展文件，与逻辑队列一一对应，按逻辑offset顺序保存每条消息属性的bloom filter。
+// 扩展文件缺失或落后于逻辑队列时，对应消息视为可能匹配，不影响消息的正确性
+type consumeQueueExt struct {
+	mfq      *mappedFileQueue
+	unitSize int64 // 每条消息bloom filter字节数
+	mfSize   int64
+}
+
+func newConsumeQueueExt(topic string, queueId int32, storePath string, cqFileSize int64, bloomBits int32) *consumeQueueExt {
+	unitSize := int64(bloomBits / 8)
+	if unitSize <= 0 {
+		unitSize = 32
+	}
+
+	// 扩展文件与逻辑队列文件保存相同条数的消息，便于按文件删除
+	mfSize := cqFileSize / CQStoreUnitSize * unitSize
+	queueDir := fmt.Sprintf("%s%c%s%c%d", storePath, os.PathSeparator, topic, os.PathSeparator, queueId)
+	return &consumeQueueExt{
+		mfq:      newMappedFileQueue(queueDir, mfSize, nil),
+		unitSize: unitSize,
+		mfSize:   mfSize,
+	}
+}
+
+func (ext *consumeQueueExt) load() bool {
+	return ext.mfq.load()
+}
+
+// put 写入第index条消息的bloom filter，已写入时忽略，中间缺失的消息填充为全部命中
+func (ext *consumeQueueExt) put(index int64, properties map[string]string) bool {
+	expectOffset := index * ext.unitSize
+	for {
+		mf, err := ext.mfq.getLastMappedFile(expectOffset)
+		if err != nil || mf == nil {
+			logger.Errorf("consumequeue ext get last mapped file err: %v.", err)
+			return false
+		}
+
+		writeOffset := mf.fileFromOffset + mf.wrotePostion
+		if writeOffset > expectOffset {
+			return true
+		}
+
+		if writeOffset == expectOffset {
+			return mf.appendMessage(ext.encode(properties))
+		}
+
+		if !mf.appendMessage(ext.fullUnit()) {
+			return false
+		}
+	}
+}
+
+// get 读取第index条消息的bloom filter，不存在时返回nil
+func (ext *consumeQueueExt) get(index int64) []byte {
+	offset := index * ext.unitSize
+	minOffset := ext.mfq.getMinOffset()
+	if minOffset < 0 || offset < minOffset || offset+ext.unitSize > ext.mfq.getMaxOffset() {
+		return nil
+	}
+
+	mf := ext.mfq.findMappedFileByOffset(offset, false)
+	if mf == nil {
+		return nil
+	}
+
+	result := mf.selectMappedBufferByPosAndSize(offset%ext.mfSize, int32(ext.unitSize))
+	if result == nil {
+		return nil
+	}
+	defer result.Release()
+
+	bits := make([]byte, ext.unitSize)
+	copy(bits, result.byteBuffer.Bytes())
+	return bits
+}
+
+func (ext *consumeQueueExt) encode(properties map[string]string) []byte {
+	bits := make([]byte, ext.unitSize)
+	for key, value := range properties {
+		for _, idx := range bloomIndexes(sql92.PropertyValue(key, value), uint32(ext.unitSize*8)) {
+			bits[idx/8] |= 1 << (idx % 8)
+		}
+	}
+
+	return bits
+}
+
+func (ext *consumeQueueExt) fullUnit() []byte {
+	bits := make([]byte, ext.unitSize)
+	for i := range bits {
+		bits[i] = 0xff
+	}
+	return bits
+}
+
+// bloomMayContain bloom filter中是否可能存在value
+func bloomMayContain(bits []byte, value string) bool {
+	for _, idx := range bloomIndexes(value, uint32(len(bits)*8)) {
+		if bits[idx/8]&(1<<(idx%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// bloomIndexes 双重哈希计算value在bloom filter中的位置
+func bloomIndexes(value string, bitNums uint32) []uint32 {
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	sum := h.Sum64()
+	h1, h2 := uint32(sum), uint32(sum>>32)
+
+	indexes := make([]uint32, bloomHashNums)
+	for i := uint32(0); i < bloomHashNums; i++ {
+		indexes[i] = (h1 + i*h2) % bitNums
+	}
+	return indexes
+}
+
+func (ext *consumeQueueExt) commit(flushLeastPages int32) bool {
+	return ext.mfq.commit(flushLeastPages)
+}
+
+// truncate 截断index之后的数据，recover时调用
+func (ext *consumeQueueExt) truncate(index int64) {
+	ext.mfq.truncateDirtyFiles(index * ext.unitSize)
+}
+
+// deleteExpiredFile 删除逻辑队列最小offset之前的文件
+func (ext *consumeQueueExt) deleteExpiredFile(minIndex int64) int {
+	mfs := ext.mfq.copyMappedFiles(0)
+	if len(mfs) == 0 {
+		return 0
+	}
+
+	minOffset := minIndex * ext.unitSize
+	toBeDeleteFileList := list.New()
+	for i := 0; i < len(mfs)-1; i++ {
+		mf := mfs[i]
+		if mf == nil {
+			continue
+		}
+
+		if mf.fileFromOffset+mf.fileSize > minOffset {
+			break
+		}
+
+		if mf.destroy(1000 * 60) {
+			toBeDeleteFileList.PushBack(mf)
+		}
+	}
+
+	ext.mfq.deleteExpiredFile(toBeDeleteFileList)
+	return toBeDeleteFileList.Len()
+}
+
+func (ext *consumeQueueExt) destroy() {
+	ext.mfq.destroy()
+}
@@ -0,0 +1,133 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package persistent
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/boltmq/boltmq/store"
+	"github.com/boltmq/common/message"
+	"github.com/boltmq/common/protocol/heartbeat"
+	"github.com/boltmq/common/utils/system"
+)
+
+func TestConsumeQueueExtBloomFilter(t *testing.T) {
+	ext := newConsumeQueueExt("TestTopic", 0, "./test/consumequeue_ext", 4*CQStoreUnitSize, 256)
+	if !ext.put(0, map[string]string{"region": "eu", "amount": "150"}) {
+		t.Errorf("put bloom filter 0 failed")
+		return
+	}
+
+	// 跳过的消息填充为全部命中
+	if !ext.put(5, map[string]string{"region": "us"}) {
+		t.Errorf("put bloom filter 5 failed")
+		return
+	}
+
+	bits := ext.get(0)
+	if bits == nil || !bloomMayContain(bits, "region=eu") || bloomMayContain(bits, "region=us") {
+		t.Errorf("bloom filter 0=%v", bits)
+		return
+	}
+
+	if bits = ext.get(3); bits == nil || !bloomMayContain(bits, "region=cn") {
+		t.Errorf("bloom filter 3=%v", bits)
+		return
+	}
+
+	if bits = ext.get(5); bits == nil || bloomMayContain(bits, "region=eu") {
+		t.Errorf("bloom filter 5=%v", bits)
+		return
+	}
+
+	if bits = ext.get(6); bits != nil {
+		t.Errorf("bloom filter 6=%v", bits)
+		return
+	}
+
+	ext.destroy()
+	if err := os.RemoveAll("./test"); err != nil {
+		t.Fail()
+	}
+}
+
+func TestPutMessageBloomFilter(t *testing.T) {
+	conf := newConfig("./test")
+	conf.MappedFileSizeCommitLog = 1024 * 1024
+	conf.MappedFileSizeConsumeQueue = 1024 * CQStoreUnitSize
+	conf.ConsumeQueueExtEnable = true
+	ms := newPersistentMessageStore(conf, nil)
+	if !ms.Load() {
+		t.Errorf("load message store failed")
+		return
+	}
+	if err := ms.Start(); err != nil {
+		t.Errorf("start message store err: %s", err)
+		return
+	}
+	defer func() {
+		ms.Shutdown()
+		ms.Destroy()
+		os.RemoveAll("./test")
+	}()
+
+	newMessage := func(region string) *store.MessageExtInner {
+		msg := new(store.MessageExtInner)
+		msg.Topic = "TestTopic"
+		msg.QueueId = 0
+		msg.Body = []byte("hello boltmq")
+		message.PutProperty(&msg.Message, "region", region)
+		msg.PropertiesString = message.MessageProperties2String(msg.Properties)
+		msg.BornTimestamp = system.CurrentTimeMillis()
+		msg.BornHost = "127.0.0.1:10911"
+		msg.StoreHost = "127.0.0.1:11911"
+		return msg
+	}
+
+	for _, region := range []string{"eu", "us"} {
+		if result := ms.PutMessage(newMessage(region)); result.Status != store.PUTMESSAGE_PUT_OK {
+			t.Errorf("put message status: %s", result.Status)
+			return
+		}
+	}
+
+	// 批量写入的消息同样生成bloom filter
+	if result := ms.PutMessages([]*store.MessageExtInner{newMessage("us"), newMessage("eu")}); result.Status != store.PUTMESSAGE_PUT_OK {
+		t.Errorf("put messages status: %s", result.Status)
+		return
+	}
+
+	// 等待分发到逻辑队列及扩展文件
+	for i := 0; i < 50 && ms.MaxOffsetInQueue("TestTopic", 0) < 4; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	subscriptionData := &heartbeat.SubscriptionData{Topic: "TestTopic", SubString: "SQL92:region = 'eu'"}
+	getResult := ms.GetMessage("TestGroup", "TestTopic", 0, 0, 32, subscriptionData)
+	if getResult == nil || getResult.Status != store.FOUND || getResult.GetMessageCount() != 2 {
+		t.Errorf("get message result: %v", getResult)
+		return
+	}
+	getResult.Release()
+
+	for _, index := range []int64{1, 2} {
+		bits := ms.findConsumeQueue("TestTopic", 0).ext.get(index)
+		if bits == nil || !bloomMayContain(bits, "region=us") || bloomMayContain(bits, "region=eu") {
+			t.Errorf("bloom filter %d=%v", index, bits)
+			return
+		}
+	}
+}
@@ -20,6 +20,7 @@ import (
 
 	"github.com/boltmq/common/logger"
 	"github.com/boltmq/common/sysflag"
+	"github.com/boltmq/common/utils/codec"
 )
 
 type dispatchRequest struct {
@@ -35,15 +36,20 @@ type dispatchRequest struct {
 	preparedTransactionOffset int64
 	producerGroup             string
 	tranStateTableOffset      int64
+	propertiesMap             map[string]string
+	rebuild                   bool          // 重建逻辑队列时从commitlog重放的请求
+	compactCopy               bool          // 压缩时复制的存活消息，替换逻辑队列中原消息的位置
+	barrier                   chan struct{} // 不为空时只用于等待之前的请求处理完成，处理到时关闭
 }
 
 type dispatchMessageService struct {
-	requestsChan chan *dispatchRequest
-	requestSize  int32
-	closeChan    chan bool
-	messageStore *PersistentMessageStore
-	mutex        sync.Mutex
-	stop         bool
+	requestsChan     chan *dispatchRequest
+	requestSize      int32
+	dispatchedOffset int64 // 最后分发的消息的结束位置
+	closeChan        chan bool
+	messageStore     *PersistentMessageStore
+	mutex            sync.Mutex
+	stop             bool
 }
 
 func newDispatchMessageService(putMsgIndexHightWater int32, messageStore *PersistentMessageStore) *dispatchMessageService {
@@ -83,8 +89,9 @@ func (dms *dispatchMessageService) destroy() {
 
 func (dms *dispatchMessageService) putRequest(request *dispatchRequest) {
 	if !dms.stop {
-		dms.requestsChan <- request
+		// 先计数再入队，保证hasRemainMessage不会漏掉已入队未处理的请求
 		atomic.AddInt32(&dms.requestSize, 1)
+		dms.requestsChan <- request
 
 		dms.messageStore.storeStats.SetDispatchMaxBuffer(int64(atomic.LoadInt32(&dms.requestSize)))
 
@@ -99,16 +106,42 @@ func (dms *dispatchMessageService) putRequest(request *dispatchRequest) {
 }
 
 func (dms *dispatchMessageService) doDispatch(request *dispatchRequest) {
-	atomic.AddInt32(&dms.requestSize, -1)
+	defer atomic.AddInt32(&dms.requestSize, -1)
+	if request.barrier != nil {
+		close(request.barrier)
+		return
+	}
+	if !request.rebuild {
+		// 选举复制模式下只分发已被多数节点确认的消息
+		nextOffset := request.commitLogOffset + request.msgSize
+		if election := dms.messageStore.election; election != nil && !election.waitForVisible(nextOffset) {
+			return
+		}
+		atomic.StoreInt64(&dms.dispatchedOffset, nextOffset)
+	}
+
+	rebuildService := dms.messageStore.rebuildMsgService
+	if request.rebuild {
+		rebuildService.dispatch(request)
+		return
+	}
+	skipCQ, skipIndex := rebuildService.intercept(request)
+
 	tranType := sysflag.GetTransactionValue(int(request.sysFlag))
 
 	switch tranType {
 	case sysflag.TransactionNotType:
 		fallthrough
 	case sysflag.TransactionCommitType:
-		dms.messageStore.putMessagePostionInfo(request.topic, request.queueId,
-			request.commitLogOffset, request.msgSize, request.tagsCode,
-			request.storeTimestamp, request.consumeQueueOffset)
+		// 重建中的topic由重放的请求写入
+		if request.compactCopy {
+			dms.messageStore.remapPosition(request.topic, request.queueId, request.consumeQueueOffset,
+				request.commitLogOffset, request.msgSize)
+		} else if !skipCQ {
+			dms.messageStore.putMessagePostionInfo(request.topic, request.queueId,
+				request.commitLogOffset, request.msgSize, request.tagsCode,
+				request.storeTimestamp, request.consumeQueueOffset, request.propertiesMap)
+		}
 		break
 	case sysflag.TransactionPreparedType:
 		fallthrough
@@ -116,35 +149,45 @@ func (dms *dispatchMessageService) doDispatch(request *dispatchRequest) {
 		break
 	}
 
-	// TODO 更新Transaction State Table
+	// 更新Transaction State Table，recover时producerGroup为空，由redo log重建
+	tsService := dms.messageStore.tsService
 	if len(request.producerGroup) > 0 {
+		groupHashCode := int32(codec.HashCode(request.producerGroup))
 		switch tranType {
 		case sysflag.TransactionNotType:
 			break
 		case sysflag.TransactionPreparedType:
-			/*
-				dms.messageStore.TransactionStateService.appendPreparedTransaction(
-					req.commitLogOffset, req.msgSize, req.storeTimestamp/1000, req.producerGroup.hashCode())
-			*/
+			tsService.appendPreparedTransaction(request.tranStateTableOffset, request.commitLogOffset,
+				int32(request.msgSize), int32(request.storeTimestamp/1000), groupHashCode)
 			break
 		case sysflag.TransactionCommitType:
 			fallthrough
 		case sysflag.TransactionRollbackType:
-			/*
-				dms.messageStore.TransactionStateService.updateTransactionState(
-					req.tranStateTableOffset, req.preparedTransactionOffset, req.producerGroup.hashCode(),
-					tranType)
-			*/
+			tsService.updateTransactionState(request.tranStateTableOffset, request.preparedTransactionOffset,
+				groupHashCode, int32(tranType))
 			break
 		}
 	}
 
-	if dms.messageStore.config.MessageIndexEnable {
+	// 记录Transaction Redo Log
+	if sysflag.TransactionNotType != tranType {
+		tsService.appendRedoLog(request)
+	}
+
+	if dms.messageStore.config.MessageIndexEnable && !skipIndex {
 		dms.messageStore.idxService.putRequest(request)
 	}
 }
 
 func (dms *dispatchMessageService) hasRemainMessage() bool {
-	// TODO
-	return false
+	return atomic.LoadInt32(&dms.requestSize) > 0
+}
+
+// undispatchedOffset 队列中有未处理的请求时返回最后分发的位置，之后的消息可能还未写入逻辑队列，没有时返回-1
+func (dms *dispatchMessageService) undispatchedOffset() int64 {
+	if !dms.hasRemainMessage() {
+		return -1
+	}
+
+	return atomic.LoadInt64(&dms.dispatchedOffset)
 }
@@ -0,0 +1,948 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package persistent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/boltmq/boltmq/common"
+	"github.com/boltmq/boltmq/store"
+	"github.com/boltmq/common/logger"
+	"github.com/boltmq/common/message"
+	"github.com/boltmq/common/utils/system"
+)
+
+const (
+	raftRequestVote   int32 = 1 // 请求投票
+	raftAppendEntries int32 = 2 // 复制commitlog数据，数据为空时作为心跳
+	raftNoVote              = int64(-1)
+	raftMaxFrameSize        = 1024 * 1024 * 64
+	// RAFT_NOOP_TOPIC leader当选后写入的空消息，使之前任期的数据随当前任期的数据一起被确认
+	RAFT_NOOP_TOPIC = "RAFT_NOOP_TOPIC_XXXX"
+)
+
+// raftRole 节点在选举组中的角色
+type raftRole int
+
+const (
+	raftFollower raftRole = iota
+	raftCandidate
+	raftLeader
+)
+
+func (role raftRole) String() string {
+	switch role {
+	case raftFollower:
+		return "FOLLOWER"
+	case raftCandidate:
+		return "CANDIDATE"
+	case raftLeader:
+		return "LEADER"
+	default:
+		return "Unknow"
+	}
+}
+
+// termEntry 任期在commitlog中的起始offset，leader当选时记录
+type termEntry struct {
+	Term        int64 `json:"term"`
+	StartOffset int64 `json:"startOffset"`
+}
+
+// raftState 需要持久化的选举状态
+type raftState struct {
+	CurrentTerm int64        `json:"currentTerm"`
+	VotedFor    int64        `json:"votedFor"`
+	TermHistory []*termEntry `json:"termHistory"`
+}
+
+// raftRequest 投票及复制请求
+type raftRequest struct {
+	Type         int32        `json:"type"`
+	Term         int64        `json:"term"`
+	CandidateId  int64        `json:"candidateId"`
+	LastTerm     int64        `json:"lastTerm"`
+	LastOffset   int64        `json:"lastOffset"`
+	LeaderId     int64        `json:"leaderId"`
+	TermHistory  []*termEntry `json:"termHistory"`
+	StartOffset  int64        `json:"startOffset"` // 为-1时只做心跳及数据对齐
+	Data         []byte       `json:"data"`
+	CommitOffset int64        `json:"commitOffset"`
+}
+
+// raftResponse 投票及复制应答，MaxOffset为对齐、追加数据后follower的commitlog最大offset
+type raftResponse struct {
+	Term      int64 `json:"term"`
+	Success   bool  `json:"success"`
+	MaxOffset int64 `json:"maxOffset"`
+}
+
+// raftPeer 选举组中的其他节点
+type raftPeer struct {
+	id          int64
+	addr        string
+	conn        net.Conn
+	nextOffset  int64 // leader下一次向该节点复制的offset，-1表示未对齐
+	matchOffset int64 // 该节点已确认与leader一致的最大offset
+	lastAck     int64 // leader最后一次收到该节点应答的时间
+	sending     int32
+	mutex       sync.Mutex
+}
+
+// electionService 同一brokerName的broker间选主并复制commitlog。
+// 每个任期的数据只来自该任期的leader，节点重新加入时按leader的任期历史截断不一致的数据。
+// 消息被多数节点确认后才写入逻辑队列，消费者看不到可能被截断的数据
+type electionService struct {
+	messageStore    *PersistentMessageStore
+	security        *haSecurity // 与HA复制通道相同的TLS及身份校验
+	selfId          int64
+	listenAddr      string
+	peers           []*raftPeer
+	state           *raftState
+	role            raftRole
+	leaderId        int64
+	commitOffset    int64         // 多数节点确认的offset，由mutex保护写入，分发消息时原子读取
+	commitChan      chan struct{} // commitOffset推进时关闭并重建，唤醒等待确认的写入
+	termStart       int64         // leader当前任期的起始offset，非leader时为-1
+	truncateOffset  int64         // 正在截断不一致数据的位置，未截断时为-1
+	gating          int32         // 服务启动后分发消息需等待确认，启动前恢复的数据及停止后不等待
+	appendChan      chan bool
+	roleChan        chan struct{}  // 通知角色切换协程，只保留最新的角色
+	pendingRole     BrokerRoleType // 待切换的存储角色，由mutex保护
+	hasPendingRole  bool
+	lastContact     int64
+	electionTimeout int64
+	listener        net.Listener
+	stoped          bool
+	mutex           sync.Mutex
+}
+
+func newElectionService(messageStore *PersistentMessageStore) *electionService {
+	members, err := parseElectionPeers(messageStore.config.ElectionPeers)
+	if err != nil {
+		logger.Errorf("election service parse peers err: %s.", err)
+		return nil
+	}
+
+	selfId := messageStore.config.ElectionSelfId
+	listenAddr, ok := members[selfId]
+	if !ok {
+		logger.Errorf("election service self id %d not in peers %s.", selfId, messageStore.config.ElectionPeers)
+		return nil
+	}
+
+	ec := &electionService{
+		messageStore:   messageStore,
+		security:       messageStore.ha.security,
+		selfId:         selfId,
+		listenAddr:     listenAddr,
+		state:          &raftState{VotedFor: raftNoVote},
+		role:           raftFollower,
+		leaderId:       raftNoVote,
+		commitChan:     make(chan struct{}),
+		termStart:      -1,
+		truncateOffset: -1,
+		appendChan:     make(chan bool, 1),
+		roleChan:       make(chan struct{}, 1),
+	}
+
+	for id, addr := range members {
+		if id != selfId {
+			ec.peers = append(ec.peers, &raftPeer{id: id, addr: addr, nextOffset: -1})
+		}
+	}
+
+	return ec
+}
+
+// parseElectionPeers 解析选举组节点，格式：id@ip:port;id@ip:port
+func parseElectionPeers(peers string) (map[int64]string, error) {
+	members := make(map[int64]string)
+	for _, item := range strings.Split(peers, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		idx := strings.Index(item, "@")
+		if idx <= 0 || idx == len(item)-1 {
+			return nil, fmt.Errorf("election peer %s is invalid", item)
+		}
+
+		id, err := strconv.ParseInt(item[:idx], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("election peer %s id is invalid", item)
+		}
+
+		if _, ok := members[id]; ok {
+			return nil, fmt.Errorf("election peer id %d is duplicated", id)
+		}
+		members[id] = item[idx+1:]
+	}
+
+	if len(members) == 0 {
+		return nil, fmt.Errorf("election peers is empty")
+	}
+
+	return members, nil
+}
+
+// lastLogTerm offset之前最后一条数据所属的任期
+func lastLogTerm(history []*termEntry, maxOffset int64) int64 {
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].StartOffset < maxOffset {
+			return history[i].Term
+		}
+	}
+
+	return 0
+}
+
+// consistentOffset 根据leader的任期历史计算本地数据与leader一致的最大offset。
+// 从本地最后一个任期向前查找leader中存在的任期，该任期在两边结束位置的较小值之后的数据需要截断；
+// 没有共同任期时，只保留双方第一个任期之前的数据
+func consistentOffset(local, leader []*termEntry, maxOffset int64) int64 {
+	for i := len(local) - 1; i >= 0; i-- {
+		localEnd := maxOffset
+		if i+1 < len(local) && local[i+1].StartOffset < localEnd {
+			localEnd = local[i+1].StartOffset
+		}
+
+		for j := len(leader) - 1; j >= 0; j-- {
+			if leader[j].Term != local[i].Term {
+				continue
+			}
+
+			if j+1 < len(leader) && leader[j+1].StartOffset < localEnd {
+				return leader[j+1].StartOffset
+			}
+			return localEnd
+		}
+	}
+
+	offset := maxOffset
+	if len(local) > 0 && local[0].StartOffset < offset {
+		offset = local[0].StartOffset
+	}
+	if len(leader) > 0 && leader[0].StartOffset < offset {
+		offset = leader[0].StartOffset
+	}
+
+	return offset
+}
+
+func sameTermHistory(a, b []*termEntry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].Term != b[i].Term || a[i].StartOffset != b[i].StartOffset {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (ec *electionService) load() bool {
+	filePath := common.GetElectionStatePath(ec.messageStore.config.StorePathRootDir)
+	content, err := common.File2String(filePath)
+	if err != nil || len(content) == 0 {
+		return true
+	}
+
+	state := &raftState{}
+	if err := common.Decode([]byte(content), state); err != nil {
+		logger.Errorf("election service decode state %s err: %s.", filePath, err)
+		return false
+	}
+
+	ec.state = state
+	logger.Infof("load election state %s success, term: %d.", filePath, state.CurrentTerm)
+	return true
+}
+
+// persist 持久化选举状态，调用方需持有锁
+func (ec *electionService) persist() {
+	content, err := common.Encode(ec.state)
+	if err != nil {
+		logger.Errorf("election service encode state err: %s.", err)
+		return
+	}
+
+	filePath := common.GetElectionStatePath(ec.messageStore.config.StorePathRootDir)
+	if err := common.String2File(content, filePath); err != nil {
+		logger.Errorf("election service persist state %s err: %s.", filePath, err)
+	}
+}
+
+func (ec *electionService) start() {
+	_, port, err := net.SplitHostPort(ec.listenAddr)
+	if err != nil {
+		logger.Errorf("election service listen address %s err: %s.", ec.listenAddr, err)
+		return
+	}
+
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		logger.Errorf("election service listen port %s err: %s.", port, err)
+		return
+	}
+
+	ec.mutex.Lock()
+	ec.listener = listener
+	ec.lastContact = system.CurrentTimeMillis()
+	ec.resetElectionTimeout()
+	ec.mutex.Unlock()
+	atomic.StoreInt32(&ec.gating, 1)
+
+	go ec.acceptLoop()
+	go ec.dispatchRoleChange()
+	logger.Infof("election service started, self id %d, listen %s.", ec.selfId, ec.listenAddr)
+
+	interval := time.Duration(ec.messageStore.config.ElectionHeartbeatInterval) * time.Millisecond
+	for {
+		select {
+		case <-ec.appendChan:
+		case <-time.After(interval):
+		}
+
+		ec.mutex.Lock()
+		if ec.stoped {
+			ec.mutex.Unlock()
+			break
+		}
+		if ec.role == raftLeader && !ec.hasQuorum() {
+			logger.Warnf("election leader lost quorum, term: %d.", ec.state.CurrentTerm)
+			ec.becomeFollower(ec.state.CurrentTerm)
+		}
+		role := ec.role
+		timeout := system.CurrentTimeMillis()-ec.lastContact > ec.electionTimeout
+		ec.mutex.Unlock()
+
+		if role == raftLeader {
+			ec.replicate()
+		} else if timeout {
+			ec.startElection()
+		}
+	}
+
+	logger.Info("election service end.")
+}
+
+func (ec *electionService) shutdown() {
+	ec.mutex.Lock()
+	defer ec.mutex.Unlock()
+
+	if ec.stoped {
+		return
+	}
+
+	ec.stoped = true
+	atomic.StoreInt32(&ec.gating, 0)
+	if ec.listener != nil {
+		ec.listener.Close()
+	}
+	close(ec.roleChan)
+
+	for _, peer := range ec.peers {
+		peer.mutex.Lock()
+		if peer.conn != nil {
+			peer.conn.Close()
+			peer.conn = nil
+		}
+		peer.mutex.Unlock()
+	}
+}
+
+// resetElectionTimeout 选举超时在[ElectionTimeout, 2*ElectionTimeout)之间随机，避免同时发起选举
+func (ec *electionService) resetElectionTimeout() {
+	timeout := int64(ec.messageStore.config.ElectionTimeout)
+	ec.electionTimeout = timeout + rand.Int63n(timeout)
+}
+
+func (ec *electionService) quorum() int {
+	return (len(ec.peers)+1)/2 + 1
+}
+
+// hasQuorum leader在选举超时内收到多数节点的应答，网络分区后的旧leader据此退为follower，
+// 不再以master身份注册。调用方需持有锁
+func (ec *electionService) hasQuorum() bool {
+	now := system.CurrentTimeMillis()
+	count := 1
+	for _, peer := range ec.peers {
+		if now-peer.lastAck <= ec.electionTimeout {
+			count++
+		}
+	}
+
+	return count >= ec.quorum()
+}
+
+// startElection 增加任期并向其他节点请求投票，获得多数票后成为leader
+func (ec *electionService) startElection() {
+	ec.mutex.Lock()
+	ec.state.CurrentTerm++
+	ec.state.VotedFor = ec.selfId
+	ec.role = raftCandidate
+	ec.leaderId = raftNoVote
+	ec.lastContact = system.CurrentTimeMillis()
+	ec.resetElectionTimeout()
+	ec.persist()
+
+	term := ec.state.CurrentTerm
+	maxOffset := ec.messageStore.clog.getMaxOffset()
+	req := &raftRequest{
+		Type:        raftRequestVote,
+		Term:        term,
+		CandidateId: ec.selfId,
+		LastTerm:    lastLogTerm(ec.state.TermHistory, maxOffset),
+		LastOffset:  maxOffset,
+	}
+
+	if ec.quorum() <= 1 {
+		ec.becomeLeader()
+		ec.mutex.Unlock()
+		return
+	}
+	ec.mutex.Unlock()
+
+	logger.Infof("election start, term: %d, last term: %d, last offset: %d.", term, req.LastTerm, req.LastOffset)
+	votes := int32(1)
+	for _, peer := range ec.peers {
+		go func(peer *raftPeer) {
+			resp, err := ec.call(peer, req)
+			if err != nil {
+				return
+			}
+
+			ec.mutex.Lock()
+			defer ec.mutex.Unlock()
+
+			if resp.Term > ec.state.CurrentTerm {
+				ec.becomeFollower(resp.Term)
+				return
+			}
+
+			if !resp.Success || ec.role != raftCandidate || ec.state.CurrentTerm != term {
+				return
+			}
+
+			if int(atomic.AddInt32(&votes, 1)) >= ec.quorum() {
+				ec.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// becomeLeader 记录新任期的起始offset，由角色切换协程将存储切换为master，调用方需持有锁
+func (ec *electionService) becomeLeader() {
+	ec.role = raftLeader
+	ec.leaderId = ec.selfId
+
+	startOffset := ec.messageStore.clog.getMaxOffset()
+	ec.state.TermHistory = append(ec.state.TermHistory, &termEntry{Term: ec.state.CurrentTerm, StartOffset: startOffset})
+	ec.persist()
+
+	atomic.StoreInt64(&ec.termStart, startOffset)
+	for _, peer := range ec.peers {
+		peer.nextOffset = -1
+		peer.matchOffset = 0
+		peer.lastAck = system.CurrentTimeMillis()
+	}
+
+	logger.Infof("election become leader, term: %d, start offset: %d.", ec.state.CurrentTerm, startOffset)
+	ec.changeRole(ASYNC_MASTER)
+}
+
+// becomeFollower 发现更大的任期或其他leader时退为follower，调用方需持有锁
+func (ec *electionService) becomeFollower(term int64) {
+	if term > ec.state.CurrentTerm {
+		ec.state.CurrentTerm = term
+		ec.state.VotedFor = raftNoVote
+		ec.persist()
+	}
+
+	if ec.role == raftLeader {
+		logger.Infof("election leader step down, term: %d.", ec.state.CurrentTerm)
+		atomic.StoreInt64(&ec.termStart, -1)
+		ec.changeRole(SLAVE)
+	}
+
+	ec.role = raftFollower
+	ec.lastContact = system.CurrentTimeMillis()
+	ec.resetElectionTimeout()
+}
+
+// changeRole 存储角色切换需要等待重放完成，放到单独的协程中执行，调用方需持有锁。
+// 通知不阻塞，切换协程尚未处理的角色被最新的角色覆盖
+func (ec *electionService) changeRole(role BrokerRoleType) {
+	if ec.stoped {
+		return
+	}
+
+	ec.pendingRole = role
+	ec.hasPendingRole = true
+	select {
+	case ec.roleChan <- struct{}{}:
+	default:
+	}
+}
+
+func (ec *electionService) dispatchRoleChange() {
+	for range ec.roleChan {
+		ec.mutex.Lock()
+		role, ok := ec.pendingRole, ec.hasPendingRole
+		ec.hasPendingRole = false
+		ec.mutex.Unlock()
+
+		if !ok {
+			continue
+		}
+
+		ec.messageStore.ChangeRole(role)
+		if listener := ec.messageStore.roleChangeListener; listener != nil {
+			listener(role)
+		}
+
+		if role != SLAVE {
+			ec.appendNoop()
+		}
+	}
+}
+
+// appendNoop 存储切换为master后写入一条空消息，leader只确认当前任期的数据，
+// 没有新消息写入时之前任期未确认的数据依靠该消息被确认
+func (ec *electionService) appendNoop() {
+	ec.mutex.Lock()
+	leader, term := ec.role == raftLeader, ec.state.CurrentTerm
+	ec.mutex.Unlock()
+
+	if !leader {
+		return
+	}
+
+	msg := new(store.MessageExtInner)
+	msg.Topic = RAFT_NOOP_TOPIC
+	msg.QueueId = 0
+	msg.Body = []byte(strconv.FormatInt(term, 10))
+	msg.BornTimestamp = system.CurrentTimeMillis()
+	msg.BornHost = ec.listenAddr
+	msg.StoreHost = ec.listenAddr
+	msg.SetWaitStoreMsgOK(false)
+	msg.PropertiesString = message.MessageProperties2String(msg.Properties)
+
+	result := ec.messageStore.PutMessage(msg)
+	if result == nil || result.Status != store.PUTMESSAGE_PUT_OK {
+		logger.Warnf("election leader append noop message failed, term: %d.", term)
+		return
+	}
+	logger.Infof("election leader append noop message, term: %d offset: %d.", term, result.Result.WroteOffset)
+}
+
+// notifyAppend 写入消息后唤醒leader立即复制
+func (ec *electionService) notifyAppend() {
+	select {
+	case ec.appendChan <- true:
+	default:
+	}
+}
+
+// waitForCommit 等待offset之前的数据被多数节点确认，超时或不再是leader时返回false
+func (ec *electionService) waitForCommit(offset int64, timeoutMillis int64) bool {
+	deadline := time.Now().Add(time.Duration(timeoutMillis) * time.Millisecond)
+	for {
+		ec.mutex.Lock()
+		if ec.commitOffset >= offset {
+			ec.mutex.Unlock()
+			return true
+		}
+
+		if ec.role != raftLeader {
+			ec.mutex.Unlock()
+			return false
+		}
+		commitChan := ec.commitChan
+		ec.mutex.Unlock()
+
+		remain := deadline.Sub(time.Now())
+		if remain <= 0 {
+			return false
+		}
+
+		select {
+		case <-commitChan:
+		case <-time.After(remain):
+		}
+	}
+}
+
+// waitForVisible 分发消息前等待offset之前的数据被多数节点确认，返回false时丢弃该消息。
+// 新leader之前任期的数据随noop一起确认，直接放行，否则切换为master时等待重放完成会阻塞；
+// 截断不一致的数据时，截断位置之前的数据与leader一致，之后的数据被丢弃
+func (ec *electionService) waitForVisible(offset int64) bool {
+	for atomic.LoadInt32(&ec.gating) == 1 {
+		if atomic.LoadInt64(&ec.commitOffset) >= offset || atomic.LoadInt64(&ec.termStart) >= offset {
+			return true
+		}
+
+		if truncateOffset := atomic.LoadInt64(&ec.truncateOffset); truncateOffset >= 0 {
+			return offset <= truncateOffset
+		}
+
+		time.Sleep(time.Millisecond * 5)
+	}
+
+	return true
+}
+
+// replicate leader向每个节点复制数据，同一节点同时只有一个复制请求
+func (ec *electionService) replicate() {
+	ec.mutex.Lock()
+	ec.advanceCommit()
+	ec.mutex.Unlock()
+
+	for _, peer := range ec.peers {
+		if atomic.CompareAndSwapInt32(&peer.sending, 0, 1) {
+			go func(peer *raftPeer) {
+				defer atomic.StoreInt32(&peer.sending, 0)
+				ec.replicateTo(peer)
+			}(peer)
+		}
+	}
+}
+
+func (ec *electionService) replicateTo(peer *raftPeer) {
+	ec.mutex.Lock()
+	if ec.role != raftLeader {
+		ec.mutex.Unlock()
+		return
+	}
+
+	term := ec.state.CurrentTerm
+	req := &raftRequest{
+		Type:         raftAppendEntries,
+		Term:         term,
+		LeaderId:     ec.selfId,
+		TermHistory:  append([]*termEntry{}, ec.state.TermHistory...),
+		StartOffset:  peer.nextOffset,
+		CommitOffset: ec.commitOffset,
+	}
+	ec.mutex.Unlock()
+
+	if req.StartOffset >= 0 {
+		if minOffset := ec.messageStore.clog.getMinOffset(); minOffset > req.StartOffset {
+			req.StartOffset = minOffset
+		}
+		req.Data = ec.readData(req.StartOffset)
+	}
+
+	resp, err := ec.call(peer, req)
+	if err != nil {
+		return
+	}
+
+	ec.mutex.Lock()
+	defer ec.mutex.Unlock()
+
+	if resp.Term > ec.state.CurrentTerm {
+		ec.becomeFollower(resp.Term)
+		return
+	}
+
+	if ec.role != raftLeader || ec.state.CurrentTerm != term {
+		return
+	}
+
+	peer.lastAck = system.CurrentTimeMillis()
+	peer.nextOffset = resp.MaxOffset
+	if resp.Success {
+		peer.matchOffset = resp.MaxOffset
+		ec.advanceCommit()
+	}
+
+	// 未追上时继续复制
+	if len(req.Data) > 0 && resp.MaxOffset < ec.messageStore.clog.getMaxOffset() {
+		ec.notifyAppend()
+	}
+}
+
+// readData 读取offset开始的一批commitlog数据
+func (ec *electionService) readData(offset int64) []byte {
+	result := ec.messageStore.clog.getData(offset)
+	if result == nil {
+		return nil
+	}
+	defer result.Release()
+
+	size := result.size
+	if batchSize := ec.messageStore.config.HaTransferBatchSize; size > batchSize {
+		size = batchSize
+	}
+
+	pos := result.byteBuffer.readPos
+	data := make([]byte, size)
+	copy(data, result.byteBuffer.mmapBuf[pos:pos+int(size)])
+	return data
+}
+
+// advanceCommit 多数节点确认的offset超过当前任期起始位置时推进commitOffset，调用方需持有锁
+func (ec *electionService) advanceCommit() {
+	offsets := []int64{ec.messageStore.clog.getMaxOffset()}
+	for _, peer := range ec.peers {
+		offsets = append(offsets, peer.matchOffset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] > offsets[j] })
+
+	offset := offsets[ec.quorum()-1]
+	termStart := int64(math.MaxInt64)
+	if len(ec.state.TermHistory) > 0 {
+		termStart = ec.state.TermHistory[len(ec.state.TermHistory)-1].StartOffset
+	}
+
+	if offset > ec.commitOffset && offset > termStart {
+		atomic.StoreInt64(&ec.commitOffset, offset)
+		close(ec.commitChan)
+		ec.commitChan = make(chan struct{})
+	}
+}
+
+func (ec *electionService) handleRequest(req *raftRequest) *raftResponse {
+	switch req.Type {
+	case raftRequestVote:
+		return ec.handleRequestVote(req)
+	case raftAppendEntries:
+		return ec.handleAppendEntries(req)
+	}
+
+	return &raftResponse{Term: -1}
+}
+
+func (ec *electionService) handleRequestVote(req *raftRequest) *raftResponse {
+	ec.mutex.Lock()
+	defer ec.mutex.Unlock()
+
+	if req.Term < ec.state.CurrentTerm {
+		return &raftResponse{Term: ec.state.CurrentTerm}
+	}
+
+	if req.Term > ec.state.CurrentTerm {
+		ec.becomeFollower(req.Term)
+	}
+
+	// 只投票给数据不落后于本节点的候选者
+	maxOffset := ec.messageStore.clog.getMaxOffset()
+	lastTerm := lastLogTerm(ec.state.TermHistory, maxOffset)
+	upToDate := req.LastTerm > lastTerm || (req.LastTerm == lastTerm && req.LastOffset >= maxOffset)
+	if !upToDate || (ec.state.VotedFor != raftNoVote && ec.state.VotedFor != req.CandidateId) {
+		return &raftResponse{Term: ec.state.CurrentTerm, MaxOffset: maxOffset}
+	}
+
+	ec.state.VotedFor = req.CandidateId
+	ec.persist()
+	ec.lastContact = system.CurrentTimeMillis()
+	logger.Infof("election vote for %d, term: %d.", req.CandidateId, req.Term)
+	return &raftResponse{Term: ec.state.CurrentTerm, Success: true, MaxOffset: maxOffset}
+}
+
+func (ec *electionService) handleAppendEntries(req *raftRequest) *raftResponse {
+	ec.mutex.Lock()
+	defer ec.mutex.Unlock()
+
+	maxOffset := ec.messageStore.clog.getMaxOffset()
+	if req.Term < ec.state.CurrentTerm {
+		return &raftResponse{Term: ec.state.CurrentTerm, MaxOffset: maxOffset}
+	}
+
+	if req.Term > ec.state.CurrentTerm || ec.role != raftFollower {
+		ec.becomeFollower(req.Term)
+	}
+	ec.leaderId = req.LeaderId
+	ec.lastContact = system.CurrentTimeMillis()
+
+	// 存储切换为slave之前不接收数据
+	if ec.messageStore.config.BrokerRole != SLAVE {
+		return &raftResponse{Term: ec.state.CurrentTerm, MaxOffset: maxOffset}
+	}
+
+	if offset := consistentOffset(ec.state.TermHistory, req.TermHistory, maxOffset); offset < maxOffset {
+		logger.Warnf("election truncate divergent commitlog from %d to %d, leader: %d, term: %d.",
+			maxOffset, offset, req.LeaderId, req.Term)
+		atomic.StoreInt64(&ec.truncateOffset, offset)
+		ec.messageStore.truncateCommitLog(offset)
+		atomic.StoreInt64(&ec.truncateOffset, -1)
+		maxOffset = ec.messageStore.clog.getMaxOffset()
+	}
+
+	if !sameTermHistory(ec.state.TermHistory, req.TermHistory) {
+		ec.state.TermHistory = req.TermHistory
+		ec.persist()
+	}
+
+	// 本地没有数据时从leader的最小offset开始复制
+	emptyLog := ec.messageStore.clog.getMinOffset() < 0
+	if len(req.Data) > 0 && (req.StartOffset == maxOffset || emptyLog) {
+		if ec.messageStore.AppendToCommitLog(req.StartOffset, req.Data) {
+			maxOffset = ec.messageStore.clog.getMaxOffset()
+		}
+	}
+
+	if commitOffset := req.CommitOffset; commitOffset > ec.commitOffset {
+		if commitOffset > maxOffset {
+			commitOffset = maxOffset
+		}
+		atomic.StoreInt64(&ec.commitOffset, commitOffset)
+	}
+
+	return &raftResponse{Term: ec.state.CurrentTerm, Success: true, MaxOffset: maxOffset}
+}
+
+// call 向节点发送请求并等待应答，连接出错时关闭，下次请求重新建立
+func (ec *electionService) call(peer *raftPeer, req *raftRequest) (*raftResponse, error) {
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+
+	timeout := time.Duration(ec.messageStore.config.ElectionTimeout) * time.Millisecond
+	if peer.conn == nil {
+		conn, err := net.DialTimeout("tcp", peer.addr, timeout)
+		if err != nil {
+			return nil, err
+		}
+
+		secureConn, err := ec.security.clientHandshake(conn, peer.addr)
+		if err != nil {
+			ec.security.recordFailure(peer.addr, err)
+			conn.Close()
+			return nil, err
+		}
+		peer.conn = secureConn
+	}
+
+	resp := &raftResponse{}
+	peer.conn.SetDeadline(time.Now().Add(timeout))
+	err := writeRaftFrame(peer.conn, req)
+	if err == nil {
+		err = readRaftFrame(peer.conn, resp)
+	}
+
+	if err != nil {
+		logger.Warnf("election call peer %d %s err: %s.", peer.id, peer.addr, err)
+		peer.conn.Close()
+		peer.conn = nil
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func (ec *electionService) acceptLoop() {
+	for {
+		conn, err := ec.listener.Accept()
+		if err != nil {
+			ec.mutex.Lock()
+			stoped := ec.stoped
+			ec.mutex.Unlock()
+			if stoped {
+				break
+			}
+
+			logger.Errorf("election service accept err: %s.", err)
+			continue
+		}
+
+		go ec.serve(conn)
+	}
+}
+
+func (ec *electionService) serve(rawConn net.Conn) {
+	defer rawConn.Close()
+
+	// 与HA复制通道相同，未通过校验的节点不能投票或写入数据
+	conn, err := ec.security.serverHandshake(rawConn)
+	if err != nil {
+		ec.security.recordFailure(rawConn.RemoteAddr().String(), err)
+		return
+	}
+
+	// leader按心跳间隔发送请求，超过选举超时未收到请求则关闭连接
+	timeout := time.Duration(ec.messageStore.config.ElectionTimeout) * 2 * time.Millisecond
+	for {
+		req := &raftRequest{}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		if err := readRaftFrame(conn, req); err != nil {
+			if err != io.EOF {
+				logger.Warnf("election service read from %s err: %s.", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(timeout))
+		if err := writeRaftFrame(conn, ec.handleRequest(req)); err != nil {
+			logger.Warnf("election service write to %s err: %s.", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// writeRaftFrame 按 4字节长度 + json 的格式写入
+func writeRaftFrame(w io.Writer, v interface{}) error {
+	body, err := common.Encode(v)
+	if err != nil {
+		return err
+	}
+
+	frame := make([]byte, 4+len(body))
+	binary.BigEndian.PutUint32(frame, uint32(len(body)))
+	copy(frame[4:], body)
+	_, err = w.Write(frame)
+	return err
+}
+
+func readRaftFrame(r io.Reader, v interface{}) error {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+
+	size := binary.BigEndian.Uint32(header)
+	if size > raftMaxFrameSize {
+		return fmt.Errorf("election frame size %d is too large", size)
+	}
+
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return err
+	}
+
+	return common.Decode(body, v)
+}
+
+func (ec *electionService) buildRunningStats(stats map[string]string) {
+	ec.mutex.Lock()
+	defer ec.mutex.Unlock()
+
+	stats[ELECTION_STATE.String()] = fmt.Sprintf("%s,%d,%d,%d", ec.role, ec.state.CurrentTerm, ec.leaderId, ec.commitOffset)
+}
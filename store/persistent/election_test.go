@@ -0,0 +1,287 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package persistent
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/boltmq/boltmq/store"
+	"github.com/boltmq/common/message"
+	"github.com/boltmq/common/utils/system"
+)
+
+func TestConsistentOffset(t *testing.T) {
+	cases := []struct {
+		local     []*termEntry
+		leader    []*termEntry
+		maxOffset int64
+		expect    int64
+	}{
+		// 本地任期2未被leader承认，截断到任期1结束位置
+		{[]*termEntry{{1, 0}, {2, 100}}, []*termEntry{{1, 0}, {3, 150}}, 200, 100},
+		// leader的任期1在80结束，本地任期1多写的数据需要截断
+		{[]*termEntry{{1, 0}}, []*termEntry{{1, 0}, {2, 80}}, 120, 80},
+		// 本地数据是leader的前缀
+		{[]*termEntry{{1, 0}, {2, 100}}, []*termEntry{{1, 0}, {2, 100}, {3, 300}}, 200, 200},
+		// 没有共同任期时只保留第一个任期之前的数据
+		{nil, []*termEntry{{1, 50}}, 100, 50},
+		{nil, nil, 100, 100},
+	}
+
+	for i, c := range cases {
+		if offset := consistentOffset(c.local, c.leader, c.maxOffset); offset != c.expect {
+			t.Errorf("case %d consistent offset=%d, expect %d", i, offset, c.expect)
+			return
+		}
+	}
+
+	if term := lastLogTerm([]*termEntry{{1, 0}, {2, 100}}, 100); term != 1 {
+		t.Errorf("last log term=%d", term)
+		return
+	}
+}
+
+func TestParseElectionPeers(t *testing.T) {
+	members, err := parseElectionPeers("1@127.0.0.1:11913; 2@127.0.0.2:11913;")
+	if err != nil {
+		t.Errorf("parse election peers err: %s", err)
+		return
+	}
+
+	if len(members) != 2 || members[2] != "127.0.0.2:11913" {
+		t.Errorf("election peers=%v", members)
+		return
+	}
+
+	for _, peers := range []string{"", "127.0.0.1:11913", "a@127.0.0.1:11913", "1@a:1;1@b:1"} {
+		if _, err := parseElectionPeers(peers); err == nil {
+			t.Errorf("parse election peers %s expect err", peers)
+			return
+		}
+	}
+}
+
+func newElectionTestStore(t *testing.T, role BrokerRoleType) *PersistentMessageStore {
+	rootDir, err := ioutil.TempDir("", "boltmq-election")
+	if err != nil {
+		t.Errorf("create temp dir err: %s", err)
+		return nil
+	}
+
+	conf := newConfig(rootDir)
+	conf.BrokerRole = role
+	conf.HaListenPort = 0
+	conf.MappedFileSizeCommitLog = 1024 * 1024
+	conf.MappedFileSizeConsumeQueue = 1024 * CQStoreUnitSize
+	conf.MaxHashSlotNum = 100
+	conf.MaxIndexNum = 400
+	ms := newPersistentMessageStore(conf, nil)
+	if !ms.Load() {
+		t.Errorf("load message store failed")
+		os.RemoveAll(rootDir)
+		return nil
+	}
+
+	if err := ms.Start(); err != nil {
+		t.Errorf("start message store err: %s", err)
+		os.RemoveAll(rootDir)
+		return nil
+	}
+
+	return ms
+}
+
+func destroyElectionTestStore(ms *PersistentMessageStore) {
+	ms.Shutdown()
+	os.RemoveAll(ms.config.StorePathRootDir)
+}
+
+// newTestElection 不监听端口的选举服务，直接调用处理请求的方法
+func newTestElection(ms *PersistentMessageStore) *electionService {
+	return &electionService{
+		messageStore:   ms,
+		security:       ms.ha.security,
+		state:          &raftState{VotedFor: raftNoVote},
+		role:           raftFollower,
+		leaderId:       raftNoVote,
+		commitChan:     make(chan struct{}),
+		termStart:      -1,
+		truncateOffset: -1,
+		appendChan:     make(chan bool, 1),
+		roleChan:       make(chan struct{}, 1),
+	}
+}
+
+func putElectionTestMessages(t *testing.T, ms *PersistentMessageStore, count int) bool {
+	for i := 0; i < count; i++ {
+		msg := new(store.MessageExtInner)
+		msg.Topic = "TestTopic"
+		msg.QueueId = 0
+		msg.Body = []byte("hello boltmq")
+		msg.PropertiesString = message.MessageProperties2String(msg.Properties)
+		msg.BornTimestamp = system.CurrentTimeMillis()
+		msg.BornHost = "127.0.0.1:10911"
+		msg.StoreHost = "127.0.0.1:11911"
+		if result := ms.PutMessage(msg); result.Status != store.PUTMESSAGE_PUT_OK {
+			t.Errorf("put message status: %s", result.Status)
+			return false
+		}
+	}
+
+	return true
+}
+
+func waitQueueOffset(ms *PersistentMessageStore, expect int64) bool {
+	for i := 0; i < 50 && ms.MaxOffsetInQueue("TestTopic", 0) != expect; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return ms.MaxOffsetInQueue("TestTopic", 0) == expect
+}
+
+func TestElectionReplicateAndTruncate(t *testing.T) {
+	leaderStore := newElectionTestStore(t, ASYNC_MASTER)
+	if leaderStore == nil {
+		return
+	}
+	defer destroyElectionTestStore(leaderStore)
+
+	followerStore := newElectionTestStore(t, SLAVE)
+	if followerStore == nil {
+		return
+	}
+	defer destroyElectionTestStore(followerStore)
+
+	if !putElectionTestMessages(t, leaderStore, 3) {
+		return
+	}
+	committed := leaderStore.clog.getMaxOffset()
+	leader := newTestElection(leaderStore)
+	follower := newTestElection(followerStore)
+
+	// 任期1的leader复制3条消息
+	resp := follower.handleAppendEntries(&raftRequest{
+		Type:         raftAppendEntries,
+		Term:         1,
+		LeaderId:     1,
+		TermHistory:  []*termEntry{{1, 0}},
+		StartOffset:  0,
+		Data:         leader.readData(0),
+		CommitOffset: committed,
+	})
+	if !resp.Success || resp.MaxOffset != committed || follower.commitOffset != committed {
+		t.Errorf("replicate resp=%v commit offset=%d, expect %d", resp, follower.commitOffset, committed)
+		return
+	}
+
+	if !waitQueueOffset(followerStore, 3) {
+		t.Errorf("follower queue offset=%d, expect 3", followerStore.MaxOffsetInQueue("TestTopic", 0))
+		return
+	}
+
+	// 任期2的leader写入的2条消息未被确认
+	if !putElectionTestMessages(t, leaderStore, 2) {
+		return
+	}
+	resp = follower.handleAppendEntries(&raftRequest{
+		Type:         raftAppendEntries,
+		Term:         2,
+		LeaderId:     2,
+		TermHistory:  []*termEntry{{1, 0}, {2, committed}},
+		StartOffset:  committed,
+		Data:         leader.readData(committed),
+		CommitOffset: committed,
+	})
+	if !resp.Success || resp.MaxOffset != leaderStore.clog.getMaxOffset() || follower.commitOffset != committed {
+		t.Errorf("replicate uncommitted resp=%v commit offset=%d", resp, follower.commitOffset)
+		return
+	}
+
+	if !waitQueueOffset(followerStore, 5) {
+		t.Errorf("follower queue offset=%d, expect 5", followerStore.MaxOffsetInQueue("TestTopic", 0))
+		return
+	}
+
+	// 任期3的leader不包含任期2的数据，follower截断到任期1结束的位置
+	resp = follower.handleAppendEntries(&raftRequest{
+		Type:         raftAppendEntries,
+		Term:         3,
+		LeaderId:     3,
+		TermHistory:  []*termEntry{{1, 0}, {3, committed}},
+		StartOffset:  -1,
+		CommitOffset: committed,
+	})
+	if !resp.Success || resp.MaxOffset != committed || followerStore.clog.getMaxOffset() != committed {
+		t.Errorf("truncate resp=%v max offset=%d, expect %d", resp, followerStore.clog.getMaxOffset(), committed)
+		return
+	}
+
+	if offset := followerStore.MaxOffsetInQueue("TestTopic", 0); offset != 3 {
+		t.Errorf("follower queue offset after truncate=%d, expect 3", offset)
+		return
+	}
+
+	// 旧任期的请求被拒绝
+	resp = follower.handleAppendEntries(&raftRequest{Type: raftAppendEntries, Term: 2, LeaderId: 2, StartOffset: -1})
+	if resp.Success || resp.Term != 3 {
+		t.Errorf("stale term resp=%v", resp)
+		return
+	}
+}
+
+func TestElectionWaitForVisible(t *testing.T) {
+	ec := &electionService{commitOffset: 100, termStart: -1, truncateOffset: -1}
+	if !ec.waitForVisible(200) {
+		t.Errorf("not started election expect visible")
+		return
+	}
+
+	ec.gating = 1
+	if !ec.waitForVisible(100) {
+		t.Errorf("committed offset expect visible")
+		return
+	}
+
+	ec.termStart = 150
+	if !ec.waitForVisible(150) {
+		t.Errorf("offset before term start expect visible")
+		return
+	}
+
+	ec.termStart = -1
+	ec.truncateOffset = 120
+	if !ec.waitForVisible(120) || ec.waitForVisible(130) {
+		t.Errorf("offset after truncate offset expect dropped")
+		return
+	}
+}
+
+func TestElectionHasQuorum(t *testing.T) {
+	now := system.CurrentTimeMillis()
+	ec := &electionService{electionTimeout: 3000}
+	ec.peers = []*raftPeer{{id: 2, lastAck: now}, {id: 3, lastAck: now - 10000}, {id: 4, lastAck: now - 10000}}
+	if ec.hasQuorum() {
+		t.Errorf("2 of 4 nodes expect no quorum")
+		return
+	}
+
+	ec.peers[1].lastAck = now
+	if !ec.hasQuorum() {
+		t.Errorf("3 of 4 nodes expect quorum")
+		return
+	}
+}
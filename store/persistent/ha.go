@@ -24,19 +24,35 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/boltmq/boltmq/store"
 	"github.com/boltmq/common/logger"
+	"github.com/boltmq/common/utils/codec"
 	"github.com/boltmq/common/utils/system"
 )
 
 const (
 	ReadSocketMaxBufferSize = 1024 * 1024
+	// master传输数据的头部：offset(8) + size(4) + crc(4) + masterMinOffset(8)
+	haTransferHeaderSize = 8 + 4 + 4 + 8
+	// 旧版本协议的传输头部：offset(8) + size(4)
+	haLegacyTransferHeaderSize = 8 + 4
+)
+
+const (
+	haVersionLegacy int32 = 1 // 旧版本协议，没有版本握手
+	haVersionCRC    int32 = 2 // 传输头部携带crc及masterMinOffset
+	haVersion             = haVersionCRC
+	// 版本握手：slave发送magic(4) + version(4)，master应答ackMagic(4) + 协商后的version(4)。
+	// magic为负数，旧版本master当作offset处理时不会传输数据，只在头部原样返回
+	haHelloMagic    int32 = -0x48410001
+	haHelloAckMagic int32 = -0x48410002
 )
 
 // readSocketService
 // Author zhoufei
 // Since 2017/10/19
 type readSocketService struct {
-	connection        *net.TCPConn
+	connection        net.Conn
 	haConn            *haConnection
 	byteBufferRead    *bytes.Buffer
 	processPosition   int32
@@ -45,7 +61,7 @@ type readSocketService struct {
 	mutex             sync.Mutex
 }
 
-func newReadSocketService(connection *net.TCPConn, haConn *haConnection) *readSocketService {
+func newReadSocketService(connection net.Conn, haConn *haConnection) *readSocketService {
 	return &readSocketService{
 		connection:        connection,
 		haConn:            haConn,
@@ -134,13 +150,13 @@ func (rss *readSocketService) processReadEvent() bool {
 				}
 
 				// 处理Slave的请求
-				rss.haConn.slaveAckOffset = readOffset
+				atomic.StoreInt64(&rss.haConn.slaveAckOffset, readOffset)
 				if rss.haConn.slaveRequestOffset < 0 {
 					rss.haConn.slaveRequestOffset = readOffset
 					logger.Infof("slave[%s] request offset %d.", rss.haConn.clientAddress, readOffset)
 				}
 
-				rss.haConn.ha.notifyTransferSome(rss.haConn.slaveAckOffset)
+				rss.haConn.ha.notifyTransferSome(readOffset)
 			}
 
 		} else if readSize == 0 {
@@ -161,7 +177,7 @@ func (rss *readSocketService) processReadEvent() bool {
 // Author zhoufei
 // Since 2017/10/19
 type writeSocketService struct {
-	connection            *net.TCPConn
+	connection            net.Conn
 	haConn                *haConnection
 	byteBufferHeader      *bytes.Buffer
 	nextTransferFromWhere int64
@@ -173,7 +189,7 @@ type writeSocketService struct {
 	mutex                 sync.Mutex
 }
 
-func newWriteSocketService(connection *net.TCPConn, haConn *haConnection) *writeSocketService {
+func newWriteSocketService(connection net.Conn, haConn *haConnection) *writeSocketService {
 	wss := new(writeSocketService)
 	wss.connection = connection
 	wss.haConn = haConn
@@ -209,6 +225,13 @@ func (wss *writeSocketService) updateNextTransferOffset() {
 			wss.nextTransferFromWhere = masterOffset
 		} else {
 			wss.nextTransferFromWhere = wss.haConn.slaveRequestOffset
+
+			// slave请求的数据已被master删除，只发送头部，由slave根据masterMinOffset重新定位
+			masterMinOffset := wss.haConn.ha.messageStore.clog.getMinOffset()
+			if wss.nextTransferFromWhere < masterMinOffset {
+				logger.Warnf("slave[%s] request offset %d less than master min offset %d.",
+					wss.haConn.clientAddress, wss.nextTransferFromWhere, masterMinOffset)
+			}
 		}
 
 		logger.Infof("master transfer data from %d  to slave[%s], and slave request %d.",
@@ -220,8 +243,8 @@ func (wss *writeSocketService) buildData() {
 	thisOffset := wss.nextTransferFromWhere
 	var size int32 = 0
 
-	bufferResult := wss.haConn.ha.messageStore.GetCommitLogData(thisOffset)
-	wss.bufferResult = bufferResult.(*mappedBufferResult)
+	bufferResult, _ := wss.haConn.ha.messageStore.GetCommitLogData(thisOffset).(*mappedBufferResult)
+	wss.bufferResult = bufferResult
 	var resultBuffer []byte
 	if wss.bufferResult != nil {
 		size = wss.bufferResult.size
@@ -230,7 +253,6 @@ func (wss *writeSocketService) buildData() {
 			size = haTransferBatchSize
 		}
 
-		wss.nextTransferFromWhere += int64(size)
 		beginIndex := thisOffset - thisOffset/int64(wss.bufferResult.byteBuffer.limit)*int64(wss.bufferResult.byteBuffer.limit)
 		endIndex := beginIndex + int64(size)
 		if endIndex > int64(wss.bufferResult.byteBuffer.limit) {
@@ -238,6 +260,10 @@ func (wss *writeSocketService) buildData() {
 		}
 
 		resultBuffer = wss.bufferResult.byteBuffer.mmapBuf[beginIndex:endIndex]
+
+		// 头部的size必须与实际发送的数据一致，否则slave会错位解析
+		size = int32(len(resultBuffer))
+		wss.nextTransferFromWhere += int64(size)
 	} else {
 		// TODO wss.haConn.ha.waitNotify.allWaitForRunning(100)
 	}
@@ -245,6 +271,11 @@ func (wss *writeSocketService) buildData() {
 	// Build Header
 	binary.Write(wss.byteBufferHeader, binary.BigEndian, thisOffset)
 	binary.Write(wss.byteBufferHeader, binary.BigEndian, size)
+	if wss.haConn.version >= haVersionCRC {
+		crc, _ := codec.Crc32(resultBuffer)
+		binary.Write(wss.byteBufferHeader, binary.BigEndian, int32(crc))
+		binary.Write(wss.byteBufferHeader, binary.BigEndian, wss.haConn.ha.messageStore.clog.getMinOffset())
+	}
 
 	if wss.bufferResult != nil && resultBuffer != nil && len(resultBuffer) > 0 {
 		logger.Infof("master writer socket service send offset: %d size: %d.", thisOffset, size)
@@ -310,18 +341,20 @@ func (wss *writeSocketService) shutdown() {
 // Since 2017/10/19
 type haConnection struct {
 	ha                 *haService
-	connection         *net.TCPConn
+	connection         net.Conn
 	clientAddress      string
 	wss                *writeSocketService
 	rss                *readSocketService
 	slaveRequestOffset int64 // Slave请求从哪里开始拉数据
 	slaveAckOffset     int64 // Slave收到数据后，应答Offset
+	version            int32 // 与slave协商的协议版本
 }
 
-func newHAConnection(ha *haService, connection *net.TCPConn) *haConnection {
+func newHAConnection(ha *haService, connection net.Conn, version int32) *haConnection {
 	haConn := new(haConnection)
 	haConn.ha = ha
 	haConn.connection = connection
+	haConn.version = version
 	haConn.clientAddress = connection.RemoteAddr().String()
 	haConn.wss = newWriteSocketService(connection, haConn)
 	haConn.rss = newReadSocketService(connection, haConn)
@@ -344,6 +377,94 @@ func (haConn *haConnection) shutdown() {
 	}
 }
 
+// haPrefixConn 先返回版本握手时预读的数据
+type haPrefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (conn *haPrefixConn) Read(b []byte) (int, error) {
+	if len(conn.prefix) > 0 {
+		n := copy(b, conn.prefix)
+		conn.prefix = conn.prefix[n:]
+		return n, nil
+	}
+
+	return conn.Conn.Read(b)
+}
+
+// negotiateServerVersion master端版本握手。旧版本slave连接后直接汇报offset，
+// 此时按旧版本协议传输，预读的offset保留给读服务处理
+func negotiateServerVersion(conn net.Conn) (net.Conn, int32, error) {
+	conn.SetDeadline(time.Now().Add(haHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	hello := make([]byte, 8)
+	if _, err := io.ReadFull(conn, hello); err != nil {
+		return nil, 0, err
+	}
+
+	if int32(binary.BigEndian.Uint32(hello[:4])) != haHelloMagic {
+		return &haPrefixConn{Conn: conn, prefix: hello}, haVersionLegacy, nil
+	}
+
+	version := int32(binary.BigEndian.Uint32(hello[4:]))
+	if version < haVersionLegacy {
+		return nil, 0, fmt.Errorf("slave ha version %d is invalid", version)
+	}
+	if version > haVersion {
+		version = haVersion
+	}
+
+	ack := bytes.NewBuffer(make([]byte, 0, 8))
+	binary.Write(ack, binary.BigEndian, haHelloAckMagic)
+	binary.Write(ack, binary.BigEndian, version)
+	if _, err := conn.Write(ack.Bytes()); err != nil {
+		return nil, 0, err
+	}
+
+	return conn, version, nil
+}
+
+// negotiateClientVersion slave端版本握手，旧版本master原样返回握手数据，此时返回haVersionLegacy，
+// 该连接上master已把握手数据当作请求offset，需要重新连接
+func negotiateClientVersion(conn net.Conn) (int32, error) {
+	conn.SetDeadline(time.Now().Add(haHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	hello := bytes.NewBuffer(make([]byte, 0, 8))
+	binary.Write(hello, binary.BigEndian, haHelloMagic)
+	binary.Write(hello, binary.BigEndian, haVersion)
+	if _, err := conn.Write(hello.Bytes()); err != nil {
+		return 0, err
+	}
+
+	ack := make([]byte, 8)
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		return 0, err
+	}
+
+	if int32(binary.BigEndian.Uint32(ack[:4])) != haHelloAckMagic {
+		return haVersionLegacy, nil
+	}
+
+	version := int32(binary.BigEndian.Uint32(ack[4:]))
+	if version < haVersionLegacy || version > haVersion {
+		return 0, fmt.Errorf("master ha version %d is invalid", version)
+	}
+
+	return version, nil
+}
+
+// haTransferHeaderLen 协议版本对应的传输头部长度
+func haTransferHeaderLen(version int32) int {
+	if version < haVersionCRC {
+		return haLegacyTransferHeaderSize
+	}
+
+	return haTransferHeaderSize
+}
+
 // acceptSocketService
 // Author zhoufei
 // Since 2017/10/19
@@ -392,13 +513,27 @@ func (ass *acceptSocketService) start() {
 		}
 
 		logger.Infof("haService receive new connection %s.", connection.RemoteAddr().String())
-		haConnection := newHAConnection(ass.ha, connection)
 
+		// 握手可能阻塞，不能影响接收其他连接
 		go func() {
+			conn, err := ass.ha.security.serverHandshake(connection)
+			if err != nil {
+				ass.ha.security.recordFailure(connection.RemoteAddr().String(), err)
+				connection.Close()
+				return
+			}
+
+			conn, version, err := negotiateServerVersion(conn)
+			if err != nil {
+				ass.ha.security.recordFailure(connection.RemoteAddr().String(), err)
+				connection.Close()
+				return
+			}
+
+			haConnection := newHAConnection(ass.ha, conn, version)
+			ass.ha.addConnection(haConnection)
 			haConnection.start()
 		}()
-
-		ass.ha.addConnection(haConnection)
 	}
 
 	ass.listener.Close()
@@ -409,67 +544,80 @@ func (ass *acceptSocketService) shutdown(interrupt bool) {
 	ass.stoped = true
 }
 
-// groupTransferService 同步进度监听服务，如果达到应用层的写入偏移量，则通知应用层该同步已经完成。
+// groupTransferService 同步进度监听服务，SYNC_MASTER模式下等待指定数量的slave确认写入偏移量
 // Author zhoufei
 // Since 2017/10/18
 type groupTransferService struct {
-	ha                   *haService
-	requestChan          chan *groupCommitRequest
-	stopChan             chan bool
-	stoped               bool
-	notifyTransferObject *system.Notify
-	requestsWrite        []*groupCommitRequest
-	requestsRead         []*groupCommitRequest
+	ha         *haService
+	notifyChan chan struct{} // slave应答offset推进时关闭并重建，唤醒等待确认的写入
+	mutex      sync.Mutex
 }
 
 func newGroupTransferService(ha *haService) *groupTransferService {
 	return &groupTransferService{
-		requestChan:          make(chan *groupCommitRequest, 100),
-		notifyTransferObject: system.CreateNotify(),
+		ha:         ha,
+		notifyChan: make(chan struct{}),
 	}
 }
 
-func (gtService *groupTransferService) putRequest(request *groupCommitRequest) {
-	gtService.requestChan <- request
-}
+// doWaitTransfer 等待至少quorum个slave确认nextOffset之前的数据。
+// 可用slave数量不足quorum时返回SLAVE_NOT_AVAILABLE，超时返回FLUSH_SLAVE_TIMEOUT
+func (gtService *groupTransferService) doWaitTransfer(nextOffset int64, quorum int, timeout int64) store.PutMessageStatus {
+	deadline := time.Now().Add(time.Duration(timeout) * time.Millisecond)
+	for {
+		gtService.mutex.Lock()
+		notifyChan := gtService.notifyChan
+		gtService.mutex.Unlock()
 
-func (gtService *groupTransferService) doWaitTransfer() {
-	select {
-	case request := <-gtService.requestChan:
-		transferOK := atomic.LoadInt64(&gtService.ha.push2SlaveMaxOffset) >= request.nextOffset
-		for i := 0; !transferOK && i < 5; i++ {
-			gtService.notifyTransferObject.WaitTimeout(1000 * time.Millisecond)
-			transferOK = atomic.LoadInt64(&gtService.ha.push2SlaveMaxOffset) >= request.nextOffset
+		acked, available := gtService.ha.slaveAckStats(nextOffset)
+		if acked >= quorum {
+			return store.PUTMESSAGE_PUT_OK
 		}
 
-		if !transferOK {
-			logger.Warnf("transfer message to slave timeout, %d.", request.nextOffset)
+		if available < quorum {
+			logger.Warnf("transfer message to slave, available slaves %d less than quorum %d, next offset: %d.",
+				available, quorum, nextOffset)
+			return store.SLAVE_NOT_AVAILABLE
 		}
 
-		request.wakeupCustomer(transferOK)
-	case <-gtService.stopChan:
-		gtService.stoped = true
-		close(gtService.requestChan)
-		close(gtService.stopChan)
+		remain := deadline.Sub(time.Now())
+		if remain <= 0 {
+			logger.Warnf("transfer message to slave timeout, acked slaves %d less than quorum %d, next offset: %d.",
+				acked, quorum, nextOffset)
+			return store.FLUSH_SLAVE_TIMEOUT
+		}
+
+		select {
+		case <-notifyChan:
+		case <-time.After(remain):
+		}
 	}
 }
 
 func (gtService *groupTransferService) notifyTransferSome() {
-	gtService.notifyTransferObject.Signal()
+	gtService.mutex.Lock()
+	close(gtService.notifyChan)
+	gtService.notifyChan = make(chan struct{})
+	gtService.mutex.Unlock()
 }
 
-func (gtService *groupTransferService) start() {
-	for {
-		if gtService.stoped {
-			break
+// countSlaveAck 统计应答offset达到offset的slave数量，以及落后不超过fallBehindMax的可用slave数量
+func countSlaveAck(ackOffsets []int64, maxOffset, offset, fallBehindMax int64) (acked, available int) {
+	for _, ackOffset := range ackOffsets {
+		if ackOffset < 0 {
+			continue
+		}
+
+		if ackOffset >= offset {
+			acked++
+		}
+
+		if maxOffset-ackOffset < fallBehindMax {
+			available++
 		}
-		gtService.notifyTransferObject.Wait()
-		gtService.doWaitTransfer()
 	}
-}
 
-func (gtService *groupTransferService) shutdown() {
-	gtService.stopChan <- true
+	return
 }
 
 // haClient HA高可用客户端
@@ -478,7 +626,7 @@ func (gtService *groupTransferService) shutdown() {
 type haClient struct {
 	masterAddress         string        // 主节点IP:PORT
 	reportOffset          *bytes.Buffer // 向Master汇报Slave最大Offset
-	connection            *net.TCPConn
+	connection            net.Conn
 	lastWriteTimestamp    int64
 	currentReportedOffset int64
 	dispatchPosition      int32
@@ -487,6 +635,9 @@ type haClient struct {
 	mutex                 sync.Mutex
 	stoped                bool
 	responseChan          chan []byte
+	masterOffset          int64  // 最近一次收到的master传输位置
+	version               int32  // 与master协商的协议版本
+	legacyMaster          string // 不支持版本握手的master地址，连接时直接使用旧版本协议
 }
 
 func newHAClient(ha *haService) *haClient {
@@ -541,13 +692,38 @@ func (client *haClient) connectMaster() bool {
 			return false
 		}
 
-		conn, err := net.DialTCP("tcp", nil, tcpAddress)
+		tcpConn, err := net.DialTCP("tcp", nil, tcpAddress)
 		if err != nil {
 			logger.Errorf("ha client connect master create connection err: %s.", err)
 			return false
 		}
 
+		conn, err := client.ha.security.clientHandshake(tcpConn, address)
+		if err != nil {
+			client.ha.security.recordFailure(address, err)
+			tcpConn.Close()
+			return false
+		}
+
+		version := haVersionLegacy
+		if address != client.legacyMaster {
+			version, err = negotiateClientVersion(conn)
+			if err != nil {
+				client.ha.security.recordFailure(address, err)
+				conn.Close()
+				return false
+			}
+
+			if version == haVersionLegacy {
+				logger.Warnf("ha master %s not support version handshake, reconnect with legacy protocol.", address)
+				client.legacyMaster = address
+				conn.Close()
+				return false
+			}
+		}
+
 		client.connection = conn
+		client.version = version
 		client.currentReportedOffset = client.ha.messageStore.MaxPhyOffset()
 	}
 
@@ -603,10 +779,13 @@ func (client *haClient) processRead() bool {
 	client.mutex.Unlock()
 
 	var (
-		offset  int64 = 0
-		size    int32 = 0
-		msgbuf        = bytes.NewBuffer(make([]byte, 0))
-		databuf       = make([]byte, client.ha.messageStore.config.HaTransferBatchSize)
+		offset          int64 = 0
+		size            int32 = 0
+		crc             int32 = 0
+		masterMinOffset int64 = 0
+		headerSize            = haTransferHeaderLen(client.version)
+		msgbuf                = bytes.NewBuffer(make([]byte, 0))
+		databuf               = make([]byte, client.ha.messageStore.config.HaTransferBatchSize)
 	)
 
 	for {
@@ -628,14 +807,25 @@ func (client *haClient) processRead() bool {
 		}
 
 		for {
-			if size == 0 && msgbuf.Len() >= 12 {
+			if size == 0 && msgbuf.Len() >= headerSize {
 				binary.Read(msgbuf, binary.BigEndian, &offset)
 				binary.Read(msgbuf, binary.BigEndian, &size)
+				if client.version >= haVersionCRC {
+					binary.Read(msgbuf, binary.BigEndian, &crc)
+					binary.Read(msgbuf, binary.BigEndian, &masterMinOffset)
+				}
+				atomic.StoreInt64(&client.masterOffset, offset+int64(size))
+
+				// master已删除传输位置的数据，重新定位后重连
+				if client.version >= haVersionCRC && offset < masterMinOffset {
+					client.rebase(offset, masterMinOffset)
+					return false
+				}
 			}
 
 			if size > 0 && int32(msgbuf.Len()) >= size {
 				// handle message body
-				if !client.handleMessageBody(offset, size, msgbuf) {
+				if !client.handleMessageBody(offset, size, crc, msgbuf) {
 					return false
 				}
 
@@ -649,12 +839,19 @@ func (client *haClient) processRead() bool {
 	return true
 }
 
-func (client *haClient) handleMessageBody(masterPhyOffset int64, bodySize int32, msgbuf *bytes.Buffer) bool {
+func (client *haClient) handleMessageBody(masterPhyOffset int64, bodySize int32, bodyCRC int32, msgbuf *bytes.Buffer) bool {
 	if bodySize > 0 {
-		msgHeaderSize := 8 + 4
+		msgHeaderSize := haTransferHeaderLen(client.version)
 		bodyData := make([]byte, bodySize)
 		msgbuf.Read(bodyData)
 
+		// 数据在传输中损坏，断开连接后从本地最大offset重新同步
+		if crc, _ := codec.Crc32(bodyData); client.version >= haVersionCRC && int32(crc) != bodyCRC {
+			logger.Errorf("ha client check crc failed, offset: %d size: %d crc: %d master crc: %d.",
+				masterPhyOffset, bodySize, int32(crc), bodyCRC)
+			return false
+		}
+
 		if len(bodyData) > 0 {
 			slavePhyOffset := client.ha.messageStore.MaxPhyOffset()
 
@@ -680,6 +877,25 @@ func (client *haClient) handleMessageBody(masterPhyOffset int64, bodySize int32,
 	return true
 }
 
+// rebase slave的同步位置早于master最小offset时，清空本地数据并从master最小offset开始同步，
+// 否则slave会一直请求master已删除的数据
+func (client *haClient) rebase(transferOffset, masterMinOffset int64) {
+	if !client.ha.messageStore.config.HaSlaveAutoRebase {
+		logger.Errorf("ha client transfer offset %d less than master min offset %d, auto rebase disabled.",
+			transferOffset, masterMinOffset)
+		time.Sleep(time.Millisecond * 1000 * 5)
+		return
+	}
+
+	logger.Warnf("ha client transfer offset %d less than master min offset %d, rebase slave commit log.",
+		transferOffset, masterMinOffset)
+	if !client.ha.messageStore.resetCommitLog(masterMinOffset) {
+		return
+	}
+
+	atomic.StoreInt64(&client.masterOffset, masterMinOffset)
+}
+
 func (client *haClient) start() {
 	logger.Info("ha client service started.")
 
@@ -733,6 +949,7 @@ type haService struct {
 	acceptSktService    *acceptSocketService            // 接收新的Socket连接服务
 	waitNotify          *system.WaitNotify              // TODO 异步通知
 	gtService           *groupTransferService           // 主从复制通知服务
+	security            *haSecurity                     // TLS及身份校验
 	client              *haClient                       // Slave订阅对象
 	mutex               sync.Mutex
 }
@@ -746,6 +963,7 @@ func newHAService(messageStore *PersistentMessageStore) *haService {
 	ha.push2SlaveMaxOffset = 0
 	ha.acceptSktService = newAcceptSocketService(messageStore.config.HaListenPort, ha)
 	ha.gtService = newGroupTransferService(ha)
+	ha.security = newHASecurity(messageStore.config)
 	ha.client = newHAClient(ha)
 	return ha
 }
@@ -760,14 +978,61 @@ func (ha *haService) destroyConnections() {
 	}
 
 	ha.connectionList = list.New()
+	ha.connectionElements = make(map[*haConnection]*list.Element)
 }
 
 func (ha *haService) updateMasterAddress(newAddr string) {
+	ha.mutex.Lock()
+	defer ha.mutex.Unlock()
+
 	if ha.client != nil {
 		ha.client.updateMasterAddress(newAddr)
 	}
 }
 
+// stopClient 停止从master同步数据，slave切换为master时调用；HA接收服务在所有角色下均已启动
+func (ha *haService) stopClient() {
+	ha.mutex.Lock()
+	defer ha.mutex.Unlock()
+
+	ha.client.updateMasterAddress("")
+	ha.client.shutdown()
+
+	// 关闭连接以中断阻塞中的读取
+	if conn := ha.client.connection; conn != nil {
+		conn.Close()
+	}
+}
+
+// startClient 以新的master地址重新开始同步，master切换为slave时调用
+func (ha *haService) startClient(masterAddr string) {
+	ha.mutex.Lock()
+	defer ha.mutex.Unlock()
+
+	ha.client.shutdown()
+	ha.client = newHAClient(ha)
+	ha.client.updateMasterAddress(masterAddr)
+	go ha.client.start()
+}
+
+// slaveFallBehind slave按最近一次收到的master传输位置计算落后的字节数，未收到过master数据时返回-1
+func (ha *haService) slaveFallBehind() int64 {
+	ha.mutex.Lock()
+	client := ha.client
+	ha.mutex.Unlock()
+
+	masterOffset := atomic.LoadInt64(&client.masterOffset)
+	if masterOffset <= 0 {
+		return -1
+	}
+
+	fallBehind := masterOffset - ha.messageStore.clog.getMaxOffset()
+	if fallBehind < 0 {
+		return 0
+	}
+	return fallBehind
+}
+
 func (ha *haService) addConnection(haConn *haConnection) {
 	ha.mutex.Lock()
 	defer ha.mutex.Unlock()
@@ -778,20 +1043,55 @@ func (ha *haService) addConnection(haConn *haConnection) {
 func (ha *haService) removeConnection(haConn *haConnection) {
 	ha.mutex.Lock()
 	defer ha.mutex.Unlock()
-	connElement := ha.connectionElements[haConn]
+	connElement, ok := ha.connectionElements[haConn]
+	if !ok {
+		return
+	}
+
 	ha.connectionList.Remove(connElement)
+	delete(ha.connectionElements, haConn)
+
+	// 可用slave减少，唤醒等待确认的写入重新判断
+	ha.gtService.notifyTransferSome()
 }
 
 func (ha *haService) notifyTransferSome(offset int64) {
 	for value := atomic.LoadInt64(&ha.push2SlaveMaxOffset); offset > value; {
 		ok := atomic.CompareAndSwapInt64(&ha.push2SlaveMaxOffset, value, offset)
 		if ok {
-			ha.gtService.notifyTransferSome()
 			break
 		} else {
 			value = atomic.LoadInt64(&ha.push2SlaveMaxOffset)
 		}
 	}
+
+	// 每个slave的应答都可能使确认数量达到quorum
+	ha.gtService.notifyTransferSome()
+}
+
+// slaveAckStats 统计已确认offset的slave数量及可用slave数量
+func (ha *haService) slaveAckStats(offset int64) (acked, available int) {
+	ha.mutex.Lock()
+	ackOffsets := make([]int64, 0, ha.connectionList.Len())
+	for element := ha.connectionList.Front(); element != nil; element = element.Next() {
+		connection := element.Value.(*haConnection)
+		ackOffsets = append(ackOffsets, atomic.LoadInt64(&connection.slaveAckOffset))
+	}
+	ha.mutex.Unlock()
+
+	maxOffset := ha.messageStore.clog.getMaxOffset()
+	fallBehindMax := int64(ha.messageStore.config.HaSlaveFallbehindMax)
+	return countSlaveAck(ackOffsets, maxOffset, offset, fallBehindMax)
+}
+
+// waitForSlaveAck 等待配置数量的slave确认nextOffset之前的数据
+func (ha *haService) waitForSlaveAck(nextOffset int64) store.PutMessageStatus {
+	quorum := int(ha.messageStore.config.SyncReplicasQuorum)
+	if quorum <= 0 {
+		return store.PUTMESSAGE_PUT_OK
+	}
+
+	return ha.gtService.doWaitTransfer(nextOffset, quorum, int64(ha.messageStore.config.SyncReplicasTimeout))
 }
 
 func (ha *haService) start() {
@@ -799,18 +1099,16 @@ func (ha *haService) start() {
 		ha.acceptSktService.start()
 	}()
 
-	go func() {
-		// ha.gtService.start()
-	}()
-
 	go func() {
 		ha.client.start()
 	}()
 }
 
 func (ha *haService) shutdown() {
+	ha.mutex.Lock()
 	ha.client.shutdown()
+	ha.mutex.Unlock()
+
 	ha.acceptSktService.shutdown(true)
 	ha.destroyConnections()
-	// TODO ha.gtService.shutdown()
 }
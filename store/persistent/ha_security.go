@@ -0,0 +1,227 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package persistent
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/boltmq/common/logger"
+)
+
+const (
+	haHandshakeTimeout = 5 * time.Second
+	haAuthNonceSize    = 16
+)
+
+// haSecurity HA复制通道的TLS及身份校验，连接建立后先完成TLS握手，再由master下发随机数，
+// slave以共享密钥计算HMAC应答，校验失败的连接直接关闭
+type haSecurity struct {
+	serverTLS       *tls.Config
+	clientTLS       *tls.Config
+	tlsErr          error    // TLS配置加载失败时拒绝所有连接
+	secret          []byte   // 共享密钥，为空时不校验
+	allowedNames    []string // mTLS模式下允许的slave证书名称，为空时只校验证书链
+	failures        int64    // 握手失败次数
+	lastFailure     atomic.Value
+	lastFailureTime int64
+}
+
+func newHASecurity(conf *Config) *haSecurity {
+	security := &haSecurity{}
+	if conf.HaAuthSecret != "" {
+		security.secret = []byte(conf.HaAuthSecret)
+	}
+
+	for _, name := range strings.Split(conf.HaTLSAllowedNames, ";") {
+		if name = strings.TrimSpace(name); name != "" {
+			security.allowedNames = append(security.allowedNames, name)
+		}
+	}
+
+	if conf.HaTLSEnable {
+		security.serverTLS, security.clientTLS, security.tlsErr = newHATLSConfig(conf)
+		if security.tlsErr != nil {
+			logger.Errorf("ha load tls config err: %s.", security.tlsErr)
+		}
+	}
+
+	return security
+}
+
+// newHATLSConfig 加载证书，配置CA时双向校验证书
+func newHATLSConfig(conf *Config) (*tls.Config, *tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(conf.HaTLSCertFile, conf.HaTLSKeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serverTLS := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	clientTLS := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12, ServerName: conf.HaTLSServerName}
+	if conf.HaTLSCAFile != "" {
+		pem, err := ioutil.ReadFile(conf.HaTLSCAFile)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("no certificate found in %s", conf.HaTLSCAFile)
+		}
+
+		serverTLS.ClientCAs = pool
+		serverTLS.ClientAuth = tls.RequireAndVerifyClientCert
+		clientTLS.RootCAs = pool
+	}
+
+	return serverTLS, clientTLS, nil
+}
+
+// serverHandshake master端握手，返回可用于传输数据的连接
+func (security *haSecurity) serverHandshake(conn net.Conn) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(haHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if security.tlsErr != nil {
+		return nil, security.tlsErr
+	}
+
+	if security.serverTLS != nil {
+		tlsConn := tls.Server(conn, security.serverTLS)
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, err
+		}
+
+		if err := checkPeerName(tlsConn.ConnectionState(), security.allowedNames); err != nil {
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	if security.secret == nil {
+		return conn, nil
+	}
+
+	nonce := make([]byte, haAuthNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(nonce); err != nil {
+		return nil, err
+	}
+
+	digest := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(conn, digest); err != nil {
+		return nil, err
+	}
+
+	if !hmac.Equal(digest, haAuthDigest(security.secret, nonce)) {
+		return nil, fmt.Errorf("slave auth secret mismatch")
+	}
+
+	return conn, nil
+}
+
+// clientHandshake slave端握手，返回可用于传输数据的连接
+func (security *haSecurity) clientHandshake(conn net.Conn, masterAddr string) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(haHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if security.tlsErr != nil {
+		return nil, security.tlsErr
+	}
+
+	if security.clientTLS != nil {
+		tlsCfg := security.clientTLS
+		if tlsCfg.ServerName == "" {
+			tlsCfg = tlsCfg.Clone()
+			tlsCfg.ServerName, _, _ = net.SplitHostPort(masterAddr)
+		}
+
+		tlsConn := tls.Client(conn, tlsCfg)
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	if security.secret == nil {
+		return conn, nil
+	}
+
+	nonce := make([]byte, haAuthNonceSize)
+	if _, err := io.ReadFull(conn, nonce); err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(haAuthDigest(security.secret, nonce)); err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// recordFailure 记录握手失败，通过RuntimeInfo展示
+func (security *haSecurity) recordFailure(addr string, err error) {
+	atomic.AddInt64(&security.failures, 1)
+	atomic.StoreInt64(&security.lastFailureTime, time.Now().UnixNano()/int64(time.Millisecond))
+	security.lastFailure.Store(fmt.Sprintf("%s: %s", addr, err))
+	logger.Warnf("ha handshake with %s failed: %s.", addr, err)
+}
+
+func (security *haSecurity) buildRunningStats(stats map[string]string) {
+	lastFailure, _ := security.lastFailure.Load().(string)
+	stats[HA_HANDSHAKE_FAILURES.String()] = fmt.Sprintf("count=%d, last=%d %s",
+		atomic.LoadInt64(&security.failures), atomic.LoadInt64(&security.lastFailureTime), lastFailure)
+}
+
+func haAuthDigest(secret, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+// checkPeerName 校验slave证书的CN或DNS名称在允许列表中
+func checkPeerName(state tls.ConnectionState, allowedNames []string) error {
+	if len(allowedNames) == 0 {
+		return nil
+	}
+
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("slave certificate is required")
+	}
+
+	cert := state.PeerCertificates[0]
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	for _, name := range names {
+		for _, allowed := range allowedNames {
+			if name == allowed {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("slave certificate %s is not allowed", cert.Subject.CommonName)
+}
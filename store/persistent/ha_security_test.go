@@ -0,0 +1,63 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package persistent
+
+import (
+	"net"
+	"testing"
+)
+
+func haHandshake(masterSecret, slaveSecret string) error {
+	master := newHASecurity(&Config{HaAuthSecret: masterSecret})
+	slave := newHASecurity(&Config{HaAuthSecret: slaveSecret})
+	masterConn, slaveConn := net.Pipe()
+	defer masterConn.Close()
+
+	go func() {
+		slave.clientHandshake(slaveConn, "127.0.0.1:10912")
+		slaveConn.Close()
+	}()
+
+	_, err := master.serverHandshake(masterConn)
+	return err
+}
+
+func TestHASecretHandshake(t *testing.T) {
+	if err := haHandshake("boltmq", "boltmq"); err != nil {
+		t.Errorf("handshake with same secret err: %s", err)
+		return
+	}
+
+	if err := haHandshake("boltmq", "unknown"); err == nil {
+		t.Errorf("handshake with wrong secret expect err")
+		return
+	}
+
+	if err := haHandshake("boltmq", ""); err == nil {
+		t.Errorf("handshake without secret expect err")
+		return
+	}
+}
+
+func TestHATLSConfigErr(t *testing.T) {
+	security := newHASecurity(&Config{HaTLSEnable: true, HaTLSCertFile: "not_exist.crt", HaTLSKeyFile: "not_exist.key"})
+	masterConn, slaveConn := net.Pipe()
+	defer masterConn.Close()
+	defer slaveConn.Close()
+
+	if _, err := security.serverHandshake(masterConn); err == nil {
+		t.Errorf("handshake with invalid tls config expect err")
+		return
+	}
+}
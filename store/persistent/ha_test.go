@@ -0,0 +1,107 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package persistent
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestCountSlaveAck(t *testing.T) {
+	cases := []struct {
+		ackOffsets []int64
+		offset     int64
+		acked      int
+		available  int
+	}{
+		// 两个slave都已确认
+		{[]int64{1000, 1200}, 1000, 2, 2},
+		// 一个slave较慢，只有一个确认
+		{[]int64{1000, 800}, 1000, 1, 2},
+		// 未应答过的连接不计入可用slave，落后过多的slave不可用
+		{[]int64{-1, 100}, 1000, 0, 0},
+		{nil, 1000, 0, 0},
+	}
+
+	for i, c := range cases {
+		acked, available := countSlaveAck(c.ackOffsets, 1200, c.offset, 500)
+		if acked != c.acked || available != c.available {
+			t.Errorf("case %d acked=%d available=%d, expect %d %d", i, acked, available, c.acked, c.available)
+			return
+		}
+	}
+}
+
+func TestHAVersionNegotiate(t *testing.T) {
+	masterConn, slaveConn := net.Pipe()
+	defer masterConn.Close()
+	defer slaveConn.Close()
+
+	go func() {
+		negotiateServerVersion(masterConn)
+	}()
+
+	version, err := negotiateClientVersion(slaveConn)
+	if err != nil || version != haVersion {
+		t.Errorf("negotiate version=%d err=%v, expect %d", version, err, haVersion)
+		return
+	}
+}
+
+func TestHAVersionLegacySlave(t *testing.T) {
+	masterConn, slaveConn := net.Pipe()
+	defer masterConn.Close()
+	defer slaveConn.Close()
+
+	// 旧版本slave连接后直接汇报offset
+	report := make([]byte, 8)
+	binary.BigEndian.PutUint64(report, 1024)
+	go func() {
+		slaveConn.Write(report)
+	}()
+
+	conn, version, err := negotiateServerVersion(masterConn)
+	if err != nil || version != haVersionLegacy {
+		t.Errorf("negotiate legacy slave version=%d err=%v", version, err)
+		return
+	}
+
+	// 预读的offset需要交给读服务处理
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(conn, buf); err != nil || binary.BigEndian.Uint64(buf) != 1024 {
+		t.Errorf("read reported offset %v err=%v", buf, err)
+		return
+	}
+}
+
+func TestHAVersionLegacyMaster(t *testing.T) {
+	masterConn, slaveConn := net.Pipe()
+	defer masterConn.Close()
+	defer slaveConn.Close()
+
+	// 旧版本master把握手数据当作offset，在传输头部原样返回
+	go func() {
+		hello := make([]byte, 8)
+		io.ReadFull(masterConn, hello)
+		masterConn.Write(append(hello, 0, 0, 0, 0))
+	}()
+
+	version, err := negotiateClientVersion(slaveConn)
+	if err != nil || version != haVersionLegacy {
+		t.Errorf("negotiate legacy master version=%d err=%v", version, err)
+		return
+	}
+}
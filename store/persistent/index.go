@@ -86,6 +86,9 @@ func (idx *indexService) load(lastExitOK bool) bool {
 			filePath := filepath.FromSlash(idx.storePath + string(os.PathSeparator) + file.Name())
 			idxFile := newIndexFile(filePath, idx.hashSlotNum, idx.indexNum, int64(0), int64(0))
 			idxFile.load()
+			if idxFile.recoverHeader() {
+				logger.Warnf("index file %s header not persisted, recover index count %d.", filePath, idxFile.header.indexCount)
+			}
 
 			if !lastExitOK {
 				// TODO
@@ -105,7 +108,10 @@ func (idx *indexService) start() {
 	for {
 		select {
 		case request := <-idx.requestQueue:
-			if request != nil {
+			if rebuild, ok := request.(*rebuildIndexRequest); ok {
+				idx.destroy()
+				close(rebuild.done)
+			} else if request != nil {
 				idx.buildIndex(request)
 			}
 		}
@@ -207,7 +213,7 @@ func (idx *indexService) getAndCreateLastIndexFile() *indexFile {
 	// 如果没找到，使用写锁创建文件
 	if idxFile == nil {
 		fileName := fmt.Sprintf("%s%c%s", idx.storePath, os.PathSeparator, timeMillisecondToHumanString(time.Now()))
-		idxFile := newIndexFile(fileName, idx.hashSlotNum, idx.indexNum, lastUpdateEndPhyOffset, lastUpdateIndexTimestamp)
+		idxFile = newIndexFile(fileName, idx.hashSlotNum, idx.indexNum, lastUpdateEndPhyOffset, lastUpdateIndexTimestamp)
 
 		idx.readWriteLock.Lock()
 		idx.indexFileList.PushBack(idxFile)
@@ -312,8 +318,14 @@ func (idx *indexService) flush(idxFile *indexFile) {
 	}
 }
 
+// shutdown 最后一个索引文件未写满时头部只在内存中，停止时刷盘
 func (idx *indexService) shutdown() {
-	// TODO
+	idx.readWriteLock.RLock()
+	defer idx.readWriteLock.RUnlock()
+
+	if element := idx.indexFileList.Back(); element != nil {
+		element.Value.(*indexFile).flush()
+	}
 }
 
 var (
@@ -344,7 +356,9 @@ func newIndexFile(fileName string, hashSlotNum, indexNum int32, endPhyOffset, en
 	idxFile.hashSlotNum = hashSlotNum
 	idxFile.indexNum = indexNum
 
-	idxFile.header = newIndexHeader(newMappedByteBuffer(make([]byte, idxFile.mf.fileSize)))
+	// 头部与文件共用映射内存，刷盘时一并持久化
+	idxFile.header = newIndexHeader(newMappedByteBuffer(idxFile.mf.byteBuffer.mmapBuf))
+	idxFile.header.load()
 
 	if endPhyOffset > 0 {
 		idxFile.header.setBeginPhyOffset(endPhyOffset)
@@ -363,6 +377,51 @@ func (idxFile *indexFile) load() {
 	idxFile.header.load()
 }
 
+// recoverHeader 头部未持久化（旧版本文件或停止前未刷盘）时，按已写入的索引条目恢复indexCount及物理offset范围。
+// 存储时间无法恢复，保持为0
+func (idxFile *indexFile) recoverHeader() bool {
+	if idxFile.header.indexCount > 1 {
+		return false
+	}
+
+	count := int32(1)
+	for ; count < idxFile.indexNum; count++ {
+		if isZeroBytes(idxFile.indexEntry(count)) {
+			break
+		}
+	}
+
+	if count == 1 {
+		return false
+	}
+
+	entry := newMappedByteBuffer(idxFile.indexEntry(1))
+	entry.ReadInt32()
+	idxFile.header.beginPhyOffset = entry.ReadInt64()
+	entry = newMappedByteBuffer(idxFile.indexEntry(count - 1))
+	entry.ReadInt32()
+	idxFile.header.endPhyOffset = entry.ReadInt64()
+	idxFile.header.hashSlotCount = count - 1
+	idxFile.header.indexCount = count
+	return true
+}
+
+// isLegacyFormat 旧版本写入索引时把哈希槽写到了索引条目的位置，哈希槽全为0，条目的keyHash被覆盖，无法校验及查询
+func (idxFile *indexFile) isLegacyFormat() bool {
+	if idxFile.header.indexCount <= 1 {
+		return false
+	}
+
+	slots := idxFile.byteBuffer.mmapBuf[INDEX_HEADER_SIZE : INDEX_HEADER_SIZE+idxFile.hashSlotNum*HASH_SLOT_SIZE]
+	return isZeroBytes(slots)
+}
+
+// indexEntry 第index条索引的原始数据
+func (idxFile *indexFile) indexEntry(index int32) []byte {
+	pos := INDEX_HEADER_SIZE + idxFile.hashSlotNum*HASH_SLOT_SIZE + index*INDEX_SIZE
+	return idxFile.byteBuffer.mmapBuf[pos : pos+INDEX_SIZE]
+}
+
 func (idxFile *indexFile) flush() {
 	beginTime := time.Now().UnixNano() / 1000000
 	if idxFile.mf.hold() {
@@ -421,7 +480,7 @@ func (idxFile *indexFile) putKey(key string, phyOffset int64, storeTimestamp int
 
 		// 更新哈希槽
 		currentwritePos := idxFile.byteBuffer.writePos
-		idxFile.byteBuffer.writePos = int(absIndexPos)
+		idxFile.byteBuffer.writePos = int(absSlotPos)
 		idxFile.byteBuffer.WriteInt32(idxFile.header.indexCount)
 		idxFile.byteBuffer.writePos = currentwritePos
 
@@ -443,7 +502,16 @@ func (idxFile *indexFile) putKey(key string, phyOffset int64, storeTimestamp int
 }
 
 func (idxFile *indexFile) indexKeyHashMethod(key string) int32 {
-	keyHash := idxFile.indexKeyHashCode(key)
+	return indexKeyHash(key)
+}
+
+func (idxFile *indexFile) indexKeyHashCode(key string) int32 {
+	return indexKeyHashCode(key)
+}
+
+// indexKeyHash 索引key的hash，压缩topic时同样按该hash对key分桶
+func indexKeyHash(key string) int32 {
+	keyHash := indexKeyHashCode(key)
 	keyHashPositive := math.Abs(float64(keyHash))
 	if keyHashPositive < 0 {
 		keyHashPositive = 0
@@ -451,7 +519,7 @@ func (idxFile *indexFile) indexKeyHashMethod(key string) int32 {
 	return int32(keyHashPositive)
 }
 
-func (idxFile *indexFile) indexKeyHashCode(key string) int32 {
+func indexKeyHashCode(key string) int32 {
 	h := fnv.New32a()
 	h.Write([]byte(key))
 	return int32(h.Sum32())
@@ -39,6 +39,9 @@ const (
 type appendMessageCallback interface {
 	// write MappedByteBuffer,and return How many bytes to write
 	doAppend(fileFromOffset int64, byteBuffer *mappedByteBuffer, maxBlank int32, msg interface{}) *store.AppendMessageResult
+	// write a batch of messages contiguously, and return the summary and the result of each message
+	doAppendBatch(fileFromOffset int64, byteBuffer *mappedByteBuffer, maxBlank int32,
+		msgs []*store.MessageExtInner) (*store.AppendMessageResult, []*store.AppendMessageResult)
 }
 
 type referenceResource struct {
@@ -201,6 +204,20 @@ func (mf *mappedFile) appendMessageWithCallBack(msg interface{}, amcb appendMess
 	return &store.AppendMessageResult{Status: store.APPENDMESSAGE_UNKNOWN_ERROR}
 }
 
+// appendMessagesWithCallBack 向MappedBuffer连续追加一批消息
+func (mf *mappedFile) appendMessagesWithCallBack(msgs []*store.MessageExtInner, amcb appendMessageCallback) (*store.AppendMessageResult, []*store.AppendMessageResult) {
+	curPos := atomic.LoadInt64(&mf.wrotePostion)
+	if curPos < mf.fileSize {
+		result, results := amcb.doAppendBatch(mf.fileFromOffset, mf.byteBuffer, int32(mf.fileSize)-int32(curPos), msgs)
+		atomic.AddInt64(&mf.wrotePostion, int64(result.WroteBytes))
+		mf.storeTimestamp = result.StoreTimestamp
+		return result, results
+	}
+
+	logger.Errorf("mapped file append messages return nil, wrotePostion:%d fileSize:%d.", curPos, mf.fileSize)
+	return &store.AppendMessageResult{Status: store.APPENDMESSAGE_UNKNOWN_ERROR}, nil
+}
+
 // appendMessage 向存储层追加数据，一般在SLAVE存储结构中使用
 // Params: data 追加数据
 // Return: 追加是否成功
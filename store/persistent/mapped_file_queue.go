@@ -48,6 +48,8 @@ type mappedFileQueue struct {
 	committedWhere int64
 	// 最后一条消息存储时间
 	storeTimestamp int64
+	// 按时间删除过期文件前回调，返回false时停止删除
+	beforeDestroy func(mf *mappedFile) bool
 }
 
 // newMappedFileQueue create mapped file queue
@@ -328,6 +330,16 @@ func (mfq *mappedFileQueue) deleteLastMappedFile() {
 // Author: tantexian, <tantexian@qq.com>
 // Since: 17/8/9
 func (mfq *mappedFileQueue) deleteExpiredFileByTime(expiredTime int64, deleteFilesInterval int,
+	intervalForcibly int64, cleanImmediately bool) int {
+	return mfq.deleteExpiredFiles(func(mf *mappedFile) bool {
+		return cleanImmediately || system.CurrentTimeMillis() > mf.storeTimestamp+expiredTime
+	}, deleteFilesInterval, intervalForcibly, cleanImmediately)
+}
+
+// deleteExpiredFiles 从第一个文件开始删除过期文件，遇到未过期的文件跳过。
+// cleanImmediately为true时磁盘空间不足，不调用删除前的回调
+// Return: 删除过期文件的数量
+func (mfq *mappedFileQueue) deleteExpiredFiles(expired func(mf *mappedFile) bool, deleteFilesInterval int,
 	intervalForcibly int64, cleanImmediately bool) int {
 	// 获取当前MappedFiles列表中所有元素副本的切片
 	files := mfq.copyMappedFiles(0)
@@ -341,8 +353,15 @@ func (mfq *mappedFileQueue) deleteExpiredFileByTime(expiredTime int64, deleteFil
 	for i := 0; i < mfsLength; i++ {
 		mf := files[i]
 		if mf != nil {
-			liveMaxTimestamp := mf.storeTimestamp + expiredTime
-			if system.CurrentTimeMillis() > liveMaxTimestamp || cleanImmediately {
+			if expired(mf) {
+				if mfq.beforeDestroy != nil {
+					if cleanImmediately {
+						logger.Warnf("disk space is low, delete %s without before destroy.", mf.fileName)
+					} else if !mfq.beforeDestroy(mf) {
+						break
+					}
+				}
+
 				if mf.destroy(intervalForcibly) {
 					toBeDeleteMfList.PushBack(mf)
 					delCount++
@@ -414,6 +433,21 @@ func (mfq *mappedFileQueue) deleteExpiredFileByOffset(offset int64, unitsize int
 	return deleteCount
 }
 
+// replaceMappedFile 用newMf替换队列中的oldMf，oldMf已不在队列中时返回false
+func (mfq *mappedFileQueue) replaceMappedFile(oldMf, newMf *mappedFile) bool {
+	mfq.rwLock.Lock()
+	defer mfq.rwLock.Unlock()
+
+	for e := mfq.mappedFiles.Front(); e != nil; e = e.Next() {
+		if e.Value.(*mappedFile) == oldMf {
+			e.Value = newMf
+			return true
+		}
+	}
+
+	return false
+}
+
 func (mfq *mappedFileQueue) commit(flushLeastPages int32) bool {
 	result := true
 
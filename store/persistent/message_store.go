@@ -29,6 +29,7 @@ import (
 	"github.com/boltmq/common/logger"
 	"github.com/boltmq/common/message"
 	"github.com/boltmq/common/protocol/heartbeat"
+	"github.com/boltmq/common/sysflag"
 	"github.com/boltmq/common/utils/system"
 )
 
@@ -52,8 +53,8 @@ func newConsumeQueueTable() *consumeQueueTable {
 // Author zhoufei
 // Since 2017/9/6
 type PersistentMessageStore struct {
-	config               *Config       // 存储配置
-	msgFilter            MessageFilter // 消息过滤
+	config               *Config             // 存储配置
+	msgFilter            store.MessageFilter // 消息过滤
 	clog                 *commitLog
 	consumeTopicTable    map[string]*consumeQueueTable
 	consumeQueueTableMu  sync.RWMutex
@@ -63,10 +64,17 @@ type PersistentMessageStore struct {
 	dispatchMsgService   *dispatchMessageService    // 分发消息索引服务
 	allocateMFileService *allocateMappedFileService // 预分配文件
 	reputMsgService      *reputMessageService       // 从物理队列解析消息重新发送到逻辑队列
+	rebuildMsgService    *rebuildMessageService     // 从物理队列重建逻辑队列及索引
+	tiered               *tieredStorageService      // 分层存储服务，配置冷存储时有效
+	retention            *retentionService          // topic保留策略服务
+	compaction           *compactionService         // 按消息key压缩topic服务
 	ha                   *haService                 // HA服务
 	idxService           *indexService              // 消息索引服务
 	scheduleMsgService   *scheduleMessageService    // 定时服务
+	timerMsgService      *timerMessageService       // 任意时间定时服务
 	tsService            *transactionService        // 分布式事务服务
+	election             *electionService           // 选举复制服务，开启选举复制模式时有效
+	roleChangeListener   func(role BrokerRoleType)  // 选举导致角色变化时回调
 	runFlags             *runningFlags              // 运行过程标志位
 	clock                *Clock                     // 优化获取时间性能，精度1ms
 	storeStats           stats.StoreStats           // 运行时数据统计
@@ -75,6 +83,7 @@ type PersistentMessageStore struct {
 	storeTicker          *system.Ticker
 	shutdownFlag         bool // 存储服务是否启动
 	printTimes           int64
+	roleMutex            sync.Mutex
 }
 
 func NewMessageStore(config *Config, brokerStats stats.BrokerStats) store.MessageStore {
@@ -83,7 +92,7 @@ func NewMessageStore(config *Config, brokerStats stats.BrokerStats) store.Messag
 
 func newPersistentMessageStore(config *Config, brokerStats stats.BrokerStats) *PersistentMessageStore {
 	ms := &PersistentMessageStore{}
-	ms.msgFilter = new(defaultMessageFilter)
+	ms.msgFilter = new(store.DefaultMessageFilter)
 	ms.runFlags = new(runningFlags)
 	ms.clock = NewClock(1000)
 	ms.shutdownFlag = true
@@ -102,24 +111,31 @@ func newPersistentMessageStore(config *Config, brokerStats stats.BrokerStats) *P
 	ms.dispatchMsgService = newDispatchMessageService(ms.config.PutMsgIndexHightWater, ms)
 	ms.tsService = newTransactionService(ms)
 	ms.flushCQService = newFlushConsumeQueueService(ms)
+	ms.timerMsgService = newTimerMessageService(ms)
+	// master不重放commitlog，保留该服务用于切换为slave
+	ms.reputMsgService = newReputMessageService(ms)
+	ms.rebuildMsgService = newRebuildMessageService(ms)
+	ms.retention = newRetentionService(ms)
+	ms.compaction = newCompactionService(ms)
 
 	switch ms.config.BrokerRole {
 	case SLAVE:
-		ms.reputMsgService = newReputMessageService(ms)
 		// reputMessageService依赖scheduleMessageService做定时消息的恢复，确保储备数据一致
 		ms.scheduleMsgService = newScheduleMessageService(ms)
 		break
 	case ASYNC_MASTER:
 		fallthrough
 	case SYNC_MASTER:
-		ms.reputMsgService = nil
 		ms.scheduleMsgService = newScheduleMessageService(ms)
 		break
 	default:
-		ms.reputMsgService = nil
 		ms.scheduleMsgService = nil
 	}
 
+	if ms.config.ReplicatedLogEnable {
+		ms.election = newElectionService(ms)
+	}
+
 	return ms
 }
 
@@ -132,6 +148,18 @@ func (ms *PersistentMessageStore) Load() bool {
 	}
 	ms.steCheckpoint = storeCheckpoint
 
+	// 未通过SetColdStorage设置时使用配置的冷存储，配置错误时不能启动，避免删除未上传的commitlog
+	if ms.tiered == nil {
+		cold, err := newColdStorage(ms.config)
+		if err != nil {
+			logger.Errorf("persistent msg load cold storage err: %s.", err)
+			return false
+		}
+		if cold != nil {
+			ms.SetColdStorage(cold)
+		}
+	}
+
 	var (
 		lastExitOk bool
 		result     = true
@@ -174,7 +202,16 @@ func (ms *PersistentMessageStore) Load() bool {
 	// load consume queue
 	ms.loadConsumeQueue()
 
-	// TODO load 事务模块
+	// load 事务模块
+	result = result && ms.tsService.load()
+
+	// load 压缩状态
+	ms.compaction.load()
+
+	// load 选举状态
+	if ms.config.ReplicatedLogEnable {
+		result = result && ms.election != nil && ms.election.load()
+	}
 	ms.idxService.load(lastExitOk)
 
 	// 尝试恢复数据
@@ -279,15 +316,12 @@ func (ms *PersistentMessageStore) recover(lastExitOK bool) {
 	}
 
 	// 保证消息都能从DispatchService缓冲队列进入到真正的队列
-	//		ticker := time.NewTicker(time.Millisecond * 500)
-	//	for _ = range ticker.C {
-	//		if !ms.dispatchMsgService.hasRemainMessage() {
-	//			break
-	//		}
-	//	}
+	for ms.dispatchMsgService.hasRemainMessage() {
+		time.Sleep(time.Millisecond * 500)
+	}
 
 	// 恢复事务模块
-	// TODO ms.TransactionStateService.recoverStateTable(lastExitOK);
+	ms.tsService.recoverStateTable(lastExitOK)
 	ms.recoverTopicQueueTable()
 }
 
@@ -297,11 +331,13 @@ func (ms *PersistentMessageStore) recoverConsumeQueue() {
 			logic.recover()
 		}
 	}
+
+	ms.tsService.tranRedoLog.recover()
 }
 
 func (ms *PersistentMessageStore) recoverTopicQueueTable() {
 	table := make(map[string]int64)
-	minPhyOffset := ms.clog.getMinOffset()
+	minPhyOffset := ms.logicMinPhyOffset()
 	for _, cqTable := range ms.consumeTopicTable {
 		for _, logic := range cqTable.consumeQueues {
 			key := fmt.Sprintf("%s-%d", logic.topic, logic.queueId) // 恢复写入消息时，记录的队列offset
@@ -313,10 +349,144 @@ func (ms *PersistentMessageStore) recoverTopicQueueTable() {
 	ms.clog.topicQueueTable = table
 }
 
+// SetTransactionCheckExecuter 设置事务回查，需要在Start之前调用
+func (ms *PersistentMessageStore) SetTransactionCheckExecuter(executer store.TransactionCheckExecuter) {
+	ms.tsService.checkExecuter = executer
+}
+
+// SetColdStorage 设置冷存储，写满的commitlog文件上传后才会被删除，需要在Load之前调用，设置后不再使用配置的冷存储
+func (ms *PersistentMessageStore) SetColdStorage(cold ColdStorage) {
+	ms.tiered = newTieredStorageService(ms, cold)
+	ms.clog.mfq.beforeDestroy = ms.tiered.offload
+}
+
+// SetTopicRetention 设置topic保留策略，retention为nil时恢复使用全局配置
+func (ms *PersistentMessageStore) SetTopicRetention(topic string, retention *TopicRetention) {
+	ms.retention.setTopicRetention(topic, retention)
+}
+
+// TopicRetentionStats 查询topic生效的保留策略及当前保留的数据
+func (ms *PersistentMessageStore) TopicRetentionStats(topic string) *TopicRetentionStats {
+	return ms.retention.stats(topic)
+}
+
+// logicMinPhyOffset 逻辑队列及索引保留的最小物理offset，开启冷存储时保留冷存储中仍可读取的消息，查询失败时全部保留
+func (ms *PersistentMessageStore) logicMinPhyOffset() int64 {
+	minOffset := ms.clog.getMinOffset()
+	if ms.tiered != nil {
+		coldMinOffset, ok := ms.tiered.lookupMinOffset(minOffset)
+		if !ok {
+			return 0
+		}
+		return coldMinOffset
+	}
+
+	return minOffset
+}
+
+// protectedPhyOffset 清理commitlog时必须保留的最小物理offset：未分发的数据、未提交的事务消息及未投递的定时消息。
+// 磁盘空间不足强制清理时只保留未分发的数据，未提交的事务及未投递的定时消息随文件删除
+func (ms *PersistentMessageStore) protectedPhyOffset(cleanImmediately bool) int64 {
+	offset := ms.clog.getMaxOffset()
+	if ms.config.BrokerRole == SLAVE {
+		if reputOffset := ms.reputMsgService.getReputFromOffset(); reputOffset < offset {
+			offset = reputOffset
+		}
+	}
+
+	if dispatchOffset := ms.dispatchMsgService.undispatchedOffset(); dispatchOffset >= 0 && dispatchOffset < offset {
+		offset = dispatchOffset
+	}
+
+	if cleanImmediately {
+		return offset
+	}
+
+	if preparedOffset := ms.tsService.minPreparedPhyOffset(); preparedOffset >= 0 && preparedOffset < offset {
+		offset = preparedOffset
+	}
+
+	if timerOffset := ms.timerMsgService.minPendingPhyOffset(); timerOffset >= 0 && timerOffset < offset {
+		offset = timerOffset
+	}
+
+	return offset
+}
+
+// SetRoleChangeListener 设置选举导致角色变化时的回调，需要在Start之前调用
+func (ms *PersistentMessageStore) SetRoleChangeListener(listener func(role BrokerRoleType)) {
+	ms.roleChangeListener = listener
+}
+
+// RebuildConsumeQueue 从commitlog异步重建指定topic的逻辑队列，topics包含*时重建全部topic，
+// rebuildIndex为true时同时重建索引文件，进度通过RuntimeInfo查看
+func (ms *PersistentMessageStore) RebuildConsumeQueue(topics []string, rebuildIndex bool) error {
+	return ms.rebuildMsgService.start(topics, rebuildIndex)
+}
+
+// ChangeRole 切换存储角色。切换为slave时停止定时消息投递，并从当前位置开始重放commitlog；
+// 切换为master时等待重放完成，恢复各队列的offset后再开放写入
+func (ms *PersistentMessageStore) ChangeRole(role BrokerRoleType) {
+	ms.roleMutex.Lock()
+	defer ms.roleMutex.Unlock()
+
+	oldRole := ms.config.BrokerRole
+	if oldRole == role {
+		return
+	}
+
+	if role == SLAVE {
+		ms.reputMsgService.mutex.Lock()
+		ms.clog.mutex.Lock()
+		atomic.StoreInt64(&ms.reputMsgService.reputFromOffset, ms.clog.getMaxOffset())
+		ms.config.BrokerRole = SLAVE
+		ms.clog.mutex.Unlock()
+		ms.reputMsgService.mutex.Unlock()
+
+		if ms.scheduleMsgService != nil {
+			ms.scheduleMsgService.shutdown()
+		}
+		ms.timerMsgService.shutdown()
+		ms.tsService.shutdown()
+		logger.Infof("message store change role from %s to %s.", oldRole, role)
+		return
+	}
+
+	if oldRole == SLAVE {
+		ms.reputMsgService.doReput()
+		for ms.dispatchMsgService.hasRemainMessage() {
+			time.Sleep(time.Millisecond * 100)
+		}
+		ms.recoverTopicQueueTable()
+
+		// 延时进度由slave从master同步到文件，需要重新加载
+		if ms.scheduleMsgService != nil {
+			ms.scheduleMsgService.loadDelayOffset()
+			ms.scheduleMsgService.start()
+		}
+		ms.timerMsgService.start()
+
+		// slave重放时没有producerGroup，不写事务状态表，只记录redo log。
+		// 由redo log重建状态表后，原master未完成的事务由新master回查
+		ms.tsService.recoverStateTable(false)
+	}
+
+	ms.config.BrokerRole = role
+	if oldRole == SLAVE {
+		ms.tsService.start()
+	}
+	logger.Infof("message store change role from %s to %s.", oldRole, role)
+}
+
 // MaxOffsetInQueue 获取指定队列最大Offset 如果队列不存在，返回-1
 // Author: zhoufei
 // Since: 2017/9/20
 func (ms *PersistentMessageStore) MaxOffsetInQueue(topic string, queueId int32) int64 {
+	// 重建中的逻辑队列只写入了一部分
+	if _, maxOffset, ok := ms.rebuildMsgService.queueOffsets(topic, queueId); ok {
+		return maxOffset
+	}
+
 	logic := ms.findConsumeQueue(topic, queueId)
 	if logic != nil {
 		return logic.getMaxOffsetInQueue()
@@ -362,6 +532,56 @@ func (ms *PersistentMessageStore) truncateDirtyLogicFiles(phyOffset int64) {
 			logic.truncateDirtyLogicFiles(phyOffset)
 		}
 	}
+
+	ms.tsService.tranRedoLog.truncateDirtyLogicFiles(phyOffset)
+}
+
+// truncateCommitLog 截断offset之后的commitlog及对应的逻辑队列，选举复制模式下丢弃与leader不一致的数据
+func (ms *PersistentMessageStore) truncateCommitLog(offset int64) {
+	ms.reputMsgService.mutex.Lock()
+	defer ms.reputMsgService.mutex.Unlock()
+
+	ms.doTruncateCommitLog(offset)
+}
+
+// doTruncateCommitLog 调用方需持有reputMsgService.mutex
+func (ms *PersistentMessageStore) doTruncateCommitLog(offset int64) {
+	for ms.dispatchMsgService.hasRemainMessage() {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	ms.clog.truncate(offset)
+	ms.truncateDirtyLogicFiles(offset)
+	if ms.reputMsgService.getReputFromOffset() > offset {
+		atomic.StoreInt64(&ms.reputMsgService.reputFromOffset, offset)
+	}
+}
+
+// resetCommitLog 清空commitlog及依赖它的逻辑队列、索引、事务状态及定时消息进度，从offset开始重新同步，
+// slave的数据早于master最小offset时调用。延时消息进度清空后由slave从master重新同步
+func (ms *PersistentMessageStore) resetCommitLog(offset int64) bool {
+	ms.reputMsgService.mutex.Lock()
+	defer ms.reputMsgService.mutex.Unlock()
+
+	for ms.dispatchMsgService.hasRemainMessage() {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if !ms.clog.reset(offset) {
+		return false
+	}
+
+	ms.destroyLogics()
+	ms.idxService.destroy()
+	ms.steCheckpoint.timerMsgOffset = 0
+	ms.steCheckpoint.flush()
+	if ms.scheduleMsgService != nil {
+		ms.scheduleMsgService.resetOffsetTable()
+	}
+
+	atomic.StoreInt64(&ms.reputMsgService.reputFromOffset, offset)
+	logger.Infof("reset commit log to offset %d.", offset)
+	return true
 }
 
 func (ms *PersistentMessageStore) destroyLogics() {
@@ -370,13 +590,23 @@ func (ms *PersistentMessageStore) destroyLogics() {
 			logic.destroy()
 		}
 	}
+
+	ms.tsService.destroy()
 }
 
 func (ms *PersistentMessageStore) putMessagePostionInfo(topic string, queueId int32, offset int64, size int64,
-	tagsCode, storeTimestamp, logicOffset int64) {
+	tagsCode, storeTimestamp, logicOffset int64, properties map[string]string) {
 	cq := ms.findConsumeQueue(topic, queueId)
 	if cq != nil {
-		cq.putMessagePostionInfoWrapper(offset, size, tagsCode, storeTimestamp, logicOffset)
+		cq.putMessagePostionInfoWrapper(offset, size, tagsCode, storeTimestamp, logicOffset, properties)
+	}
+}
+
+// remapPosition 将逻辑队列中第index条消息的位置替换为压缩时复制的消息
+func (ms *PersistentMessageStore) remapPosition(topic string, queueId int32, index, offset, size int64) {
+	cq := ms.findConsumeQueue(topic, queueId)
+	if cq != nil && !cq.remapPosition(index, offset, int32(size)) {
+		logger.Warnf("remap compacted message %s-%d index %d to offset %d skipped.", topic, queueId, index, offset)
 	}
 }
 
@@ -426,6 +656,11 @@ func (ms *PersistentMessageStore) Start() error {
 		ms.scheduleMsgService.start()
 	}
 
+	// 与scheduleMessageService相同，slave不投递定时消息
+	if ms.timerMsgService != nil && SLAVE != ms.config.BrokerRole {
+		ms.timerMsgService.start()
+	}
+
 	if ms.reputMsgService != nil {
 		ms.reputMsgService.setReputFromOffset(ms.clog.getMaxOffset())
 		go ms.reputMsgService.start()
@@ -435,6 +670,20 @@ func (ms *PersistentMessageStore) Start() error {
 	go ms.tsService.start()
 	go ms.ha.start()
 
+	if ms.election != nil {
+		go ms.election.start()
+	}
+
+	if ms.tiered != nil {
+		go ms.tiered.start()
+	}
+
+	if ms.config.RebuildTopics != "" || ms.config.RebuildIndex {
+		if err := ms.RebuildConsumeQueue(parseRebuildTopics(ms.config.RebuildTopics), ms.config.RebuildIndex); err != nil {
+			logger.Errorf("rebuild consume queue on start err: %s.", err)
+		}
+	}
+
 	ms.createTempFile()
 	ms.addScheduleTask()
 	ms.shutdownFlag = false
@@ -479,6 +728,10 @@ func (ms *PersistentMessageStore) addScheduleTask() {
 }
 
 func (ms *PersistentMessageStore) cleanFilesPeriodically() {
+	// 先压缩topic，再按topic保留策略推进逻辑队列的最小offset
+	ms.compaction.run()
+	ms.retention.run()
+
 	if ms.cleanCQService != nil {
 		ms.cleanCLogService.run()
 	}
@@ -502,10 +755,24 @@ func (ms *PersistentMessageStore) Shutdown() {
 			ms.scheduleMsgService.shutdown()
 		}
 
+		if ms.timerMsgService != nil {
+			ms.timerMsgService.shutdown()
+		}
+
+		ms.tsService.shutdown()
+
 		if ms.ha != nil {
 			ms.ha.shutdown()
 		}
 
+		if ms.election != nil {
+			ms.election.shutdown()
+		}
+
+		if ms.tiered != nil {
+			ms.tiered.shutdown()
+		}
+
 		ms.storeStats.Shutdown()
 		ms.dispatchMsgService.shutdown()
 		ms.idxService.shutdown()
@@ -554,28 +821,8 @@ func (ms *PersistentMessageStore) Destroy() {
 }
 
 func (ms *PersistentMessageStore) PutMessage(msg *store.MessageExtInner) *store.PutMessageResult {
-	if ms.shutdownFlag {
-		return &store.PutMessageResult{Status: store.SERVICE_NOT_AVAILABLE}
-	}
-
-	if SLAVE == ms.config.BrokerRole {
-		atomic.AddInt64(&ms.printTimes, 1)
-		if ms.printTimes%50000 == 0 {
-			logger.Warn("message store is slave mode, so putMessage is forbidden.")
-		}
-
-		return &store.PutMessageResult{Status: store.SERVICE_NOT_AVAILABLE}
-	}
-
-	if !ms.runFlags.isWriteable() {
-		atomic.AddInt64(&ms.printTimes, 1)
-		if ms.printTimes%50000 == 0 {
-			logger.Warnf("message store is not writeable, so putMessage is forbidden. flag=%d.", ms.runFlags.flagBits)
-		}
-
-		return &store.PutMessageResult{Status: store.SERVICE_NOT_AVAILABLE}
-	} else {
-		atomic.StoreInt64(&ms.printTimes, 0)
+	if result := ms.checkPutable(); result != nil {
+		return result
 	}
 
 	// message topic长度校验
@@ -590,6 +837,12 @@ func (ms *PersistentMessageStore) PutMessage(msg *store.MessageExtInner) *store.
 		return &store.PutMessageResult{Status: store.MESSAGE_ILLEGAL}
 	}
 
+	// 定时消息投递时间校验
+	if deliverMs, ok := parseDeliverMs(msg); ok && deliverMs-system.CurrentTimeMillis() > ms.config.TimerMaxDelay {
+		logger.Warnf("put message deliver time %d exceeds max delay %d.", deliverMs, ms.config.TimerMaxDelay)
+		return &store.PutMessageResult{Status: store.MESSAGE_ILLEGAL}
+	}
+
 	beginTime := system.CurrentTimeMillis()
 	result := ms.clog.putMessage(msg)
 
@@ -610,6 +863,88 @@ func (ms *PersistentMessageStore) PutMessage(msg *store.MessageExtInner) *store.
 	return result
 }
 
+// PutMessages 批量写入同一topic、同一队列的普通消息，整批消息连续写入commitlog
+func (ms *PersistentMessageStore) PutMessages(msgs []*store.MessageExtInner) *store.PutMessageResult {
+	if result := ms.checkPutable(); result != nil {
+		return result
+	}
+
+	if len(msgs) == 0 {
+		return &store.PutMessageResult{Status: store.MESSAGE_ILLEGAL}
+	}
+
+	topic, queueId := msgs[0].Topic, msgs[0].QueueId
+	for _, msg := range msgs {
+		if msg.Topic != topic || msg.QueueId != queueId {
+			logger.Warnf("put messages topic or queue mismatch, %s-%d %s-%d.", topic, queueId, msg.Topic, msg.QueueId)
+			return &store.PutMessageResult{Status: store.MESSAGE_ILLEGAL}
+		}
+
+		if len(msg.Topic) > 127 {
+			logger.Warnf("put messages topic length too long %d.", len(msg.Topic))
+			return &store.PutMessageResult{Status: store.MESSAGE_ILLEGAL}
+		}
+
+		if len(msg.PropertiesString) > 32767 {
+			logger.Warnf("put messages properties length too long, %d.", len(msg.PropertiesString))
+			return &store.PutMessageResult{Status: store.MESSAGE_ILLEGAL}
+		}
+
+		// 批量消息不支持事务、延时与定时消息
+		if sysflag.GetTransactionValue(int(msg.SysFlag)) != sysflag.TransactionNotType ||
+			msg.GetDelayTimeLevel() > 0 || msg.GetProperty(PROPERTY_TIMER_DELIVER_MS) != "" {
+			logger.Warnf("put messages not support transaction, delay or timer message, topic: %s.", msg.Topic)
+			return &store.PutMessageResult{Status: store.MESSAGE_ILLEGAL}
+		}
+	}
+
+	beginTime := system.CurrentTimeMillis()
+	result := ms.clog.putMessages(msgs)
+
+	eclipseTime := system.CurrentTimeMillis() - beginTime
+	if eclipseTime > 1000 {
+		logger.Warnf("putMessages not in lock eclipse time(ms) %d.", eclipseTime)
+	}
+
+	ms.storeStats.SetPutMessageEntireTimeMax(eclipseTime)
+	size := ms.storeStats.GetSinglePutMessageTopicTimesTotal(topic)
+	ms.storeStats.SetSinglePutMessageTopicTimesTotal(topic, atomic.AddInt64(&size, int64(len(msgs))))
+
+	if nil == result || !result.IsOk() {
+		ms.storeStats.SetPutMessageFailedTimes(1)
+	}
+
+	return result
+}
+
+// checkPutable 检查存储是否可写，不可写时返回对应的结果
+func (ms *PersistentMessageStore) checkPutable() *store.PutMessageResult {
+	if ms.shutdownFlag {
+		return &store.PutMessageResult{Status: store.SERVICE_NOT_AVAILABLE}
+	}
+
+	if SLAVE == ms.config.BrokerRole {
+		atomic.AddInt64(&ms.printTimes, 1)
+		if ms.printTimes%50000 == 0 {
+			logger.Warn("message store is slave mode, so putMessage is forbidden.")
+		}
+
+		return &store.PutMessageResult{Status: store.SERVICE_NOT_AVAILABLE}
+	}
+
+	if !ms.runFlags.isWriteable() {
+		atomic.AddInt64(&ms.printTimes, 1)
+		if ms.printTimes%50000 == 0 {
+			logger.Warnf("message store is not writeable, so putMessage is forbidden. flag=%d.", ms.runFlags.flagBits)
+		}
+
+		return &store.PutMessageResult{Status: store.SERVICE_NOT_AVAILABLE}
+	}
+
+	atomic.StoreInt64(&ms.printTimes, 0)
+	return nil
+}
+
 func (ms *PersistentMessageStore) QueryMessage(topic string, key string, maxNum int32, begin int64, end int64) *store.QueryMessageResult {
 	queryMsgResult := &store.QueryMessageResult{}
 
@@ -646,6 +981,13 @@ func (ms *PersistentMessageStore) GetMessage(group string, topic string, queueId
 
 	getResult := new(store.GetMessageResult)
 
+	// 逻辑队列重建中，保持消费位置等待重建完成
+	if ms.rebuildMsgService.isRebuilding(topic) {
+		getResult.Status = store.OFFSET_FOUND_NULL
+		getResult.NextBeginOffset = offset
+		return getResult
+	}
+
 	cq := ms.findConsumeQueue(topic, queueId)
 	if cq != nil {
 		minOffset = cq.getMinOffsetInQueue()
@@ -692,6 +1034,11 @@ func (ms *PersistentMessageStore) GetMessage(group string, topic string, queueId
 					sizePy := bufferConsumeQueue.byteBuffer.ReadInt32()
 					tagsCode := bufferConsumeQueue.byteBuffer.ReadInt64()
 
+					// 已被压缩的消息
+					if tagsCode == compactedTagsCode {
+						continue
+					}
+
 					maxPhyOffsetPulling = offsetPy
 
 					// 说明物理文件正在被删除
@@ -709,9 +1056,17 @@ func (ms *PersistentMessageStore) GetMessage(group string, topic string, queueId
 						break
 					}
 
-					// 消息过滤
-					if ms.msgFilter.IsMessageMatched(subscriptionData, tagsCode) {
+					// 消息过滤，先按tag hashcode和扩展文件中的bloom filter过滤，避免读取commitlog
+					if ms.msgFilter.IsMessageMatched(subscriptionData, tagsCode) &&
+						cq.isMatchedByExt(ms.msgFilter, subscriptionData, offset+int64(i/CQStoreUnitSize)) {
 						selectResult := ms.clog.getMessage(offsetPy, sizePy)
+						if selectResult != nil && !ms.msgFilter.IsMatchedByCommitLog(subscriptionData, selectResult.byteBuffer.Bytes()) {
+							selectResult.Release()
+							if getResult.BufferTotalSize == 0 {
+								status = store.NO_MATCHED_MESSAGE
+							}
+							continue
+						}
 
 						if selectResult != nil {
 							ms.storeStats.SetMessageTransferedMsgCount(1)
@@ -840,6 +1195,12 @@ func (ms *PersistentMessageStore) lookMessageByOffset(commitLogOffset int64, siz
 			return nil
 		}
 
+		// 压缩的消息解压后返回，拉取消息时仍返回压缩的数据
+		if err := store.DecompressMessageExt(mesageExt); err != nil {
+			logger.Errorf("message store decompress message by offset %d err: %s.", commitLogOffset, err)
+			return nil
+		}
+
 		return mesageExt
 	}
 
@@ -850,6 +1211,10 @@ func (ms *PersistentMessageStore) lookMessageByOffset(commitLogOffset int64, siz
 // Author: zhoufei
 // Since: 2017/9/20
 func (ms *PersistentMessageStore) MinOffsetInQueue(topic string, queueId int32) int64 {
+	if minOffset, _, ok := ms.rebuildMsgService.queueOffsets(topic, queueId); ok {
+		return minOffset
+	}
+
 	logic := ms.findConsumeQueue(topic, queueId)
 	if logic != nil {
 		return logic.getMinOffsetInQueue()
@@ -909,6 +1274,10 @@ func (ms *PersistentMessageStore) SelectOneMessageByOffsetAndSize(commitLogOffse
 // Author: zhoufei
 // Since: 2017/9/21
 func (ms *PersistentMessageStore) OffsetInQueueByTime(topic string, queueId int32, timestamp int64) int64 {
+	if ms.rebuildMsgService.isRebuilding(topic) {
+		return 0
+	}
+
 	logic := ms.findConsumeQueue(topic, queueId)
 	if logic != nil {
 		return logic.getOffsetInQueueByTime(timestamp)
@@ -921,9 +1290,13 @@ func (ms *PersistentMessageStore) OffsetInQueueByTime(topic string, queueId int3
 // Author: zhoufei
 // Since: 2017/9/21
 func (ms *PersistentMessageStore) EarliestMessageTime(topic string, queueId int32) int64 {
+	if ms.rebuildMsgService.isRebuilding(topic) {
+		return -1
+	}
+
 	logicQueue := ms.findConsumeQueue(topic, queueId)
 	if logicQueue != nil {
-		result := logicQueue.getIndexBuffer(logicQueue.minLogicOffset / CQStoreUnitSize)
+		result := logicQueue.getIndexBuffer(logicQueue.getMinOffsetInQueue())
 		if result != nil {
 			defer result.Release()
 
@@ -961,6 +1334,24 @@ func (ms *PersistentMessageStore) RuntimeInfo() map[string]string {
 		ms.scheduleMsgService.buildRunningStats(result)
 	}
 
+	// 定时进度
+	if ms.timerMsgService != nil {
+		ms.timerMsgService.buildRunningStats(result)
+	}
+
+	// 选举状态
+	if ms.election != nil {
+		ms.election.buildRunningStats(result)
+	}
+
+	// HA握手失败
+	if ms.ha != nil {
+		ms.ha.security.buildRunningStats(result)
+	}
+
+	// 逻辑队列重建进度
+	ms.rebuildMsgService.buildRunningStats(result)
+
 	result[COMMIT_LOG_MIN_OFFSET.String()] = fmt.Sprintf("%d", ms.clog.getMinOffset())
 	result[COMMIT_LOG_MAX_OFFSET.String()] = fmt.Sprintf("%d", ms.clog.getMaxOffset())
 
@@ -971,6 +1362,10 @@ func (ms *PersistentMessageStore) RuntimeInfo() map[string]string {
 // Author: zhoufei
 // Since: 2017/9/21
 func (ms *PersistentMessageStore) MessageStoreTimeStamp(topic string, queueId int32, offset int64) int64 {
+	if ms.rebuildMsgService.isRebuilding(topic) {
+		return -1
+	}
+
 	logicQueue := ms.findConsumeQueue(topic, queueId)
 	if logicQueue != nil {
 		result := logicQueue.getIndexBuffer(offset)
@@ -992,14 +1387,14 @@ func (ms *PersistentMessageStore) MessageStoreTimeStamp(topic string, queueId in
 func (ms *PersistentMessageStore) CleanExpiredConsumerQueue() {
 	minCommitLogOffset := ms.clog.getMinOffset()
 	for topic, queueTable := range ms.consumeTopicTable {
-		if topic != SCHEDULE_TOPIC {
+		if topic != SCHEDULE_TOPIC && topic != TIMER_TOPIC {
 			for queueId, cq := range queueTable.consumeQueues {
 				maxCLOffsetInconsumeQueue := cq.getLastOffset()
 
 				// maxCLOffsetInconsumeQueue==-1有可能正好是索引文件刚好创建的那一时刻,此时不清除数据
 				if maxCLOffsetInconsumeQueue == -1 {
 					logger.Warnf("maybe consumeQueue was created just now. topic=%s queueId=%d maxPhysicOffset=%d minLogicOffset=%d.",
-						cq.topic, cq.queueId, cq.maxPhysicOffset, cq.minLogicOffset)
+						cq.topic, cq.queueId, cq.maxPhysicOffset, atomic.LoadInt64(&cq.minLogicOffset))
 				} else if maxCLOffsetInconsumeQueue < minCommitLogOffset {
 					logger.Infof("cleanExpiredConsumerQueue: %s %d consumer queue destroyed, minCommitLogOffset: %d maxCLOffsetInconsumeQueue: %d.",
 						topic, queueId, minCommitLogOffset, maxCLOffsetInconsumeQueue)
@@ -1033,11 +1428,64 @@ func (ms *PersistentMessageStore) UpdateHaMasterAddress(newAddr string) {
 // Since: 2017/9/21
 func (ms *PersistentMessageStore) SlaveFallBehindMuch() int64 {
 	if ms.ha != nil {
+		// slave返回落后于master的字节数，未收到过master数据时返回-1
+		if SLAVE == ms.config.BrokerRole {
+			return ms.ha.slaveFallBehind()
+		}
 		return ms.clog.getMaxOffset() - ms.ha.push2SlaveMaxOffset
 	}
 	return 0
 }
 
+// PromoteToMaster slave切换为master：停止从master同步，截断尾部未复制完整的消息后切换角色
+func (ms *PersistentMessageStore) PromoteToMaster(role BrokerRoleType) error {
+	if role == SLAVE {
+		return fmt.Errorf("broker role %s is not master", role)
+	}
+
+	if ms.config.BrokerRole != SLAVE {
+		return fmt.Errorf("broker role %s is not slave", ms.config.BrokerRole)
+	}
+
+	ms.ha.stopClient()
+
+	// HA按字节复制，重放停止的位置之后是不完整的消息。重放与截断在同一把锁内完成，
+	// 后台重放协程在此期间等待，不会读到截断前的数据
+	ms.reputMsgService.mutex.Lock()
+	ms.reputMsgService.reput()
+	reputOffset := ms.reputMsgService.getReputFromOffset()
+	if maxOffset := ms.clog.getMaxOffset(); reputOffset < maxOffset {
+		logger.Warnf("promote to master truncate uncompleted commitlog from %d to %d.", maxOffset, reputOffset)
+		ms.doTruncateCommitLog(reputOffset)
+	}
+	ms.reputMsgService.mutex.Unlock()
+
+	ms.ChangeRole(role)
+	return nil
+}
+
+// DemoteToSlave master切换为slave，从masterAddr同步数据。
+// 本地超过新master最大offset(masterMaxOffset)的数据未复制到新master，切换前截断，保证与新master的数据一致
+func (ms *PersistentMessageStore) DemoteToSlave(masterAddr string, masterMaxOffset int64) error {
+	if ms.config.BrokerRole == SLAVE {
+		return fmt.Errorf("broker role is already %s", SLAVE)
+	}
+
+	if minOffset := ms.clog.getMinOffset(); minOffset > 0 && masterMaxOffset < minOffset {
+		return fmt.Errorf("master max offset %d less than local min offset %d", masterMaxOffset, minOffset)
+	}
+
+	ms.ChangeRole(SLAVE)
+	if maxOffset := ms.clog.getMaxOffset(); masterMaxOffset < maxOffset {
+		logger.Warnf("demote to slave truncate unreplicated commitlog from %d to %d.", maxOffset, masterMaxOffset)
+		ms.truncateCommitLog(masterMaxOffset)
+	}
+
+	ms.config.HaMasterAddress = masterAddr
+	ms.ha.startClient(masterAddr)
+	return nil
+}
+
 // CleanUnusedTopic 清除未使用Topic
 func (ms *PersistentMessageStore) CleanUnusedTopic(topics []string) int32 {
 	// TODO
@@ -1111,6 +1559,15 @@ func (ms *PersistentMessageStore) EncodeScheduleMsg() string {
 // Author: luoji, <gunsluo@gmail.com>
 // Since: 2018-01-02
 func (ms *PersistentMessageStore) CommitLogOffsetInQueue(topic string, queueId int32, cqOffset int64) int64 {
+	logicQueue := ms.findConsumeQueue(topic, queueId)
+	if logicQueue != nil {
+		result := logicQueue.getIndexBuffer(cqOffset)
+		if result != nil {
+			defer result.Release()
+			return result.byteBuffer.ReadInt64()
+		}
+	}
+
 	return 0
 }
 
@@ -0,0 +1,479 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package persistent
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/boltmq/common/logger"
+	"github.com/boltmq/common/sysflag"
+	"github.com/boltmq/common/utils/system"
+)
+
+const (
+	REBUILD_ALL_TOPICS = "*"         // 重建全部topic的逻辑队列
+	rebuildCatchUpGap  = 1024 * 1024 // 与commitlog相差不足该字节数时，确定切换位置并完成剩余重放
+)
+
+// rebuildTask 一次重建任务，topics为空且all为false时只重建索引
+type rebuildTask struct {
+	all    bool
+	topics map[string]bool
+	index  bool
+}
+
+func newRebuildTask(topics []string, rebuildIndex bool) (*rebuildTask, error) {
+	task := &rebuildTask{topics: make(map[string]bool), index: rebuildIndex}
+	for _, topic := range topics {
+		topic = strings.TrimSpace(topic)
+		if topic == REBUILD_ALL_TOPICS {
+			task.all = true
+		} else if topic != "" {
+			task.topics[topic] = true
+		}
+	}
+
+	if !task.all && len(task.topics) == 0 && !task.index {
+		return nil, fmt.Errorf("nothing to rebuild")
+	}
+
+	return task, nil
+}
+
+func (task *rebuildTask) matchTopic(topic string) bool {
+	return task.all || task.topics[topic]
+}
+
+func (task *rebuildTask) String() string {
+	topics := make([]string, 0, len(task.topics))
+	if task.all {
+		topics = append(topics, REBUILD_ALL_TOPICS)
+	}
+	for topic := range task.topics {
+		topics = append(topics, topic)
+	}
+
+	return fmt.Sprintf("topics=[%s], index=%t", strings.Join(topics, ","), task.index)
+}
+
+// parseRebuildTopics 解析以;分隔的topic配置
+func parseRebuildTopics(topics string) []string {
+	var result []string
+	for _, topic := range strings.Split(topics, ";") {
+		if topic = strings.TrimSpace(topic); topic != "" {
+			result = append(result, topic)
+		}
+	}
+
+	return result
+}
+
+// rebuildIndexRequest 通过索引服务的请求队列重置索引文件，保证之前的请求已处理完成
+type rebuildIndexRequest struct {
+	done chan struct{}
+}
+
+// rebuildMessageService 从commitlog重建逻辑队列及索引。重建期间分发服务跳过相关topic及索引的实时写入，
+// 重放的请求同样经由分发服务写入。追上commitlog后记录切换位置handoffOffset，之后的实时请求暂存，
+// 重放到切换位置后按顺序写入暂存的请求，整个过程不阻塞消息写入，其他topic不受影响。
+// 配置冷存储时从冷存储中最早的文件开始重放
+type rebuildMessageService struct {
+	messageStore  *PersistentMessageStore
+	mutex         sync.RWMutex
+	task          *rebuildTask       // 当前任务，为空表示没有重建
+	handoffOffset int64              // 切换位置，-1表示未开始切换
+	pending       []*dispatchRequest // 切换阶段暂存的实时请求
+	minOffsets    map[string]int64   // 重建前逻辑队列的最小offset，重建期间查询使用
+	maxOffsets    map[string]int64   // 重建前逻辑队列的最大offset
+	lastTask      string
+	state         string
+	fromOffset    int64
+	rebuildOffset int64
+	beginTime     int64
+	endTime       int64
+}
+
+func newRebuildMessageService(messageStore *PersistentMessageStore) *rebuildMessageService {
+	return &rebuildMessageService{
+		messageStore:  messageStore,
+		handoffOffset: -1,
+		state:         "IDLE",
+	}
+}
+
+func (rms *rebuildMessageService) start(topics []string, rebuildIndex bool) error {
+	task, err := newRebuildTask(topics, rebuildIndex)
+	if err != nil {
+		return err
+	}
+
+	if task.index && !rms.messageStore.config.MessageIndexEnable {
+		return fmt.Errorf("message index is disabled")
+	}
+
+	// 压缩的topic中存活的消息被复制到commitlog末尾，重放会写入重复的索引，只能离线修复
+	for topic := range rms.messageStore.retention.compactTopics() {
+		if task.matchTopic(topic) {
+			return fmt.Errorf("topic %s is compacted, repair it offline by verify -repair", topic)
+		}
+	}
+
+	rms.mutex.Lock()
+	if rms.task != nil {
+		rms.mutex.Unlock()
+		return fmt.Errorf("rebuild is running, %s", rms.task)
+	}
+	rms.task = task
+	rms.handoffOffset = -1
+	rms.pending = nil
+	rms.minOffsets = make(map[string]int64)
+	rms.maxOffsets = make(map[string]int64)
+	rms.lastTask = task.String()
+	rms.state = "RESETTING"
+	rms.beginTime = system.CurrentTimeMillis()
+	rms.endTime = 0
+	atomic.StoreInt64(&rms.fromOffset, 0)
+	atomic.StoreInt64(&rms.rebuildOffset, 0)
+	rms.mutex.Unlock()
+
+	logger.Infof("rebuild consume queue begin, %s.", task)
+	go rms.run(task)
+	return nil
+}
+
+func (rms *rebuildMessageService) setState(state string) {
+	rms.mutex.Lock()
+	rms.state = state
+	rms.mutex.Unlock()
+}
+
+func (rms *rebuildMessageService) currentTask() *rebuildTask {
+	rms.mutex.RLock()
+	defer rms.mutex.RUnlock()
+	return rms.task
+}
+
+// isRebuilding topic的逻辑队列是否在重建中
+func (rms *rebuildMessageService) isRebuilding(topic string) bool {
+	task := rms.currentTask()
+	return task != nil && task.matchTopic(topic)
+}
+
+// intercept 分发服务处理实时请求前调用，返回逻辑队列、索引是否由重建写入。
+// 切换阶段offset不小于handoffOffset的请求暂存，重放完成后按顺序写入，更早的请求由重放写入
+func (rms *rebuildMessageService) intercept(request *dispatchRequest) (skipCQ, skipIndex bool) {
+	if rms.currentTask() == nil {
+		return false, false
+	}
+
+	rms.mutex.Lock()
+	defer rms.mutex.Unlock()
+
+	task := rms.task
+	if task == nil {
+		return false, false
+	}
+
+	skipCQ, skipIndex = task.matchTopic(request.topic), task.index
+	if (skipCQ || skipIndex) && rms.handoffOffset >= 0 && request.commitLogOffset >= rms.handoffOffset {
+		rms.pending = append(rms.pending, request)
+	}
+
+	return skipCQ, skipIndex
+}
+
+// queueOffsets 重建中队列的最小、最大offset，最小offset使用重建前的值，最大offset使用commitlog记录的下一个队列offset，
+// 避免查询到重建了一部分的逻辑队列
+func (rms *rebuildMessageService) queueOffsets(topic string, queueId int32) (minOffset, maxOffset int64, ok bool) {
+	key := fmt.Sprintf("%s-%d", topic, queueId)
+	rms.mutex.RLock()
+	task := rms.task
+	minOffset, ok = rms.minOffsets[key]
+	maxOffset = rms.maxOffsets[key]
+	rms.mutex.RUnlock()
+
+	if task == nil || !task.matchTopic(topic) {
+		return 0, 0, false
+	}
+
+	clog := rms.messageStore.clog
+	clog.mutex.Lock()
+	queueOffset, exist := clog.topicQueueTable[key]
+	clog.mutex.Unlock()
+	if exist && queueOffset > maxOffset {
+		maxOffset = queueOffset
+	}
+
+	return minOffset, maxOffset, ok || exist
+}
+
+func (rms *rebuildMessageService) run(task *rebuildTask) {
+	ms := rms.messageStore
+
+	// 等待标记前的请求分发完成，之后的实时请求会跳过重建中的topic
+	rms.waitDispatch()
+	rms.resetConsumeQueues(task)
+	if task.index {
+		request := &rebuildIndexRequest{done: make(chan struct{})}
+		ms.idxService.putRequest(request)
+		<-request.done
+	}
+
+	offset := ms.clog.getMinOffset()
+	if ms.tiered != nil {
+		offset = ms.tiered.minOffset(offset)
+	}
+	atomic.StoreInt64(&rms.fromOffset, offset)
+	atomic.StoreInt64(&rms.rebuildOffset, offset)
+	rms.setState("REPLAYING")
+
+	// 追赶commitlog，差距足够小时确定切换位置
+	for ms.clog.getMaxOffset()-offset > rebuildCatchUpGap {
+		next := rms.replay(task, offset, math.MaxInt64)
+		if next == offset {
+			break
+		}
+		offset = next
+	}
+
+	// commitlog锁内的位置是完整消息的边界
+	ms.clog.mutex.Lock()
+	rms.mutex.Lock()
+	handoffOffset := ms.clog.getMaxOffset()
+	rms.handoffOffset = handoffOffset
+	rms.state = "HANDOFF"
+	rms.mutex.Unlock()
+	ms.clog.mutex.Unlock()
+
+	rms.replay(task, offset, handoffOffset)
+	rms.waitDispatch()
+
+	endTime := system.CurrentTimeMillis()
+	rms.mutex.Lock()
+	for _, request := range rms.pending {
+		rms.write(task, request)
+	}
+	pending := len(rms.pending)
+	rms.pending = nil
+	rms.handoffOffset = -1
+	rms.task = nil
+	rms.state = "FINISHED"
+	rms.endTime = endTime
+	beginTime := rms.beginTime
+	rms.mutex.Unlock()
+
+	// 重放从最早的消息开始，恢复重建后逻辑队列的最小offset
+	minPhyOffset := ms.logicMinPhyOffset()
+	ms.consumeQueueTableMu.RLock()
+	for topic, cqTable := range ms.consumeTopicTable {
+		if !task.matchTopic(topic) {
+			continue
+		}
+		cqTable.consumeQueuesMu.RLock()
+		for _, cq := range cqTable.consumeQueues {
+			cq.correctMinOffset(minPhyOffset)
+		}
+		cqTable.consumeQueuesMu.RUnlock()
+	}
+	ms.consumeQueueTableMu.RUnlock()
+
+	logger.Infof("rebuild consume queue end, %s, offset: %d, pending: %d, cost: %dms.", task,
+		atomic.LoadInt64(&rms.rebuildOffset), pending, endTime-beginTime)
+}
+
+// resetConsumeQueues 从表中移除重建的逻辑队列并删除文件，记录重建前的offset范围
+func (rms *rebuildMessageService) resetConsumeQueues(task *rebuildTask) {
+	ms := rms.messageStore
+
+	ms.consumeQueueTableMu.Lock()
+	var cqTables []*consumeQueueTable
+	for topic, cqTable := range ms.consumeTopicTable {
+		if task.matchTopic(topic) {
+			cqTables = append(cqTables, cqTable)
+			delete(ms.consumeTopicTable, topic)
+		}
+	}
+	ms.consumeQueueTableMu.Unlock()
+
+	for _, cqTable := range cqTables {
+		cqTable.consumeQueuesMu.Lock()
+		for _, cq := range cqTable.consumeQueues {
+			key := fmt.Sprintf("%s-%d", cq.topic, cq.queueId)
+			rms.mutex.Lock()
+			rms.minOffsets[key] = cq.getMinOffsetInQueue()
+			rms.maxOffsets[key] = cq.getMaxOffsetInQueue()
+			rms.mutex.Unlock()
+			cq.destroy()
+		}
+		cqTable.consumeQueuesMu.Unlock()
+	}
+}
+
+// replay 从offset开始重放commitlog到end，返回重放到的位置
+func (rms *rebuildMessageService) replay(task *rebuildTask, offset, end int64) int64 {
+	ms := rms.messageStore
+
+	for doNext := true; doNext && offset < end; {
+		// 本地已删除的文件从冷存储重放
+		if ms.tiered != nil && offset < ms.clog.getMinOffset() {
+			offset = rms.replayCold(task, offset)
+			continue
+		}
+
+		result := ms.clog.getData(offset)
+		if result == nil {
+			break
+		}
+
+		offset = result.startOffset
+		for readSize := int32(0); readSize < result.size && doNext && offset < end; {
+			dRequest := ms.clog.checkMessageAndReturnSize(result.byteBuffer, false, false)
+			size := dRequest.msgSize
+
+			if size > 0 {
+				rms.replayRequest(task, dRequest)
+				offset += size
+				readSize += int32(size)
+			} else if size == -1 {
+				doNext = false
+			} else if size == 0 {
+				offset = ms.clog.rollNextFile(offset)
+				readSize = result.size
+			}
+		}
+
+		result.Release()
+	}
+
+	return offset
+}
+
+// replayCold 重放offset所在的冷存储文件，返回下一个文件的起始offset
+func (rms *rebuildMessageService) replayCold(task *rebuildTask, offset int64) int64 {
+	ms := rms.messageStore
+	fileSize := ms.tiered.fileSize
+	fileFromOffset := offset - offset%fileSize
+	nextFileOffset := fileFromOffset + fileSize
+	name := offset2FileName(fileFromOffset)
+
+	for offset < nextFileOffset {
+		header, err := ms.tiered.read(name, offset-fileFromOffset, 4)
+		if err != nil {
+			logger.Errorf("rebuild read cold storage file %s at %d err: %s.", name, offset, err)
+			break
+		}
+
+		size := newMappedByteBuffer(header).ReadInt32()
+		if size <= 0 || offset+int64(size) > nextFileOffset {
+			break
+		}
+
+		result := ms.tiered.getMessage(offset, size)
+		if result == nil {
+			break
+		}
+
+		dRequest := ms.clog.checkMessageAndReturnSize(result.byteBuffer, false, false)
+		if dRequest.msgSize <= 0 {
+			// 文件末尾的空白填充
+			result.Release()
+			break
+		}
+
+		rms.replayRequest(task, dRequest)
+		offset += dRequest.msgSize
+		result.Release()
+	}
+
+	atomic.StoreInt64(&rms.rebuildOffset, nextFileOffset)
+	return nextFileOffset
+}
+
+func (rms *rebuildMessageService) replayRequest(task *rebuildTask, dRequest *dispatchRequest) {
+	if task.index || task.matchTopic(dRequest.topic) {
+		dRequest.rebuild = true
+		rms.messageStore.putDispatchRequest(dRequest)
+	}
+
+	atomic.StoreInt64(&rms.rebuildOffset, dRequest.commitLogOffset+dRequest.msgSize)
+}
+
+// dispatch 写入重放的请求
+func (rms *rebuildMessageService) dispatch(request *dispatchRequest) {
+	task := rms.currentTask()
+	if task == nil {
+		return
+	}
+
+	rms.write(task, request)
+}
+
+// write 写入逻辑队列及索引，不再处理事务状态
+func (rms *rebuildMessageService) write(task *rebuildTask, request *dispatchRequest) {
+	tranType := sysflag.GetTransactionValue(int(request.sysFlag))
+	if task.matchTopic(request.topic) &&
+		(tranType == sysflag.TransactionNotType || tranType == sysflag.TransactionCommitType) {
+		rms.messageStore.putMessagePostionInfo(request.topic, request.queueId,
+			request.commitLogOffset, request.msgSize, request.tagsCode,
+			request.storeTimestamp, request.consumeQueueOffset, request.propertiesMap)
+	}
+
+	if task.index {
+		rms.messageStore.idxService.putRequest(request)
+	}
+}
+
+// waitDispatch 等待之前放入分发服务的请求处理完成，持续写入时也不会一直等待
+func (rms *rebuildMessageService) waitDispatch() {
+	if rms.messageStore.dispatchMsgService.stop {
+		return
+	}
+
+	barrier := &dispatchRequest{barrier: make(chan struct{})}
+	rms.messageStore.putDispatchRequest(barrier)
+	<-barrier.barrier
+}
+
+func (rms *rebuildMessageService) buildRunningStats(stats map[string]string) {
+	rms.mutex.RLock()
+	defer rms.mutex.RUnlock()
+
+	if rms.lastTask == "" {
+		stats[REBUILD_PROGRESS.String()] = rms.state
+		return
+	}
+
+	fromOffset := atomic.LoadInt64(&rms.fromOffset)
+	rebuildOffset := atomic.LoadInt64(&rms.rebuildOffset)
+	maxOffset := rms.messageStore.clog.getMaxOffset()
+	percent := float64(100)
+	if rms.task != nil {
+		percent = 0
+		if maxOffset > fromOffset && rebuildOffset > fromOffset {
+			percent = float64(rebuildOffset-fromOffset) * 100 / float64(maxOffset-fromOffset)
+		}
+	}
+
+	endTime := rms.endTime
+	if endTime == 0 {
+		endTime = system.CurrentTimeMillis()
+	}
+
+	stats[REBUILD_PROGRESS.String()] = fmt.Sprintf("state=%s, %s, offset=%d/%d, percent=%.2f, cost=%dms",
+		rms.state, rms.lastTask, rebuildOffset, maxOffset, percent, endTime-rms.beginTime)
+}
@@ -0,0 +1,129 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package persistent
+
+import (
+	"testing"
+)
+
+func TestRebuildTask(t *testing.T) {
+	topics := parseRebuildTopics(" TopicA; ;TopicB;")
+	if len(topics) != 2 || topics[0] != "TopicA" || topics[1] != "TopicB" {
+		t.Errorf("parse rebuild topics=%v", topics)
+		return
+	}
+
+	task, err := newRebuildTask(topics, false)
+	if err != nil {
+		t.Errorf("new rebuild task err: %s", err)
+		return
+	}
+
+	if !task.matchTopic("TopicA") || task.matchTopic("TopicC") {
+		t.Errorf("rebuild task %s match topic failed", task)
+		return
+	}
+
+	task, err = newRebuildTask([]string{REBUILD_ALL_TOPICS}, false)
+	if err != nil || !task.matchTopic("TopicC") {
+		t.Errorf("rebuild all topics task=%v, err=%v", task, err)
+		return
+	}
+
+	task, err = newRebuildTask(nil, true)
+	if err != nil || task.matchTopic("TopicA") {
+		t.Errorf("rebuild index task=%v, err=%v", task, err)
+		return
+	}
+
+	if _, err = newRebuildTask([]string{" "}, false); err == nil {
+		t.Errorf("new empty rebuild task expect err")
+		return
+	}
+}
+
+func TestRebuildIntercept(t *testing.T) {
+	ms := &PersistentMessageStore{clog: &commitLog{topicQueueTable: make(map[string]int64)}}
+	rms := newRebuildMessageService(ms)
+
+	if skipCQ, skipIndex := rms.intercept(&dispatchRequest{topic: "TopicA"}); skipCQ || skipIndex {
+		t.Errorf("intercept without rebuild skipCQ=%t, skipIndex=%t", skipCQ, skipIndex)
+		return
+	}
+
+	task, _ := newRebuildTask([]string{"TopicA"}, false)
+	rms.task = task
+	if skipCQ, _ := rms.intercept(&dispatchRequest{topic: "TopicA", commitLogOffset: 100}); !skipCQ {
+		t.Errorf("intercept rebuilding topic expect skip")
+		return
+	}
+	if skipCQ, _ := rms.intercept(&dispatchRequest{topic: "TopicB", commitLogOffset: 100}); skipCQ {
+		t.Errorf("intercept other topic expect not skip")
+		return
+	}
+	if len(rms.pending) != 0 {
+		t.Errorf("pending before handoff=%d", len(rms.pending))
+		return
+	}
+
+	// 切换位置之后的请求暂存，之前的由重放写入
+	rms.handoffOffset = 200
+	rms.intercept(&dispatchRequest{topic: "TopicA", commitLogOffset: 100})
+	rms.intercept(&dispatchRequest{topic: "TopicA", commitLogOffset: 200})
+	rms.intercept(&dispatchRequest{topic: "TopicB", commitLogOffset: 300})
+	rms.intercept(&dispatchRequest{topic: "TopicA", commitLogOffset: 300})
+	if len(rms.pending) != 2 || rms.pending[0].commitLogOffset != 200 || rms.pending[1].commitLogOffset != 300 {
+		t.Errorf("pending=%d", len(rms.pending))
+		return
+	}
+}
+
+func TestRebuildQueueOffsets(t *testing.T) {
+	ms := &PersistentMessageStore{clog: &commitLog{topicQueueTable: make(map[string]int64)}}
+	rms := newRebuildMessageService(ms)
+
+	if _, _, ok := rms.queueOffsets("TopicA", 0); ok {
+		t.Errorf("queue offsets without rebuild expect not ok")
+		return
+	}
+
+	task, _ := newRebuildTask([]string{"TopicA"}, false)
+	rms.task = task
+	rms.minOffsets = map[string]int64{"TopicA-0": 10}
+	rms.maxOffsets = map[string]int64{"TopicA-0": 50}
+	if minOffset, maxOffset, ok := rms.queueOffsets("TopicA", 0); !ok || minOffset != 10 || maxOffset != 50 {
+		t.Errorf("queue offsets min=%d, max=%d, ok=%t", minOffset, maxOffset, ok)
+		return
+	}
+
+	// 重建期间写入的新消息
+	ms.clog.topicQueueTable["TopicA-0"] = 60
+	ms.clog.topicQueueTable["TopicA-1"] = 5
+	if _, maxOffset, _ := rms.queueOffsets("TopicA", 0); maxOffset != 60 {
+		t.Errorf("queue offsets max=%d, expect 60", maxOffset)
+		return
+	}
+	if minOffset, maxOffset, ok := rms.queueOffsets("TopicA", 1); !ok || minOffset != 0 || maxOffset != 5 {
+		t.Errorf("new queue offsets min=%d, max=%d, ok=%t", minOffset, maxOffset, ok)
+		return
+	}
+	if _, _, ok := rms.queueOffsets("TopicA", 2); ok {
+		t.Errorf("missing queue offsets expect not ok")
+		return
+	}
+	if _, _, ok := rms.queueOffsets("TopicB", 0); ok {
+		t.Errorf("other topic queue offsets expect not ok")
+		return
+	}
+}
@@ -22,7 +22,7 @@ import (
 )
 
 type reputMessageService struct {
-	reputFromOffset int64
+	reputFromOffset int64 // 持有mutex时修改，原子写入供清理任务读取
 	reputChan       chan bool
 	stoped          bool
 	messageStore    *PersistentMessageStore
@@ -45,13 +45,30 @@ func (rmsg *reputMessageService) notify() {
 }
 
 func (rmsg *reputMessageService) setReputFromOffset(offset int64) {
-	rmsg.reputFromOffset = offset
+	rmsg.mutex.Lock()
+	atomic.StoreInt64(&rmsg.reputFromOffset, offset)
+	rmsg.mutex.Unlock()
+}
+
+// getReputFromOffset 重放到的位置，之后的数据还未分发
+func (rmsg *reputMessageService) getReputFromOffset() int64 {
+	return atomic.LoadInt64(&rmsg.reputFromOffset)
 }
 
 func (rmsg *reputMessageService) doReput() {
 	rmsg.mutex.Lock()
 	defer rmsg.mutex.Unlock()
 
+	rmsg.reput()
+}
+
+// reput 从reputFromOffset重放到commitlog末尾，调用方需持有mutex
+func (rmsg *reputMessageService) reput() {
+	// master写入时已分发，不再重放
+	if rmsg.messageStore.config.BrokerRole != SLAVE {
+		return
+	}
+
 	doNext := true
 	for {
 		if !doNext {
@@ -60,7 +77,7 @@ func (rmsg *reputMessageService) doReput() {
 
 		result := rmsg.messageStore.clog.getData(rmsg.reputFromOffset)
 		if result != nil {
-			rmsg.reputFromOffset = result.startOffset
+			atomic.StoreInt64(&rmsg.reputFromOffset, result.startOffset)
 
 			for readSize := int32(0); readSize < result.size && doNext; {
 				dRequest := rmsg.messageStore.clog.checkMessageAndReturnSize(
@@ -70,7 +87,7 @@ func (rmsg *reputMessageService) doReput() {
 				if size > 0 {
 					rmsg.messageStore.putDispatchRequest(dRequest)
 
-					rmsg.reputFromOffset += size
+					atomic.AddInt64(&rmsg.reputFromOffset, size)
 					readSize += int32(size)
 
 					storeStatsService := rmsg.messageStore.storeStats
@@ -81,7 +98,7 @@ func (rmsg *reputMessageService) doReput() {
 				} else if size == -1 {
 					doNext = false
 				} else if size == 0 {
-					rmsg.reputFromOffset = rmsg.messageStore.clog.rollNextFile(rmsg.reputFromOffset)
+					atomic.StoreInt64(&rmsg.reputFromOffset, rmsg.messageStore.clog.rollNextFile(rmsg.reputFromOffset))
 					readSize = result.size
 				}
 			}
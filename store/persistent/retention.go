@@ -0,0 +1,337 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package persistent
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"github.com/boltmq/common/logger"
+	"github.com/boltmq/common/utils/system"
+)
+
+// TopicRetention topic保留策略，字段为0时使用全局配置
+type TopicRetention struct {
+	ReservedTime  int64 // 保留时间，单位小时，0表示使用FileReservedTime
+	MaxBytes      int64 // 保留的最大字节数，按队列平均分配，0表示不限制
+	Compact       bool  // 按消息key压缩，只保留每个key的最新消息，没有key的消息被压缩。开启后不按时间及字节数淘汰逻辑队列
+	TombstoneTime int64 // 压缩时消息体为空的删除标记保留时间，单位小时，0表示24小时
+}
+
+// TopicRetentionStats topic生效的保留策略及当前保留的数据
+type TopicRetentionStats struct {
+	ReservedTime  int64 `json:"reservedTime"`  // 生效的保留时间，单位小时
+	MaxBytes      int64 `json:"maxBytes"`      // 生效的最大保留字节数，0表示不限制
+	RetainedBytes int64 `json:"retainedBytes"` // 当前保留的字节数，只在限制字节数时统计
+	EarliestTime  int64 `json:"earliestTime"`  // 最早保留消息的存储时间，-1表示没有消息
+	Compact       bool  `json:"compact"`       // 是否按消息key压缩
+	Keys          int64 `json:"keys"`          // 压缩时保留的key数量
+}
+
+// queueRetention 按字节数淘汰时单个队列的统计，记录[minOffset, scanOffset)的消息字节数
+type queueRetention struct {
+	minOffset  int64
+	scanOffset int64
+	bytes      int64
+}
+
+// retentionService 按topic保留策略推进逻辑队列的最小offset，所有topic都不再需要的commitlog文件才会被删除。
+// 没有设置任何topic保留策略时保持按FileReservedTime删除commitlog的行为
+type retentionService struct {
+	messageStore *PersistentMessageStore
+	mutex        sync.RWMutex
+	policies     map[string]*TopicRetention
+	queues       map[*consumeQueue]*queueRetention // 限制字节数的队列统计，由queuesMutex保护
+	queuesMutex  sync.Mutex
+	neededOffset int64 // 仍被topic需要的最小物理offset，-1表示未开启
+}
+
+func newRetentionService(messageStore *PersistentMessageStore) *retentionService {
+	return &retentionService{
+		messageStore: messageStore,
+		policies:     make(map[string]*TopicRetention),
+		queues:       make(map[*consumeQueue]*queueRetention),
+		neededOffset: -1,
+	}
+}
+
+func (rs *retentionService) setTopicRetention(topic string, retention *TopicRetention) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	if retention == nil || (retention.ReservedTime <= 0 && retention.MaxBytes <= 0 && !retention.Compact) {
+		delete(rs.policies, topic)
+		return
+	}
+
+	copied := *retention
+	rs.policies[topic] = &copied
+}
+
+func (rs *retentionService) enabled() bool {
+	rs.mutex.RLock()
+	defer rs.mutex.RUnlock()
+	return len(rs.policies) > 0
+}
+
+// effective topic生效的保留时间（小时）及最大字节数
+func (rs *retentionService) effective(topic string) (int64, int64) {
+	reservedTime := rs.messageStore.config.FileReservedTime
+	maxBytes := int64(0)
+
+	rs.mutex.RLock()
+	policy, ok := rs.policies[topic]
+	rs.mutex.RUnlock()
+
+	if ok {
+		if policy.ReservedTime > 0 {
+			reservedTime = policy.ReservedTime
+		}
+		maxBytes = policy.MaxBytes
+	}
+
+	return reservedTime, maxBytes
+}
+
+// compactTopics 开启压缩的topic及删除标记保留时间（小时）
+func (rs *retentionService) compactTopics() map[string]int64 {
+	rs.mutex.RLock()
+	defer rs.mutex.RUnlock()
+
+	topics := make(map[string]int64)
+	for topic, policy := range rs.policies {
+		if !policy.Compact {
+			continue
+		}
+
+		topics[topic] = policy.TombstoneTime
+		if policy.TombstoneTime <= 0 {
+			topics[topic] = defaultTombstoneRetention
+		}
+	}
+
+	return topics
+}
+
+func (rs *retentionService) neededPhyOffset() int64 {
+	return atomic.LoadInt64(&rs.neededOffset)
+}
+
+// run 推进所有topic逻辑队列的最小offset，并计算仍被需要的最小物理offset，由清理任务定期调用
+func (rs *retentionService) run() {
+	ms := rs.messageStore
+	rs.queuesMutex.Lock()
+	defer rs.queuesMutex.Unlock()
+
+	if !rs.enabled() {
+		rs.queues = make(map[*consumeQueue]*queueRetention)
+		atomic.StoreInt64(&rs.neededOffset, -1)
+		return
+	}
+
+	now := system.CurrentTimeMillis()
+	neededOffset := ms.protectedPhyOffset(false)
+	queues := make(map[*consumeQueue]*queueRetention)
+	compactTopics := rs.compactTopics()
+	for topic, cqs := range rs.topicQueues() {
+		// 重建中的逻辑队列不完整，暂不删除commitlog
+		if ms.rebuildMsgService.isRebuilding(topic) {
+			neededOffset = 0
+			continue
+		}
+
+		reservedTime, maxBytes := rs.effective(topic)
+		threshold := now - reservedTime*60*60*1000
+		share := maxBytes / int64(len(cqs))
+		if maxBytes > 0 && share == 0 {
+			share = 1
+		}
+
+		_, compact := compactTopics[topic]
+		for _, cq := range cqs {
+			// 压缩的topic只保留每个key的最新消息，由压缩服务处理
+			if !compact {
+				rs.enforce(cq, threshold, share)
+				if qr, ok := rs.queues[cq]; ok && share > 0 {
+					queues[cq] = qr
+				}
+			}
+
+			if compact {
+				// 存活的消息超过保留时间后由压缩服务复制到commitlog末尾，未压缩过的队列暂不删除commitlog
+				phyOffset, ok := ms.compaction.neededPhyOffset(cq)
+				if !ok {
+					phyOffset = 0
+				}
+				if phyOffset < neededOffset {
+					neededOffset = phyOffset
+				}
+				continue
+			}
+
+			if phyOffset, _, ok := rs.firstEntry(cq, cq.getMinOffsetInQueue()); ok && phyOffset < neededOffset {
+				neededOffset = phyOffset
+			}
+		}
+	}
+
+	rs.queues = queues
+	atomic.StoreInt64(&rs.neededOffset, neededOffset)
+}
+
+func (rs *retentionService) topicQueues() map[string][]*consumeQueue {
+	ms := rs.messageStore
+	result := make(map[string][]*consumeQueue)
+
+	ms.consumeQueueTableMu.RLock()
+	defer ms.consumeQueueTableMu.RUnlock()
+
+	for topic, cqTable := range ms.consumeTopicTable {
+		cqTable.consumeQueuesMu.RLock()
+		for _, cq := range cqTable.consumeQueues {
+			result[topic] = append(result[topic], cq)
+		}
+		cqTable.consumeQueuesMu.RUnlock()
+	}
+
+	return result
+}
+
+// enforce 淘汰存储时间早于threshold的消息，share大于0时淘汰最早的消息直到队列字节数不超过share
+func (rs *retentionService) enforce(cq *consumeQueue, threshold, share int64) {
+	minOffset, maxOffset := cq.getMinOffsetInQueue(), cq.getMaxOffsetInQueue()
+	if minOffset >= maxOffset {
+		return
+	}
+
+	target := rs.offsetByTime(cq, minOffset, maxOffset, threshold)
+	if share > 0 {
+		qr, ok := rs.queues[cq]
+		if !ok || qr.minOffset != minOffset || qr.scanOffset > maxOffset {
+			qr = &queueRetention{minOffset: minOffset, scanOffset: minOffset}
+			rs.queues[cq] = qr
+		}
+
+		qr.scanOffset = cq.forEachEntry(qr.scanOffset, maxOffset, func(index, phyOffset int64, size int32, tagsCode int64) bool {
+			qr.bytes += int64(size)
+			return true
+		})
+
+		qr.minOffset = cq.forEachEntry(qr.minOffset, qr.scanOffset, func(index, phyOffset int64, size int32, tagsCode int64) bool {
+			if index >= target && qr.bytes <= share {
+				return false
+			}
+
+			qr.bytes -= int64(size)
+			return true
+		})
+		target = qr.minOffset
+	}
+
+	if target <= minOffset {
+		return
+	}
+
+	if target >= maxOffset {
+		cq.correctMinOffset(math.MaxInt64)
+	} else if phyOffset, _, ok := rs.entry(cq, target); ok {
+		cq.correctMinOffset(phyOffset)
+	}
+
+	logger.Infof("topic %s queue %d retention advance min offset from %d to %d.",
+		cq.topic, cq.queueId, minOffset, cq.getMinOffsetInQueue())
+}
+
+// offsetByTime 二分查找第一条存储时间不早于threshold的消息，读取不到的消息视为过期
+func (rs *retentionService) offsetByTime(cq *consumeQueue, minOffset, maxOffset, threshold int64) int64 {
+	low, high := minOffset, maxOffset
+	for low < high {
+		mid := low + (high-low)/2
+		phyOffset, size, ok := rs.entry(cq, mid)
+		if ok && rs.messageStore.clog.pickupStoretimestamp(phyOffset, size) >= threshold {
+			high = mid
+		} else {
+			low = mid + 1
+		}
+	}
+
+	return low
+}
+
+// firstEntry 从from开始第一条未被压缩的消息
+func (rs *retentionService) firstEntry(cq *consumeQueue, from int64) (int64, int32, bool) {
+	var (
+		phyOffset int64
+		size      int32
+		found     bool
+	)
+
+	cq.forEachEntry(from, cq.getMaxOffsetInQueue(), func(index, offset int64, sz int32, tagsCode int64) bool {
+		if tagsCode == compactedTagsCode {
+			return true
+		}
+
+		phyOffset, size, found = offset, sz, true
+		return false
+	})
+
+	return phyOffset, size, found
+}
+
+func (rs *retentionService) entry(cq *consumeQueue, index int64) (int64, int32, bool) {
+	if index >= cq.getMaxOffsetInQueue() {
+		return 0, 0, false
+	}
+
+	result := cq.getIndexBuffer(index)
+	if result == nil {
+		return 0, 0, false
+	}
+	defer result.Release()
+
+	phyOffset := result.byteBuffer.ReadInt64()
+	size := result.byteBuffer.ReadInt32()
+	return phyOffset, size, true
+}
+
+func (rs *retentionService) stats(topic string) *TopicRetentionStats {
+	reservedTime, maxBytes := rs.effective(topic)
+	stats := &TopicRetentionStats{ReservedTime: reservedTime, MaxBytes: maxBytes, EarliestTime: -1}
+	if _, ok := rs.compactTopics()[topic]; ok {
+		stats.Compact = true
+		stats.Keys = rs.messageStore.compaction.keyCount(topic)
+	}
+
+	rs.queuesMutex.Lock()
+	defer rs.queuesMutex.Unlock()
+
+	for _, cq := range rs.topicQueues()[topic] {
+		if qr, ok := rs.queues[cq]; ok {
+			stats.RetainedBytes += qr.bytes
+		}
+
+		phyOffset, size, ok := rs.firstEntry(cq, cq.getMinOffsetInQueue())
+		if !ok {
+			continue
+		}
+
+		storeTime := rs.messageStore.clog.pickupStoretimestamp(phyOffset, size)
+		if storeTime > 0 && (stats.EarliestTime < 0 || storeTime < stats.EarliestTime) {
+			stats.EarliestTime = storeTime
+		}
+	}
+
+	return stats
+}
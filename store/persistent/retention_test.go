@@ -0,0 +1,58 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package persistent
+
+import (
+	"testing"
+)
+
+func TestTopicRetentionPolicy(t *testing.T) {
+	rs := newRetentionService(&PersistentMessageStore{config: &Config{FileReservedTime: 72}})
+	if rs.enabled() {
+		t.Errorf("retention enabled without policy")
+		return
+	}
+
+	rs.setTopicRetention("audit", &TopicRetention{ReservedTime: 24 * 30})
+	rs.setTopicRetention("telemetry", &TopicRetention{ReservedTime: 6, MaxBytes: 1024})
+	rs.setTopicRetention("other", &TopicRetention{})
+	if !rs.enabled() {
+		t.Errorf("retention not enabled")
+		return
+	}
+
+	cases := []struct {
+		topic        string
+		reservedTime int64
+		maxBytes     int64
+	}{
+		{"audit", 720, 0},
+		{"telemetry", 6, 1024},
+		{"other", 72, 0},
+	}
+
+	for _, c := range cases {
+		if reservedTime, maxBytes := rs.effective(c.topic); reservedTime != c.reservedTime || maxBytes != c.maxBytes {
+			t.Errorf("topic %s retention=%d/%d, expect %d/%d", c.topic, reservedTime, maxBytes, c.reservedTime, c.maxBytes)
+			return
+		}
+	}
+
+	rs.setTopicRetention("audit", nil)
+	rs.setTopicRetention("telemetry", nil)
+	if rs.enabled() {
+		t.Errorf("retention enabled after policies removed")
+		return
+	}
+}
@@ -16,9 +16,17 @@ package persistent
 import (
 	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/boltmq/boltmq/common"
+	"github.com/boltmq/boltmq/store"
+	"github.com/boltmq/common/basis"
 	"github.com/boltmq/common/logger"
+	"github.com/boltmq/common/message"
+	"github.com/boltmq/common/utils/system"
 )
 
 const (
@@ -31,15 +39,20 @@ const (
 type scheduleMessageService struct {
 	delayLevelTable map[int32]int64         // 每个level对应的延时时间
 	offsetTable     map[int32]int64         // 延时计算到了哪里
-	ticker          *time.Ticker            // 定时器
+	offsetTableMu   sync.RWMutex            //
+	timers          map[int32]*time.Timer   // 每个level对应的投递定时器
+	timersMu        sync.Mutex              //
+	ticker          *system.Ticker          // 定时持久化延时进度
 	messageStore    *PersistentMessageStore // 存储顶层对象
 	maxDelayLevel   int32                   // 最大值
+	started         bool                    // 服务是否启动
 }
 
 func newScheduleMessageService(messageStore *PersistentMessageStore) *scheduleMessageService {
 	service := &scheduleMessageService{
 		delayLevelTable: make(map[int32]int64, 32),
 		offsetTable:     make(map[int32]int64, 32),
+		timers:          make(map[int32]*time.Timer, 32),
 		messageStore:    messageStore,
 	}
 	return service
@@ -50,6 +63,9 @@ func delayLevel2QueueId(delayLevel int32) int32 {
 }
 
 func (sms *scheduleMessageService) buildRunningStats(stats map[string]string) {
+	sms.offsetTableMu.RLock()
+	defer sms.offsetTableMu.RUnlock()
+
 	for key, value := range sms.offsetTable {
 		queueId := delayLevel2QueueId(key)
 		delayOffset := value
@@ -61,7 +77,9 @@ func (sms *scheduleMessageService) buildRunningStats(stats map[string]string) {
 }
 
 func (sms *scheduleMessageService) encodeOffsetTable() string {
+	sms.offsetTableMu.RLock()
 	result, err := json.Marshal(sms.offsetTable)
+	sms.offsetTableMu.RUnlock()
 	if err != nil {
 		logger.Infof("schedule message service offset table to json error: %s.", err)
 		return ""
@@ -70,6 +88,32 @@ func (sms *scheduleMessageService) encodeOffsetTable() string {
 	return string(result)
 }
 
+func (sms *scheduleMessageService) decodeOffsetTable(content string) error {
+	offsetTable := make(map[int32]int64, 32)
+	if err := json.Unmarshal([]byte(content), &offsetTable); err != nil {
+		return err
+	}
+
+	sms.offsetTableMu.Lock()
+	sms.offsetTable = offsetTable
+	sms.offsetTableMu.Unlock()
+	return nil
+}
+
+// resetOffsetTable 清空延时进度，投递时从逻辑队列的最小offset开始
+func (sms *scheduleMessageService) resetOffsetTable() {
+	sms.offsetTableMu.Lock()
+	sms.offsetTable = make(map[int32]int64, 32)
+	sms.offsetTableMu.Unlock()
+	sms.persist()
+}
+
+func (sms *scheduleMessageService) updateOffset(delayLevel int32, offset int64) {
+	sms.offsetTableMu.Lock()
+	sms.offsetTable[delayLevel] = offset
+	sms.offsetTableMu.Unlock()
+}
+
 func (sms *scheduleMessageService) computeDeliverTimestamp(delayLevel int32, storeTimestamp int64) int64 {
 	time, ok := sms.delayLevelTable[delayLevel]
 	if ok {
@@ -83,22 +127,260 @@ func (sms *scheduleMessageService) encode() string {
 	return sms.encodeOffsetTable()
 }
 
+// load 加载延时进度及延时级别
 func (sms *scheduleMessageService) load() bool {
-	// TODO
+	if !sms.loadDelayOffset() {
+		return false
+	}
+
+	return sms.parseDelayLevel()
+}
+
+func (sms *scheduleMessageService) loadDelayOffset() bool {
+	filePath := common.GetDelayOffsetStorePath(sms.messageStore.config.StorePathRootDir)
+	content, err := common.File2String(filePath)
+	if err != nil || len(content) == 0 {
+		// 文件不存在时尝试从备份文件恢复
+		content, err = common.File2String(filePath + ".bak")
+		if err != nil || len(content) == 0 {
+			return true
+		}
+	}
+
+	if err := sms.decodeOffsetTable(content); err != nil {
+		logger.Errorf("schedule message service decode delay offset %s err: %s.", filePath, err)
+		return false
+	}
+
+	logger.Infof("load delay offset %s success.", filePath)
+	return true
+}
+
+// parseDelayLevel 解析延时级别，格式如：1s 5s 10s 30s 1m 2m 1h 2h 1d
+func (sms *scheduleMessageService) parseDelayLevel() bool {
+	timeUnitTable := map[string]int64{
+		"s": 1000,
+		"m": 1000 * 60,
+		"h": 1000 * 60 * 60,
+		"d": 1000 * 60 * 60 * 24,
+	}
+
+	levels := strings.Fields(sms.messageStore.config.MessageDelayLevel)
+	for i, value := range levels {
+		if len(value) < 2 {
+			logger.Errorf("parse delay level %s failed.", value)
+			return false
+		}
+
+		unit, ok := timeUnitTable[value[len(value)-1:]]
+		if !ok {
+			logger.Errorf("parse delay level %s failed, unknown time unit.", value)
+			return false
+		}
+
+		num, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+		if err != nil {
+			logger.Errorf("parse delay level %s err: %s.", value, err)
+			return false
+		}
+
+		level := int32(i + 1)
+		if level > sms.maxDelayLevel {
+			sms.maxDelayLevel = level
+		}
+		sms.delayLevelTable[level] = num * unit
+	}
+
 	return true
 }
 
 func (sms *scheduleMessageService) start() {
-	// TODO
+	sms.timersMu.Lock()
+	sms.started = true
+	sms.timersMu.Unlock()
+
+	for level := range sms.delayLevelTable {
+		sms.offsetTableMu.RLock()
+		offset := sms.offsetTable[level]
+		sms.offsetTableMu.RUnlock()
+
+		sms.scheduleDeliver(level, offset, FIRST_DELAY_TIME)
+	}
+
+	sms.ticker = system.NewTicker(true, 10*time.Second,
+		time.Duration(sms.messageStore.config.FlushDelayOffsetInterval)*time.Millisecond, func() {
+			sms.persist()
+		})
+	sms.ticker.Start()
+}
+
+// scheduleDeliver 延时delay毫秒后，从offset开始投递delayLevel对应队列的消息
+func (sms *scheduleMessageService) scheduleDeliver(delayLevel int32, offset int64, delay int64) {
+	sms.timersMu.Lock()
+	defer sms.timersMu.Unlock()
+
+	if !sms.started {
+		return
+	}
+
+	task := &deliverDelayedMessageTask{sms: sms, delayLevel: delayLevel, offset: offset}
+	sms.timers[delayLevel] = time.AfterFunc(time.Duration(delay)*time.Millisecond, task.run)
+}
+
+func (sms *scheduleMessageService) persist() {
+	content := sms.encodeOffsetTable()
+	if len(content) == 0 {
+		return
+	}
+
+	filePath := common.GetDelayOffsetStorePath(sms.messageStore.config.StorePathRootDir)
+	if err := common.String2File([]byte(content), filePath); err != nil {
+		logger.Errorf("schedule message service persist delay offset %s err: %s.", filePath, err)
+	}
 }
 
 func (sms *scheduleMessageService) shutdown() {
+	sms.timersMu.Lock()
+	started := sms.started
+	sms.started = false
+	for _, timer := range sms.timers {
+		timer.Stop()
+	}
+	sms.timersMu.Unlock()
+
 	if sms.ticker != nil {
 		sms.ticker.Stop()
 	}
+
+	// slave未启动投递，避免覆盖从master同步的延时进度
+	if started {
+		sms.persist()
+	}
 	logger.Info("shutdown schedule message service.")
 }
 
+// deliverDelayedMessageTask 投递某个延时级别到期的消息
+type deliverDelayedMessageTask struct {
+	sms        *scheduleMessageService
+	delayLevel int32
+	offset     int64
+}
+
+func (task *deliverDelayedMessageTask) run() {
+	defer func() {
+		if e := recover(); e != nil {
+			logger.Errorf("deliver delayed message task panic: %v.", e)
+			task.sms.scheduleDeliver(task.delayLevel, task.offset, DELAY_FOR_A_PERIOD)
+		}
+	}()
+
+	task.executeOnTimeup()
+}
+
+// correctDeliverTimestamp 纠正投递时间，避免系统时间回调导致消息长时间不投递
+func (task *deliverDelayedMessageTask) correctDeliverTimestamp(now, deliverTimestamp int64) int64 {
+	maxTimestamp := now + task.sms.delayLevelTable[task.delayLevel]
+	if deliverTimestamp > maxTimestamp {
+		return now
+	}
+
+	return deliverTimestamp
+}
+
+func (task *deliverDelayedMessageTask) executeOnTimeup() {
+	sms := task.sms
+	ms := sms.messageStore
+	cq := ms.findConsumeQueue(SCHEDULE_TOPIC, delayLevel2QueueId(task.delayLevel))
+	failScheduleOffset := task.offset
+
+	if cq != nil {
+		bufferCQ := cq.getIndexBuffer(task.offset)
+		if bufferCQ != nil {
+			defer bufferCQ.Release()
+
+			nextOffset := task.offset
+			for i := 0; i < int(bufferCQ.size); i += CQStoreUnitSize {
+				offsetPy := bufferCQ.byteBuffer.ReadInt64()
+				sizePy := bufferCQ.byteBuffer.ReadInt32()
+				tagsCode := bufferCQ.byteBuffer.ReadInt64()
+
+				now := system.CurrentTimeMillis()
+				deliverTimestamp := task.correctDeliverTimestamp(now, tagsCode)
+				nextOffset = task.offset + int64(i/CQStoreUnitSize)
+
+				countdown := deliverTimestamp - now
+				if countdown > 0 {
+					// 该级别队列中后续消息均未到期
+					sms.scheduleDeliver(task.delayLevel, nextOffset, countdown)
+					sms.updateOffset(task.delayLevel, nextOffset)
+					return
+				}
+
+				msgExt := ms.lookMessageByOffset(offsetPy, sizePy)
+				if msgExt != nil {
+					msgInner := task.messageTimeup(msgExt)
+					result := ms.PutMessage(msgInner)
+					if result == nil || result.Status != store.PUTMESSAGE_PUT_OK {
+						logger.Errorf("schedule message service, a message time up, but reput it failed, topic: %s msgId: %s.",
+							msgExt.Topic, msgExt.MsgId)
+						sms.scheduleDeliver(task.delayLevel, nextOffset, DELAY_FOR_A_PERIOD)
+						sms.updateOffset(task.delayLevel, nextOffset)
+						return
+					}
+				}
+			}
+
+			nextOffset = task.offset + int64(bufferCQ.size/CQStoreUnitSize)
+			sms.scheduleDeliver(task.delayLevel, nextOffset, DELAY_FOR_A_WHILE)
+			sms.updateOffset(task.delayLevel, nextOffset)
+			return
+		}
+
+		// 消费进度小于队列最小offset时，从最小offset开始投递
+		if minOffset := cq.getMinOffsetInQueue(); task.offset < minOffset {
+			failScheduleOffset = minOffset
+			logger.Errorf("schedule message service, offset %d less than min offset %d, delay level: %d.",
+				task.offset, minOffset, task.delayLevel)
+		}
+	}
+
+	sms.scheduleDeliver(task.delayLevel, failScheduleOffset, DELAY_FOR_A_WHILE)
+}
+
+// messageTimeup 还原到期消息的真实topic、queueId
+func (task *deliverDelayedMessageTask) messageTimeup(msgExt *message.MessageExt) *store.MessageExtInner {
+	return timeupMessage(msgExt, message.PROPERTY_DELAY_TIME_LEVEL)
+}
+
+// timeupMessage 根据到期消息构造投递到真实topic、queueId的消息，并清除触发延时的属性
+func timeupMessage(msgExt *message.MessageExt, delayProperty string) *store.MessageExtInner {
+	msgInner := new(store.MessageExtInner)
+	msgInner.Body = msgExt.Body
+	msgInner.Flag = msgExt.Flag
+
+	properties := make(map[string]string, len(msgExt.Properties))
+	for key, value := range msgExt.Properties {
+		properties[key] = value
+	}
+	delete(properties, delayProperty)
+	message.SetPropertiesMap(&msgInner.Message, properties)
+
+	msgInner.TagsCode = basis.TagsString2tagsCode(basis.ParseTopicFilterType(msgExt.SysFlag), msgInner.GetTags())
+	msgInner.SysFlag = msgExt.SysFlag
+	msgInner.BornTimestamp = msgExt.BornTimestamp
+	msgInner.BornHost = msgExt.BornHost
+	msgInner.StoreHost = msgExt.StoreHost
+	msgInner.ReconsumeTimes = msgExt.ReconsumeTimes
+	msgInner.SetWaitStoreMsgOK(false)
+	msgInner.PropertiesString = message.MessageProperties2String(msgInner.Properties)
+
+	msgInner.Topic = msgInner.GetProperty(message.PROPERTY_REAL_TOPIC)
+	queueId, _ := strconv.Atoi(msgInner.GetProperty(message.PROPERTY_REAL_QUEUE_ID))
+	msgInner.QueueId = int32(queueId)
+
+	return msgInner
+}
+
 type runningStats int
 
 const (
@@ -107,6 +389,10 @@ const (
 	COMMIT_LOG_DISK_RATIO
 	CONSUME_QUEUE_DISK_RATIO
 	SCHEDULE_MESSAGE_OFFSET
+	TIMER_MESSAGE_OFFSET
+	ELECTION_STATE
+	HA_HANDSHAKE_FAILURES
+	REBUILD_PROGRESS
 )
 
 func (state runningStats) String() string {
@@ -121,6 +407,14 @@ func (state runningStats) String() string {
 		return "consumeQueueDiskRatio"
 	case SCHEDULE_MESSAGE_OFFSET:
 		return "scheduleMessageOffset"
+	case TIMER_MESSAGE_OFFSET:
+		return "timerMessageOffset"
+	case ELECTION_STATE:
+		return "electionState"
+	case HA_HANDSHAKE_FAILURES:
+		return "haHandshakeFailures"
+	case REBUILD_PROGRESS:
+		return "rebuildProgress"
 	default:
 		return "Unknow"
 	}
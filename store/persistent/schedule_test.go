@@ -0,0 +1,61 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package persistent
+
+import (
+	"testing"
+)
+
+func TestParseDelayLevel(t *testing.T) {
+	ms := &PersistentMessageStore{config: newConfig("./test")}
+	ms.config.MessageDelayLevel = "1s 5m 2h 1d"
+	sms := newScheduleMessageService(ms)
+	if !sms.parseDelayLevel() {
+		t.Errorf("parse delay level failed")
+		return
+	}
+
+	if sms.maxDelayLevel != 4 {
+		t.Errorf("maxDelayLevel=%d", sms.maxDelayLevel)
+		return
+	}
+
+	if sms.delayLevelTable[2] != 1000*60*5 || sms.delayLevelTable[4] != 1000*60*60*24 {
+		t.Errorf("delayLevelTable=%v", sms.delayLevelTable)
+		return
+	}
+
+	if sms.computeDeliverTimestamp(1, 100) != 1100 {
+		t.Errorf("computeDeliverTimestamp=%d", sms.computeDeliverTimestamp(1, 100))
+		return
+	}
+}
+
+func TestDelayOffsetEncodeAndDecode(t *testing.T) {
+	ms := &PersistentMessageStore{config: newConfig("./test")}
+	wsms := newScheduleMessageService(ms)
+	wsms.updateOffset(1, 10)
+	wsms.updateOffset(3, 30)
+
+	rsms := newScheduleMessageService(ms)
+	if err := rsms.decodeOffsetTable(wsms.encodeOffsetTable()); err != nil {
+		t.Errorf("decode offset table err: %s", err)
+		return
+	}
+
+	if rsms.offsetTable[1] != 10 || rsms.offsetTable[3] != 30 {
+		t.Errorf("offsetTable=%v", rsms.offsetTable)
+		return
+	}
+}
@@ -29,6 +29,7 @@ type storeCheckpoint struct {
 	physicMsgTimestamp int64
 	logicsMsgTimestamp int64
 	indexMsgTimestamp  int64
+	timerMsgOffset     int64 // 任意时间定时消息已投递的连续进度
 }
 
 func newStoreCheckpoint(scpPath string) (*storeCheckpoint, error) {
@@ -67,6 +68,7 @@ func newStoreCheckpoint(scpPath string) (*storeCheckpoint, error) {
 		scp.physicMsgTimestamp = scp.byteBuffer.ReadInt64()
 		scp.logicsMsgTimestamp = scp.byteBuffer.ReadInt64()
 		scp.indexMsgTimestamp = scp.byteBuffer.ReadInt64()
+		scp.timerMsgOffset = scp.byteBuffer.ReadInt64()
 	}
 
 	return scp, nil
@@ -82,6 +84,7 @@ func (scp *storeCheckpoint) flush() {
 	scp.byteBuffer.WriteInt64(scp.physicMsgTimestamp)
 	scp.byteBuffer.WriteInt64(scp.logicsMsgTimestamp)
 	scp.byteBuffer.WriteInt64(scp.indexMsgTimestamp)
+	scp.byteBuffer.WriteInt64(scp.timerMsgOffset)
 	scp.byteBuffer.flush()
 }
 
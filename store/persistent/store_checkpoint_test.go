@@ -28,6 +28,7 @@ func TestSCWriteAndRead(t *testing.T) {
 
 	wscp.physicMsgTimestamp = 0xAABB
 	wscp.logicsMsgTimestamp = 0xCCDD
+	wscp.timerMsgOffset = 0xEEFF
 	wscp.flush()
 	wscp.shutdown()
 
@@ -47,6 +48,11 @@ func TestSCWriteAndRead(t *testing.T) {
 		return
 	}
 
+	if wscp.timerMsgOffset != rscp.timerMsgOffset {
+		t.Errorf("timerMsgOffset=%d", rscp.timerMsgOffset)
+		return
+	}
+
 	if err := os.RemoveAll("./test"); err != nil {
 		t.Fail()
 	}
@@ -0,0 +1,365 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package persistent
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/boltmq/common/logger"
+	"github.com/boltmq/common/utils/system"
+)
+
+const (
+	COLD_STORAGE_LOCAL = "local"
+	COLD_STORAGE_S3    = "s3"
+
+	coldReadBlockSize      = 4 * 1024 * 1024 // 从冷存储按块读取，顺序拉取时复用
+	coldOffloadInterval    = 10 * time.Second
+	coldOffloadMaxPerRound = 10
+	coldMinOffsetRefresh   = 60 * 1000 // 冷存储最小offset的缓存时间，单位毫秒
+)
+
+// ColdStorage 冷存储接口，保存写满的commitlog文件，文件名与本地commitlog文件名一致
+type ColdStorage interface {
+	// Put 上传文件
+	Put(name string, data io.Reader, size int64) error
+	// ReadAt 从文件off处读取len(p)字节
+	ReadAt(name string, p []byte, off int64) (int, error)
+	// Exists 文件是否已存在
+	Exists(name string) (bool, error)
+}
+
+// localColdStorage 本地目录冷存储，用于测试或挂载的网络文件系统
+type localColdStorage struct {
+	dir string
+}
+
+func NewLocalColdStorage(dir string) (ColdStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &localColdStorage{dir: dir}, nil
+}
+
+func (lcs *localColdStorage) Put(name string, data io.Reader, size int64) error {
+	path := filepath.Join(lcs.dir, name)
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	n, err := io.Copy(file, data)
+	if err == nil && n != size {
+		err = fmt.Errorf("write %d bytes, expect %d", n, size)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+func (lcs *localColdStorage) ReadAt(name string, p []byte, off int64) (int, error) {
+	file, err := os.Open(filepath.Join(lcs.dir, name))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	return file.ReadAt(p, off)
+}
+
+func (lcs *localColdStorage) Exists(name string) (bool, error) {
+	_, err := os.Stat(filepath.Join(lcs.dir, name))
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+
+	return false, err
+}
+
+// newColdStorage 根据配置创建冷存储，未配置时返回nil
+func newColdStorage(conf *Config) (ColdStorage, error) {
+	switch conf.ColdStorageType {
+	case "":
+		return nil, nil
+	case COLD_STORAGE_LOCAL:
+		return NewLocalColdStorage(conf.ColdStorageDir)
+	case COLD_STORAGE_S3:
+		return NewS3ColdStorage(conf.ColdStorageEndpoint, conf.ColdStorageRegion, conf.ColdStorageBucket,
+			conf.ColdStoragePrefix, conf.ColdStorageAccessKey, conf.ColdStorageSecretKey)
+	default:
+		return nil, fmt.Errorf("unknown cold storage type %s", conf.ColdStorageType)
+	}
+}
+
+// coldBlock 最近读取的冷存储数据块
+type coldBlock struct {
+	name   string
+	offset int64
+	data   []byte
+}
+
+// tieredStorageService 分层存储服务，写满的commitlog文件上传到冷存储后才允许删除，磁盘空间不足时除外，
+// 本地已删除的offset从冷存储读取
+type tieredStorageService struct {
+	messageStore *PersistentMessageStore
+	cold         ColdStorage
+	fileSize     int64
+	uploaded     map[int64]bool // 已上传的文件起始offset
+	coldMin      int64          // 缓存的冷存储最小offset
+	coldMinTime  int64          // 查找coldMin的时间，0表示未查找
+	mutex        sync.Mutex
+	block        *coldBlock
+	blockMutex   sync.Mutex
+	closeChan    chan bool
+}
+
+func newTieredStorageService(messageStore *PersistentMessageStore, cold ColdStorage) *tieredStorageService {
+	return &tieredStorageService{
+		messageStore: messageStore,
+		cold:         cold,
+		fileSize:     int64(messageStore.config.MappedFileSizeCommitLog),
+		uploaded:     make(map[int64]bool),
+		closeChan:    make(chan bool, 1),
+	}
+}
+
+func (ts *tieredStorageService) start() {
+	logger.Info("tiered storage service started.")
+
+	ticker := time.NewTicker(coldOffloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ts.offloadSealed()
+		case <-ts.closeChan:
+			logger.Info("tiered storage service end.")
+			return
+		}
+	}
+}
+
+func (ts *tieredStorageService) shutdown() {
+	ts.closeChan <- true
+}
+
+// offloadSealed 上传写满的commitlog文件，最后一个文件处于写状态不上传
+func (ts *tieredStorageService) offloadSealed() {
+	files := ts.messageStore.clog.mfq.copyMappedFiles(0)
+	if len(files) > 0 {
+		ts.pruneUploaded(files[0].fileFromOffset)
+	}
+
+	count := 0
+	for i := 0; i < len(files)-1 && count < coldOffloadMaxPerRound; i++ {
+		if ts.isUploaded(files[i].fileFromOffset) {
+			continue
+		}
+
+		if !ts.offload(files[i]) {
+			return
+		}
+		count++
+	}
+}
+
+// pruneUploaded 移除本地已删除文件的上传记录
+func (ts *tieredStorageService) pruneUploaded(minFileFromOffset int64) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	for fileFromOffset := range ts.uploaded {
+		if fileFromOffset < minFileFromOffset {
+			delete(ts.uploaded, fileFromOffset)
+		}
+	}
+}
+
+func (ts *tieredStorageService) isUploaded(fileFromOffset int64) bool {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	return ts.uploaded[fileFromOffset]
+}
+
+// offload 上传单个文件，作为删除commitlog文件前的回调，返回false时不删除
+func (ts *tieredStorageService) offload(mf *mappedFile) bool {
+	if ts.isUploaded(mf.fileFromOffset) {
+		return true
+	}
+
+	if !mf.isFull() {
+		logger.Warnf("commit log %s is not sealed, skip offload.", mf.fileName)
+		return false
+	}
+
+	if !mf.hold() {
+		return false
+	}
+	defer mf.release()
+
+	name := filepath.Base(mf.fileName)
+	exists, err := ts.cold.Exists(name)
+	if err != nil {
+		logger.Errorf("check cold storage file %s err: %s.", name, err)
+		return false
+	}
+
+	if !exists {
+		data := mf.byteBuffer.mmapBuf[:mf.fileSize]
+		if err := ts.cold.Put(name, bytes.NewReader(data), int64(len(data))); err != nil {
+			logger.Errorf("offload commit log %s err: %s.", name, err)
+			return false
+		}
+		logger.Infof("offload commit log %s to cold storage success.", name)
+	}
+
+	ts.mutex.Lock()
+	ts.uploaded[mf.fileFromOffset] = true
+	ts.mutex.Unlock()
+	return true
+}
+
+// minOffset 冷存储中最早文件的起始offset，查询失败时返回已找到的连续文件中最早的offset
+func (ts *tieredStorageService) minOffset(localMinOffset int64) int64 {
+	minOffset, _ := ts.lookupMinOffset(localMinOffset)
+	return minOffset
+}
+
+// lookupMinOffset 从本地最小offset向前查找冷存储中连续存在的文件，查询失败时返回false。
+// 结果缓存coldMinOffsetRefresh，过期后缓存的文件仍存在时从缓存的位置继续查找
+func (ts *tieredStorageService) lookupMinOffset(localMinOffset int64) (int64, bool) {
+	ts.mutex.Lock()
+	cached, checkTime := ts.coldMin, ts.coldMinTime
+	ts.mutex.Unlock()
+
+	now := system.CurrentTimeMillis()
+	minOffset, from := localMinOffset, localMinOffset-localMinOffset%ts.fileSize
+	if checkTime > 0 && cached < localMinOffset {
+		if now-checkTime < coldMinOffsetRefresh {
+			return cached, true
+		}
+
+		if exists, err := ts.cold.Exists(offset2FileName(cached)); err == nil && exists {
+			minOffset, from = cached, cached
+		}
+	}
+
+	for offset := from - ts.fileSize; offset >= 0; offset -= ts.fileSize {
+		name := offset2FileName(offset)
+		exists, err := ts.cold.Exists(name)
+		if err != nil {
+			logger.Errorf("check cold storage file %s err: %s.", name, err)
+			return minOffset, false
+		}
+		if !exists {
+			break
+		}
+		minOffset = offset
+	}
+
+	ts.mutex.Lock()
+	ts.coldMin, ts.coldMinTime = minOffset, now
+	ts.mutex.Unlock()
+	return minOffset, true
+}
+
+// getMessage 从冷存储读取消息，读取失败返回nil
+func (ts *tieredStorageService) getMessage(offset int64, size int32) *mappedBufferResult {
+	pos := offset % ts.fileSize
+	if offset < 0 || size <= 0 || pos+int64(size) > ts.fileSize {
+		return nil
+	}
+
+	name := offset2FileName(offset - pos)
+	data, err := ts.read(name, pos, size)
+	if err != nil {
+		logger.Warnf("read cold storage file %s pos %d size %d err: %s.", name, pos, size, err)
+		return nil
+	}
+
+	byteBuffer := newMappedByteBuffer(data)
+	byteBuffer.writePos = int(size)
+	return newMappedBufferResult(offset, byteBuffer, size, nil)
+}
+
+func (ts *tieredStorageService) read(name string, pos int64, size int32) ([]byte, error) {
+	blockOffset := pos - pos%coldReadBlockSize
+	end := pos + int64(size)
+	if end > blockOffset+coldReadBlockSize {
+		// 跨块的消息直接读取
+		data := make([]byte, size)
+		if _, err := ts.readFull(name, data, pos); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+
+	ts.blockMutex.Lock()
+	block := ts.block
+	ts.blockMutex.Unlock()
+
+	if block == nil || block.name != name || block.offset != blockOffset {
+		blockSize := ts.fileSize - blockOffset
+		if blockSize > coldReadBlockSize {
+			blockSize = coldReadBlockSize
+		}
+
+		data := make([]byte, blockSize)
+		n, err := ts.readFull(name, data, blockOffset)
+		if err != nil && int64(n) < end-blockOffset {
+			return nil, err
+		}
+
+		block = &coldBlock{name: name, offset: blockOffset, data: data[:n]}
+		ts.blockMutex.Lock()
+		ts.block = block
+		ts.blockMutex.Unlock()
+	}
+
+	if int64(len(block.data)) < end-blockOffset {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	return block.data[pos-blockOffset : end-blockOffset], nil
+}
+
+func (ts *tieredStorageService) readFull(name string, p []byte, off int64) (int, error) {
+	n, err := ts.cold.ReadAt(name, p, off)
+	if err == io.EOF && n == len(p) {
+		err = nil
+	}
+
+	return n, err
+}
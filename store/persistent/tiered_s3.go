@@ -0,0 +1,391 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package persistent
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltmq/common/logger"
+)
+
+const (
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3EmptyPayload    = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	s3RequestTimeout  = 60 * time.Second // 单个请求的超时时间，大文件分段上传
+	s3PartSize        = 8 * 1024 * 1024  // 分段上传每段的大小
+)
+
+// s3ColdStorage S3兼容的对象存储，使用path-style地址及AWS Signature V4签名
+type s3ColdStorage struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	prefix    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func NewS3ColdStorage(endpoint, region, bucket, prefix, accessKey, secretKey string) (ColdStorage, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("s3 endpoint %s is invalid", endpoint)
+	}
+
+	if bucket == "" {
+		return nil, fmt.Errorf("s3 bucket is empty")
+	}
+
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	return &s3ColdStorage{
+		endpoint:  u,
+		region:    region,
+		bucket:    bucket,
+		prefix:    strings.Trim(prefix, "/"),
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: s3RequestTimeout},
+	}, nil
+}
+
+func (s3 *s3ColdStorage) objectURL(name string) *url.URL {
+	key := name
+	if s3.prefix != "" {
+		key = s3.prefix + "/" + name
+	}
+
+	u := *s3.endpoint
+	u.Path = strings.TrimRight(u.Path, "/") + "/" + s3.bucket + "/" + key
+	return &u
+}
+
+// s3InitiateMultipartUploadResult 创建分段上传的响应
+type s3InitiateMultipartUploadResult struct {
+	UploadId string `xml:"UploadId"`
+}
+
+// s3CompleteMultipartUpload 完成分段上传的请求
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name           `xml:"CompleteMultipartUpload"`
+	Parts   []*s3CompletedPart `xml:"Part"`
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// Put 上传文件，超过s3PartSize时分段上传，每段在请求超时时间内完成
+func (s3 *s3ColdStorage) Put(name string, data io.Reader, size int64) error {
+	if size > s3PartSize {
+		return s3.putMultipart(name, data, size)
+	}
+
+	req, err := http.NewRequest(http.MethodPut, s3.objectURL(name).String(), data)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+
+	resp, err := s3.do(req, s3UnsignedPayload)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return s3ResponseError(resp, http.StatusOK)
+}
+
+// putMultipart 分段上传，失败时取消上传，释放已上传的分段
+func (s3 *s3ColdStorage) putMultipart(name string, data io.Reader, size int64) error {
+	uploadId, err := s3.createMultipartUpload(name)
+	if err != nil {
+		return err
+	}
+
+	complete := &s3CompleteMultipartUpload{}
+	for number, offset := 1, int64(0); offset < size; number++ {
+		partSize := size - offset
+		if partSize > s3PartSize {
+			partSize = s3PartSize
+		}
+
+		etag, err := s3.uploadPart(name, uploadId, number, io.LimitReader(data, partSize), partSize)
+		if err != nil {
+			s3.abortMultipartUpload(name, uploadId)
+			return err
+		}
+		complete.Parts = append(complete.Parts, &s3CompletedPart{PartNumber: number, ETag: etag})
+		offset += partSize
+	}
+
+	if err := s3.completeMultipartUpload(name, uploadId, complete); err != nil {
+		s3.abortMultipartUpload(name, uploadId)
+		return err
+	}
+
+	return nil
+}
+
+func (s3 *s3ColdStorage) createMultipartUpload(name string) (string, error) {
+	u := s3.objectURL(name)
+	u.RawQuery = "uploads="
+	req, err := http.NewRequest(http.MethodPost, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := s3.do(req, s3EmptyPayload)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if err := s3ResponseError(resp, http.StatusOK); err != nil {
+		return "", err
+	}
+
+	result := &s3InitiateMultipartUploadResult{}
+	if err := xml.NewDecoder(resp.Body).Decode(result); err != nil {
+		return "", err
+	}
+	if result.UploadId == "" {
+		return "", fmt.Errorf("s3 create multipart upload %s without upload id", name)
+	}
+
+	return result.UploadId, nil
+}
+
+func (s3 *s3ColdStorage) uploadPart(name, uploadId string, number int, data io.Reader, size int64) (string, error) {
+	u := s3.objectURL(name)
+	u.RawQuery = url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadId}}.Encode()
+	req, err := http.NewRequest(http.MethodPut, u.String(), data)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = size
+
+	resp, err := s3.do(req, s3UnsignedPayload)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if err := s3ResponseError(resp, http.StatusOK); err != nil {
+		return "", err
+	}
+
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		return "", fmt.Errorf("s3 upload part %d of %s without etag", number, name)
+	}
+
+	return etag, nil
+}
+
+func (s3 *s3ColdStorage) completeMultipartUpload(name, uploadId string, complete *s3CompleteMultipartUpload) error {
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+
+	u := s3.objectURL(name)
+	u.RawQuery = url.Values{"uploadId": {uploadId}}.Encode()
+	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	resp, err := s3.do(req, s3Hash(string(body)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := s3ResponseError(resp, http.StatusOK); err != nil {
+		return err
+	}
+
+	// 完成分段上传失败时仍可能返回200，错误信息在响应体中
+	result, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(result, []byte("<Error>")) {
+		return fmt.Errorf("s3 complete multipart upload %s: %s", name, strings.TrimSpace(string(result)))
+	}
+
+	return nil
+}
+
+func (s3 *s3ColdStorage) abortMultipartUpload(name, uploadId string) {
+	u := s3.objectURL(name)
+	u.RawQuery = url.Values{"uploadId": {uploadId}}.Encode()
+	req, err := http.NewRequest(http.MethodDelete, u.String(), nil)
+	if err != nil {
+		return
+	}
+
+	resp, err := s3.do(req, s3EmptyPayload)
+	if err != nil {
+		logger.Warnf("s3 abort multipart upload %s err: %s.", name, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if err := s3ResponseError(resp, http.StatusNoContent); err != nil {
+		logger.Warnf("s3 abort multipart upload %s err: %s.", name, err)
+	}
+}
+
+func (s3 *s3ColdStorage) ReadAt(name string, p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, s3.objectURL(name).String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
+
+	resp, err := s3.do(req, s3EmptyPayload)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if err := s3ResponseError(resp, http.StatusPartialContent); err != nil {
+		return 0, err
+	}
+
+	n, err := io.ReadFull(resp.Body, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+func (s3 *s3ColdStorage) Exists(name string) (bool, error) {
+	req, err := http.NewRequest(http.MethodHead, s3.objectURL(name).String(), nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := s3.do(req, s3EmptyPayload)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+
+	if err := s3ResponseError(resp, http.StatusOK); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (s3 *s3ColdStorage) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	s3Sign(req, s3.accessKey, s3.secretKey, s3.region, payloadHash, time.Now())
+	return s3.client.Do(req)
+}
+
+func s3ResponseError(resp *http.Response, expect int) error {
+	if resp.StatusCode == expect {
+		return nil
+	}
+
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("s3 %s %s status %d: %s", resp.Request.Method, resp.Request.URL.Path,
+		resp.StatusCode, strings.TrimSpace(string(body)))
+}
+
+// s3Sign 按AWS Signature V4签名，签名头包括host、range及x-amz-*
+func s3Sign(req *http.Request, accessKey, secretKey, region, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for key, values := range req.Header {
+		key = strings.ToLower(key)
+		if key == "range" || strings.HasPrefix(key, "x-amz-") {
+			headers[key] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery,
+		canonicalHeaders.String(), signedHeaders, payloadHash}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, s3Hash(canonicalRequest)}, "\n")
+
+	key := s3HMAC([]byte("AWS4"+secretKey), date)
+	key = s3HMAC(key, region)
+	key = s3HMAC(key, "s3")
+	key = s3HMAC(key, "aws4_request")
+	signature := hex.EncodeToString(s3HMAC(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func s3Hash(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
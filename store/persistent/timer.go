@@ -0,0 +1,413 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package persistent
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/boltmq/boltmq/store"
+	"github.com/boltmq/common/logger"
+	"github.com/boltmq/common/utils/system"
+)
+
+const (
+	TIMER_TOPIC    = "TIMER_TOPIC_XXX"
+	TIMER_QUEUE_ID = int32(0)
+	// PROPERTY_TIMER_DELIVER_MS 消息的绝对投递时间，毫秒时间戳
+	PROPERTY_TIMER_DELIVER_MS = "TIMER_DELIVER_MS"
+)
+
+const (
+	timerEntryPending = iota // 未到加载窗口，只记录在TIMER_TOPIC逻辑队列中
+	timerEntryLoaded         // 已加载到时间轮
+	timerEntryDone           // 已投递
+)
+
+// timerEntry 时间轮中的一条定时消息
+type timerEntry struct {
+	cqOffset  int64 // 在TIMER_TOPIC逻辑队列中的offset
+	phyOffset int64
+	size      int32
+	deliverMs int64
+}
+
+// timerMessageService 任意时间定时消息服务
+// 定时消息先写入TIMER_TOPIC逻辑队列，服务只将一圈时间轮内到期的消息加载到内存，到期后投递到真实topic，
+// 更晚到期的消息在加载窗口推进时从逻辑队列重新读取。
+// 已投递的连续进度记录在storeCheckpoint中，重启后从该进度重建时间轮，投递语义为至少一次。
+// 未投递消息所在的commitlog文件不会被清理任务删除，磁盘空间不足强制清理时除外，见minPendingPhyOffset。
+type timerMessageService struct {
+	messageStore *PersistentMessageStore
+	precisionMs  int64           // 时间轮刻度，毫秒
+	slots        [][]*timerEntry // 时间轮
+	retryEntries []*timerEntry   // 投递失败待重试的消息
+	currentTick  int64           // 已处理到的刻度
+	loadedOffset int64           // 下一条需要加载到时间轮的逻辑offset
+	commitOffset int64           // 小于该offset的消息均已投递
+	doneWindow   []int8          // [commitOffset, loadedOffset)区间内消息的状态
+	windowEnd    int64           // 投递时间早于该时间的消息已加载到时间轮
+	mutex        sync.Mutex
+	ticker       *system.Ticker
+	started      bool
+}
+
+func newTimerMessageService(messageStore *PersistentMessageStore) *timerMessageService {
+	precisionMs := messageStore.config.TimerPrecisionMs
+	if precisionMs <= 0 {
+		precisionMs = 1000
+	}
+
+	slotNums := messageStore.config.TimerWheelSlots
+	if slotNums <= 0 {
+		slotNums = 3600
+	}
+
+	return &timerMessageService{
+		messageStore: messageStore,
+		precisionMs:  precisionMs,
+		slots:        make([][]*timerEntry, slotNums),
+	}
+}
+
+// parseDeliverMs 解析消息的绝对投递时间，没有设置时返回false
+func parseDeliverMs(msg *store.MessageExtInner) (int64, bool) {
+	value := msg.GetProperty(PROPERTY_TIMER_DELIVER_MS)
+	if len(value) == 0 {
+		return 0, false
+	}
+
+	deliverMs, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return deliverMs, true
+}
+
+func (tms *timerMessageService) start() {
+	cq := tms.messageStore.findConsumeQueue(TIMER_TOPIC, TIMER_QUEUE_ID)
+	offset := tms.messageStore.steCheckpoint.timerMsgOffset
+	if minOffset := cq.getMinOffsetInQueue(); offset < minOffset {
+		offset = minOffset
+	}
+
+	tms.mutex.Lock()
+	tms.loadedOffset = offset
+	tms.commitOffset = offset
+	tms.currentTick = system.CurrentTimeMillis()/tms.precisionMs - 1
+	tms.doneWindow = nil
+	tms.windowEnd = 0
+	tms.started = true
+	tms.mutex.Unlock()
+
+	logger.Infof("timer message service start from offset %d.", offset)
+	tms.ticker = system.NewTicker(true, 0, time.Duration(tms.precisionMs)*time.Millisecond, func() {
+		tms.run()
+	})
+	tms.ticker.Start()
+}
+
+func (tms *timerMessageService) shutdown() {
+	tms.mutex.Lock()
+	tms.started = false
+	tms.mutex.Unlock()
+
+	if tms.ticker != nil {
+		tms.ticker.Stop()
+	}
+	logger.Info("shutdown timer message service.")
+}
+
+func (tms *timerMessageService) run() {
+	defer func() {
+		if e := recover(); e != nil {
+			logger.Errorf("timer message service panic: %v.", e)
+		}
+	}()
+
+	now := system.CurrentTimeMillis()
+	tms.loadEntries(now)
+
+	for _, entry := range tms.pollExpired(now) {
+		if !tms.deliver(entry) {
+			entry.deliverMs = now + DELAY_FOR_A_PERIOD
+			tms.mutex.Lock()
+			tms.retryEntries = append(tms.retryEntries, entry)
+			tms.mutex.Unlock()
+			continue
+		}
+
+		tms.markDelivered(entry.cqOffset)
+	}
+
+	tms.mutex.Lock()
+	tms.messageStore.steCheckpoint.timerMsgOffset = tms.commitOffset
+	tms.mutex.Unlock()
+}
+
+// loadEntries 推进加载窗口，并将TIMER_TOPIC逻辑队列中新写入的消息加载到时间轮。
+// 投递时间超出窗口的消息只记录状态，窗口推进到半圈时重新扫描未加载的消息
+func (tms *timerMessageService) loadEntries(now int64) {
+	horizon := int64(len(tms.slots)) * tms.precisionMs
+	tms.mutex.Lock()
+	windowEnd := tms.windowEnd
+	tms.mutex.Unlock()
+
+	if now+horizon/2 >= windowEnd {
+		tms.advanceWindow(now + horizon)
+	}
+
+	cq := tms.messageStore.findConsumeQueue(TIMER_TOPIC, TIMER_QUEUE_ID)
+	maxOffset := cq.getMaxOffsetInQueue()
+
+	for {
+		tms.mutex.Lock()
+		offset := tms.loadedOffset
+		tms.mutex.Unlock()
+
+		if offset >= maxOffset {
+			return
+		}
+
+		bufferCQ := cq.getIndexBuffer(offset)
+		if bufferCQ == nil {
+			// 逻辑队列文件已被删除，跳过已不存在的消息
+			if minOffset := cq.getMinOffsetInQueue(); offset < minOffset {
+				logger.Warnf("timer message offset %d less than min offset %d, skip it.", offset, minOffset)
+				tms.skipTo(minOffset)
+				continue
+			}
+			return
+		}
+
+		var entries []*timerEntry
+		for i := 0; i < int(bufferCQ.size) && offset < maxOffset; i += CQStoreUnitSize {
+			entries = append(entries, &timerEntry{
+				cqOffset:  offset,
+				phyOffset: bufferCQ.byteBuffer.ReadInt64(),
+				size:      bufferCQ.byteBuffer.ReadInt32(),
+				deliverMs: bufferCQ.byteBuffer.ReadInt64(),
+			})
+			offset++
+		}
+		bufferCQ.Release()
+
+		if len(entries) == 0 {
+			return
+		}
+
+		tms.mutex.Lock()
+		if tms.loadedOffset == entries[0].cqOffset {
+			for _, entry := range entries {
+				if entry.deliverMs < tms.windowEnd {
+					tms.addEntry(entry)
+					tms.doneWindow = append(tms.doneWindow, timerEntryLoaded)
+				} else {
+					tms.doneWindow = append(tms.doneWindow, timerEntryPending)
+				}
+			}
+			tms.loadedOffset = offset
+		}
+		tms.mutex.Unlock()
+	}
+}
+
+// advanceWindow 将加载窗口推进到windowEnd，从逻辑队列重新读取窗口内到期的未加载消息
+func (tms *timerMessageService) advanceWindow(windowEnd int64) {
+	tms.mutex.Lock()
+	from, to := tms.commitOffset, tms.loadedOffset
+	tms.mutex.Unlock()
+
+	var entries []*timerEntry
+	if from < to {
+		cq := tms.messageStore.findConsumeQueue(TIMER_TOPIC, TIMER_QUEUE_ID)
+		cq.forEachEntry(from, to, func(index, phyOffset int64, size int32, deliverMs int64) bool {
+			if deliverMs < windowEnd {
+				entries = append(entries, &timerEntry{cqOffset: index, phyOffset: phyOffset, size: size, deliverMs: deliverMs})
+			}
+			return true
+		})
+	}
+
+	tms.mutex.Lock()
+	defer tms.mutex.Unlock()
+
+	for _, entry := range entries {
+		idx := entry.cqOffset - tms.commitOffset
+		if idx < 0 || idx >= int64(len(tms.doneWindow)) || tms.doneWindow[idx] != timerEntryPending {
+			continue
+		}
+
+		tms.addEntry(entry)
+		tms.doneWindow[idx] = timerEntryLoaded
+	}
+	tms.windowEnd = windowEnd
+}
+
+// addEntry 将消息放入到期刻度对应的槽位，调用方需持有锁
+func (tms *timerMessageService) addEntry(entry *timerEntry) {
+	tick := entry.deliverMs / tms.precisionMs
+	if tick <= tms.currentTick {
+		tms.retryEntries = append(tms.retryEntries, entry)
+		return
+	}
+
+	idx := tick % int64(len(tms.slots))
+	tms.slots[idx] = append(tms.slots[idx], entry)
+}
+
+// pollExpired 推进时间轮，取出所有已到期的消息
+func (tms *timerMessageService) pollExpired(now int64) []*timerEntry {
+	tms.mutex.Lock()
+	defer tms.mutex.Unlock()
+
+	var expired []*timerEntry
+	if len(tms.retryEntries) > 0 {
+		var remain []*timerEntry
+		for _, entry := range tms.retryEntries {
+			if entry.deliverMs <= now {
+				expired = append(expired, entry)
+			} else {
+				remain = append(remain, entry)
+			}
+		}
+		tms.retryEntries = remain
+	}
+
+	nowTick := now / tms.precisionMs
+	fromTick := tms.currentTick + 1
+	if nowTick-fromTick >= int64(len(tms.slots)) {
+		// 落后超过一圈，扫描全部槽位即可
+		fromTick = nowTick - int64(len(tms.slots)) + 1
+	}
+
+	for tick := fromTick; tick <= nowTick; tick++ {
+		idx := tick % int64(len(tms.slots))
+		slot := tms.slots[idx]
+		if len(slot) == 0 {
+			continue
+		}
+
+		var remain []*timerEntry
+		for _, entry := range slot {
+			if entry.deliverMs/tms.precisionMs <= nowTick {
+				expired = append(expired, entry)
+			} else {
+				remain = append(remain, entry)
+			}
+		}
+		tms.slots[idx] = remain
+	}
+
+	if nowTick > tms.currentTick {
+		tms.currentTick = nowTick
+	}
+
+	return expired
+}
+
+// deliver 投递到期消息到真实topic。消息暂时读取不到时返回false稍后重试，
+// 只有消息所在的commitlog已被删除时才放弃投递
+func (tms *timerMessageService) deliver(entry *timerEntry) bool {
+	msgExt := tms.messageStore.lookMessageByOffset(entry.phyOffset, entry.size)
+	if msgExt == nil {
+		if tms.messageStore.tiered == nil && entry.phyOffset < tms.messageStore.clog.getMinOffset() {
+			logger.Errorf("timer message commitlog deleted, offset: %d size: %d, drop it.", entry.phyOffset, entry.size)
+			return true
+		}
+
+		logger.Warnf("timer message not found, offset: %d size: %d, retry later.", entry.phyOffset, entry.size)
+		return false
+	}
+
+	msgInner := timeupMessage(msgExt, PROPERTY_TIMER_DELIVER_MS)
+	result := tms.messageStore.PutMessage(msgInner)
+	if result == nil || result.Status != store.PUTMESSAGE_PUT_OK {
+		logger.Errorf("timer message time up, but reput it failed, topic: %s msgId: %s.", msgExt.Topic, msgExt.MsgId)
+		return false
+	}
+
+	return true
+}
+
+// markDelivered 标记消息已投递，并推进连续的投递进度
+func (tms *timerMessageService) markDelivered(cqOffset int64) {
+	tms.mutex.Lock()
+	defer tms.mutex.Unlock()
+
+	idx := cqOffset - tms.commitOffset
+	if idx < 0 || idx >= int64(len(tms.doneWindow)) {
+		return
+	}
+
+	tms.doneWindow[idx] = timerEntryDone
+	n := 0
+	for n < len(tms.doneWindow) && tms.doneWindow[n] == timerEntryDone {
+		n++
+	}
+	tms.doneWindow = tms.doneWindow[n:]
+	tms.commitOffset += int64(n)
+}
+
+// skipTo 跳过offset之前已被删除的消息
+func (tms *timerMessageService) skipTo(offset int64) {
+	tms.mutex.Lock()
+	defer tms.mutex.Unlock()
+
+	if offset <= tms.loadedOffset {
+		return
+	}
+
+	// 区间内未投递的消息已随逻辑队列删除，到期时查找不到会被忽略
+	tms.doneWindow = nil
+	tms.loadedOffset = offset
+	tms.commitOffset = offset
+}
+
+// minPendingPhyOffset 最早的未投递消息的物理offset，没有未投递的消息时返回-1。
+// 逻辑队列按写入顺序编址，commitOffset处的消息即物理offset最小的未投递消息
+func (tms *timerMessageService) minPendingPhyOffset() int64 {
+	tms.mutex.Lock()
+	started, commitOffset := tms.started, tms.commitOffset
+	tms.mutex.Unlock()
+
+	cq := tms.messageStore.findConsumeQueue(TIMER_TOPIC, TIMER_QUEUE_ID)
+	if !started {
+		// 服务未启动时(如slave)从checkpoint记录的进度开始保护
+		commitOffset = tms.messageStore.steCheckpoint.timerMsgOffset
+	}
+	if minOffset := cq.getMinOffsetInQueue(); commitOffset < minOffset {
+		commitOffset = minOffset
+	}
+
+	phyOffset := int64(-1)
+	cq.forEachEntry(commitOffset, cq.getMaxOffsetInQueue(), func(index, offset int64, size int32, deliverMs int64) bool {
+		phyOffset = offset
+		return false
+	})
+
+	return phyOffset
+}
+
+func (tms *timerMessageService) buildRunningStats(stats map[string]string) {
+	tms.mutex.Lock()
+	commitOffset := tms.commitOffset
+	tms.mutex.Unlock()
+
+	maxOffset := tms.messageStore.MaxOffsetInQueue(TIMER_TOPIC, TIMER_QUEUE_ID)
+	stats[TIMER_MESSAGE_OFFSET.String()] = fmt.Sprintf("%d,%d", commitOffset, maxOffset)
+}
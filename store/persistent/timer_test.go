@@ -0,0 +1,56 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package persistent
+
+import (
+	"testing"
+)
+
+func TestTimerWheelPollExpired(t *testing.T) {
+	ms := &PersistentMessageStore{config: newConfig("./test")}
+	ms.config.TimerWheelSlots = 10
+	tms := newTimerMessageService(ms)
+	tms.currentTick = 0
+
+	// 超过一圈的消息与较早到期的消息落在同一槽位
+	tms.addEntry(&timerEntry{cqOffset: 0, deliverMs: 3000})
+	tms.addEntry(&timerEntry{cqOffset: 1, deliverMs: 13000})
+	tms.addEntry(&timerEntry{cqOffset: 2, deliverMs: 5000})
+	tms.doneWindow = make([]int8, 3)
+
+	expired := tms.pollExpired(3500)
+	if len(expired) != 1 || expired[0].cqOffset != 0 {
+		t.Errorf("expired=%v", expired)
+		return
+	}
+
+	expired = tms.pollExpired(13000)
+	if len(expired) != 2 {
+		t.Errorf("expired=%v", expired)
+		return
+	}
+
+	tms.markDelivered(2)
+	if tms.commitOffset != 0 {
+		t.Errorf("commitOffset=%d", tms.commitOffset)
+		return
+	}
+
+	tms.markDelivered(0)
+	tms.markDelivered(1)
+	if tms.commitOffset != 3 || len(tms.doneWindow) != 0 {
+		t.Errorf("commitOffset=%d doneWindow=%v", tms.commitOffset, tms.doneWindow)
+		return
+	}
+}
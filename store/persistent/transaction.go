@@ -13,16 +13,515 @@
 // limitations under the License.
 package persistent
 
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/boltmq/boltmq/store"
+	"github.com/boltmq/common/logger"
+	"github.com/boltmq/common/message"
+	"github.com/boltmq/common/sysflag"
+	"github.com/boltmq/common/utils/codec"
+	"github.com/boltmq/common/utils/system"
+)
+
+const (
+	TRANSACTION_REDOLOG_TOPIC         = "TRANSACTION_REDOLOG_TOPIC_XXXX"
+	TRANSACTION_REDOLOG_TOPIC_QUEUEID = int32(0)
+	PREPARED_MESSAGE_TAGS_CODE        = int64(-1) // redo log中prepared消息的tagsCode
+	TSStoreUnitSize                   = 24        // 事务状态表存储单元大小
+)
+
+// transactionService 分布式事务服务
+// 事务状态表存储单元：commitlog offset(8) + size(4) + 存储时间秒(4) + producer group hash(4) + 事务状态(4)
+// redo log复用逻辑队列格式，prepared消息的tagsCode为-1，commit/rollback消息的tagsCode为prepared消息的commitlog offset
 type transactionService struct {
-	// TODO
+	messageStore         *PersistentMessageStore
+	tranStateTable       *mappedFileQueue  // 事务状态表
+	tranRedoLog          *consumeQueue     // 事务redo log
+	tranStateTableOffset int64             // 下一条prepared消息在事务状态表中的offset
+	byteBufferAppend     *mappedByteBuffer // 写状态表存储单元的缓冲
+	checkExecuter        store.TransactionCheckExecuter
+	checkTimes           map[int64]int32 // 事务状态表offset对应的回查次数
+	checkTicker          *system.Ticker
+	mutex                sync.Mutex
 }
 
 func newTransactionService(messageStore *PersistentMessageStore) *transactionService {
 	ts := new(transactionService)
+	ts.messageStore = messageStore
+	ts.tranStateTable = newMappedFileQueue(messageStore.config.TranStateTableStorePath,
+		int64(messageStore.config.TranStateTableMappedFileSize), nil)
+	ts.tranRedoLog = newConsumeQueue(TRANSACTION_REDOLOG_TOPIC, TRANSACTION_REDOLOG_TOPIC_QUEUEID,
+		messageStore.config.TranRedoLogStorePath, int64(messageStore.config.TranRedoLogMappedFileSize), messageStore)
+	ts.byteBufferAppend = newMappedByteBuffer(make([]byte, TSStoreUnitSize))
+	ts.checkTimes = make(map[int64]int32)
 
 	return ts
 }
 
+func (ts *transactionService) load() bool {
+	result := ts.tranStateTable.load()
+	result = result && ts.tranRedoLog.load()
+	return result
+}
+
+// start 启动事务回查，slave不回查，切换为master时由ChangeRole启动
 func (ts *transactionService) start() {
-	// TODO
+	config := ts.messageStore.config
+	if !config.CheckTransactionMessageEnable || ts.checkExecuter == nil || SLAVE == config.BrokerRole {
+		logger.Info("transaction service started, check transaction message disabled.")
+		return
+	}
+
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	if ts.checkTicker != nil {
+		return
+	}
+
+	interval := time.Duration(config.CheckTransactionMessageTimerInterval) * time.Millisecond
+	ts.checkTicker = system.NewTicker(true, interval, interval, func() {
+		ts.checkTransactionState()
+	})
+	ts.checkTicker.Start()
+	logger.Info("transaction service started.")
+}
+
+// shutdown 停止事务回查，切换为slave时也会调用
+func (ts *transactionService) shutdown() {
+	ts.mutex.Lock()
+	checkTicker := ts.checkTicker
+	ts.checkTicker = nil
+	ts.mutex.Unlock()
+
+	if checkTicker != nil {
+		checkTicker.Stop()
+	}
+	logger.Info("shutdown transaction service.")
+}
+
+// checkTransactionState 扫描事务状态表，回查超过CheckTransactionMessageAtleastInterval仍未提交的prepared消息
+func (ts *transactionService) checkTransactionState() {
+	defer func() {
+		if e := recover(); e != nil {
+			logger.Errorf("check transaction state panic: %v.", e)
+		}
+	}()
+
+	var (
+		now             = system.CurrentTimeMillis()
+		atleastInterval = ts.messageStore.config.CheckTransactionMessageAtleastInterval
+		minPhyOffset    = ts.messageStore.clog.getMinOffset()
+	)
+
+	for _, mf := range ts.tranStateTable.copyMappedFiles(0) {
+		if mf == nil {
+			continue
+		}
+
+		result := mf.selectMappedBuffer(0)
+		if result == nil {
+			continue
+		}
+
+		for i := 0; i+TSStoreUnitSize <= int(result.size); i += TSStoreUnitSize {
+			clOffset := result.byteBuffer.ReadInt64()
+			size := result.byteBuffer.ReadInt32()
+			timestamp := result.byteBuffer.ReadInt32()
+			groupHashCode := result.byteBuffer.ReadInt32()
+			state := result.byteBuffer.ReadInt32()
+
+			if int32(sysflag.TransactionPreparedType) != state || now-int64(timestamp)*1000 < atleastInterval {
+				continue
+			}
+
+			tsOffset := (result.startOffset + int64(i)) / TSStoreUnitSize
+			if clOffset < minPhyOffset {
+				logger.Warnf("check transaction state, but prepared message deleted, tsOffset: %d clOffset: %d, rollback it.",
+					tsOffset, clOffset)
+				ts.updateTransactionState(tsOffset, clOffset, groupHashCode, int32(sysflag.TransactionRollbackType))
+				continue
+			}
+
+			times := ts.increaseCheckTimes(tsOffset)
+			if times > ts.messageStore.config.CheckTransactionMessageMaxTimes {
+				logger.Warnf("check transaction state %d times, give up and rollback it, tsOffset: %d clOffset: %d.",
+					times-1, tsOffset, clOffset)
+				ts.rollbackTransaction(tsOffset, clOffset, size, groupHashCode)
+				continue
+			}
+
+			logger.Infof("check transaction state, tsOffset: %d clOffset: %d times: %d.", tsOffset, clOffset, times)
+			ts.checkExecuter.GotoCheck(int(groupHashCode), tsOffset, clOffset, int(size))
+		}
+		result.Release()
+	}
+}
+
+// rollbackTransaction 放弃回查时回滚prepared消息。与客户端回滚相同，写入一条rollback消息，
+// 由分发服务更新事务状态表并记录redo log，异常退出后根据redo log重建状态表时不会恢复为prepared
+func (ts *transactionService) rollbackTransaction(tsOffset, clOffset int64, size, groupHashCode int32) {
+	msgExt := ts.messageStore.lookMessageByOffset(clOffset, size)
+	if msgExt == nil {
+		logger.Warnf("rollback transaction, but prepared message not found, tsOffset: %d clOffset: %d.", tsOffset, clOffset)
+		ts.updateTransactionState(tsOffset, clOffset, groupHashCode, int32(sysflag.TransactionRollbackType))
+		return
+	}
+
+	msgInner := &store.MessageExtInner{}
+	msgInner.Topic = msgExt.Topic
+	msgInner.QueueId = msgExt.QueueId
+	msgInner.Flag = msgExt.Flag
+	msgInner.Properties = msgExt.Properties
+	msgInner.SysFlag = int32(sysflag.ResetTransactionValue(int(msgExt.SysFlag), sysflag.TransactionRollbackType))
+	msgInner.BornTimestamp = msgExt.BornTimestamp
+	msgInner.BornHost = msgExt.BornHost
+	msgInner.StoreHost = msgExt.StoreHost
+	msgInner.StoreTimestamp = msgExt.StoreTimestamp
+	msgInner.ReconsumeTimes = msgExt.ReconsumeTimes
+	msgInner.QueueOffset = tsOffset
+	msgInner.PreparedTransactionOffset = clOffset
+	msgInner.SetWaitStoreMsgOK(false)
+	if msgInner.Properties != nil {
+		delete(msgInner.Properties, message.PROPERTY_DELAY_TIME_LEVEL)
+	}
+	msgInner.PropertiesString = message.MessageProperties2String(msgInner.Properties)
+
+	result := ts.messageStore.PutMessage(msgInner)
+	if result == nil || result.Status != store.PUTMESSAGE_PUT_OK {
+		logger.Errorf("rollback transaction put message failed, tsOffset: %d clOffset: %d, update state table only.",
+			tsOffset, clOffset)
+		ts.updateTransactionState(tsOffset, clOffset, groupHashCode, int32(sysflag.TransactionRollbackType))
+	}
+}
+
+// minPreparedPhyOffset 最早的未提交prepared消息的物理offset，没有时返回-1。
+// 状态表按写入顺序记录，第一条prepared消息即最早的消息，回查放弃后会回滚，不会一直保护
+func (ts *transactionService) minPreparedPhyOffset() int64 {
+	for _, mf := range ts.tranStateTable.copyMappedFiles(0) {
+		if mf == nil {
+			continue
+		}
+
+		result := mf.selectMappedBuffer(0)
+		if result == nil {
+			continue
+		}
+
+		for i := 0; i+TSStoreUnitSize <= int(result.size); i += TSStoreUnitSize {
+			clOffset := result.byteBuffer.ReadInt64()
+			result.byteBuffer.ReadInt32()
+			result.byteBuffer.ReadInt32()
+			result.byteBuffer.ReadInt32()
+			state := result.byteBuffer.ReadInt32()
+
+			if int32(sysflag.TransactionPreparedType) == state {
+				result.Release()
+				return clOffset
+			}
+		}
+		result.Release()
+	}
+
+	return -1
+}
+
+func (ts *transactionService) increaseCheckTimes(tsOffset int64) int32 {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	ts.checkTimes[tsOffset]++
+	return ts.checkTimes[tsOffset]
+}
+
+// appendPreparedTransaction 追加prepared消息到事务状态表，tsOffset为写入消息时分配的offset
+func (ts *transactionService) appendPreparedTransaction(tsOffset, clOffset int64, size, timestamp, groupHashCode int32) bool {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	return ts.appendStateUnit(tsOffset, clOffset, size, timestamp, groupHashCode, int32(sysflag.TransactionPreparedType))
+}
+
+// appendStateUnit 在事务状态表tsOffset处写入存储单元，调用方需持有锁
+func (ts *transactionService) appendStateUnit(tsOffset, clOffset int64, size, timestamp, groupHashCode, state int32) bool {
+	expectOffset := tsOffset * TSStoreUnitSize
+	mf, err := ts.tranStateTable.getLastMappedFile(expectOffset)
+	if err != nil {
+		logger.Errorf("transaction state table get last mapped file err: %s.", err)
+		return false
+	}
+
+	if mf == nil {
+		logger.Errorf("transaction state table create mapped file failed, offset: %d.", expectOffset)
+		return false
+	}
+
+	// 新建的文件从expectOffset所在的文件起始位置开始，之前的存储单元以已回滚填充
+	if mf.wrotePostion == 0 && expectOffset > mf.fileFromOffset {
+		for offset := mf.fileFromOffset; offset < expectOffset; offset += TSStoreUnitSize {
+			mf.appendMessage(ts.encodeStateUnit(0, 0, 0, 0, int32(sysflag.TransactionRollbackType)))
+		}
+	}
+
+	currentOffset := mf.fileFromOffset + mf.wrotePostion
+	if currentOffset != expectOffset {
+		logger.Warnf("transaction state table order maybe wrong, expectOffset: %d currentOffset: %d.",
+			expectOffset, currentOffset)
+	}
+
+	return mf.appendMessage(ts.encodeStateUnit(clOffset, size, timestamp, groupHashCode, state))
+}
+
+func (ts *transactionService) encodeStateUnit(clOffset int64, size, timestamp, groupHashCode, state int32) []byte {
+	ts.byteBufferAppend.writePos = 0
+	ts.byteBufferAppend.WriteInt64(clOffset)
+	ts.byteBufferAppend.WriteInt32(size)
+	ts.byteBufferAppend.WriteInt32(timestamp)
+	ts.byteBufferAppend.WriteInt32(groupHashCode)
+	ts.byteBufferAppend.WriteInt32(state)
+	return ts.byteBufferAppend.Bytes()
+}
+
+// updateTransactionState 更新事务状态表中prepared消息的状态
+func (ts *transactionService) updateTransactionState(tsOffset, clOffset int64, groupHashCode, state int32) bool {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	offset := tsOffset * TSStoreUnitSize
+	mf := ts.tranStateTable.findMappedFileByOffset(offset, false)
+	if mf == nil {
+		logger.Warnf("transaction state table not found, tsOffset: %d clOffset: %d.", tsOffset, clOffset)
+		return false
+	}
+
+	pos := offset % ts.tranStateTable.mappedFileSize
+	if pos+TSStoreUnitSize > mf.wrotePostion {
+		logger.Warnf("transaction state table offset invalid, tsOffset: %d clOffset: %d.", tsOffset, clOffset)
+		return false
+	}
+
+	byteBuffer := newMappedByteBuffer(mf.byteBuffer.mmapBuf[pos : pos+TSStoreUnitSize])
+	clOffsetRead := byteBuffer.ReadInt64()
+	byteBuffer.ReadInt32()
+	byteBuffer.ReadInt32()
+	groupHashCodeRead := byteBuffer.ReadInt32()
+	stateRead := byteBuffer.ReadInt32()
+
+	if clOffsetRead != clOffset {
+		logger.Warnf("update transaction state, commitlog offset not matched, read: %d request: %d.", clOffsetRead, clOffset)
+		return false
+	}
+
+	if groupHashCodeRead != groupHashCode {
+		logger.Warnf("update transaction state, producer group not matched, read: %d request: %d.",
+			groupHashCodeRead, groupHashCode)
+		return false
+	}
+
+	if int32(sysflag.TransactionPreparedType) != stateRead {
+		logger.Warnf("update transaction state, the transaction is updated before, tsOffset: %d state: %d.", tsOffset, stateRead)
+		return true
+	}
+
+	byteBuffer.writePos = TSStoreUnitSize - 4
+	byteBuffer.WriteInt32(state)
+	delete(ts.checkTimes, tsOffset)
+	return true
+}
+
+// appendRedoLog 记录事务redo log
+func (ts *transactionService) appendRedoLog(request *dispatchRequest) {
+	tagsCode := PREPARED_MESSAGE_TAGS_CODE
+	if sysflag.TransactionPreparedType != sysflag.GetTransactionValue(int(request.sysFlag)) {
+		tagsCode = request.preparedTransactionOffset
+	}
+
+	ts.tranRedoLog.putMessagePostionInfoWrapper(request.commitLogOffset, request.msgSize, tagsCode,
+		request.storeTimestamp, ts.tranRedoLog.getMaxOffsetInQueue(), nil)
+}
+
+// recoverStateTable 正常退出时从事务状态表文件恢复，异常退出时根据redo log重建事务状态表
+func (ts *transactionService) recoverStateTable(lastExitOK bool) {
+	if lastExitOK {
+		ts.recoverStateTableNormally()
+	} else {
+		ts.tranStateTable.destroy()
+		ts.recreateStateTable()
+	}
+
+	logger.Infof("recover transaction state table over, state table offset: %d.", ts.getTranStateTableOffset())
+}
+
+func (ts *transactionService) recoverStateTableNormally() {
+	mfs := ts.tranStateTable.mappedFiles
+	if mfs.Len() == 0 {
+		return
+	}
+
+	index := mfs.Len() - 3
+	if index < 0 {
+		index = 0
+	}
+
+	mf := getMappedFileByIndex(mfs, index)
+	processOffset := mf.fileFromOffset
+	mfOffset := int64(0)
+	for {
+		byteBuffer := newMappedByteBuffer(mf.byteBuffer.mmapBuf)
+		for i := int64(0); i < mf.fileSize; i += TSStoreUnitSize {
+			byteBuffer.ReadInt64()
+			byteBuffer.ReadInt32()
+			byteBuffer.ReadInt32()
+			byteBuffer.ReadInt32()
+			state := byteBuffer.ReadInt32()
+
+			// 状态为空说明后面没有数据
+			if int32(sysflag.TransactionNotType) == state {
+				break
+			}
+			mfOffset = i + TSStoreUnitSize
+		}
+
+		if mfOffset != mf.fileSize {
+			break
+		}
+
+		index++
+		if index >= mfs.Len() {
+			break
+		}
+
+		mf = getMappedFileByIndex(mfs, index)
+		processOffset = mf.fileFromOffset
+		mfOffset = 0
+	}
+
+	processOffset += mfOffset
+	ts.tranStateTable.truncateDirtyFiles(processOffset)
+	atomic.StoreInt64(&ts.tranStateTableOffset, processOffset/TSStoreUnitSize)
+}
+
+// recreateStateTable 扫描redo log找出未提交的prepared消息，按消息原有的offset重建事务状态表
+func (ts *transactionService) recreateStateTable() {
+	var (
+		preparedItems      = make(map[int64]bool)
+		lastPreparedOffset = int64(-1)
+		processOffset      = ts.tranRedoLog.getMinOffsetInQueue()
+		maxOffset          = ts.tranRedoLog.getMaxOffsetInQueue()
+	)
+
+	for processOffset < maxOffset {
+		bufferCQ := ts.tranRedoLog.getIndexBuffer(processOffset)
+		if bufferCQ == nil {
+			break
+		}
+
+		for i := 0; i < int(bufferCQ.size) && processOffset < maxOffset; i += CQStoreUnitSize {
+			clOffset := bufferCQ.byteBuffer.ReadInt64()
+			bufferCQ.byteBuffer.ReadInt32()
+			tagsCode := bufferCQ.byteBuffer.ReadInt64()
+
+			if PREPARED_MESSAGE_TAGS_CODE == tagsCode {
+				preparedItems[clOffset] = true
+				lastPreparedOffset = clOffset
+			} else {
+				delete(preparedItems, tagsCode)
+			}
+			processOffset++
+		}
+		bufferCQ.Release()
+	}
+
+	logger.Infof("scan transaction redolog over, end offset: %d, prepared transaction count: %d.",
+		processOffset, len(preparedItems))
+
+	clOffsets := make([]int64, 0, len(preparedItems))
+	for clOffset := range preparedItems {
+		clOffsets = append(clOffsets, clOffset)
+	}
+	sort.Slice(clOffsets, func(i, j int) bool { return clOffsets[i] < clOffsets[j] })
+
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	atomic.StoreInt64(&ts.tranStateTableOffset, 0)
+	for _, clOffset := range clOffsets {
+		msgExt := ts.messageStore.LookMessageByOffset(clOffset)
+		if msgExt == nil {
+			continue
+		}
+
+		ts.fillStateTable(msgExt.QueueOffset)
+		tsOffset := atomic.LoadInt64(&ts.tranStateTableOffset)
+		groupHashCode := int32(codec.HashCode(msgExt.Properties[message.PROPERTY_PRODUCER_GROUP]))
+		if ts.appendStateUnit(tsOffset, clOffset, int32(msgExt.StoreSize), int32(msgExt.StoreTimestamp/1000),
+			groupHashCode, int32(sysflag.TransactionPreparedType)) {
+			atomic.AddInt64(&ts.tranStateTableOffset, 1)
+		}
+	}
+
+	// 之后写入的prepared消息需要排在最后一条prepared消息之后
+	if lastPreparedOffset >= 0 {
+		if msgExt := ts.messageStore.LookMessageByOffset(lastPreparedOffset); msgExt != nil {
+			ts.fillStateTable(msgExt.QueueOffset + 1)
+		}
+	}
+}
+
+// fillStateTable 以已回滚的存储单元填充状态表至tsOffset，调用方需持有锁
+func (ts *transactionService) fillStateTable(tsOffset int64) {
+	current := atomic.LoadInt64(&ts.tranStateTableOffset)
+	if tsOffset <= current {
+		return
+	}
+
+	// 状态表为空时从tsOffset所在的文件开始，避免填充过多无效数据
+	if ts.tranStateTable.mappedFiles.Len() == 0 {
+		unitsInFile := ts.tranStateTable.mappedFileSize / TSStoreUnitSize
+		current = tsOffset - tsOffset%unitsInFile
+	}
+
+	for ; current < tsOffset; current++ {
+		if !ts.appendStateUnit(current, 0, 0, 0, 0, int32(sysflag.TransactionRollbackType)) {
+			break
+		}
+	}
+	atomic.StoreInt64(&ts.tranStateTableOffset, current)
+}
+
+func (ts *transactionService) getTranStateTableOffset() int64 {
+	return atomic.LoadInt64(&ts.tranStateTableOffset)
+}
+
+// nextTranStateTableOffset 为prepared消息分配事务状态表offset，在写commitlog时调用
+func (ts *transactionService) nextTranStateTableOffset() int64 {
+	return atomic.AddInt64(&ts.tranStateTableOffset, 1) - 1
+}
+
+func (ts *transactionService) commit(flushLeastPages int32) {
+	ts.mutex.Lock()
+	ts.tranStateTable.commit(flushLeastPages)
+	ts.mutex.Unlock()
+
+	ts.tranRedoLog.commit(flushLeastPages)
+}
+
+func (ts *transactionService) deleteExpiredFile(offset int64) {
+	ts.mutex.Lock()
+	ts.tranStateTable.deleteExpiredFileByOffset(offset, TSStoreUnitSize)
+	ts.mutex.Unlock()
+
+	ts.tranRedoLog.deleteExpiredFile(offset)
+}
+
+func (ts *transactionService) destroy() {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	ts.tranStateTable.destroy()
+	ts.tranRedoLog.destroy()
+	atomic.StoreInt64(&ts.tranStateTableOffset, 0)
 }
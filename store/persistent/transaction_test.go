@@ -0,0 +1,95 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package persistent
+
+import (
+	"os"
+	"testing"
+
+	"github.com/boltmq/common/sysflag"
+)
+
+func TestTranStateTableRecover(t *testing.T) {
+	ms := &PersistentMessageStore{config: newConfig("./test")}
+	ms.config.TranStateTableMappedFileSize = 4 * TSStoreUnitSize
+	wts := newTransactionService(ms)
+
+	for i := int64(0); i < 6; i++ {
+		if !wts.appendPreparedTransaction(wts.nextTranStateTableOffset(), i*100, 100, 0, 1) {
+			t.Errorf("append prepared transaction %d failed", i)
+			return
+		}
+	}
+
+	if !wts.updateTransactionState(4, 400, 1, int32(sysflag.TransactionCommitType)) {
+		t.Errorf("update transaction state failed")
+		return
+	}
+
+	if wts.updateTransactionState(5, 400, 1, int32(sysflag.TransactionCommitType)) {
+		t.Errorf("update transaction state with wrong commitlog offset")
+		return
+	}
+	wts.commit(0)
+
+	rts := newTransactionService(ms)
+	if !rts.load() {
+		t.Errorf("load transaction service failed")
+		return
+	}
+
+	rts.recoverStateTable(true)
+	if rts.getTranStateTableOffset() != 6 {
+		t.Errorf("tranStateTableOffset=%d", rts.getTranStateTableOffset())
+		return
+	}
+
+	if err := os.RemoveAll("./test"); err != nil {
+		t.Fail()
+	}
+}
+
+func TestMinPreparedPhyOffset(t *testing.T) {
+	ms := &PersistentMessageStore{config: newConfig("./test")}
+	ms.config.TranStateTableMappedFileSize = 4 * TSStoreUnitSize
+	defer os.RemoveAll("./test")
+	ts := newTransactionService(ms)
+
+	if offset := ts.minPreparedPhyOffset(); offset != -1 {
+		t.Errorf("min prepared offset of empty table=%d", offset)
+		return
+	}
+
+	for i := int64(0); i < 6; i++ {
+		if !ts.appendPreparedTransaction(ts.nextTranStateTableOffset(), i*100, 100, 0, 1) {
+			t.Errorf("append prepared transaction %d failed", i)
+			return
+		}
+	}
+
+	// 跨文件查找第一条未提交的消息
+	for i := int64(0); i < 5; i++ {
+		if offset := ts.minPreparedPhyOffset(); offset != i*100 {
+			t.Errorf("min prepared offset=%d, expect %d", offset, i*100)
+			return
+		}
+		ts.updateTransactionState(i, i*100, 1, int32(sysflag.TransactionCommitType))
+	}
+
+	ts.updateTransactionState(5, 500, 1, int32(sysflag.TransactionRollbackType))
+	if offset := ts.minPreparedPhyOffset(); offset != -1 {
+		t.Errorf("min prepared offset after all committed=%d", offset)
+		return
+	}
+}
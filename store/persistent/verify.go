@@ -0,0 +1,547 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package persistent
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/boltmq/boltmq/common"
+	"github.com/boltmq/boltmq/stats"
+	"github.com/boltmq/common/message"
+	"github.com/boltmq/common/sysflag"
+)
+
+// VerifyReport 离线校验结果
+type VerifyReport struct {
+	CommitLogFiles    int           // commitlog文件数
+	Messages          int64         // commitlog有效消息数
+	ConsumeQueueUnits int64         // 校验的逻辑队列单元数
+	IndexEntries      int64         // 校验的索引条目数
+	LegacyIndexFiles  int           // 旧版本格式的索引文件数，无法校验，repair时重建
+	Corruptions       []*Corruption // 损坏的数据范围
+	Repaired          bool          // 是否已由commitlog重建逻辑队列及索引文件
+}
+
+// Corruption 损坏的数据范围，Begin、End为文件内位置
+type Corruption struct {
+	File   string
+	Begin  int64
+	End    int64
+	Reason string
+}
+
+func (corruption *Corruption) String() string {
+	return fmt.Sprintf("%s [%d, %d): %s", corruption.File, corruption.Begin, corruption.End, corruption.Reason)
+}
+
+// OK 是否未发现损坏
+func (report *VerifyReport) OK() bool {
+	return len(report.Corruptions) == 0
+}
+
+func (report *VerifyReport) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "commitlog files: %d, messages: %d, consumequeue units: %d, index entries: %d, legacy index files: %d, corruptions: %d, repaired: %t",
+		report.CommitLogFiles, report.Messages, report.ConsumeQueueUnits, report.IndexEntries, report.LegacyIndexFiles,
+		len(report.Corruptions), report.Repaired)
+	for _, corruption := range report.Corruptions {
+		buf.WriteString("\n  ")
+		buf.WriteString(corruption.String())
+	}
+
+	return buf.String()
+}
+
+// storeVerifier 离线校验存储文件，复用恢复流程中的消息解析及CRC校验
+type storeVerifier struct {
+	ms           *PersistentMessageStore
+	report       *VerifyReport
+	minPhyOffset int64                         // commitlog最小offset，小于该值的逻辑队列及索引已过期
+	maxPhyOffset int64                         // commitlog有效数据的结束位置
+	copies       map[string][]*dispatchRequest // 重建时压缩复制的消息，按队列分组，按逻辑offset排序
+}
+
+// Verify 离线校验config存储目录下的commitlog、逻辑队列及索引文件，repair为true时由commitlog重建逻辑队列及索引文件，
+// 重建后删除压缩状态，broker启动后重新压缩并按保留策略淘汰消息。config需与broker使用的存储配置一致，必须在broker停止后执行
+func Verify(config *Config, repair bool) (*VerifyReport, error) {
+	return verify(config, repair)
+}
+
+func verify(config *Config, repair bool) (*VerifyReport, error) {
+	sv, err := newStoreVerifier(config)
+	if err != nil {
+		return nil, err
+	}
+
+	sv.verifyCommitLog()
+	sv.verifyConsumeQueues()
+	sv.verifyIndexFiles()
+
+	if repair {
+		if err := sv.repair(); err != nil {
+			return sv.report, err
+		}
+		sv.report.Repaired = true
+	}
+
+	return sv.report, nil
+}
+
+func newStoreVerifier(config *Config) (*storeVerifier, error) {
+	rootDir := config.StorePathRootDir
+	if exist, _ := common.PathExists(config.StorePathCommitLog); !exist {
+		return nil, fmt.Errorf("commit log dir %s not exist", config.StorePathCommitLog)
+	}
+
+	if exist, _ := common.PathExists(common.GetStorePathAbortFile(rootDir)); exist {
+		return nil, fmt.Errorf("abort file exists, stop the broker first or remove %s after an abnormal exit",
+			common.GetStorePathAbortFile(rootDir))
+	}
+
+	// 只创建校验需要的组件，不启动任何服务
+	ms := &PersistentMessageStore{}
+	ms.config = config
+	ms.runFlags = new(runningFlags)
+	ms.storeStats = stats.NewStoreStats()
+	ms.consumeTopicTable = make(map[string]*consumeQueueTable)
+	ms.clog = newCommitLog(ms)
+	ms.idxService = newIndexService(ms)
+	ms.scheduleMsgService = newScheduleMessageService(ms)
+
+	checkpoint, err := newStoreCheckpoint(common.GetStorePathCheckpoint(rootDir))
+	if err != nil {
+		return nil, err
+	}
+	ms.steCheckpoint = checkpoint
+
+	if !ms.scheduleMsgService.load() {
+		return nil, fmt.Errorf("load schedule message delay level failed")
+	}
+
+	sv := &storeVerifier{ms: ms, report: &VerifyReport{}}
+	sv.checkFileSize(config.StorePathCommitLog, int64(config.MappedFileSizeCommitLog))
+	if !ms.clog.load() {
+		return nil, fmt.Errorf("load commit log failed")
+	}
+
+	if !ms.loadConsumeQueue() {
+		return nil, fmt.Errorf("load consume queue failed")
+	}
+
+	return sv, nil
+}
+
+func (sv *storeVerifier) corrupt(file string, begin, end int64, format string, args ...interface{}) {
+	sv.report.Corruptions = append(sv.report.Corruptions, &Corruption{
+		File:   file,
+		Begin:  begin,
+		End:    end,
+		Reason: fmt.Sprintf(format, args...),
+	})
+}
+
+// checkFileSize 大小不符的文件在加载时会被忽略，单独报告
+func (sv *storeVerifier) checkFileSize(dir string, fileSize int64) {
+	files, err := listFilesOrDir(dir, "FILE")
+	if err != nil {
+		return
+	}
+
+	for _, path := range files {
+		if info, err := os.Stat(path); err == nil && info.Size() != fileSize {
+			sv.corrupt(path, 0, info.Size(), "file size %d not match %d", info.Size(), fileSize)
+		}
+	}
+}
+
+// verifyCommitLog 逐个文件校验magic code、CRC及消息记录的物理offset
+func (sv *storeVerifier) verifyCommitLog() {
+	sv.minPhyOffset = sv.ms.clog.getMinOffset()
+	sv.maxPhyOffset = sv.walkCommitLog(true, func(request *dispatchRequest) {
+		sv.report.Messages++
+	})
+}
+
+// walkCommitLog 遍历commitlog的有效消息，返回有效数据的结束位置
+func (sv *storeVerifier) walkCommitLog(report bool, visit func(request *dispatchRequest)) int64 {
+	var maxPhyOffset int64
+	mappedFiles := sv.ms.clog.mfq.mappedFiles
+	for element := mappedFiles.Front(); element != nil; element = element.Next() {
+		mf := element.Value.(*mappedFile)
+		last := element.Next() == nil
+		if report {
+			sv.report.CommitLogFiles++
+		}
+
+		byteBuffer := newMappedByteBuffer(mf.byteBuffer.mmapBuf)
+		byteBuffer.writePos = int(mf.fileSize)
+		pos := int64(0)
+		for pos < mf.fileSize {
+			byteBuffer.readPos = int(pos)
+			request := sv.ms.clog.checkMessageAndReturnSize(byteBuffer, true, true)
+			if request.msgSize > 0 {
+				if report && request.commitLogOffset != mf.fileFromOffset+pos {
+					sv.corrupt(mf.fileName, pos, pos+request.msgSize, "physical offset %d not match %d",
+						request.commitLogOffset, mf.fileFromOffset+pos)
+				}
+
+				visit(request)
+				pos += request.msgSize
+				maxPhyOffset = mf.fileFromOffset + pos
+				continue
+			}
+
+			// 文件末尾的空白填充
+			if request.msgSize == 0 {
+				break
+			}
+
+			// 最后一个文件未写入的区域
+			if last && isZeroBytes(mf.byteBuffer.mmapBuf[pos:]) {
+				break
+			}
+
+			if report {
+				sv.corrupt(mf.fileName, pos, mf.fileSize, "illegal magic code or crc at offset %d", mf.fileFromOffset+pos)
+			}
+			break
+		}
+	}
+
+	return maxPhyOffset
+}
+
+// readMessage 解析物理offset处的消息，size小于等于0时读取消息头部的长度
+func (sv *storeVerifier) readMessage(offset int64, size int32) *dispatchRequest {
+	mf := sv.ms.clog.mfq.findMappedFileByOffset(offset, false)
+	if mf == nil {
+		return nil
+	}
+
+	pos := offset - mf.fileFromOffset
+	if size <= 0 {
+		if pos+4 > mf.fileSize {
+			return nil
+		}
+
+		header := newMappedByteBuffer(mf.byteBuffer.mmapBuf[pos : pos+4])
+		size = header.ReadInt32()
+	}
+
+	if size <= 0 || pos+int64(size) > mf.fileSize {
+		return nil
+	}
+
+	byteBuffer := newMappedByteBuffer(mf.byteBuffer.mmapBuf[pos : pos+int64(size)])
+	byteBuffer.writePos = int(size)
+	request := sv.ms.clog.checkMessageAndReturnSize(byteBuffer, false, false)
+	if request.msgSize != int64(size) || request.commitLogOffset != offset {
+		return nil
+	}
+
+	return request
+}
+
+// verifyConsumeQueues 校验每个逻辑队列单元的物理offset、size及tagsCode与commitlog一致
+func (sv *storeVerifier) verifyConsumeQueues() {
+	cqRootDir := common.GetStorePathConsumeQueue(sv.ms.config.StorePathRootDir)
+	cqFileSize := int64(sv.ms.config.getMappedFileSizeConsumeQueue())
+	for topic, cqTable := range sv.ms.consumeTopicTable {
+		for queueId, cq := range cqTable.consumeQueues {
+			sv.checkFileSize(filepath.Join(cqRootDir, topic, fmt.Sprintf("%d", queueId)), cqFileSize)
+			sv.verifyConsumeQueue(cq)
+		}
+	}
+}
+
+func (sv *storeVerifier) verifyConsumeQueue(cq *consumeQueue) {
+	for element := cq.mfq.mappedFiles.Front(); element != nil; element = element.Next() {
+		mf := element.Value.(*mappedFile)
+		byteBuffer := newMappedByteBuffer(mf.byteBuffer.mmapBuf)
+		for pos := int64(0); pos+CQStoreUnitSize <= mf.fileSize; pos += CQStoreUnitSize {
+			offset := byteBuffer.ReadInt64()
+			size := byteBuffer.ReadInt32()
+			tagsCode := byteBuffer.ReadInt64()
+
+			// 未写入的区域
+			if offset == 0 && size == 0 && tagsCode == 0 {
+				break
+			}
+
+			// 队列起始的空白填充
+			if offset == 0 && size == 0x7fffffff {
+				continue
+			}
+
+			sv.report.ConsumeQueueUnits++
+			if offset < sv.minPhyOffset || tagsCode == compactedTagsCode {
+				continue
+			}
+
+			if offset+int64(size) > sv.maxPhyOffset {
+				sv.corrupt(mf.fileName, pos, pos+CQStoreUnitSize, "physical offset %d size %d beyond commit log %d",
+					offset, size, sv.maxPhyOffset)
+				continue
+			}
+
+			request := sv.readMessage(offset, size)
+			if request == nil {
+				sv.corrupt(mf.fileName, pos, pos+CQStoreUnitSize, "no message of size %d at physical offset %d", size, offset)
+				continue
+			}
+
+			cqOffset := (mf.fileFromOffset + pos) / CQStoreUnitSize
+			switch {
+			case request.topic != cq.topic || request.queueId != cq.queueId:
+				sv.corrupt(mf.fileName, pos, pos+CQStoreUnitSize, "message at physical offset %d belongs to %s:%d",
+					offset, request.topic, request.queueId)
+			case request.tagsCode != tagsCode:
+				sv.corrupt(mf.fileName, pos, pos+CQStoreUnitSize, "tags code %d not match %d at physical offset %d",
+					tagsCode, request.tagsCode, offset)
+			case request.consumeQueueOffset != cqOffset:
+				sv.corrupt(mf.fileName, pos, pos+CQStoreUnitSize, "queue offset %d not match %d at physical offset %d",
+					cqOffset, request.consumeQueueOffset, offset)
+			}
+		}
+	}
+}
+
+// verifyIndexFiles 校验索引文件的哈希槽、索引链及每条索引的key哈希与commitlog中的消息一致
+func (sv *storeVerifier) verifyIndexFiles() {
+	idx := sv.ms.idxService
+	indexFileSize := int64(INDEX_HEADER_SIZE + idx.hashSlotNum*HASH_SLOT_SIZE + idx.indexNum*INDEX_SIZE)
+	sv.checkFileSize(idx.storePath, indexFileSize)
+
+	files, err := listFilesOrDir(idx.storePath, "FILE")
+	if err != nil {
+		return
+	}
+
+	for _, path := range files {
+		if info, err := os.Stat(path); err != nil || info.Size() != indexFileSize {
+			continue
+		}
+
+		idxFile := newIndexFile(path, idx.hashSlotNum, idx.indexNum, 0, 0)
+		idxFile.recoverHeader()
+		if idxFile.isLegacyFormat() {
+			sv.report.LegacyIndexFiles++
+		} else {
+			sv.verifyIndexFile(idxFile)
+		}
+		idxFile.mf.byteBuffer.unmap()
+	}
+}
+
+func (sv *storeVerifier) verifyIndexFile(idxFile *indexFile) {
+	fileName := idxFile.mf.fileName
+	indexCount := idxFile.header.indexCount
+	if indexCount > idxFile.indexNum {
+		sv.corrupt(fileName, 0, int64(INDEX_HEADER_SIZE), "index count %d more than %d", indexCount, idxFile.indexNum)
+		return
+	}
+
+	byteBuffer := newMappedByteBuffer(idxFile.mf.byteBuffer.mmapBuf)
+	for slot := int32(0); slot < idxFile.hashSlotNum; slot++ {
+		slotPos := INDEX_HEADER_SIZE + slot*HASH_SLOT_SIZE
+		byteBuffer.readPos = int(slotPos)
+		if slotValue := byteBuffer.ReadInt32(); slotValue < INVALID_INDEX || slotValue >= indexCount {
+			sv.corrupt(fileName, int64(slotPos), int64(slotPos+HASH_SLOT_SIZE), "hash slot value %d out of index count %d",
+				slotValue, indexCount)
+		}
+	}
+
+	for i := int32(1); i < indexCount; i++ {
+		indexPos := INDEX_HEADER_SIZE + idxFile.hashSlotNum*HASH_SLOT_SIZE + i*INDEX_SIZE
+		byteBuffer.readPos = int(indexPos)
+		keyHash := byteBuffer.ReadInt32()
+		phyOffset := byteBuffer.ReadInt64()
+		byteBuffer.ReadInt32()
+		prevIndex := byteBuffer.ReadInt32()
+		sv.report.IndexEntries++
+
+		begin, end := int64(indexPos), int64(indexPos+INDEX_SIZE)
+		if prevIndex < INVALID_INDEX || prevIndex >= i {
+			sv.corrupt(fileName, begin, end, "prev index %d of index %d is invalid", prevIndex, i)
+			continue
+		}
+
+		if phyOffset < sv.minPhyOffset {
+			continue
+		}
+
+		request := sv.readMessage(phyOffset, 0)
+		if request == nil {
+			sv.corrupt(fileName, begin, end, "no message at physical offset %d", phyOffset)
+			continue
+		}
+
+		if !sv.matchKeyHash(idxFile, request, keyHash) {
+			sv.corrupt(fileName, begin, end, "key hash %d not match message at physical offset %d", keyHash, phyOffset)
+		}
+	}
+}
+
+func (sv *storeVerifier) matchKeyHash(idxFile *indexFile, request *dispatchRequest, keyHash int32) bool {
+	for _, key := range strings.Split(request.keys, message.KEY_SEPARATOR) {
+		if len(key) > 0 && idxFile.indexKeyHashMethod(sv.ms.idxService.buildKey(request.topic, key)) == keyHash {
+			return true
+		}
+	}
+
+	return false
+}
+
+// repair 删除逻辑队列及索引文件，由commitlog的有效消息重建
+func (sv *storeVerifier) repair() error {
+	for _, cqTable := range sv.ms.consumeTopicTable {
+		for _, cq := range cqTable.consumeQueues {
+			cq.destroy()
+		}
+	}
+	sv.ms.consumeTopicTable = make(map[string]*consumeQueueTable)
+
+	config := sv.ms.config
+	compactionPath := common.GetCompactionStatePath(config.StorePathRootDir)
+	for _, dir := range []string{common.GetStorePathConsumeQueue(config.StorePathRootDir),
+		common.GetStorePathConsumeQueueExt(config.StorePathRootDir), sv.ms.idxService.storePath,
+		compactionPath, compactionPath + ".bak"} {
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+
+	sv.collectCopies()
+	sv.walkCommitLog(false, sv.rebuild)
+	for _, copies := range sv.copies {
+		for _, request := range copies {
+			sv.place(request)
+		}
+	}
+
+	for _, cqTable := range sv.ms.consumeTopicTable {
+		for _, cq := range cqTable.consumeQueues {
+			cq.commit(0)
+		}
+	}
+
+	for element := sv.ms.idxService.indexFileList.Front(); element != nil; element = element.Next() {
+		element.Value.(*indexFile).flush()
+	}
+
+	sv.ms.steCheckpoint.flush()
+	return nil
+}
+
+// collectCopies 收集压缩时复制的消息，同一逻辑offset多次复制时使用最后一次
+func (sv *storeVerifier) collectCopies() {
+	latest := make(map[string]map[int64]*dispatchRequest)
+	sv.walkCommitLog(false, func(request *dispatchRequest) {
+		if !request.compactCopy || request.commitLogOffset < sv.minPhyOffset {
+			return
+		}
+
+		key := fmt.Sprintf("%s-%d", request.topic, request.queueId)
+		if latest[key] == nil {
+			latest[key] = make(map[int64]*dispatchRequest)
+		}
+		latest[key][request.consumeQueueOffset] = request
+	})
+
+	sv.copies = make(map[string][]*dispatchRequest, len(latest))
+	for key, requests := range latest {
+		copies := make([]*dispatchRequest, 0, len(requests))
+		for _, request := range requests {
+			copies = append(copies, request)
+		}
+		sort.Slice(copies, func(i, j int) bool {
+			return copies[i].consumeQueueOffset < copies[j].consumeQueueOffset
+		})
+		sv.copies[key] = copies
+	}
+}
+
+// rebuild 与dispatchMessageService.doDispatch一致，同步写入逻辑队列及索引。
+// 复制的消息按逻辑offset写入，替换原消息的位置
+func (sv *storeVerifier) rebuild(request *dispatchRequest) {
+	if request.commitLogOffset < sv.minPhyOffset {
+		return
+	}
+
+	switch sysflag.GetTransactionValue(int(request.sysFlag)) {
+	case sysflag.TransactionNotType, sysflag.TransactionCommitType:
+		key := fmt.Sprintf("%s-%d", request.topic, request.queueId)
+		copies, ok := sv.copies[key]
+		if !ok {
+			sv.ms.putMessagePostionInfo(request.topic, request.queueId, request.commitLogOffset, request.msgSize,
+				request.tagsCode, request.storeTimestamp, request.consumeQueueOffset, request.propertiesMap)
+			break
+		}
+		if request.compactCopy {
+			break
+		}
+
+		for len(copies) > 0 && copies[0].consumeQueueOffset < request.consumeQueueOffset {
+			sv.place(copies[0])
+			copies = copies[1:]
+		}
+		if len(copies) > 0 && copies[0].consumeQueueOffset == request.consumeQueueOffset {
+			sv.place(copies[0])
+			copies = copies[1:]
+		} else {
+			sv.place(request)
+		}
+		sv.copies[key] = copies
+	}
+
+	if sv.ms.config.MessageIndexEnable {
+		sv.ms.idxService.buildIndex(request)
+	}
+}
+
+// place 按逻辑offset写入压缩的队列，跳过的逻辑offset写入空洞。复制的消息物理offset不递增，不按物理offset去重
+func (sv *storeVerifier) place(request *dispatchRequest) {
+	cq := sv.ms.findConsumeQueue(request.topic, request.queueId)
+	index := request.consumeQueueOffset
+	maxOffset := cq.getMaxOffsetInQueue()
+	if index < maxOffset {
+		return
+	}
+
+	put := func(index, tagsCode int64, properties map[string]string) {
+		cq.maxPhysicOffset = -1
+		cq.putMessagePostionInfo(request.commitLogOffset, request.msgSize, tagsCode, index, properties)
+	}
+	if maxOffset > 0 {
+		for hole := maxOffset; hole < index; hole++ {
+			put(hole, compactedTagsCode, nil)
+		}
+	}
+	put(index, request.tagsCode, request.propertiesMap)
+}
+
+func isZeroBytes(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
+}
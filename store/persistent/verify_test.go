@@ -0,0 +1,292 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package persistent
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltmq/boltmq/common"
+	"github.com/boltmq/boltmq/store"
+	"github.com/boltmq/common/message"
+	"github.com/boltmq/common/utils/system"
+)
+
+func TestVerifyRejectsInvalidRoot(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "boltmq-verify")
+	if err != nil {
+		t.Errorf("create temp dir err: %s", err)
+		return
+	}
+	defer os.RemoveAll(rootDir)
+
+	if _, err := Verify(newConfig(rootDir), false); err == nil {
+		t.Errorf("verify root without commit log expect err")
+		return
+	}
+
+	common.EnsureDir(common.GetStorePathCommitLog(rootDir))
+	if err := ioutil.WriteFile(common.GetStorePathAbortFile(rootDir), []byte{}, 0644); err != nil {
+		t.Errorf("create abort file err: %s", err)
+		return
+	}
+
+	if _, err := Verify(newConfig(rootDir), false); err == nil {
+		t.Errorf("verify root with abort file expect err")
+		return
+	}
+}
+
+func TestIsZeroBytes(t *testing.T) {
+	if !isZeroBytes(make([]byte, 16)) || isZeroBytes([]byte{0, 0, 1}) {
+		t.Errorf("is zero bytes err")
+		return
+	}
+}
+
+func TestVerifyDetectsCorruption(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "boltmq-verify")
+	if err != nil {
+		t.Errorf("create temp dir err: %s", err)
+		return
+	}
+	defer os.RemoveAll(rootDir)
+
+	conf := newConfig(rootDir)
+	conf.MappedFileSizeCommitLog = 1024 * 1024
+	conf.MappedFileSizeConsumeQueue = 1024 * CQStoreUnitSize
+	conf.MaxHashSlotNum = 100
+	conf.MaxIndexNum = 400
+	ms := newPersistentMessageStore(conf, nil)
+	if !ms.Load() {
+		t.Errorf("load message store failed")
+		return
+	}
+	if err := ms.Start(); err != nil {
+		t.Errorf("start message store err: %s", err)
+		return
+	}
+
+	const count = 4
+	body := []byte("hello boltmq")
+	for i := 0; i < count; i++ {
+		msg := new(store.MessageExtInner)
+		msg.Topic = "TestTopic"
+		msg.QueueId = 0
+		msg.Body = body
+		msg.SetKeys(fmt.Sprintf("key-%d", i))
+		msg.PropertiesString = message.MessageProperties2String(msg.Properties)
+		msg.BornTimestamp = system.CurrentTimeMillis()
+		msg.BornHost = "127.0.0.1:10911"
+		msg.StoreHost = "127.0.0.1:11911"
+		if result := ms.PutMessage(msg); result.Status != store.PUTMESSAGE_PUT_OK {
+			t.Errorf("put message status: %s", result.Status)
+			ms.Shutdown()
+			return
+		}
+	}
+
+	// 等待分发到逻辑队列及索引
+	indexed := func() bool {
+		ms.idxService.readWriteLock.RLock()
+		defer ms.idxService.readWriteLock.RUnlock()
+		element := ms.idxService.indexFileList.Back()
+		return element != nil && element.Value.(*indexFile).header.indexCount > count
+	}
+	for i := 0; i < 50 && (ms.MaxOffsetInQueue("TestTopic", 0) < count || !indexed()); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	slot := indexKeyHash(ms.idxService.buildKey("TestTopic", "key-0")) % conf.MaxHashSlotNum
+	ms.Shutdown()
+
+	report, err := verify(conf, false)
+	if err != nil || !report.OK() || report.Messages != count || report.ConsumeQueueUnits != count || report.IndexEntries != count {
+		t.Errorf("verify intact store err: %v, report: %v", err, report)
+		return
+	}
+
+	// 最后一条消息的消息体、第一个逻辑队列单元的tagsCode、key-0所在的哈希槽
+	clogFile := filepath.Join(common.GetStorePathCommitLog(rootDir), offset2FileName(0))
+	data, err := ioutil.ReadFile(clogFile)
+	if err != nil {
+		t.Errorf("read commit log err: %s", err)
+		return
+	}
+	corruptFile(t, clogFile, int64(bytes.LastIndex(data, body)), []byte{'H'})
+
+	cqFile := filepath.Join(common.GetStorePathConsumeQueue(rootDir), "TestTopic", "0", offset2FileName(0))
+	corruptFile(t, cqFile, 12, bytes.Repeat([]byte{0x11}, 8))
+
+	indexFiles, err := listFilesOrDir(common.GetStorePathIndex(rootDir), "FILE")
+	if err != nil || len(indexFiles) != 1 {
+		t.Errorf("list index files %v err: %v", indexFiles, err)
+		return
+	}
+	corruptFile(t, indexFiles[0], int64(INDEX_HEADER_SIZE+slot*HASH_SLOT_SIZE), []byte{0x7f, 0xff, 0xff, 0xff})
+
+	report, err = verify(conf, false)
+	if err != nil {
+		t.Errorf("verify corrupted store err: %s", err)
+		return
+	}
+
+	for file, reason := range map[string]string{
+		clogFile:      "illegal magic code or crc",
+		cqFile:        "tags code",
+		indexFiles[0]: "hash slot value",
+	} {
+		if !hasCorruption(report, file, reason) {
+			t.Errorf("corruption %s in %s not detected, report: %v", reason, file, report)
+			return
+		}
+	}
+}
+
+func TestIndexFileRecoverHeader(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "boltmq-index")
+	if err != nil {
+		t.Errorf("create temp dir err: %s", err)
+		return
+	}
+	defer os.RemoveAll(rootDir)
+
+	fileName := filepath.Join(rootDir, "index")
+	idxFile := newIndexFile(fileName, 10, 40, 0, 0)
+	idxFile.putKey("key-0", 100, system.CurrentTimeMillis())
+	idxFile.putKey("key-1", 200, system.CurrentTimeMillis())
+	idxFile.mf.byteBuffer.unmap()
+
+	// 头部未刷盘，按索引条目恢复
+	idxFile = newIndexFile(fileName, 10, 40, 0, 0)
+	defer idxFile.mf.byteBuffer.unmap()
+	if !idxFile.recoverHeader() || idxFile.header.indexCount != 3 ||
+		idxFile.header.beginPhyOffset != 100 || idxFile.header.endPhyOffset != 200 {
+		t.Errorf("recover header count=%d begin=%d end=%d", idxFile.header.indexCount,
+			idxFile.header.beginPhyOffset, idxFile.header.endPhyOffset)
+		return
+	}
+
+	if idxFile.isLegacyFormat() {
+		t.Errorf("index file is not legacy format")
+		return
+	}
+
+	// 旧版本没有写入哈希槽
+	copy(idxFile.byteBuffer.mmapBuf[INDEX_HEADER_SIZE:INDEX_HEADER_SIZE+10*HASH_SLOT_SIZE], make([]byte, 10*HASH_SLOT_SIZE))
+	if !idxFile.isLegacyFormat() {
+		t.Errorf("index file without hash slots expect legacy format")
+		return
+	}
+}
+
+func corruptFile(t *testing.T, fileName string, offset int64, data []byte) {
+	file, err := os.OpenFile(fileName, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf("open %s err: %s", fileName, err)
+	}
+	defer file.Close()
+
+	if _, err := file.WriteAt(data, offset); err != nil {
+		t.Fatalf("write %s err: %s", fileName, err)
+	}
+}
+
+func hasCorruption(report *VerifyReport, fileName, reason string) bool {
+	for _, corruption := range report.Corruptions {
+		if filepath.Clean(corruption.File) == filepath.Clean(fileName) && strings.Contains(corruption.Reason, reason) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestVerifyRepairCompactedQueue(t *testing.T) {
+	ms := newElectionTestStore(t, ASYNC_MASTER)
+	if ms == nil {
+		return
+	}
+	conf := ms.config
+	defer os.RemoveAll(conf.StorePathRootDir)
+
+	ms.retention.setTopicRetention("TestTopic", &TopicRetention{Compact: true})
+	for _, key := range []string{"a", "b", "a"} {
+		msg := new(store.MessageExtInner)
+		msg.Topic = "TestTopic"
+		msg.QueueId = 0
+		msg.Body = []byte("hello " + key)
+		msg.SetKeys(key)
+		msg.PropertiesString = message.MessageProperties2String(msg.Properties)
+		msg.BornTimestamp = system.CurrentTimeMillis()
+		msg.BornHost = "127.0.0.1:10911"
+		msg.StoreHost = "127.0.0.1:11911"
+		if result := ms.PutMessage(msg); result.Status != store.PUTMESSAGE_PUT_OK {
+			t.Errorf("put message status: %s", result.Status)
+			ms.Shutdown()
+			return
+		}
+	}
+	if !waitQueueOffset(ms, 3) {
+		t.Errorf("dispatch messages timeout")
+		ms.Shutdown()
+		return
+	}
+
+	// 复制key a、b的最新消息并等待替换位置
+	cq := ms.findConsumeQueue("TestTopic", 0)
+	copyBefore := ms.clog.getMaxOffset()
+	quota := maxCompactCopies
+	ms.compaction.compact(cq, newQueueCompaction(0), 0, copyBefore, &quota)
+	for i := 0; i < 50; i++ {
+		if phyOffset, _, _ := ms.retention.entry(cq, 2); phyOffset >= copyBefore {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	statePath := common.GetCompactionStatePath(conf.StorePathRootDir)
+	common.String2File([]byte("{}"), statePath)
+	ms.Shutdown()
+
+	report, err := verify(conf, true)
+	if err != nil || !report.OK() || !report.Repaired {
+		t.Errorf("repair compacted store err: %v, report: %v", err, report)
+		return
+	}
+	if exist, _ := common.PathExists(statePath); exist {
+		t.Errorf("compaction state %s not removed after repair", statePath)
+		return
+	}
+
+	sv, err := newStoreVerifier(conf)
+	if err != nil {
+		t.Errorf("load repaired store err: %s", err)
+		return
+	}
+	var phyOffsets []int64
+	cq = sv.ms.findConsumeQueue("TestTopic", 0)
+	cq.forEachEntry(0, cq.getMaxOffsetInQueue(), func(index, phyOffset int64, size int32, tagsCode int64) bool {
+		phyOffsets = append(phyOffsets, phyOffset)
+		return true
+	})
+	if len(phyOffsets) != 3 || phyOffsets[0] >= copyBefore || phyOffsets[1] < copyBefore || phyOffsets[2] < copyBefore {
+		t.Errorf("repaired physical offsets=%v, expect copies after %d at index 1 and 2", phyOffsets, copyBefore)
+		return
+	}
+}
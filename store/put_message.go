@@ -56,8 +56,9 @@ func (status PutMessageStatus) String() string {
 // Author gaoyanlei
 // Since 2017/8/16
 type PutMessageResult struct {
-	Status PutMessageStatus
-	Result *AppendMessageResult
+	Status  PutMessageStatus
+	Result  *AppendMessageResult
+	Results []*AppendMessageResult // 批量写入时每条消息的写入结果
 }
 
 func (pms *PutMessageResult) IsOk() bool {
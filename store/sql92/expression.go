@@ -0,0 +1,327 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package sql92
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// EXPRESSION_PREFIX 订阅表达式以该前缀开头时，按SQL92语法对消息属性过滤
+	EXPRESSION_PREFIX = "SQL92:"
+)
+
+// IsExpression 订阅表达式是否为SQL92过滤表达式
+func IsExpression(subString string) bool {
+	return strings.HasPrefix(subString, EXPRESSION_PREFIX)
+}
+
+// Expression 编译后的过滤表达式
+type Expression struct {
+	source string
+	root   node
+}
+
+// Compile 编译过滤表达式，subString可以带有EXPRESSION_PREFIX前缀
+func Compile(subString string) (*Expression, error) {
+	source := strings.TrimPrefix(subString, EXPRESSION_PREFIX)
+	tokens, err := tokenize(source)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	root, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Expression{source: source, root: root}, nil
+}
+
+// Evaluate 根据消息属性计算表达式，属性不存在或类型不匹配时视为不匹配
+func (expr *Expression) Evaluate(properties map[string]string) bool {
+	return expr.root.eval(properties) == resultTrue
+}
+
+// RequiredValues 表达式成立时消息属性必须具有的取值，格式为key=value。
+// 外层之间为AND关系，内层之间为OR关系，用于在读取消息前通过bloom filter排除不可能匹配的消息
+func (expr *Expression) RequiredValues() [][]string {
+	return requiredValues(expr.root)
+}
+
+func requiredValues(n node) [][]string {
+	switch v := n.(type) {
+	case *andNode:
+		return append(requiredValues(v.left), requiredValues(v.right)...)
+	case *compareNode:
+		if v.op != "=" || v.numeric {
+			return nil
+		}
+
+		if v.left.property != "" && v.right.isString {
+			return [][]string{{PropertyValue(v.left.property, v.right.text)}}
+		}
+
+		if v.right.property != "" && v.left.isString {
+			return [][]string{{PropertyValue(v.right.property, v.left.text)}}
+		}
+	case *inNode:
+		if v.not || v.target.property == "" {
+			return nil
+		}
+
+		var values []string
+		for value := range v.values {
+			values = append(values, PropertyValue(v.target.property, value))
+		}
+		return [][]string{values}
+	}
+
+	return nil
+}
+
+// PropertyValue 消息属性在bloom filter中的表示
+func PropertyValue(key, value string) string {
+	return key + "=" + value
+}
+
+func (expr *Expression) String() string {
+	return expr.source
+}
+
+// result SQL92三值逻辑的计算结果
+type result int
+
+const (
+	resultFalse result = iota
+	resultTrue
+	resultUnknown
+)
+
+func toResult(b bool) result {
+	if b {
+		return resultTrue
+	}
+	return resultFalse
+}
+
+type node interface {
+	eval(properties map[string]string) result
+}
+
+// operand 比较运算的操作数，属性或常量
+type operand struct {
+	property string
+	isNumber bool
+	isString bool
+	isBool   bool
+	number   float64
+	text     string
+}
+
+func (o *operand) value(properties map[string]string) (string, bool) {
+	if o.property == "" {
+		return o.text, true
+	}
+
+	v, ok := properties[o.property]
+	return v, ok
+}
+
+func (o *operand) numberValue(properties map[string]string) (float64, bool) {
+	if o.isNumber {
+		return o.number, true
+	}
+
+	v, ok := o.value(properties)
+	if !ok {
+		return 0, false
+	}
+
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+type andNode struct {
+	left, right node
+}
+
+func (n *andNode) eval(properties map[string]string) result {
+	l := n.left.eval(properties)
+	if l == resultFalse {
+		return resultFalse
+	}
+
+	r := n.right.eval(properties)
+	if r == resultFalse {
+		return resultFalse
+	}
+
+	if l == resultUnknown || r == resultUnknown {
+		return resultUnknown
+	}
+	return resultTrue
+}
+
+type orNode struct {
+	left, right node
+}
+
+func (n *orNode) eval(properties map[string]string) result {
+	l := n.left.eval(properties)
+	if l == resultTrue {
+		return resultTrue
+	}
+
+	r := n.right.eval(properties)
+	if r == resultTrue {
+		return resultTrue
+	}
+
+	if l == resultUnknown || r == resultUnknown {
+		return resultUnknown
+	}
+	return resultFalse
+}
+
+type notNode struct {
+	child node
+}
+
+func (n *notNode) eval(properties map[string]string) result {
+	switch n.child.eval(properties) {
+	case resultTrue:
+		return resultFalse
+	case resultFalse:
+		return resultTrue
+	}
+	return resultUnknown
+}
+
+type boolNode struct {
+	value bool
+}
+
+func (n *boolNode) eval(properties map[string]string) result {
+	return toResult(n.value)
+}
+
+// compareNode 比较运算，任一侧为数字常量或运算符为大小比较时按数字比较
+type compareNode struct {
+	op          string
+	left, right *operand
+	numeric     bool
+}
+
+func (n *compareNode) eval(properties map[string]string) result {
+	if n.numeric {
+		l, lok := n.left.numberValue(properties)
+		r, rok := n.right.numberValue(properties)
+		if !lok || !rok {
+			return resultUnknown
+		}
+
+		switch n.op {
+		case "=":
+			return toResult(l == r)
+		case "<>":
+			return toResult(l != r)
+		case "<":
+			return toResult(l < r)
+		case "<=":
+			return toResult(l <= r)
+		case ">":
+			return toResult(l > r)
+		case ">=":
+			return toResult(l >= r)
+		}
+		return resultUnknown
+	}
+
+	l, lok := n.left.value(properties)
+	r, rok := n.right.value(properties)
+	if !lok || !rok {
+		return resultUnknown
+	}
+
+	if n.left.isBool || n.right.isBool {
+		l, r = strings.ToLower(l), strings.ToLower(r)
+	}
+
+	if n.op == "=" {
+		return toResult(l == r)
+	}
+	return toResult(l != r)
+}
+
+type nullNode struct {
+	property string
+	not      bool
+}
+
+func (n *nullNode) eval(properties map[string]string) result {
+	_, ok := properties[n.property]
+	return toResult(ok == n.not)
+}
+
+type betweenNode struct {
+	target    *operand
+	low, high float64
+	not       bool
+}
+
+func (n *betweenNode) eval(properties map[string]string) result {
+	v, ok := n.target.numberValue(properties)
+	if !ok {
+		return resultUnknown
+	}
+
+	return toResult((v >= n.low && v <= n.high) != n.not)
+}
+
+type inNode struct {
+	target *operand
+	values map[string]bool
+	not    bool
+}
+
+func (n *inNode) eval(properties map[string]string) result {
+	v, ok := n.target.value(properties)
+	if !ok {
+		return resultUnknown
+	}
+
+	return toResult(n.values[v] != n.not)
+}
+
+type likeNode struct {
+	target  *operand
+	pattern *regexp.Regexp
+	not     bool
+}
+
+func (n *likeNode) eval(properties map[string]string) result {
+	v, ok := n.target.value(properties)
+	if !ok {
+		return resultUnknown
+	}
+
+	return toResult(n.pattern.MatchString(v) != n.not)
+}
@@ -0,0 +1,107 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package sql92
+
+import (
+	"testing"
+)
+
+func TestExpressionEvaluate(t *testing.T) {
+	properties := map[string]string{
+		"region": "eu",
+		"amount": "150",
+		"vip":    "true",
+		"name":   "bolt'mq",
+	}
+
+	cases := map[string]bool{
+		"region = 'eu' AND amount > 100":                  true,
+		"region = 'eu' AND amount > 200":                  false,
+		"region <> 'eu' OR amount >= 150":                 true,
+		"NOT (region = 'us')":                             true,
+		"amount BETWEEN 100 AND 200":                      true,
+		"amount NOT BETWEEN 100 AND 200":                  false,
+		"region IN ('us', 'eu')":                          true,
+		"region NOT IN ('us', 'eu')":                      false,
+		"name LIKE 'bolt''%'":                             true,
+		"name LIKE 'b_lt%'":                               true,
+		"vip = TRUE":                                      true,
+		"color IS NULL AND region IS NOT NULL":            true,
+		"color = 'red'":                                   false,
+		"NOT (color = 'red')":                             false,
+		"color = 'red' OR amount != 150":                  false,
+		"amount > -1 and region = 'eu'":                   true,
+		"SQL92:(region = 'eu' or region = 'us') AND TRUE": true,
+	}
+
+	for source, expect := range cases {
+		expr, err := Compile(source)
+		if err != nil {
+			t.Errorf("compile %s err: %s", source, err)
+			return
+		}
+
+		if expr.Evaluate(properties) != expect {
+			t.Errorf("evaluate %s, expect %t", source, expect)
+			return
+		}
+	}
+}
+
+func TestExpressionCompileError(t *testing.T) {
+	sources := []string{
+		"",
+		"region = ",
+		"region = 'eu",
+		"region > 'eu'",
+		"amount = 'a' AND",
+		"(region = 'eu'",
+		"amount BETWEEN 1 OR 2",
+		"region IN ('eu' 'us')",
+		"'eu' IS NULL",
+		"region ! 'eu'",
+	}
+
+	for _, source := range sources {
+		if _, err := Compile(source); err == nil {
+			t.Errorf("compile %s expect err", source)
+			return
+		}
+	}
+}
+
+func TestExpressionRequiredValues(t *testing.T) {
+	expr, err := Compile("region = 'eu' AND amount > 100 AND (color = 'red' OR color = 'blue') AND 'gold' = level")
+	if err != nil {
+		t.Errorf("compile err: %s", err)
+		return
+	}
+
+	values := expr.RequiredValues()
+	if len(values) != 2 || values[0][0] != "region=eu" || values[1][0] != "level=gold" {
+		t.Errorf("required values=%v", values)
+		return
+	}
+
+	expr, err = Compile("region IN ('eu', 'us') OR amount > 100")
+	if err != nil {
+		t.Errorf("compile err: %s", err)
+		return
+	}
+
+	if values := expr.RequiredValues(); len(values) != 0 {
+		t.Errorf("required values=%v", values)
+		return
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package sql92
+
+import (
+	"fmt"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenOperator
+	tokenKeyword
+	tokenLParen
+	tokenRParen
+	tokenComma
+)
+
+var keywords = map[string]bool{
+	"AND":     true,
+	"OR":      true,
+	"NOT":     true,
+	"IS":      true,
+	"NULL":    true,
+	"IN":      true,
+	"BETWEEN": true,
+	"LIKE":    true,
+	"TRUE":    true,
+	"FALSE":   true,
+}
+
+// token 词法单元，关键字统一转为大写
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentPart(c byte) bool {
+	return isIdentStart(c) || c == '.' || (c >= '0' && c <= '9')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// tokenize 将表达式拆分为词法单元
+func tokenize(expr string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '(':
+			tokens = append(tokens, token{kind: tokenLParen, text: "(", pos: i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{kind: tokenRParen, text: ")", pos: i})
+			i++
+		case c == ',':
+			tokens = append(tokens, token{kind: tokenComma, text: ",", pos: i})
+			i++
+		case c == '=':
+			tokens = append(tokens, token{kind: tokenOperator, text: "=", pos: i})
+			i++
+		case c == '<' || c == '>' || c == '!':
+			op, n := string(c), 1
+			if i+1 < len(expr) && (expr[i+1] == '=' || (c == '<' && expr[i+1] == '>')) {
+				op, n = expr[i:i+2], 2
+			}
+			if op == "!" {
+				return nil, fmt.Errorf("unexpected character '!' at %d", i)
+			}
+			if op == "!=" {
+				op = "<>"
+			}
+			tokens = append(tokens, token{kind: tokenOperator, text: op, pos: i})
+			i += n
+		case c == '\'':
+			str, n, err := scanString(expr, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: tokenString, text: str, pos: i})
+			i += n
+		case isDigit(c) || (c == '-' && i+1 < len(expr) && isDigit(expr[i+1]) && !followsOperand(tokens)):
+			start := i
+			i++
+			for i < len(expr) && (isDigit(expr[i]) || expr[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: expr[start:i], pos: start})
+		case isIdentStart(c):
+			start := i
+			for i < len(expr) && isIdentPart(expr[i]) {
+				i++
+			}
+			text := expr[start:i]
+			if upper := strings.ToUpper(text); keywords[upper] {
+				tokens = append(tokens, token{kind: tokenKeyword, text: upper, pos: start})
+			} else {
+				tokens = append(tokens, token{kind: tokenIdent, text: text, pos: start})
+			}
+		default:
+			return nil, fmt.Errorf("unexpected character '%c' at %d", c, i)
+		}
+	}
+
+	return append(tokens, token{kind: tokenEOF, pos: len(expr)}), nil
+}
+
+// scanString 读取单引号字符串，两个连续单引号表示一个单引号
+func scanString(expr string, start int) (string, int, error) {
+	var buf []byte
+	for i := start + 1; i < len(expr); i++ {
+		if expr[i] != '\'' {
+			buf = append(buf, expr[i])
+			continue
+		}
+
+		if i+1 < len(expr) && expr[i+1] == '\'' {
+			buf = append(buf, '\'')
+			i++
+			continue
+		}
+
+		return string(buf), i - start + 1, nil
+	}
+
+	return "", 0, fmt.Errorf("unterminated string at %d", start)
+}
+
+// followsOperand 前一个词法单元是否为操作数，用于区分负号与减号
+func followsOperand(tokens []token) bool {
+	if len(tokens) == 0 {
+		return false
+	}
+
+	switch tokens[len(tokens)-1].kind {
+	case tokenIdent, tokenString, tokenNumber, tokenRParen:
+		return true
+	}
+	return false
+}
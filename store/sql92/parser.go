@@ -0,0 +1,332 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package sql92
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// parser 递归下降解析器，语法如下:
+//
+//	expr := and (OR and)*
+//	and := not (AND not)*
+//	not := NOT not | predicate
+//	predicate := '(' expr ')' | operand [compare | IS [NOT] NULL | [NOT] BETWEEN | [NOT] IN | [NOT] LIKE]
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) isKeyword(text string) bool {
+	tok := p.peek()
+	return tok.kind == tokenKeyword && tok.text == text
+}
+
+func (p *parser) expectKeyword(text string) error {
+	tok := p.next()
+	if tok.kind != tokenKeyword || tok.text != text {
+		return fmt.Errorf("expect %s at %d, but got '%s'", text, tok.pos, tok.text)
+	}
+	return nil
+}
+
+func (p *parser) expect(kind tokenKind, text string) error {
+	tok := p.next()
+	if tok.kind != kind {
+		return fmt.Errorf("expect '%s' at %d, but got '%s'", text, tok.pos, tok.text)
+	}
+	return nil
+}
+
+func (p *parser) parse() (node, error) {
+	if p.peek().kind == tokenEOF {
+		return nil, fmt.Errorf("expression is empty")
+	}
+
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected '%s' at %d", tok.text, tok.pos)
+	}
+	return root, nil
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isKeyword("OR") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isKeyword("AND") {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (node, error) {
+	if p.isKeyword("NOT") {
+		p.next()
+		child, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{child: child}, nil
+	}
+
+	return p.parsePredicate()
+}
+
+func (p *parser) parsePredicate() (node, error) {
+	if p.peek().kind == tokenLParen {
+		p.next()
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := p.expect(tokenRParen, ")"); err != nil {
+			return nil, err
+		}
+		return n, nil
+	}
+
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	tok := p.peek()
+	if tok.kind == tokenOperator {
+		p.next()
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return newCompareNode(tok, left, right)
+	}
+
+	if tok.kind != tokenKeyword {
+		if left.isBool {
+			return &boolNode{value: left.text == "TRUE"}, nil
+		}
+		return nil, fmt.Errorf("expect operator at %d, but got '%s'", tok.pos, tok.text)
+	}
+
+	if tok.text == "IS" {
+		p.next()
+		not := false
+		if p.isKeyword("NOT") {
+			p.next()
+			not = true
+		}
+
+		if err := p.expectKeyword("NULL"); err != nil {
+			return nil, err
+		}
+
+		if left.property == "" {
+			return nil, fmt.Errorf("IS NULL must be used on property at %d", tok.pos)
+		}
+		return &nullNode{property: left.property, not: not}, nil
+	}
+
+	not := false
+	if tok.text == "NOT" {
+		p.next()
+		not = true
+		tok = p.peek()
+	}
+
+	switch {
+	case tok.kind == tokenKeyword && tok.text == "BETWEEN":
+		p.next()
+		return p.parseBetween(left, not)
+	case tok.kind == tokenKeyword && tok.text == "IN":
+		p.next()
+		return p.parseIn(left, not)
+	case tok.kind == tokenKeyword && tok.text == "LIKE":
+		p.next()
+		return p.parseLike(left, not)
+	}
+
+	if left.isBool && !not {
+		return &boolNode{value: left.text == "TRUE"}, nil
+	}
+	return nil, fmt.Errorf("unexpected '%s' at %d", tok.text, tok.pos)
+}
+
+func (p *parser) parseOperand() (*operand, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokenIdent:
+		return &operand{property: tok.text}, nil
+	case tokenString:
+		return &operand{isString: true, text: tok.text}, nil
+	case tokenNumber:
+		n, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number '%s' at %d", tok.text, tok.pos)
+		}
+		return &operand{isNumber: true, number: n, text: tok.text}, nil
+	case tokenKeyword:
+		if tok.text == "TRUE" || tok.text == "FALSE" {
+			return &operand{isBool: true, text: tok.text}, nil
+		}
+	}
+
+	if tok.kind == tokenEOF {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected '%s' at %d", tok.text, tok.pos)
+}
+
+func newCompareNode(tok token, left, right *operand) (node, error) {
+	ordering := tok.text != "=" && tok.text != "<>"
+	if ordering && (left.isString || right.isString || left.isBool || right.isBool) {
+		return nil, fmt.Errorf("operator %s at %d only support number", tok.text, tok.pos)
+	}
+
+	if (left.isNumber && (right.isString || right.isBool)) || (right.isNumber && (left.isString || left.isBool)) {
+		return nil, fmt.Errorf("mismatched types of operator %s at %d", tok.text, tok.pos)
+	}
+
+	numeric := ordering || left.isNumber || right.isNumber
+	return &compareNode{op: tok.text, left: left, right: right, numeric: numeric}, nil
+}
+
+func (p *parser) parseNumber() (float64, error) {
+	tok := p.next()
+	if tok.kind != tokenNumber {
+		return 0, fmt.Errorf("expect number at %d, but got '%s'", tok.pos, tok.text)
+	}
+
+	n, err := strconv.ParseFloat(tok.text, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number '%s' at %d", tok.text, tok.pos)
+	}
+	return n, nil
+}
+
+func (p *parser) parseBetween(target *operand, not bool) (node, error) {
+	low, err := p.parseNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.expectKeyword("AND"); err != nil {
+		return nil, err
+	}
+
+	high, err := p.parseNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	return &betweenNode{target: target, low: low, high: high, not: not}, nil
+}
+
+func (p *parser) parseIn(target *operand, not bool) (node, error) {
+	if err := p.expect(tokenLParen, "("); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]bool)
+	for {
+		tok := p.next()
+		if tok.kind != tokenString {
+			return nil, fmt.Errorf("expect string at %d, but got '%s'", tok.pos, tok.text)
+		}
+		values[tok.text] = true
+
+		tok = p.next()
+		if tok.kind == tokenRParen {
+			break
+		}
+
+		if tok.kind != tokenComma {
+			return nil, fmt.Errorf("expect ',' or ')' at %d, but got '%s'", tok.pos, tok.text)
+		}
+	}
+
+	return &inNode{target: target, values: values, not: not}, nil
+}
+
+func (p *parser) parseLike(target *operand, not bool) (node, error) {
+	tok := p.next()
+	if tok.kind != tokenString {
+		return nil, fmt.Errorf("expect string at %d, but got '%s'", tok.pos, tok.text)
+	}
+
+	// %匹配任意个字符，_匹配单个字符
+	var buf bytes.Buffer
+	buf.WriteString("(?s)^")
+	for _, c := range tok.text {
+		switch c {
+		case '%':
+			buf.WriteString(".*")
+		case '_':
+			buf.WriteString(".")
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	buf.WriteString("$")
+
+	pattern, err := regexp.Compile(buf.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid like pattern '%s' at %d", tok.text, tok.pos)
+	}
+
+	return &likeNode{target: target, pattern: pattern, not: not}, nil
+}
@@ -0,0 +1,19 @@
+// Copyright 2017 luoji
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//    http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package store
+
+// TransactionCheckExecuter 事务回查接口，存储层发现长时间未提交的prepared消息时回调
+type TransactionCheckExecuter interface {
+	GotoCheck(producerGroupHashCode int, tranStateTableOffset, commitLogOffset int64, msgSize int)
+}